@@ -47,8 +47,14 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	}()
 	record = &ArchivalData{}
 
-	m := controlConn.Messager()
 	connType := s.ConnectionType().String()
+	m, err := controlConn.Encoding().MessagerE(controlConn)
+	if err != nil {
+		log.Println("Could not create a Messager", err)
+		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "Messager").Inc()
+		return record, err
+	}
+	defer m.Release()
 
 	srv, err := s.SingleServingServer("c2s")
 	if err != nil {
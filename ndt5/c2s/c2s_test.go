@@ -2,6 +2,7 @@ package c2s
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 	"strconv"
@@ -9,7 +10,10 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/singleserving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/ndt-server/ndt5/tcplistener"
 
@@ -120,3 +124,27 @@ func Test_DrainForeverButMeasureFor_CountsAllBytesNotJustWsGoodput(t *testing.T)
 		t.Errorf("Expected positive byte count but got %d", metrics.TCPInfo.BytesReceived)
 	}
 }
+
+// serverWithoutPorts is an ndt.Server that cannot start single serving servers.
+type serverWithoutPorts struct{}
+
+func (serverWithoutPorts) SingleServingServer(string) (ndt.SingleMeasurementServer, error) {
+	return nil, errors.New("no ports left")
+}
+func (serverWithoutPorts) ConnectionType() ndt.ConnectionType             { return ndt.Plain }
+func (serverWithoutPorts) DataDir() string                                { return "" }
+func (serverWithoutPorts) LoginCeremony(protocol.Connection) (int, error) { return 0, nil }
+
+func TestManageTestReleasesMessager(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := protocol.AdaptNetConn(server, server)
+	conn.SetEncoding(protocol.TLV)
+	if _, err := ManageTest(context.Background(), conn, serverWithoutPorts{}); err == nil {
+		t.Fatal("ManageTest() without a single serving server should fail")
+	}
+	if n := testutil.ToFloat64(ndt5metrics.ActiveMessagers.WithLabelValues("TLV")); n != 0 {
+		t.Errorf("%v active TLV Messagers after ManageTest() returned, want 0", n)
+	}
+}
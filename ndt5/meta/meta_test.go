@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
@@ -43,6 +44,9 @@ func (m *fakeMessager) SendMessage(t protocol.MessageType, msg []byte) error {
 	m.sent = append(m.sent, sendMessage{t: t, msg: msg})
 	return nil
 }
+func (m *fakeMessager) SendMessageString(t protocol.MessageType, msg string) error {
+	return m.SendMessage(t, []byte(msg))
+}
 func (m *fakeMessager) ReceiveMessage(t protocol.MessageType) ([]byte, error) {
 	if len(m.recv) <= m.c {
 		return []byte(""), nil
@@ -54,10 +58,47 @@ func (m *fakeMessager) ReceiveMessage(t protocol.MessageType) ([]byte, error) {
 	}
 	return msg, nil
 }
+func (m *fakeMessager) ReceiveOneOf(kinds ...protocol.MessageType) (protocol.MessageType, []byte, error) {
+	msg, err := m.ReceiveMessage(kinds[0])
+	return kinds[0], msg, err
+}
+func (m *fakeMessager) ReceiveAnyMessage() (protocol.MessageType, []byte, error) {
+	msg, err := m.ReceiveMessage(protocol.TestMsg)
+	return protocol.TestMsg, msg, err
+}
+func (m *fakeMessager) ReceiveMessageContext(_ context.Context, t protocol.MessageType) ([]byte, error) {
+	return m.ReceiveMessage(t)
+}
+func (m *fakeMessager) ReceiveAnyMessageContext(context.Context) (protocol.MessageType, []byte, error) {
+	return m.ReceiveAnyMessage()
+}
+func (m *fakeMessager) CancelReceive() {
+	// Unused.
+}
 func (m *fakeMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
 	// Unused.
 	return nil
 }
+func (m *fakeMessager) SetReadDeadline(time.Time) error {
+	// Unused.
+	return nil
+}
+func (m *fakeMessager) SetWriteDeadline(time.Time) error {
+	// Unused.
+	return nil
+}
+func (m *fakeMessager) Flush() error {
+	// Unused.
+	return nil
+}
+func (m *fakeMessager) Release() {
+	// Unused.
+}
+func (m *fakeMessager) Close() error {
+	// Unused.
+	return nil
+}
+
 func (m *fakeMessager) Encoding() protocol.Encoding {
 	// Unused.
 	return protocol.JSON
@@ -105,4 +105,33 @@ var (
 				11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 		},
 	)
+	ControlMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_control_messages_total",
+			Help: "Number of control channel messages sent and received.",
+		},
+		[]string{"direction", "type", "encoding"},
+	)
+	ControlMessageBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt5_control_message_bytes",
+			Help:    "Sizes of control channel message payloads.",
+			Buckets: prometheus.ExponentialBuckets(16, 4, 8),
+		},
+		[]string{"direction", "encoding"},
+	)
+	MalformedMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt5_malformed_messages_total",
+			Help: "The number of received ndt5 messages that were malformed, by encoding.",
+		},
+		[]string{"encoding"},
+	)
+	ActiveMessagers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ndt5_active_messagers",
+			Help: "A gauge of the control channel messagers that have been created and not yet released or closed, by encoding.",
+		},
+		[]string{"encoding"},
+	)
 )
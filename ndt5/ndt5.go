@@ -3,11 +3,11 @@ package ndt5
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
@@ -68,6 +68,7 @@ func panicMsgToErrType(msg string) string {
 	okayWords := map[string]struct{}{
 		"Login":           {},
 		"ParseInt":        {},
+		"Messager":        {},
 		"SrvQueue":        {},
 		"MsgLoginVersion": {},
 		"MsgLoginTests":   {},
@@ -182,7 +183,7 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "TestStatus").Inc()
 		return
 	}
-	testsToRun := []string{}
+	testsToRun := 0
 	runC2s := (tests & cTestC2S) != 0
 	runS2c := (tests & cTestS2C) != 0
 	runMeta := (tests & cTestMETA) != 0
@@ -195,12 +196,12 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		suites = append(suites, "mid")
 	}
 	if runC2s {
-		testsToRun = append(testsToRun, strconv.Itoa(cTestC2S))
+		testsToRun |= cTestC2S
 		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "c2s").Inc()
 		suites = append(suites, "c2s")
 	}
 	if runS2c {
-		testsToRun = append(testsToRun, strconv.Itoa(cTestS2C))
+		testsToRun |= cTestS2C
 		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "s2c").Inc()
 		suites = append(suites, "s2c")
 	}
@@ -209,24 +210,26 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		suites = append(suites, "sfw")
 	}
 	if runMeta {
-		testsToRun = append(testsToRun, strconv.Itoa(cTestMETA))
+		testsToRun |= cTestMETA
 		ndt5metrics.ClientRequestedTests.WithLabelValues(connType, "meta").Inc()
 		suites = append(suites, "meta")
 	}
 	// Count the combined test suites by name. i.e. "status-s2c-meta"
 	ndt5metrics.ClientRequestedTestSuites.WithLabelValues(connType, strings.Join(suites, "-")).Inc()
 
-	m := conn.Messager()
+	m, err := conn.Encoding().MessagerE(conn)
+	rtx.PanicOnError(err, "Messager - Could not create a Messager (uuid: %s)", record.Control.UUID)
+	defer m.Release()
 	record.Control.MessageProtocol = m.Encoding().String()
-	rtx.PanicOnError(
-		m.SendMessage(protocol.SrvQueue, []byte("0")),
-		"SrvQueue - Could not send SrvQueue (uuid: %s)", record.Control.UUID)
-	rtx.PanicOnError(
-		m.SendMessage(protocol.MsgLogin, []byte("v5.0-NDTinGO")),
-		"MsgLoginVersion - Could not send MsgLogin with version (uuid: %s)", record.Control.UUID)
-	rtx.PanicOnError(
-		m.SendMessage(protocol.MsgLogin, []byte(strings.Join(testsToRun, " "))),
-		"MsgLoginTests - Could not send MsgLogin with the tests (uuid: %s)", record.Control.UUID)
+	if err := protocol.SendLoginAck(m, "v5.0-NDTinGO", testsToRun); err != nil {
+		// Label the panic with the message that could not be sent.
+		step := "SrvQueue"
+		var ae *protocol.LoginAckError
+		if errors.As(err, &ae) {
+			step = ae.Step
+		}
+		rtx.PanicOnError(err, "%s - Could not send the login acknowledgement (uuid: %s)", step, record.Control.UUID)
+	}
 
 	var c2sRate, s2cRate float64
 	if runC2s {
@@ -3,12 +3,10 @@ package plain
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
@@ -171,28 +169,20 @@ func (ps *plainServer) LoginCeremony(conn protocol.Connection) (int, error) {
 	if !ok {
 		return 0, errors.New("the connection is unable to set its encoding dynamically - this is a bug")
 	}
-	v, t, err := protocol.ReadTLVMessage(conn, protocol.MsgLogin, protocol.MsgExtendedLogin)
+	enc, v, err := protocol.DetectEncoding(conn)
 	if err != nil {
 		return 0, err
 	}
-	switch t {
-	case protocol.MsgExtendedLogin:
-		flex.SetEncoding(protocol.JSON)
-		msg := protocol.JSONMessage{}
-		err := json.Unmarshal(v, &msg)
-		if err != nil {
-			return 0, err
-		}
-		return strconv.Atoi(msg.Tests)
-	case protocol.MsgLogin:
-		flex.SetEncoding(protocol.TLV)
-		if len(v) != 1 {
-			return 0, errors.New("MsgLogin requires a 1-byte message")
-		}
-		return int(v[0]), nil
-	default:
-		return 0, errors.New("Unknown message type")
+	flex.SetEncoding(enc)
+	kind := protocol.MsgExtendedLogin
+	if enc == protocol.TLV {
+		kind = protocol.MsgLogin
+	}
+	login, err := protocol.ParseLogin(kind, v)
+	if err != nil {
+		return 0, err
 	}
+	return login.Tests, nil
 }
 
 func (ps *plainServer) Addr() net.Addr {
@@ -11,6 +11,7 @@ import (
 
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
 )
 
 type fakeAccepter struct{}
@@ -125,3 +126,44 @@ func TestNewPlainServerBrokenForwarding(t *testing.T) {
 		t.Error("This should have failed")
 	}
 }
+
+func TestLoginCeremonySetsEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		login []byte
+		want  protocol.Encoding
+	}{
+		{
+			name:  "MsgLogin",
+			login: []byte{byte(protocol.MsgLogin), 0, 1, 22},
+			want:  protocol.TLV,
+		},
+		{
+			name:  "MsgExtendedLogin",
+			login: append([]byte{byte(protocol.MsgExtendedLogin), 0, 14}, []byte(`{"tests":"22"}`)...),
+			want:  protocol.JSON,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			conn := protocol.AdaptNetConn(server, server)
+			if conn.Encoding() != protocol.Unknown {
+				t.Errorf("Encoding() before login = %v, want Unknown", conn.Encoding())
+			}
+			go client.Write(tt.login)
+			ps := &plainServer{}
+			tests, err := ps.LoginCeremony(conn)
+			if err != nil || tests != 22 {
+				t.Fatalf("LoginCeremony() = %d, %v", tests, err)
+			}
+			if conn.Encoding() != tt.want {
+				t.Errorf("Encoding() after login = %v, want %v", conn.Encoding(), tt.want)
+			}
+			if conn.Messager().Encoding() != conn.Encoding() {
+				t.Errorf("Messager().Encoding() = %v, want %v", conn.Messager().Encoding(), conn.Encoding())
+			}
+		})
+	}
+}
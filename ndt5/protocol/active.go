@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+)
+
+// activeMessager keeps metrics.ActiveMessagers up to date for a Messager
+// created by Encoding.Messager, from its creation until it is released or
+// closed, across changes of its encoding. A nil *activeMessager is not
+// counted.
+type activeMessager struct {
+	mu       sync.Mutex
+	encoding Encoding
+	closed   bool
+}
+
+// open counts the Messager as active.
+func (a *activeMessager) open() {
+	metrics.ActiveMessagers.WithLabelValues(a.encoding.String()).Inc()
+}
+
+// switchTo moves the Messager to the gauge of another encoding.
+func (a *activeMessager) switchTo(e Encoding) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed || a.encoding == e {
+		return
+	}
+	metrics.ActiveMessagers.WithLabelValues(a.encoding.String()).Dec()
+	metrics.ActiveMessagers.WithLabelValues(e.String()).Inc()
+	a.encoding = e
+}
+
+// current returns the encoding the Messager uses now, or Unknown for a nil
+// *activeMessager.
+func (a *activeMessager) current() Encoding {
+	if a == nil {
+		return Unknown
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.encoding
+}
+
+// close stops counting the Messager as active. Later calls do nothing.
+func (a *activeMessager) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	metrics.ActiveMessagers.WithLabelValues(a.encoding.String()).Dec()
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// activeMessagers returns the number of active Messagers of each encoding.
+func activeMessagers() map[Encoding]float64 {
+	counts := make(map[Encoding]float64)
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		counts[enc] = testutil.ToFloat64(metrics.ActiveMessagers.WithLabelValues(enc.String()))
+	}
+	return counts
+}
+
+func TestActiveMessagers(t *testing.T) {
+	before := activeMessagers()
+	var ms []Messager
+	for i, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		for j := 0; j <= i; j++ {
+			ms = append(ms, enc.Messager(&loopbackConnection{}))
+		}
+	}
+	after := activeMessagers()
+	for i, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		if got, want := after[enc]-before[enc], float64(i+1); got != want {
+			t.Errorf("%d more active %v Messagers, want %v", int(got), enc, want)
+		}
+	}
+
+	for _, m := range ms {
+		m.Close()
+		// Closing twice only counts once.
+		m.Close()
+	}
+	if after := activeMessagers(); after[JSON] != before[JSON] || after[TLV] != before[TLV] ||
+		after[MessagePack] != before[MessagePack] || after[CBOR] != before[CBOR] {
+		t.Errorf("active Messagers after closing them all = %v, want %v", after, before)
+	}
+
+	// Messagers that could not be created are not counted.
+	Unknown.Messager(&loopbackConnection{})
+	if after := activeMessagers(); after[JSON] != before[JSON] || after[TLV] != before[TLV] {
+		t.Errorf("active Messagers after failing to create one = %v, want %v", after, before)
+	}
+}
+
+func TestActiveMessagersSwitchEncoding(t *testing.T) {
+	before := activeMessagers()
+	s := NewSwitchingMessager(TLV.Messager(&loopbackConnection{}))
+	if err := s.SetEncoding(JSON); err != nil {
+		t.Fatal(err)
+	}
+	after := activeMessagers()
+	if after[TLV] != before[TLV] || after[JSON] != before[JSON]+1 {
+		t.Errorf("active Messagers after switching from TLV to JSON = %v, want one more JSON than %v", after, before)
+	}
+	s.Close()
+	if after := activeMessagers(); after[TLV] != before[TLV] || after[JSON] != before[JSON] {
+		t.Errorf("active Messagers after closing = %v, want %v", after, before)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	before := activeMessagers()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server))
+	m.Release()
+	if after := activeMessagers(); after[TLV] != before[TLV] {
+		t.Errorf("active Messagers after releasing = %v, want %v", after, before)
+	}
+
+	// The connection is left open.
+	go m.SendMessage(TestMsg, []byte("hi"))
+	cm := TLV.Messager(AdaptNetConn(client, client))
+	if b, err := cm.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() from a released Messager = %q, %v", b, err)
+	}
+	cm.Release()
+
+	// Releasing again, or closing, does not count the Messager twice.
+	m.Release()
+	m.Close()
+	if after := activeMessagers(); after[TLV] != before[TLV] {
+		t.Errorf("active Messagers after closing a released Messager = %v, want %v", after, before)
+	}
+}
+
+func TestReleaseThroughWrappers(t *testing.T) {
+	before := activeMessagers()
+	m := NewSyncMessager(NewRecordingMessager(NewDeadlineMessager(TLV.Messager(&loopbackConnection{}), time.Second)))
+	if after := activeMessagers(); after[TLV] != before[TLV]+1 {
+		t.Errorf("active Messagers after creating = %v, want one more TLV than %v", after, before)
+	}
+	m.Release()
+	if after := activeMessagers(); after[TLV] != before[TLV] {
+		t.Errorf("active Messagers after releasing a wrapped Messager = %v, want %v", after, before)
+	}
+}
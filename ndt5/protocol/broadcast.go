@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SendAllError is returned by SendMessageAll when sending to some of the
+// Messagers failed.
+type SendAllError struct {
+	// Errors holds the error returned by each Messager, in the order they
+	// were given, with nil for those that sent the message.
+	Errors []error
+}
+
+func (e *SendAllError) Error() string {
+	var failed []string
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%d: %v", i, err))
+		}
+	}
+	return fmt.Sprintf("could not send to %d of %d Messagers (%s)", len(failed), len(e.Errors), strings.Join(failed, "; "))
+}
+
+// Unwrap returns the errors of the Messagers that failed, so that errors.Is
+// and errors.As match any of them.
+func (e *SendAllError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// SendMessageAll sends the same message to every Messager in turn, for
+// instance to mirror the state of a test to observers. A failure to send to
+// one Messager does not stop the message from being sent to the others. If
+// any of them failed, the error is a *SendAllError.
+func SendMessageAll(kind MessageType, contents []byte, ms ...Messager) error {
+	errs := make([]error, len(ms))
+	failed := false
+	for i, m := range ms {
+		errs[i] = m.SendMessage(kind, contents)
+		failed = failed || errs[i] != nil
+	}
+	if failed {
+		return &SendAllError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSendMessageAll(t *testing.T) {
+	errFirst := errors.New("first failure")
+	errSecond := errors.New("second failure")
+	var recorders []*RecordingMessager
+	var ms []Messager
+	wantErrs := []error{nil, errFirst, nil, errSecond}
+	for _, err := range wantErrs {
+		r := NewRecordingMessager(NewNopMessager(TLV))
+		f := NewFaultMessager(r)
+		if err != nil {
+			f.FailSend(1, err)
+		}
+		recorders = append(recorders, r)
+		ms = append(ms, f)
+	}
+
+	err := SendMessageAll(TestMsg, []byte("state"), ms...)
+	se, ok := err.(*SendAllError)
+	if !ok {
+		t.Fatalf("SendMessageAll() = %v, want a *SendAllError", err)
+	}
+	if !reflect.DeepEqual(se.Errors, wantErrs) {
+		t.Errorf("SendAllError.Errors = %v, want %v", se.Errors, wantErrs)
+	}
+	if !errors.Is(err, errFirst) || !errors.Is(err, errSecond) {
+		t.Errorf("SendMessageAll() = %v, want it to wrap both failures", err)
+	}
+	// Every Messager was attempted, and those that did not fail sent the
+	// message.
+	for i, r := range recorders {
+		want := 1
+		if wantErrs[i] != nil {
+			want = 0
+		}
+		sent := r.Sent()
+		if len(sent) != want {
+			t.Errorf("Messager %d sent %d messages, want %d", i, len(sent), want)
+		} else if want == 1 && (sent[0].Type != TestMsg || string(sent[0].Data) != "state") {
+			t.Errorf("Messager %d sent %v, %q", i, sent[0].Type, sent[0].Data)
+		}
+	}
+
+	ok1 := NewRecordingMessager(NewNopMessager(TLV))
+	ok2 := NewRecordingMessager(NewNopMessager(JSON))
+	if err := SendMessageAll(TestMsg, []byte("state"), ok1, ok2); err != nil {
+		t.Errorf("SendMessageAll() = %v", err)
+	}
+	if len(ok1.Sent()) != 1 || len(ok2.Sent()) != 1 {
+		t.Errorf("SendMessageAll() sent %d and %d messages, want 1 each", len(ok1.Sent()), len(ok2.Sent()))
+	}
+	if err := SendMessageAll(TestMsg, []byte("state")); err != nil {
+		t.Errorf("SendMessageAll() to no Messagers = %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The header of every TLV frame is a one-byte type followed by the length of
+// the payload as a 16-bit integer in network byte order, which is
+// big-endian. Frames are built and parsed in that order throughout this
+// package, and a connection whose peer uses another order translates the
+// header of each frame as it is written and read.
+
+// WithTLVByteOrder sets the byte order of the length in the header of each TLV
+// frame, for interoperating with clients that do not send it in network byte
+// order. The default is binary.BigEndian, as the ndt5 protocol specifies; pass
+// binary.LittleEndian for nonconforming clients.
+func WithTLVByteOrder(order binary.ByteOrder) MessagerOption {
+	return func(o *messagerOptions) {
+		o.byteOrder = order
+	}
+}
+
+// AdaptTLVByteOrder returns a Connection that reads and writes TLV frames whose
+// lengths are in the given byte order on the wire, for use with ReadTLVMessage
+// and WriteTLVMessage. For connections that read frames from a byte stream,
+// like those returned by AdaptNetConn, it returns a view of conn in that
+// order, and conn itself, along with every other view of it, keeps its own
+// order. Other connections are wrapped. Either way, conn should be adapted
+// before anything else that changes its frames. A nil order, or
+// binary.BigEndian, leaves conn as it is.
+func AdaptTLVByteOrder(conn Connection, order binary.ByteOrder) Connection {
+	if order == nil || order == binary.BigEndian {
+		return conn
+	}
+	if sf, ok := conn.(streamFormatter); ok {
+		return sf.withStreamFormat(func(f *streamFormat) {
+			f.byteOrder = order
+		})
+	}
+	return &byteOrderConnection{wrappedConnection: wrappedConnection{Connection: conn}, order: order}
+}
+
+// reorderTLVHeader returns a copy of frame with the length in its header
+// converted from one byte order to the other.
+func reorderTLVHeader(frame []byte, from, to binary.ByteOrder) ([]byte, error) {
+	if len(frame) < 3 {
+		return nil, errors.New("Message is too short")
+	}
+	out := append([]byte{}, frame...)
+	to.PutUint16(out[1:3], from.Uint16(frame[1:3]))
+	return out, nil
+}
+
+// byteOrderConnection translates the length in the header of each frame
+// between network byte order, used throughout this package, and the byte
+// order of the peer. It is only used for connections that preserve the
+// boundaries of frames.
+type byteOrderConnection struct {
+	wrappedConnection
+	order binary.ByteOrder
+}
+
+func (bc *byteOrderConnection) WriteMessage(messageType int, data []byte) error {
+	frame, err := reorderTLVHeader(data, binary.BigEndian, bc.order)
+	if err != nil {
+		return err
+	}
+	return bc.Connection.WriteMessage(messageType, frame)
+}
+
+func (bc *byteOrderConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := bc.Connection.ReadMessage()
+	if err != nil {
+		return messageType, data, err
+	}
+	frame, err := reorderTLVHeader(data, bc.order, binary.BigEndian)
+	return messageType, frame, err
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLVByteOrderRoundTrip(t *testing.T) {
+	payload := strings.Repeat("x", 0x0102)
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			conn := AdaptTLVByteOrder(lc, order)
+			if err := WriteTLVMessage(conn, TestMsg, payload); err != nil {
+				t.Fatal(err)
+			}
+			if got := order.Uint16(lc.frames[0][1:3]); got != 0x0102 {
+				t.Errorf("the header on the wire holds the length 0x%04X, want 0x0102", got)
+			}
+			b, kind, err := ReadTLVMessage(conn, TestMsg)
+			if err != nil || kind != TestMsg || string(b) != payload {
+				t.Errorf("ReadTLVMessage() = %d bytes, %v, %v", len(b), kind, err)
+			}
+
+			for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+				lc := &loopbackConnection{}
+				m := enc.Messager(lc, WithTLVByteOrder(order))
+				if err := m.SendMessage(TestMsg, []byte(payload)); err != nil {
+					t.Fatal(err)
+				}
+				if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != payload {
+					t.Errorf("%v: ReceiveMessage() = %d bytes, %v", enc, len(b), err)
+				}
+			}
+		})
+	}
+}
+
+func TestTLVByteOrderMismatch(t *testing.T) {
+	payload := strings.Repeat("x", 0x0102)
+	orders := []binary.ByteOrder{binary.BigEndian, binary.LittleEndian}
+	for i, order := range orders {
+		other := orders[1-i]
+		t.Run(order.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			if err := WriteTLVMessage(AdaptTLVByteOrder(lc, order), TestMsg, payload); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := ReadTLVMessage(AdaptTLVByteOrder(lc, other), TestMsg); err == nil {
+				t.Errorf("reading a frame written in %v with %v succeeded", order, other)
+			}
+		})
+	}
+}
+
+func TestTLVByteOrderNetConnection(t *testing.T) {
+	payload := strings.Repeat("x", 0x0102)
+	for _, tt := range []struct {
+		name          string
+		write, read   binary.ByteOrder
+		wantTruncated bool
+	}{
+		{name: "big endian", write: binary.BigEndian, read: binary.BigEndian},
+		{name: "little endian", write: binary.LittleEndian, read: binary.LittleEndian},
+		// The reader expects a frame of 0x0201 bytes, and finds it cut short
+		// when the writer closes the connection.
+		{name: "mismatch", write: binary.LittleEndian, read: binary.BigEndian, wantTruncated: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				WriteTLVMessage(AdaptTLVByteOrder(AdaptNetConn(client, client), tt.write), TestMsg, payload)
+				client.Close()
+			}()
+			conn := AdaptTLVByteOrder(AdaptNetConn(server, server), tt.read)
+			b, _, err := ReadTLVMessage(conn, TestMsg)
+			if tt.wantTruncated {
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("ReadTLVMessage() = %v, want a truncated message", err)
+				}
+				return
+			}
+			if err != nil || string(b) != payload {
+				t.Errorf("ReadTLVMessage() = %d bytes, %v, want %d bytes", len(b), err, len(payload))
+			}
+		})
+	}
+}
+
+func TestTLVByteOrderWithOtherOptions(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		opts   []MessagerOption
+		header []byte
+	}{
+		{name: "byte counts", opts: []MessagerOption{WithByteCounts()}, header: []byte{byte(TestMsg), 4, 0}},
+		{name: "wide type", opts: []MessagerOption{WithTypeWidth(2)}, header: []byte{0, byte(TestMsg), 4, 0}},
+		{name: "both", opts: []MessagerOption{WithByteCounts(), WithTypeWidth(2)}, header: []byte{0, byte(TestMsg), 4, 0}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			// Misframed reads fail rather than hang.
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			opts := append([]MessagerOption{WithTLVByteOrder(binary.LittleEndian)}, tt.opts...)
+			sender := TLV.Messager(AdaptNetConn(server, server), opts...)
+			go func() {
+				sender.SendMessage(TestMsg, []byte("rate"))
+				sender.SendMessage(TestMsg, []byte("next"))
+			}()
+			wire := make([]byte, len(tt.header)+4)
+			if _, err := io.ReadFull(client, wire); err != nil {
+				t.Fatal(err)
+			}
+			if got := wire[:len(tt.header)]; !reflect.DeepEqual(got, tt.header) {
+				t.Errorf("header on the wire = %v, want %v", got, tt.header)
+			}
+			receiver := TLV.Messager(AdaptNetConn(client, client), opts...)
+			if b, err := receiver.ReceiveMessage(TestMsg); err != nil || string(b) != "next" {
+				t.Errorf("ReceiveMessage() = %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestTLVByteOrderStaysWithMessager(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := AdaptNetConn(server, server)
+	little := TLV.Messager(conn, WithTLVByteOrder(binary.LittleEndian))
+	standard := TLV.Messager(conn)
+	go func() {
+		little.SendMessage(TestMsg, []byte("rate"))
+		standard.SendMessage(TestMsg, []byte("rate"))
+		WriteTLVMessage(conn, TestMsg, "rate")
+	}()
+	wire := make([]byte, 21)
+	if _, err := io.ReadFull(client, wire); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		byte(TestMsg), 4, 0, 'r', 'a', 't', 'e',
+		byte(TestMsg), 0, 4, 'r', 'a', 't', 'e',
+		byte(TestMsg), 0, 4, 'r', 'a', 't', 'e',
+	}
+	if !reflect.DeepEqual(wire, want) {
+		t.Errorf("frames on the wire = %v, want %v", wire, want)
+	}
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrReceiveCancelled is returned by a receive that was cancelled with
+// Messager.CancelReceive.
+var ErrReceiveCancelled = errors.New("receive cancelled")
+
+// receiveCanceller records whether the receive in progress, or the next one,
+// has been cancelled. A nil *receiveCanceller never cancels a receive.
+//
+// Only a receive in progress is unblocked with a read deadline, so that a
+// deadline set by the caller, such as the one set by a DeadlineMessager, is
+// left alone unless this code had to replace it, in which case it is put back
+// once the receive is over, if the connection keeps track of it.
+type receiveCanceller struct {
+	mu        sync.Mutex
+	pending   bool
+	receiving bool
+	installed bool
+}
+
+// cancel cancels the receive from conn in progress, or the next one.
+func (c *receiveCanceller) cancel(conn Connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = true
+	if !c.receiving || c.installed {
+		return
+	}
+	if interruptRead(conn) == nil {
+		c.installed = true
+	}
+}
+
+// start marks the beginning of a receive from conn. It returns
+// ErrReceiveCancelled if the receive has already been cancelled; otherwise
+// the caller must call stop once the receive is over.
+func (c *receiveCanceller) start(conn Connection) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(conn); err != nil {
+		return err
+	}
+	c.receiving = true
+	return nil
+}
+
+// stop marks the end of a receive started with start.
+func (c *receiveCanceller) stop() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.receiving = false
+}
+
+// done returns ErrReceiveCancelled in place of err if a read from conn that
+// failed with err was cancelled. A read that succeeded leaves the
+// cancellation for the next receive, rather than dropping what was read.
+func (c *receiveCanceller) done(conn Connection, err error) error {
+	if err == nil || c == nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cerr := c.check(conn); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// check returns ErrReceiveCancelled, and puts back the read deadline of conn
+// if cancel replaced it, if a receive has been cancelled. c.mu must be held.
+func (c *receiveCanceller) check(conn Connection) error {
+	if !c.pending {
+		return nil
+	}
+	c.pending = false
+	if c.installed {
+		c.installed = false
+		resumeRead(conn)
+	}
+	return ErrReceiveCancelled
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCancelReceive(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			m := enc.Messager(AdaptNetConn(server, server))
+
+			errs := make(chan error)
+			go func() {
+				_, err := m.ReceiveMessage(TestMsg)
+				errs <- err
+			}()
+			// Give the receive time to block on the empty pipe.
+			time.Sleep(10 * time.Millisecond)
+			m.CancelReceive()
+			select {
+			case err := <-errs:
+				if err != ErrReceiveCancelled {
+					t.Fatalf("cancelled ReceiveMessage() = %v, want ErrReceiveCancelled", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("CancelReceive() did not unblock ReceiveMessage()")
+			}
+
+			// The read deadline was restored, so the next receive waits for
+			// the message, however long it takes.
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				enc.Messager(AdaptNetConn(client, client)).SendMessage(TestMsg, []byte("after"))
+			}()
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "after" {
+				t.Errorf("ReceiveMessage() after a cancelled one = %q, %v, want \"after\"", b, err)
+			}
+		})
+	}
+}
+
+func TestCancelReceiveBeforeReceiving(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc)
+	m.SendMessage(TestMsg, []byte("one"))
+	// A cancellation that comes before the receive starts is not lost.
+	m.CancelReceive()
+	if _, err := m.ReceiveMessage(TestMsg); err != ErrReceiveCancelled {
+		t.Errorf("ReceiveMessage() after CancelReceive() = %v, want ErrReceiveCancelled", err)
+	}
+	if len(lc.frames) != 1 {
+		t.Errorf("the cancelled ReceiveMessage() read %d messages", 1-len(lc.frames))
+	}
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "one" {
+		t.Errorf("ReceiveMessage() after a cancelled one = %q, %v, want \"one\"", b, err)
+	}
+}
+
+func TestCancelReceiveKeepsCallerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := AdaptNetConn(server, server)
+	m := TLV.Messager(conn)
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	m.CancelReceive()
+	if _, err := m.ReceiveMessage(TestMsg); err != ErrReceiveCancelled {
+		t.Fatalf("ReceiveMessage() after CancelReceive() = %v, want ErrReceiveCancelled", err)
+	}
+
+	// The cancellation did not install a deadline, so it must not have
+	// cleared the one set by the caller.
+	errs := make(chan error)
+	go func() {
+		_, err := m.ReceiveMessage(TestMsg)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if !isTransient(err) {
+			t.Errorf("ReceiveMessage() past the caller's deadline = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CancelReceive() cleared the caller's read deadline")
+	}
+}
+
+func TestCancelReceiveInProgressKeepsCallerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := AdaptNetConn(server, server)
+	m := TLV.Messager(conn)
+	conn.(readDeadliner).SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		m.CancelReceive()
+	}()
+	if _, err := m.ReceiveMessage(TestMsg); err != ErrReceiveCancelled {
+		t.Fatalf("ReceiveMessage() cancelled while reading = %v, want ErrReceiveCancelled", err)
+	}
+
+	// The cancellation replaced the deadline set by the caller, and must
+	// have put it back.
+	errs := make(chan error)
+	go func() {
+		_, err := m.ReceiveMessage(TestMsg)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if !isTransient(err) {
+			t.Errorf("ReceiveMessage() past the caller's deadline = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CancelReceive() cleared the caller's read deadline")
+	}
+}
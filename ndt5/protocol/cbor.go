@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/ugorji/go/codec"
+)
+
+// cborHandle configures the CBOR codec.
+var cborHandle = &codec.CborHandle{}
+
+// cborMessager has all the methods for sending CBOR-format NDT messages along
+// the passed-in connection, for clients that already use CBOR. Just like the
+// MessagePack encoding, each message is a map with a "msg" key carried inside
+// a TLV frame.
+type cborMessager struct {
+	baseMessager
+}
+
+// cbor serializes the results as the map sent to CBOR clients, which has the
+// same keys and integer values as the map sent to MessagePack clients.
+func (r *S2CResult) cbor(f s2cFormat) ([]byte, error) {
+	return encodeCBOR(r.codecS2CResult(f))
+}
+
+func encodeCBOR(v interface{}) ([]byte, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, cborHandle).Encode(v)
+	return b, err
+}
+
+func (cm *cborMessager) SendMessage(kind MessageType, contents []byte) error {
+	return cm.SendMessageString(kind, string(contents))
+}
+
+func (cm *cborMessager) SendMessageString(kind MessageType, s string) error {
+	if err := checkMessageSize(kind, len(s)); err != nil {
+		return err
+	}
+	b, err := encodeCBOR(&JSONMessage{Msg: s})
+	if err != nil {
+		return err
+	}
+	if err := cm.applyWriteDeadline(cm.conn); err != nil {
+		return err
+	}
+	return writeTLVMessage(cm.conn, kind, b)
+}
+
+func (cm *cborMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	r := &S2CResult{
+		ThroughputKbps: throughputKbps,
+		UnsentBytes:    unsentBytes,
+		TotalSentBytes: totalSentBytes,
+	}
+	if err := cm.checkS2CResult(r); err != nil {
+		return err
+	}
+	b, err := r.cbor(cm.s2cFormat())
+	if err != nil {
+		return err
+	}
+	if err := cm.applyWriteDeadline(cm.conn); err != nil {
+		return err
+	}
+	return writeTLVMessage(cm.conn, TestMsg, b)
+}
+
+// cborEnvelope is the CBOR encoding of the start of a map with a single "msg"
+// key, which is followed by the encoded value.
+var cborEnvelope = []byte{0xa1, 0x63, 'm', 's', 'g'}
+
+// SendRawFrame sends raw, which should be an encoded CBOR value, as the
+// value of the "msg" key.
+func (cm *cborMessager) SendRawFrame(kind MessageType, raw []byte) error {
+	if err := cm.applyWriteDeadline(cm.conn); err != nil {
+		return err
+	}
+	return writeRawFrame(cm.conn, kind, cborEnvelope, raw, nil)
+}
+
+func (cm *cborMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	_, b, err := cm.ReceiveOneOf(kind)
+	return b, err
+}
+
+func (cm *cborMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	b, kind, _, err := cm.receiveMeta(kinds...)
+	return kind, b, err
+}
+
+// ReceiveMessageMeta returns the length of the encoded map declared by the TLV
+// headers, which is longer than the returned message.
+func (cm *cborMessager) ReceiveMessageMeta(kind MessageType) ([]byte, MessageType, int, error) {
+	return cm.receiveMeta(kind)
+}
+
+func (cm *cborMessager) receiveMeta(kinds ...MessageType) ([]byte, MessageType, int, error) {
+	b, kind, declaredLen, err := readTLVMessageMeta(cm.conn, cm.limits(), kinds...)
+	if err != nil {
+		if ue, ok := err.(*UnexpectedMessageError); ok {
+			if msg, derr := decodeCBORMessage(ue.Payload); derr == nil {
+				ue.Payload = msg
+			}
+		}
+		return nil, kind, declaredLen, err
+	}
+	msg, err := decodeCBORMessage(b)
+	return msg, kind, declaredLen, cm.countMalformed(err)
+}
+
+func (cm *cborMessager) ReceiveMessageInto(kind MessageType, v interface{}) error {
+	b, _, err := readTLVMessage(cm.conn, cm.limits(), kind)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return cm.countMalformed(errors.New("empty CBOR message received"))
+	}
+	return cm.countMalformed(codec.NewDecoderBytes(b, cborHandle).Decode(v))
+}
+
+func (cm *cborMessager) ReceiveTyped(kinds ...MessageType) (Message, error) {
+	object := func(b []byte, v interface{}) error {
+		return codec.NewDecoderBytes(b, cborHandle).Decode(v)
+	}
+	return receiveTyped(cm.conn, cm.limits(), kinds, decodeCBORMessage, object)
+}
+
+func (cm *cborMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	b, kind, err := readAnyTLVMessage(cm.conn, cm.limits())
+	if err != nil {
+		return kind, nil, err
+	}
+	msg, err := decodeCBORMessage(b)
+	return kind, msg, cm.countMalformed(err)
+}
+
+func (cm *cborMessager) receiveS2CResults() (*S2CResult, error) {
+	b, _, err := readTLVMessage(cm.conn, cm.limits(), TestMsg)
+	if err != nil {
+		return nil, err
+	}
+	v := &msgpackS2CResult{}
+	err = codec.NewDecoderBytes(b, cborHandle).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	r := &S2CResult{
+		ThroughputKbps: v.ThroughputValue,
+		UnsentBytes:    v.UnsentDataAmount,
+		TotalSentBytes: v.TotalSentByte,
+	}
+	if v.Checksum == nil {
+		return r, nil
+	}
+	return r, r.verify(*v.Checksum)
+}
+
+func decodeCBORMessage(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty CBOR message received")
+	}
+	msg := &JSONMessage{}
+	err := codec.NewDecoderBytes(b, cborHandle).Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(msg.Msg), nil
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestCBOREncoding(t *testing.T) {
+	if CBOR.String() != "CBOR" {
+		t.Errorf("CBOR.String() = %q", CBOR.String())
+	}
+	m := CBOR.Messager(&loopbackConnection{})
+	if m == nil || m.Encoding() != CBOR {
+		t.Errorf("Messager() for CBOR returned %v", m)
+	}
+}
+
+func TestCBORMessagerRoundTrip(t *testing.T) {
+	for _, kind := range allMessageTypes {
+		for _, payload := range []string{"", "0", "v5.0-NDTinGO", "2 4 32", "line\nwith \"quotes\"\n"} {
+			m := CBOR.Messager(&loopbackConnection{})
+			if err := m.SendMessage(kind, []byte(payload)); err != nil {
+				t.Fatalf("SendMessage(%v, %q) failed: %v", kind, payload, err)
+			}
+			if err := m.SendMessageString(kind, payload); err != nil {
+				t.Fatalf("SendMessageString(%v, %q) failed: %v", kind, payload, err)
+			}
+			got, err := m.ReceiveMessage(kind)
+			if err != nil || string(got) != payload {
+				t.Errorf("ReceiveMessage(%v) = %q, %v, want %q", kind, got, err, payload)
+			}
+			gotKind, got, err := m.ReceiveAnyMessage()
+			if err != nil || gotKind != kind || string(got) != payload {
+				t.Errorf("ReceiveAnyMessage() = %v, %q, %v, want %v, %q", gotKind, got, err, kind, payload)
+			}
+		}
+	}
+}
+
+func TestCBORMessagerWrongType(t *testing.T) {
+	m := CBOR.Messager(&loopbackConnection{})
+	if err := m.SendMessage(MsgError, []byte("oops")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.ReceiveMessage(MsgResults)
+	ue, ok := err.(*UnexpectedMessageError)
+	if !ok || string(ue.Payload) != "oops" {
+		t.Errorf("ReceiveMessage() of the wrong type = %v, want an *UnexpectedMessageError with the decoded payload", err)
+	}
+}
+
+func TestCBORMessagerSendS2CResults(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := CBOR.Messager(lc)
+	if err := m.SendS2CResults(1000, 20, 3000000000); err != nil {
+		t.Fatal(err)
+	}
+	b, kind, err := ReadTLVMessage(lc, TestMsg)
+	if err != nil || kind != TestMsg {
+		t.Fatal("Could not read S2C results frame", kind, err)
+	}
+	r := map[string]int64{}
+	if err := codec.NewDecoderBytes(b, cborHandle).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{
+		"ThroughputValue":  1000,
+		"UnsentDataAmount": 20,
+		"TotalSentByte":    3000000000,
+	}
+	for k, v := range want {
+		if r[k] != v {
+			t.Errorf("results[%q] = %d, want %d", k, r[k], v)
+		}
+	}
+
+	m = CBOR.Messager(lc, WithS2CChecksum(), WithExtendedS2CResults())
+	if err := m.SendS2CResults(1000, 20, 3000000000); err != nil {
+		t.Fatal(err)
+	}
+	throughput, unsent, total, err := ReceiveS2CResults(m)
+	if err != nil || throughput != 1000 || unsent != 20 || total != 3000000000 {
+		t.Errorf("ReceiveS2CResults() = %d, %d, %d, %v", throughput, unsent, total, err)
+	}
+}
+
+func TestCBORMessagerReceiveMessageInto(t *testing.T) {
+	lc := &loopbackConnection{}
+	b, err := encodeCBOR(&JSONMessage{Msg: "v5.0", Tests: "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	WriteTLVMessage(lc, MsgExtendedLogin, string(b))
+	l, err := ReadLogin(CBOR.Messager(lc))
+	if err != nil || l.Tests != 22 || l.Version != "v5.0" {
+		t.Errorf("ReadLogin() = %+v, %v", l, err)
+	}
+}
@@ -0,0 +1,62 @@
+package protocol
+
+// A message longer than a single TLV frame can carry is split into several
+// frames of the same type. Every frame but the last one is of the largest
+// possible size, which tells the reader to expect another, so a message that
+// fills its last frame is ended by an empty frame. The ndt5 protocol has no
+// such rule, and a peer that does not follow it would have a full frame and
+// the message after it read as one, so frames are only chunked on connections
+// where both peers have agreed to it.
+
+// WithChunkedMessages makes the Messager split messages longer than a single
+// TLV frame into several frames when sending, rather than returning a
+// *MessageTooLongError, and reassemble them when receiving. It is for peers
+// that have agreed to chunk messages, like those sending dumps of extended
+// metrics; the peer must be set up the same way. It has no effect on
+// connections that preserve message boundaries, like websockets, which carry
+// every message in a single frame.
+func WithChunkedMessages() MessagerOption {
+	return func(o *messagerOptions) {
+		o.chunked = true
+	}
+}
+
+// AdaptTLVChunking returns a Connection on which WriteTLVMessage splits
+// messages longer than a single TLV frame into several frames, and
+// ReadTLVMessage reassembles them. Like AdaptTLVByteOrder, it returns a view
+// of connections that read frames from a byte stream, and wraps others.
+// Connections that preserve message boundaries are returned as they are.
+func AdaptTLVChunking(conn Connection) Connection {
+	if framesMessages(conn) {
+		return conn
+	}
+	if sf, ok := conn.(streamFormatter); ok {
+		return sf.withStreamFormat(func(f *streamFormat) {
+			f.chunked = true
+		})
+	}
+	return &chunkingConnection{wrappedConnection{Connection: conn}}
+}
+
+// chunkingConnection carries chunked messages over a connection that does not
+// read frames from a byte stream itself.
+type chunkingConnection struct {
+	wrappedConnection
+}
+
+func (cc *chunkingConnection) chunksMessages() bool {
+	return true
+}
+
+// messageChunker is implemented by connections that may split messages into
+// several frames.
+type messageChunker interface {
+	chunksMessages() bool
+}
+
+// chunksMessages returns whether messages longer than a single frame are split
+// into several frames on conn.
+func chunksMessages(conn Connection) bool {
+	mc, ok := conn.(messageChunker)
+	return ok && mc.chunksMessages()
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import "sync/atomic"
+
+// WithByteCounts counts the bytes of every frame sent and received, as they
+// appear on the Connection, so that the control channel can be accounted for
+// separately from the test data. The counts include the TLV headers, and the
+// sequence numbers added by WithSequenceNumbers, but not the framing of the
+// transport, such as websocket headers.
+func WithByteCounts() MessagerOption {
+	return func(o *messagerOptions) {
+		o.counts = &byteCounts{}
+	}
+}
+
+// byteCounts holds the bytes sent and received by a Messager. A nil
+// *byteCounts counts nothing.
+type byteCounts struct {
+	sent     int64
+	received int64
+}
+
+func (bc *byteCounts) bytesSent() int64 {
+	if bc == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&bc.sent)
+}
+
+func (bc *byteCounts) bytesReceived() int64 {
+	if bc == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&bc.received)
+}
+
+// countingConnection counts the bytes of the frames written to and read from
+// another Connection.
+type countingConnection struct {
+	wrappedConnection
+	counts *byteCounts
+	// extra is the number of bytes in each frame on the wire beyond those in
+	// the frames of the underlying Connection.
+	extra int64
+}
+
+func (cc *countingConnection) WriteMessage(messageType int, data []byte) error {
+	err := cc.Connection.WriteMessage(messageType, data)
+	if err == nil {
+		atomic.AddInt64(&cc.counts.sent, int64(len(data))+cc.extra)
+	}
+	return err
+}
+
+func (cc *countingConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := cc.Connection.ReadMessage()
+	if err == nil {
+		atomic.AddInt64(&cc.counts.received, int64(len(data))+cc.extra)
+	}
+	return messageType, data, err
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import "testing"
+
+func TestByteCounts(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			sender := enc.Messager(lc, WithByteCounts())
+			sender.SendMessage(MsgLogin, []byte("v5.0"))
+			sender.SendMessageString(TestMsg, "rate")
+			sender.SendS2CResults(1, 2, 3)
+			var want int64
+			for _, f := range lc.frames {
+				want += int64(len(f))
+			}
+			cm := sender.(ExtendedMessager)
+			if sent, received := cm.BytesSent(), cm.BytesReceived(); sent != want || received != 0 {
+				t.Errorf("BytesSent(), BytesReceived() = %d, %d, want %d, 0", sent, received, want)
+			}
+
+			receiver := enc.Messager(lc, WithByteCounts())
+			receiver.ReceiveMessage(MsgLogin)
+			receiver.ReceiveMessage(TestMsg)
+			if _, _, _, err := ReceiveS2CResults(receiver); err != nil {
+				t.Error(err)
+			}
+			cm = receiver.(ExtendedMessager)
+			if sent, received := cm.BytesSent(), cm.BytesReceived(); sent != 0 || received != want {
+				t.Errorf("BytesSent(), BytesReceived() = %d, %d, want 0, %d", sent, received, want)
+			}
+		})
+	}
+}
+
+func TestByteCountsIncludeFraming(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []MessagerOption
+		want int64
+	}{
+		{name: "header", opts: []MessagerOption{WithByteCounts()}, want: 2 * (3 + 4)},
+		{name: "sequence numbers", opts: []MessagerOption{WithByteCounts(), WithSequenceNumbers()}, want: 2 * (3 + seqLen + 4)},
+		{name: "wide type", opts: []MessagerOption{WithByteCounts(), WithTypeWidth(2)}, want: 2 * (4 + 4)},
+		{name: "not counted", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := TLV.Messager(lc, tt.opts...).(ExtendedMessager)
+			m.SendMessage(MsgLogin, []byte("v5.0"))
+			m.SendMessage(TestMsg, []byte("rate"))
+			m.ReceiveMessage(MsgLogin)
+			m.ReceiveMessage(TestMsg)
+			if sent, received := m.BytesSent(), m.BytesReceived(); sent != tt.want || received != tt.want {
+				t.Errorf("BytesSent(), BytesReceived() = %d, %d, want %d, %d", sent, received, tt.want, tt.want)
+			}
+		})
+	}
+}
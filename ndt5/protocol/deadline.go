@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DeadlineMessager wraps another Messager so that every send and receive must
+// finish within a fixed timeout. It sets a deadline through the wrapped
+// Messager before each operation, and puts back the deadline set by the
+// caller afterwards, so it works the same for every encoding. Operations that
+// time out return the timeout error of the connection. Deadlines set with
+// SetReadDeadline and SetWriteDeadline on the DeadlineMessager apply along
+// with the timeout, and the earlier of the two is the one in force.
+type DeadlineMessager struct {
+	Messager
+	timeout time.Duration
+	// mu guards the deadlines set by the caller, which are restored after
+	// each operation.
+	mu    sync.Mutex
+	read  time.Time
+	write time.Time
+}
+
+// NewDeadlineMessager creates a DeadlineMessager that forwards to m and limits
+// every operation to timeout.
+func NewDeadlineMessager(m Messager, timeout time.Duration) *DeadlineMessager {
+	return &DeadlineMessager{Messager: m, timeout: timeout}
+}
+
+// within returns the deadline of an operation that starts now, given the
+// deadline set by the caller.
+func (d *DeadlineMessager) within(outer time.Time) time.Time {
+	t := time.Now().Add(d.timeout)
+	if !outer.IsZero() && outer.Before(t) {
+		return outer
+	}
+	return t
+}
+
+// SetReadDeadline sets the deadline for receives, which applies along with the
+// timeout.
+func (d *DeadlineMessager) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.read = t
+	return d.Messager.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for sends, which applies along with the
+// timeout.
+func (d *DeadlineMessager) SetWriteDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.write = t
+	return d.Messager.SetWriteDeadline(t)
+}
+
+// withWriteDeadline runs send with a write deadline, and then puts back the
+// write deadline set by the caller.
+func (d *DeadlineMessager) withWriteDeadline(send func() error) error {
+	d.mu.Lock()
+	err := d.Messager.SetWriteDeadline(d.within(d.write))
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.Messager.SetWriteDeadline(d.write)
+	}()
+	return send()
+}
+
+// withReadDeadline runs receive with a read deadline, and then puts back the
+// read deadline set by the caller.
+func (d *DeadlineMessager) withReadDeadline(receive func() error) error {
+	d.mu.Lock()
+	err := d.Messager.SetReadDeadline(d.within(d.read))
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.Messager.SetReadDeadline(d.read)
+	}()
+	return receive()
+}
+
+// SendMessage forwards the message, failing if it takes too long.
+func (d *DeadlineMessager) SendMessage(kind MessageType, contents []byte) error {
+	return d.withWriteDeadline(func() error {
+		return d.Messager.SendMessage(kind, contents)
+	})
+}
+
+// SendMessageString forwards the message, failing if it takes too long.
+func (d *DeadlineMessager) SendMessageString(kind MessageType, s string) error {
+	return d.withWriteDeadline(func() error {
+		return d.Messager.SendMessageString(kind, s)
+	})
+}
+
+// SendS2CResults forwards the results, failing if it takes too long.
+func (d *DeadlineMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	return d.withWriteDeadline(func() error {
+		return d.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+	})
+}
+
+// Flush flushes the wrapped Messager, failing if it takes too long.
+func (d *DeadlineMessager) Flush() error {
+	return d.withWriteDeadline(d.Messager.Flush)
+}
+
+// ReceiveMessage receives a message, failing if none arrives in time.
+func (d *DeadlineMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	var b []byte
+	err := d.withReadDeadline(func() (err error) {
+		b, err = d.Messager.ReceiveMessage(kind)
+		return err
+	})
+	return b, err
+}
+
+// ReceiveOneOf receives a message, failing if none arrives in time.
+func (d *DeadlineMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	var kind MessageType
+	var b []byte
+	err := d.withReadDeadline(func() (err error) {
+		kind, b, err = d.Messager.ReceiveOneOf(kinds...)
+		return err
+	})
+	return kind, b, err
+}
+
+// ReceiveAnyMessage receives a message, failing if none arrives in time.
+func (d *DeadlineMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	var kind MessageType
+	var b []byte
+	err := d.withReadDeadline(func() (err error) {
+		kind, b, err = d.Messager.ReceiveAnyMessage()
+		return err
+	})
+	return kind, b, err
+}
+
+// ReceiveMessageContext receives a message, failing if none arrives in time or
+// once ctx is done.
+func (d *DeadlineMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	var b []byte
+	err := d.withReadDeadline(func() (err error) {
+		b, err = d.Messager.ReceiveMessageContext(ctx, kind)
+		return err
+	})
+	return b, err
+}
+
+// ReceiveAnyMessageContext receives a message, failing if none arrives in time
+// or once ctx is done.
+func (d *DeadlineMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	var kind MessageType
+	var b []byte
+	err := d.withReadDeadline(func() (err error) {
+		kind, b, err = d.Messager.ReceiveAnyMessageContext(ctx)
+		return err
+	})
+	return kind, b, err
+}
+
+// isTransient returns whether err is a timeout that a new attempt to receive
+// might not run into. A timeout in the middle of a frame is not: the peer
+// stalled while sending a message, rather than before it.
+func isTransient(err error) bool {
+	var pe *PartialFrameError
+	if errors.As(err, &pe) {
+		return false
+	}
+	return isTimeout(err)
+}
+
+// isTimeout returns whether err is an expired idle timeout or read deadline.
+func isTimeout(err error) bool {
+	if err == ErrIdleTimeout {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// ReceiveMessageWithin receives a message of the given type from m, retrying up
+// to retries times after a transient error, like an idle timeout or read
+// deadline that expired before any of the message arrived, for flaky links,
+// while keeping to a single deadline for all the attempts. Other errors, like
+// io.EOF, a malformed message or a *PartialFrameError, are returned at once.
+// Once total has elapsed, the read in progress is abandoned and
+// context.DeadlineExceeded is returned, whatever retries are left. Otherwise
+// the error of the last attempt is returned.
+func ReceiveMessageWithin(m Messager, kind MessageType, total time.Duration, retries int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), total)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		b, err := m.ReceiveMessageContext(ctx, kind)
+		if err == nil || ctx.Err() != nil || attempt >= retries || !isTransient(err) {
+			return b, err
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func assertDeadlineMessagerIsMessager(d *DeadlineMessager) {
+	func(m Messager) {}(d)
+}
+
+func TestDeadlineMessager(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			// Nothing reads from or writes to the client end of the pipe, so
+			// every operation on the server end blocks until it times out.
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			conn := AdaptNetConn(server, server)
+			d := NewDeadlineMessager(enc.Messager(conn), timeout)
+
+			ops := map[string]func() error{
+				"SendMessage": func() error { return d.SendMessage(TestMsg, []byte("hi")) },
+				"ReceiveMessage": func() error {
+					_, err := d.ReceiveMessage(TestMsg)
+					return err
+				},
+			}
+			for name, op := range ops {
+				start := time.Now()
+				err := op()
+				elapsed := time.Since(start)
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					t.Errorf("%s() = %v, want a timeout", name, err)
+				}
+				if elapsed < timeout || elapsed > 10*timeout {
+					t.Errorf("%s() timed out after %v, want %v", name, elapsed, timeout)
+				}
+			}
+
+			// The deadlines are cleared after each operation.
+			go func() {
+				client.Write([]byte{byte(TestMsg), 0, 0})
+			}()
+			time.Sleep(2 * timeout)
+			if _, _, err := ReadTLVMessage(conn, TestMsg); err != nil {
+				t.Errorf("ReadTLVMessage() after a timeout = %v", err)
+			}
+		})
+	}
+}
+
+func TestDeadlineMessagerUnsupported(t *testing.T) {
+	lc := &loopbackConnection{}
+	d := NewDeadlineMessager(TLV.Messager(lc), time.Second)
+	if d.SendMessage(TestMsg, nil) == nil {
+		t.Error("SendMessage() succeeded on a connection without write deadlines")
+	}
+	if _, err := d.ReceiveMessage(TestMsg); err == nil {
+		t.Error("ReceiveMessage() succeeded on a connection without read deadlines")
+	}
+}
+
+func TestDeadlineMessagerKeepsCallerDeadlines(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server))
+	d := NewDeadlineMessager(m, time.Hour)
+	d.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	d.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+
+	go func() {
+		client.Write([]byte{byte(TestMsg), 0, 2, 'h', 'i'})
+		io.ReadFull(client, make([]byte, 5))
+	}()
+	if b, err := d.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Fatalf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if err := d.SendMessage(TestMsg, []byte("hi")); err != nil {
+		t.Fatalf("SendMessage() = %v", err)
+	}
+
+	// The deadlines set by the caller are back in force after each
+	// operation, even on the wrapped Messager, and are earlier than the
+	// timeout.
+	errs := make(chan error, 3)
+	go func() {
+		_, err := m.ReceiveMessage(TestMsg)
+		errs <- err
+		errs <- m.SendMessage(TestMsg, []byte("hi"))
+		_, err = d.ReceiveMessage(TestMsg)
+		errs <- err
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if !isTransient(err) {
+				t.Errorf("operation %d past the caller's deadline = %v, want a timeout", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("operation %d ignored the caller's deadline", i)
+		}
+	}
+}
+
+func TestReceiveMessageWithinRetries(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			m := enc.Messager(AdaptNetConn(server, server), WithIdleTimeout(30*time.Millisecond))
+
+			// The message arrives after the first attempt has timed out.
+			lc := &loopbackConnection{}
+			enc.Messager(lc).SendMessage(TestMsg, []byte("late"))
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				client.Write(lc.frames[0])
+			}()
+			if b, err := ReceiveMessageWithin(m, TestMsg, 5*time.Second, 10); err != nil || string(b) != "late" {
+				t.Fatalf("ReceiveMessageWithin() of a late message = %q, %v", b, err)
+			}
+
+			// Without retries, the first timeout is returned.
+			if _, err := ReceiveMessageWithin(m, TestMsg, 5*time.Second, 0); err != ErrIdleTimeout {
+				t.Errorf("ReceiveMessageWithin() without retries = %v, want ErrIdleTimeout", err)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageWithinPartialFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server), WithIdleTimeout(30*time.Millisecond))
+
+	// The client stalls in the middle of the first frame, then sends the
+	// rest of it and another message.
+	first := historicalTLVFrame(TestMsg, []byte("first"))
+	resume := make(chan struct{})
+	go func() {
+		client.Write(first[:4])
+		<-resume
+		client.Write(first[4:])
+		client.Write(historicalTLVFrame(TestMsg, []byte("second")))
+	}()
+	var pe *PartialFrameError
+	_, err := ReceiveMessageWithin(m, TestMsg, 5*time.Second, 10)
+	close(resume)
+	if !errors.As(err, &pe) || pe.Err != ErrIdleTimeout {
+		t.Fatalf("ReceiveMessageWithin() of a stalled frame = %v, want a *PartialFrameError of ErrIdleTimeout", err)
+	}
+	// The stream is still in step: the frame continues where it stopped.
+	for _, want := range []string{"first", "second"} {
+		if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != want {
+			t.Errorf("ReceiveMessage() after the partial frame = %q, %v, want %q", b, err, want)
+		}
+	}
+}
+
+func TestReceiveMessageWithinBudget(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server), WithIdleTimeout(30*time.Millisecond))
+	start := time.Now()
+	if _, err := ReceiveMessageWithin(m, TestMsg, 200*time.Millisecond, 1000); err != context.DeadlineExceeded {
+		t.Errorf("ReceiveMessageWithin() from a silent client = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("ReceiveMessageWithin() gave up after %v, want about 200ms", elapsed)
+	}
+
+	// Permanent errors are not retried.
+	client.Close()
+	start = time.Now()
+	if _, err := ReceiveMessageWithin(m, TestMsg, time.Hour, 1000); err == nil || isTransient(err) {
+		t.Errorf("ReceiveMessageWithin() from a closed client = %v, want a permanent error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReceiveMessageWithin() of a permanent error took %v", elapsed)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	server.SetReadDeadline(time.Now())
+	_, timeout := server.Read(make([]byte, 1))
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{ErrIdleTimeout, true},
+		{timeout, true},
+		{&PartialFrameError{Err: ErrIdleTimeout}, false},
+		{&PartialFrameError{Err: timeout}, false},
+		{io.EOF, false},
+		{ErrReceiveCancelled, false},
+		{&UnexpectedMessageError{Expected: TestMsg, Got: TestStart}, false},
+	} {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
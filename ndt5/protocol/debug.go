@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"flag"
+	"fmt"
+)
+
+var debug = flag.Bool("ndt5.protocol.debug", false, "Log the type, length, and encoding of every message sent and received by a Messager")
+
+// debugPayloadLen is the number of bytes of each message logged in debug
+// mode. Longer messages are truncated, so that secrets and test data stay out
+// of the logs.
+const debugPayloadLen = 16
+
+// debugConnection logs every frame that a Messager writes to or reads from
+// another Connection.
+type debugConnection struct {
+	wrappedConnection
+	encoding Encoding
+}
+
+func (dc *debugConnection) WriteMessage(messageType int, data []byte) error {
+	err := dc.Connection.WriteMessage(messageType, data)
+	if err == nil {
+		dc.log("send", data)
+	}
+	return err
+}
+
+func (dc *debugConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := dc.Connection.ReadMessage()
+	if err == nil {
+		dc.log("receive", data)
+	}
+	return messageType, data, err
+}
+
+// log logs a single TLV frame as key=value pairs.
+func (dc *debugConnection) log(direction string, frame []byte) {
+	if len(frame) < 3 {
+		return
+	}
+	logger.Printf("ndt5 message: conn=%s direction=%s type=%v length=%d encoding=%v payload=%s\n",
+		dc.String(), direction, MessageType(frame[0]), len(frame)-3, dc.encoding, debugPayload(frame[3:]))
+}
+
+// debugPayload quotes the start of a message, noting how much was left out.
+func debugPayload(b []byte) string {
+	if len(b) <= debugPayloadLen {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("%q...(%d more bytes)", b[:debugPayloadLen], len(b)-debugPayloadLen)
+}
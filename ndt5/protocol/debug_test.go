@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebugLogging(t *testing.T) {
+	c := &capturingLogger{}
+	SetLogger(c)
+	defer SetLogger(nil)
+
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc)
+	m.SendMessage(TestMsg, []byte("hi"))
+	m.ReceiveMessage(TestMsg)
+	if len(c.lines) != 0 {
+		t.Errorf("logged %q without the debug flag", c.lines)
+	}
+
+	*debug = true
+	defer func() { *debug = false }()
+	m = JSON.Messager(lc)
+	secret := "v5.0 " + strings.Repeat("secret", 10)
+	m.SendMessage(MsgLogin, []byte(secret))
+	m.ReceiveMessage(MsgLogin)
+	if len(c.lines) != 2 {
+		t.Fatalf("logged %q, want a line for the send and the receive", c.lines)
+	}
+	for i, direction := range []string{"send", "receive"} {
+		line := c.lines[i]
+		for _, want := range []string{"direction=" + direction, "type=MsgLogin", "encoding=JSON", "length=", "more bytes"} {
+			if !strings.Contains(line, want) {
+				t.Errorf("logged %q, want it to contain %q", line, want)
+			}
+		}
+		if strings.Contains(line, "secretsecret") {
+			t.Errorf("logged %q, which includes the end of the message", line)
+		}
+	}
+}
+
+func TestDebugPayload(t *testing.T) {
+	if got := debugPayload([]byte("hi")); got != `"hi"` {
+		t.Errorf("debugPayload() = %s", got)
+	}
+	if got := debugPayload([]byte("0123456789abcdefXYZ")); got != `"0123456789abcdef"...(3 more bytes)` {
+		t.Errorf("debugPayload() = %s", got)
+	}
+}
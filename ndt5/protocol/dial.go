@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// kickoff is sent by the server to plain TCP clients once they have logged in.
+const kickoff = "123456 654321"
+
+// dialTests is the set of tests requested by DialMessager: only the status
+// test, which every client must support.
+const dialTests = 16
+
+// DialMessager connects to the plain TCP ndt5 server at addr, logs in with the
+// login message that selects enc, and returns a Messager for the rest of the
+// session. TLV logs in with MsgLogin and JSON with MsgExtendedLogin; other
+// encodings cannot be selected by logging in. The timeout applies to both
+// connecting and logging in.
+//
+// DialMessager is meant for test clients and load generators. It requests
+// only the status test, so the server runs no measurements.
+func DialMessager(network, addr string, enc Encoding, timeout time.Duration) (Messager, error) {
+	if enc != TLV && enc != JSON {
+		return nil, fmt.Errorf("cannot log in with the %v encoding", enc)
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := dialLogin(conn, enc, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	nc := AdaptNetConn(conn, conn)
+	nc.SetEncoding(enc)
+	return enc.MessagerE(nc)
+}
+
+// dialLogin sends the login message for enc on conn, and waits for the
+// kickoff message that the server sends in reply.
+func dialLogin(conn net.Conn, enc Encoding, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	nc := AdaptNetConn(conn, conn)
+	var err error
+	if enc == TLV {
+		err = WriteTLVMessage(nc, MsgLogin, string([]byte{dialTests}))
+	} else {
+		err = writeJSONFrame(nc, MsgExtendedLogin, &JSONMessage{Msg: "v5.0", Tests: strconv.Itoa(dialTests)})
+	}
+	if err != nil {
+		return err
+	}
+	b := make([]byte, len(kickoff))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if string(b) != kickoff {
+		return fmt.Errorf("received %q instead of the kickoff message", b)
+	}
+	return nil
+}
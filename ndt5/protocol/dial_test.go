@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// serveLogin accepts a single connection on ln, completes the login the way
+// the plain server does, and echoes one TestMsg.
+func serveLogin(t *testing.T, ln net.Listener, logins chan<- Encoding) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	nc := AdaptNetConn(conn, conn)
+	enc, _, err := DetectEncoding(nc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logins <- enc
+	nc.SetEncoding(enc)
+	conn.Write([]byte(kickoff))
+	m := enc.Messager(nc)
+	b, err := m.ReceiveMessage(TestMsg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	m.SendMessage(TestMsg, b)
+}
+
+func TestDialMessager(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV} {
+		t.Run(enc.String(), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			logins := make(chan Encoding, 1)
+			done := make(chan struct{})
+			go func() {
+				serveLogin(t, ln, logins)
+				close(done)
+			}()
+
+			m, err := DialMessager("tcp", ln.Addr().String(), enc, 10*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if got := <-logins; got != enc {
+				t.Errorf("server detected encoding %v, want %v", got, enc)
+			}
+			if m.Encoding() != enc {
+				t.Errorf("Encoding() = %v, want %v", m.Encoding(), enc)
+			}
+			if err := m.SendMessage(TestMsg, []byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "ping" {
+				t.Errorf("ReceiveMessage() = %q, %v, want \"ping\"", b, err)
+			}
+			<-done
+		})
+	}
+}
+
+func TestDialMessagerErrors(t *testing.T) {
+	if _, err := DialMessager("tcp", "127.0.0.1:1", MessagePack, time.Second); err == nil {
+		t.Error("DialMessager() succeeded with the MessagePack encoding")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never send the kickoff message.
+		time.Sleep(time.Second)
+	}()
+	start := time.Now()
+	if _, err := DialMessager("tcp", ln.Addr().String(), TLV, 50*time.Millisecond); err == nil {
+		t.Error("DialMessager() succeeded without a kickoff message")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("DialMessager() took %v to time out", elapsed)
+	}
+}
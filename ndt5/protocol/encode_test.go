@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeTLV(t *testing.T) {
+	for _, size := range []int{0, 1, 3, 1000, maxTLVFrameSize} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		for kind := 0; kind <= 255; kind++ {
+			frame, err := EncodeTLV(MessageType(kind), payload)
+			if err != nil {
+				t.Fatalf("EncodeTLV(%d, %d bytes) = %v", kind, size, err)
+			}
+			gotKind, got, n, err := DecodeTLV(frame)
+			if err != nil || gotKind != MessageType(kind) || !bytes.Equal(got, payload) || n != len(frame) {
+				t.Fatalf("DecodeTLV(EncodeTLV(%d, %d bytes)) = %v, %d bytes, %d, %v", kind, size, gotKind, len(got), n, err)
+			}
+		}
+		lc := &loopbackConnection{}
+		if err := WriteTLVMessage(lc, TestMsg, string(payload)); err != nil {
+			t.Fatal(err)
+		}
+		if frame, _ := EncodeTLV(TestMsg, payload); !bytes.Equal(frame, lc.frames[0]) {
+			t.Errorf("EncodeTLV() of %d bytes differs from what WriteTLVMessage writes", size)
+		}
+	}
+}
+
+func TestEncodeDecodeJSON(t *testing.T) {
+	for _, s := range []string{"", "hi", `quotes " and \ slashes`, "héllo ☃", strings.Repeat("0123456789", 1000)} {
+		for kind := 0; kind <= 255; kind++ {
+			frame, err := EncodeJSON(MessageType(kind), []byte(s))
+			if err != nil {
+				t.Fatalf("EncodeJSON(%d, %q) = %v", kind, s, err)
+			}
+			gotKind, got, n, err := DecodeJSON(frame)
+			if err != nil || gotKind != MessageType(kind) || string(got) != s || n != len(frame) {
+				t.Fatalf("DecodeJSON(EncodeJSON(%d, %q)) = %v, %q, %d, %v", kind, s, gotKind, got, n, err)
+			}
+		}
+		lc := &loopbackConnection{}
+		if err := SendJSONMessage(TestMsg, s, lc); err != nil {
+			t.Fatal(err)
+		}
+		if frame, _ := EncodeJSON(TestMsg, []byte(s)); !bytes.Equal(frame, lc.frames[0]) {
+			t.Errorf("EncodeJSON(%q) = %q, but SendJSONMessage writes %q", s, frame, lc.frames[0])
+		}
+	}
+}
+
+func TestDecodeTLVSeveralFrames(t *testing.T) {
+	var buf []byte
+	for _, s := range []string{"one", "", "three"} {
+		frame, _ := EncodeTLV(TestMsg, []byte(s))
+		buf = append(buf, frame...)
+	}
+	var got []string
+	for len(buf) > 0 {
+		_, b, n, err := DecodeTLV(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+		buf = buf[n:]
+	}
+	if strings.Join(got, ",") != "one,,three" {
+		t.Errorf("decoded %q", got)
+	}
+}
+
+func TestEncodeDecodeErrors(t *testing.T) {
+	long := make([]byte, maxTLVFrameSize+1)
+	if _, err := EncodeTLV(TestMsg, long); err == nil {
+		t.Error("EncodeTLV() of a payload longer than a frame succeeded")
+	}
+	if _, err := EncodeJSON(TestMsg, long); err == nil {
+		t.Error("EncodeJSON() of a payload longer than a frame succeeded")
+	}
+	// The JSON encoding of a payload that just fits is too long.
+	if _, err := EncodeJSON(TestMsg, long[1:]); err == nil {
+		t.Error("EncodeJSON() of a payload whose JSON is longer than a frame succeeded")
+	}
+	for _, data := range [][]byte{nil, {byte(TestMsg), 0}, {byte(TestMsg), 0, 2, 'h'}} {
+		if _, _, _, err := DecodeTLV(data); err == nil {
+			t.Errorf("DecodeTLV(%q) succeeded", data)
+		}
+	}
+	if _, _, _, err := DecodeJSON([]byte{byte(TestMsg), 0, 2, 'h', 'i'}); err == nil {
+		t.Error("DecodeJSON() of a frame that is not JSON succeeded")
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+)
+
+// faultPolicy decides which operations in one direction fail. The zero
+// faultPolicy fails nothing.
+type faultPolicy struct {
+	err error
+	// n is the number of operations, counted from when the policy was
+	// set, before the failure.
+	n     int
+	count int
+	// always makes every operation after the first n fail, rather than
+	// only the next one.
+	always bool
+}
+
+// next counts an operation and returns the error it should fail with, if any.
+func (p *faultPolicy) next() error {
+	if p.err == nil {
+		return nil
+	}
+	p.count++
+	if p.count <= p.n {
+		return nil
+	}
+	err := p.err
+	if !p.always {
+		*p = faultPolicy{}
+	}
+	return err
+}
+
+// FaultMessager wraps another Messager to fail chosen sends and receives with
+// a chosen error, for testing how handlers deal with failures. Sends are
+// SendMessage, SendMessageString and SendS2CResults, and receives are
+// ReceiveMessage, ReceiveOneOf, ReceiveAnyMessage and their Context variants. A failed operation is
+// not forwarded, so nothing is sent and the message that would have been
+// received is left for the next receive. Everything else is forwarded
+// unchanged. It is safe to set failures from another goroutine.
+type FaultMessager struct {
+	Messager
+	mu      sync.Mutex
+	send    faultPolicy
+	receive faultPolicy
+}
+
+// NewFaultMessager creates a FaultMessager that forwards to m until failures
+// are set.
+func NewFaultMessager(m Messager) *FaultMessager {
+	return &FaultMessager{Messager: m}
+}
+
+// FailSend makes the nth send from now fail with err, counting from 1. Sends
+// before and after it are forwarded.
+func (f *FaultMessager) FailSend(n int, err error) {
+	f.setPolicy(&f.send, faultPolicy{err: err, n: n - 1})
+}
+
+// FailSendsAfter forwards the next n sends, and makes every send after them
+// fail with err.
+func (f *FaultMessager) FailSendsAfter(n int, err error) {
+	f.setPolicy(&f.send, faultPolicy{err: err, n: n, always: true})
+}
+
+// FailReceive makes the nth receive from now fail with err, counting from 1.
+// Receives before and after it are forwarded.
+func (f *FaultMessager) FailReceive(n int, err error) {
+	f.setPolicy(&f.receive, faultPolicy{err: err, n: n - 1})
+}
+
+// FailReceivesAfter forwards the next n receives, and makes every receive
+// after them fail with err.
+func (f *FaultMessager) FailReceivesAfter(n int, err error) {
+	f.setPolicy(&f.receive, faultPolicy{err: err, n: n, always: true})
+}
+
+// FailNextReceive makes the next receive fail with err.
+func (f *FaultMessager) FailNextReceive(err error) {
+	f.FailReceive(1, err)
+}
+
+// Reset clears every failure, so that all calls are forwarded again.
+func (f *FaultMessager) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.send = faultPolicy{}
+	f.receive = faultPolicy{}
+}
+
+func (f *FaultMessager) setPolicy(p *faultPolicy, policy faultPolicy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*p = policy
+}
+
+func (f *FaultMessager) fault(p *faultPolicy) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return p.next()
+}
+
+// SendMessage forwards the message, unless the send should fail.
+func (f *FaultMessager) SendMessage(kind MessageType, contents []byte) error {
+	if err := f.fault(&f.send); err != nil {
+		return err
+	}
+	return f.Messager.SendMessage(kind, contents)
+}
+
+// SendMessageString forwards the message, unless the send should fail.
+func (f *FaultMessager) SendMessageString(kind MessageType, s string) error {
+	if err := f.fault(&f.send); err != nil {
+		return err
+	}
+	return f.Messager.SendMessageString(kind, s)
+}
+
+// SendS2CResults forwards the results, unless the send should fail.
+func (f *FaultMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	if err := f.fault(&f.send); err != nil {
+		return err
+	}
+	return f.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+}
+
+// ReceiveMessage receives a message, unless the receive should fail.
+func (f *FaultMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	if err := f.fault(&f.receive); err != nil {
+		return nil, err
+	}
+	return f.Messager.ReceiveMessage(kind)
+}
+
+// ReceiveOneOf receives a message, unless the receive should fail.
+func (f *FaultMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	if err := f.fault(&f.receive); err != nil {
+		return MsgUnknown, nil, err
+	}
+	return f.Messager.ReceiveOneOf(kinds...)
+}
+
+// ReceiveAnyMessage receives a message, unless the receive should fail.
+func (f *FaultMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	if err := f.fault(&f.receive); err != nil {
+		return MsgUnknown, nil, err
+	}
+	return f.Messager.ReceiveAnyMessage()
+}
+
+// ReceiveMessageContext receives a message, unless the receive should fail.
+func (f *FaultMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	if err := f.fault(&f.receive); err != nil {
+		return nil, err
+	}
+	return f.Messager.ReceiveMessageContext(ctx, kind)
+}
+
+// ReceiveAnyMessageContext receives a message, unless the receive should fail.
+func (f *FaultMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	if err := f.fault(&f.receive); err != nil {
+		return MsgUnknown, nil, err
+	}
+	return f.Messager.ReceiveAnyMessageContext(ctx)
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func assertFaultMessagerIsMessager(f *FaultMessager) {
+	func(m Messager) {}(f)
+}
+
+var errFault = errors.New("injected fault")
+
+// sendResults sends n numbered messages through f and returns which failed.
+func sendResults(f *FaultMessager, n int) []bool {
+	failed := make([]bool, n)
+	for i := range failed {
+		err := f.SendMessageString(TestMsg, fmt.Sprint(i))
+		failed[i] = err == errFault
+	}
+	return failed
+}
+
+func TestFaultMessagerSend(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(f *FaultMessager)
+		want []bool
+	}{
+		{name: "none", set: func(*FaultMessager) {}, want: []bool{false, false, false, false}},
+		{name: "once", set: func(f *FaultMessager) { f.FailSend(2, errFault) }, want: []bool{false, true, false, false}},
+		{name: "always after", set: func(f *FaultMessager) { f.FailSendsAfter(2, errFault) }, want: []bool{false, false, true, true}},
+		{name: "always", set: func(f *FaultMessager) { f.FailSendsAfter(0, errFault) }, want: []bool{true, true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &loopbackConnection{}
+			f := NewFaultMessager(TLV.Messager(lc))
+			tt.set(f)
+			if got := sendResults(f, 4); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sends failed %v, want %v", got, tt.want)
+			}
+			// Only the sends that did not fail were forwarded.
+			sent := 0
+			for _, failed := range tt.want {
+				if !failed {
+					sent++
+				}
+			}
+			if len(lc.frames) != sent {
+				t.Errorf("%d frames sent, want %d", len(lc.frames), sent)
+			}
+		})
+	}
+}
+
+func TestFaultMessagerReceive(t *testing.T) {
+	lc := &loopbackConnection{}
+	sender := TLV.Messager(lc)
+	for _, s := range []string{"one", "two", "three"} {
+		sender.SendMessageString(TestMsg, s)
+	}
+	f := NewFaultMessager(TLV.Messager(lc))
+
+	f.FailNextReceive(errFault)
+	if _, err := f.ReceiveMessage(TestMsg); err != errFault {
+		t.Errorf("ReceiveMessage() = %v, want the injected fault", err)
+	}
+	// The failed receive left the message to be read.
+	if b, err := f.ReceiveMessage(TestMsg); err != nil || string(b) != "one" {
+		t.Errorf("ReceiveMessage() after the fault = %q, %v, want \"one\"", b, err)
+	}
+
+	f.FailReceivesAfter(1, errFault)
+	if _, b, err := f.ReceiveOneOf(TestMsg, MsgError); err != nil || string(b) != "two" {
+		t.Errorf("ReceiveOneOf() = %q, %v, want \"two\"", b, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := f.ReceiveAnyMessage(); err != errFault {
+			t.Errorf("ReceiveAnyMessage() = %v, want the injected fault", err)
+		}
+	}
+
+	f.Reset()
+	if b, err := f.ReceiveMessage(TestMsg); err != nil || string(b) != "three" {
+		t.Errorf("ReceiveMessage() after Reset() = %q, %v, want \"three\"", b, err)
+	}
+}
+
+func TestFaultMessagerDirections(t *testing.T) {
+	lc := &loopbackConnection{}
+	f := NewFaultMessager(TLV.Messager(lc))
+	f.FailReceive(1, errFault)
+	// Sends do not count towards receive failures, and vice versa.
+	if err := f.SendS2CResults(1, 2, 3); err != nil {
+		t.Errorf("SendS2CResults() = %v", err)
+	}
+	if _, err := f.ReceiveMessage(TestMsg); err != errFault {
+		t.Errorf("ReceiveMessage() = %v, want the injected fault", err)
+	}
+	if _, err := f.ReceiveMessage(TestMsg); err != nil {
+		t.Errorf("ReceiveMessage() = %v", err)
+	}
+}
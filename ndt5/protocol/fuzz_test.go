@@ -0,0 +1,29 @@
+//go:build go1.18
+// +build go1.18
+
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+)
+
+func FuzzParseTLVFrame(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{byte(protocol.MsgLogin), 0, 0})
+	f.Add([]byte{byte(protocol.TestMsg), 0, 2, 'h', 'i'})
+	f.Add([]byte{byte(protocol.TestMsg), 0, 3, 'h', 'i'})
+	f.Add([]byte{byte(protocol.TestMsg), 0xFF, 0xFF})
+	f.Add(append([]byte{byte(protocol.MsgExtendedLogin), 0, 30}, `{"msg": "v5.0", "tests": "22"}`...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		kind, payload, err := protocol.ParseTLVFrame(data)
+		if err != nil {
+			return
+		}
+		if kind != protocol.MessageType(data[0]) || !bytes.Equal(payload, data[3:]) {
+			t.Errorf("ParseTLVFrame(%q) = %v, %q", data, kind, payload)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// DefaultGzipThreshold is the message length above which a GzipMessager
+// created with a non-positive threshold compresses messages.
+const DefaultGzipThreshold = 1024
+
+// maxGunzippedSize limits the length of a decompressed message, so that a
+// small compressed message cannot expand to fill the server's memory.
+const maxGunzippedSize = 1 << 20
+
+// gzipMarker prefixes every message compressed by a GzipMessager. ndt5
+// messages are text, so they never start with a NUL byte.
+var gzipMarker = []byte("\x00GZ")
+
+// ErrGunzippedTooLong is returned when a compressed message decompresses to
+// more than maxGunzippedSize bytes.
+var ErrGunzippedTooLong = errors.New("decompressed message is too long")
+
+// GzipMessager wraps another Messager, compressing messages longer than a
+// threshold before sending them and decompressing received messages. Both
+// ends of the connection must use a GzipMessager. Compressed messages are
+// sent as the marker followed by the gzip data, which is base64 encoded for
+// every encoding but TLV so that it survives being sent as a string.
+type GzipMessager struct {
+	Messager
+	threshold int
+}
+
+// NewGzipMessager creates a GzipMessager that forwards to m, compressing
+// messages longer than threshold bytes. If threshold is not positive,
+// DefaultGzipThreshold is used.
+func NewGzipMessager(m Messager, threshold int) *GzipMessager {
+	if threshold <= 0 {
+		threshold = DefaultGzipThreshold
+	}
+	return &GzipMessager{Messager: m, threshold: threshold}
+}
+
+// SendMessage sends the message, compressed if it is longer than the
+// threshold. Messages that happen to start with the marker are always
+// compressed, so that the receiver cannot mistake them for compressed data.
+func (g *GzipMessager) SendMessage(kind MessageType, contents []byte) error {
+	if len(contents) <= g.threshold && !bytes.HasPrefix(contents, gzipMarker) {
+		return g.Messager.SendMessage(kind, contents)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(contents); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	b := append([]byte{}, gzipMarker...)
+	if g.Encoding() == TLV {
+		b = append(b, buf.Bytes()...)
+	} else {
+		b = append(b, base64.StdEncoding.EncodeToString(buf.Bytes())...)
+	}
+	return g.Messager.SendMessage(kind, b)
+}
+
+// SendMessageString is SendMessage for a message that is already a string.
+func (g *GzipMessager) SendMessageString(kind MessageType, s string) error {
+	return g.SendMessage(kind, []byte(s))
+}
+
+// ReceiveMessage receives a message, decompressing it if it was compressed.
+func (g *GzipMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	b, err := g.Messager.ReceiveMessage(kind)
+	if err != nil {
+		return b, err
+	}
+	return g.gunzip(b)
+}
+
+// ReceiveOneOf receives a message of any of the given types, decompressing it
+// if it was compressed.
+func (g *GzipMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	kind, b, err := g.Messager.ReceiveOneOf(kinds...)
+	if err != nil {
+		return kind, b, err
+	}
+	b, err = g.gunzip(b)
+	return kind, b, err
+}
+
+// ReceiveAnyMessage receives a message of any type, decompressing it if it
+// was compressed.
+func (g *GzipMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	kind, b, err := g.Messager.ReceiveAnyMessage()
+	if err != nil {
+		return kind, b, err
+	}
+	b, err = g.gunzip(b)
+	return kind, b, err
+}
+
+// ReceiveMessageContext is ReceiveMessage, but gives up once ctx is done.
+func (g *GzipMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	b, err := g.Messager.ReceiveMessageContext(ctx, kind)
+	if err != nil {
+		return b, err
+	}
+	return g.gunzip(b)
+}
+
+// ReceiveAnyMessageContext is ReceiveAnyMessage, but gives up once ctx is
+// done.
+func (g *GzipMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	kind, b, err := g.Messager.ReceiveAnyMessageContext(ctx)
+	if err != nil {
+		return kind, b, err
+	}
+	b, err = g.gunzip(b)
+	return kind, b, err
+}
+
+func (g *GzipMessager) gunzip(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, gzipMarker) {
+		return b, nil
+	}
+	b = b[len(gzipMarker):]
+	if g.Encoding() != TLV {
+		var err error
+		b, err = base64.StdEncoding.DecodeString(string(b))
+		if err != nil {
+			return nil, err
+		}
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, maxGunzippedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxGunzippedSize {
+		return nil, ErrGunzippedTooLong
+	}
+	return out, nil
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func assertGzipMessagerIsMessager(g *GzipMessager) {
+	func(m Messager) {}(g)
+}
+
+func TestGzipMessagerRoundTrip(t *testing.T) {
+	large := []byte(strings.Repeat("TCPInfo.BytesAcked: 117653750\n", 100))
+	tests := []struct {
+		name       string
+		msg        []byte
+		compressed bool
+	}{
+		{name: "small", msg: []byte("CurMSS: 1448\n")},
+		{name: "at-threshold", msg: bytes.Repeat([]byte("a"), 100)},
+		{name: "above-threshold", msg: bytes.Repeat([]byte("a"), 101), compressed: true},
+		{name: "large", msg: large, compressed: true},
+		{name: "looks-compressed", msg: []byte("\x00GZ"), compressed: true},
+		{name: "empty", msg: []byte{}},
+	}
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		for _, tt := range tests {
+			t.Run(enc.String()+"/"+tt.name, func(t *testing.T) {
+				lc := &loopbackConnection{}
+				g := NewGzipMessager(enc.Messager(lc), 100)
+				err := g.SendMessage(TestMsg, tt.msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				g.SendMessage(MsgResults, tt.msg)
+
+				// Check what was actually sent with a plain messager.
+				raw, err := enc.Messager(&loopbackConnection{frames: lc.frames[:1]}).ReceiveMessage(TestMsg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := bytes.HasPrefix(raw, gzipMarker); got != tt.compressed {
+					t.Errorf("sent %q, compressed = %v, want %v", raw, got, tt.compressed)
+				}
+				if tt.compressed && len(tt.msg) > 1000 && len(raw) >= len(tt.msg)/4 {
+					t.Errorf("compressed %d bytes to %d", len(tt.msg), len(raw))
+				}
+
+				b, err := g.ReceiveMessage(TestMsg)
+				if err != nil || !bytes.Equal(b, tt.msg) {
+					t.Errorf("ReceiveMessage() = %q, %v, want %q", b, err, tt.msg)
+				}
+				kind, b, err := g.ReceiveAnyMessage()
+				if err != nil || kind != MsgResults || !bytes.Equal(b, tt.msg) {
+					t.Errorf("ReceiveAnyMessage() = %v, %q, %v, want %q", kind, b, err, tt.msg)
+				}
+			})
+		}
+	}
+}
+
+func TestGzipMessagerDefaultThreshold(t *testing.T) {
+	if g := NewGzipMessager(NewNopMessager(TLV), 0); g.threshold != DefaultGzipThreshold {
+		t.Errorf("threshold = %d, want %d", g.threshold, DefaultGzipThreshold)
+	}
+}
+
+func TestGzipMessagerErrors(t *testing.T) {
+	var bomb bytes.Buffer
+	w := gzip.NewWriter(&bomb)
+	w.Write(make([]byte, maxGunzippedSize+1))
+	w.Close()
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{name: "not-gzip", msg: []byte("\x00GZnot gzip data")},
+		{name: "truncated", msg: append([]byte("\x00GZ"), bomb.Bytes()[:20]...)},
+		{name: "too-long", msg: append([]byte("\x00GZ"), bomb.Bytes()...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNopMessager(TLV)
+			n.AddResponse(TestMsg, tt.msg)
+			_, err := NewGzipMessager(n, 0).ReceiveMessage(TestMsg)
+			if err == nil {
+				t.Error("ReceiveMessage() succeeded")
+			}
+		})
+	}
+	n := NewNopMessager(JSON)
+	n.AddResponse(TestMsg, []byte("\x00GZ!!not base64"))
+	if _, err := NewGzipMessager(n, 0).ReceiveMessage(TestMsg); err == nil {
+		t.Error("ReceiveMessage() succeeded on bad base64")
+	}
+	n = NewNopMessager(TLV)
+	n.AddResponse(TestMsg, append([]byte("\x00GZ"), bomb.Bytes()...))
+	if _, err := NewGzipMessager(n, 0).ReceiveMessage(TestMsg); err != ErrGunzippedTooLong {
+		t.Errorf("ReceiveMessage() = %v, want ErrGunzippedTooLong", err)
+	}
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrReceiveDisabled is returned by receives on a Messager whose receives have
+// been disabled with SetReceiveDisabled.
+var ErrReceiveDisabled = errors.New("receiving is disabled during the throughput test")
+
+// receiveGate records whether receiving is disabled. A nil *receiveGate never
+// disables receiving.
+type receiveGate struct {
+	disabled int32
+}
+
+func (g *receiveGate) set(disabled bool) {
+	var v int32
+	if disabled {
+		v = 1
+	}
+	atomic.StoreInt32(&g.disabled, v)
+}
+
+// check returns ErrReceiveDisabled if receiving is disabled.
+func (g *receiveGate) check() error {
+	if g != nil && atomic.LoadInt32(&g.disabled) != 0 {
+		return ErrReceiveDisabled
+	}
+	return nil
+}
+
+// receiveGateKeeper is implemented by connections that keep a receiveGate for
+// every Messager on the connection.
+type receiveGateKeeper interface {
+	keptReceiveGate() *receiveGate
+}
+
+// receiveGateOf returns the receiveGate kept by conn. For connections that
+// keep none it returns a new one, which disables the receives of a single
+// Messager only.
+func receiveGateOf(conn Connection) *receiveGate {
+	if k, ok := conn.(receiveGateKeeper); ok {
+		if g := k.keptReceiveGate(); g != nil {
+			return g
+		}
+	}
+	return &receiveGate{}
+}
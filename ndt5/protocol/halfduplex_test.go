@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetReceiveDisabled(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc).(ExtendedMessager)
+			m.SendMessage(TestMsg, []byte("one"))
+
+			m.SetReceiveDisabled(true)
+			// Sends are unaffected.
+			if err := m.SendMessage(TestMsg, []byte("two")); err != nil {
+				t.Errorf("SendMessage() while receiving is disabled = %v", err)
+			}
+			receives := map[string]func() error{
+				"ReceiveMessage": func() error {
+					_, err := m.ReceiveMessage(TestMsg)
+					return err
+				},
+				"ReceiveOneOf": func() error {
+					_, _, err := m.ReceiveOneOf(TestMsg, MsgError)
+					return err
+				},
+				"ReceiveAnyMessage": func() error {
+					_, _, err := m.ReceiveAnyMessage()
+					return err
+				},
+				"Peek": func() error {
+					_, err := m.(ExtendedMessager).Peek()
+					return err
+				},
+			}
+			for name, receive := range receives {
+				if err := receive(); err != ErrReceiveDisabled {
+					t.Errorf("%s() while receiving is disabled = %v, want ErrReceiveDisabled", name, err)
+				}
+			}
+			if len(lc.frames) != 2 {
+				t.Errorf("%d frames left, want both frames left unread", len(lc.frames))
+			}
+
+			m.SetReceiveDisabled(false)
+			for _, want := range []string{"one", "two"} {
+				if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != want {
+					t.Errorf("ReceiveMessage() after re-enabling = %q, %v, want %q", b, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetReceiveDisabledSharedByMessagers(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// Receives that are not disabled fail rather than hang.
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn := AdaptNetConn(server, server)
+	s2c := TLV.Messager(conn).(ExtendedMessager)
+	control := JSON.Messager(conn)
+
+	s2c.SetReceiveDisabled(true)
+	if _, err := control.ReceiveMessage(TestMsg); err != ErrReceiveDisabled {
+		t.Errorf("ReceiveMessage() on another Messager = %v, want ErrReceiveDisabled", err)
+	}
+	if _, err := TLV.Messager(conn).ReceiveMessage(TestMsg); err != ErrReceiveDisabled {
+		t.Errorf("ReceiveMessage() on a Messager created later = %v, want ErrReceiveDisabled", err)
+	}
+
+	s2c.SetReceiveDisabled(false)
+	go JSON.Messager(AdaptNetConn(client, client)).SendMessage(TestMsg, []byte("rate"))
+	if b, err := control.ReceiveMessage(TestMsg); err != nil || string(b) != "rate" {
+		t.Errorf("ReceiveMessage() after re-enabling = %q, %v", b, err)
+	}
+}
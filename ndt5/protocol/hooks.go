@@ -0,0 +1,63 @@
+package protocol
+
+// WithSendHook calls fn after every frame that the Messager sends, with the
+// type of the frame and the length of its payload, as encoded on the wire.
+// Frames that could not be sent are not reported. fn is called from the
+// goroutine that is sending, so it should return quickly, and it cannot
+// change what is sent.
+func WithSendHook(fn func(kind MessageType, length int)) MessagerOption {
+	return func(o *messagerOptions) {
+		o.onSend = fn
+	}
+}
+
+// WithReceiveHook calls fn after every attempt of the Messager to read a frame,
+// with the type of the frame, the length of its payload, as encoded on the
+// wire, and the error from reading it, if any. A frame that could not be read
+// is reported as MsgUnknown, with a length of zero. Like the send hook, fn is
+// called from the goroutine that is receiving, and it cannot change what is
+// received.
+func WithReceiveHook(fn func(kind MessageType, length int, err error)) MessagerOption {
+	return func(o *messagerOptions) {
+		o.onReceive = fn
+	}
+}
+
+// hookConnection reports every frame that a Messager writes to or reads from
+// another Connection to the hooks set by WithSendHook and WithReceiveHook.
+// Either hook may be nil.
+type hookConnection struct {
+	wrappedConnection
+	onSend    func(MessageType, int)
+	onReceive func(MessageType, int, error)
+}
+
+func (hc *hookConnection) WriteMessage(messageType int, data []byte) error {
+	err := hc.Connection.WriteMessage(messageType, data)
+	if err == nil && hc.onSend != nil {
+		kind, length := frameSummary(data)
+		hc.onSend(kind, length)
+	}
+	return err
+}
+
+func (hc *hookConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := hc.Connection.ReadMessage()
+	if hc.onReceive != nil {
+		kind, length := MsgUnknown, 0
+		if err == nil {
+			kind, length = frameSummary(data)
+		}
+		hc.onReceive(kind, length, err)
+	}
+	return messageType, data, err
+}
+
+// frameSummary returns the type and the payload length of a TLV frame, or
+// MsgUnknown and zero if it is too short to have a header.
+func frameSummary(frame []byte) (MessageType, int) {
+	if len(frame) < 3 {
+		return MsgUnknown, 0
+	}
+	return MessageType(frame[0]), len(frame) - 3
+}
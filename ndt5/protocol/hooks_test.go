@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// hookCall is a single call of a send or receive hook.
+type hookCall struct {
+	kind   MessageType
+	length int
+	err    error
+}
+
+func TestHooks(t *testing.T) {
+	for _, tt := range []struct {
+		enc Encoding
+		// length is the length of the payload carrying "hello".
+		length int
+	}{
+		{TLV, len("hello")},
+		{JSON, len(`{"msg":"hello"}`)},
+	} {
+		t.Run(tt.enc.String(), func(t *testing.T) {
+			var sends, receives []hookCall
+			lc := &loopbackConnection{}
+			m := tt.enc.Messager(lc,
+				WithSendHook(func(kind MessageType, length int) {
+					sends = append(sends, hookCall{kind, length, nil})
+				}),
+				WithReceiveHook(func(kind MessageType, length int, err error) {
+					receives = append(receives, hookCall{kind, length, err})
+				}))
+			if err := m.SendMessage(TestMsg, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SendMessage(MsgLogin, []byte("")); err != nil {
+				t.Fatal(err)
+			}
+			wantSends := []hookCall{{TestMsg, tt.length, nil}, {MsgLogin, tt.length - len("hello"), nil}}
+			if !reflect.DeepEqual(sends, wantSends) {
+				t.Errorf("send hook calls = %v, want %v", sends, wantSends)
+			}
+
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "hello" {
+				t.Errorf("ReceiveMessage() = %q, %v, want \"hello\"", b, err)
+			}
+			// A message of the wrong type is still reported as read.
+			if _, err := m.ReceiveMessage(TestMsg); err == nil {
+				t.Error("ReceiveMessage() of a MsgLogin succeeded")
+			}
+			if _, err := m.ReceiveMessage(TestMsg); err != io.EOF {
+				t.Errorf("ReceiveMessage() at the end = %v, want io.EOF", err)
+			}
+			wantReceives := []hookCall{
+				{TestMsg, tt.length, nil},
+				{MsgLogin, tt.length - len("hello"), nil},
+				{MsgUnknown, 0, io.EOF},
+			}
+			if !reflect.DeepEqual(receives, wantReceives) {
+				t.Errorf("receive hook calls = %v, want %v", receives, wantReceives)
+			}
+		})
+	}
+}
+
+func TestHooksAreOptional(t *testing.T) {
+	var sends int
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc, WithSendHook(func(MessageType, int) { sends++ }), WithReceiveHook(nil))
+	m.SendMessage(TestMsg, []byte("hello"))
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "hello" {
+		t.Errorf("ReceiveMessage() with a nil receive hook = %q, %v", b, err)
+	}
+	if sends != 1 {
+		t.Errorf("send hook called %d times, want 1", sends)
+	}
+}
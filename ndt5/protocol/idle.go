@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is returned by a receive when no data arrived for the idle
+// timeout set by WithIdleTimeout.
+var ErrIdleTimeout = errors.New("no data received within the idle timeout")
+
+// WithIdleTimeout makes receives fail with ErrIdleTimeout once no data has
+// arrived for d. Unlike a deadline, the timeout starts over whenever data
+// arrives, even partway through a message, so that a client that sends slowly
+// but steadily is never cut off. Read deadlines set on the connection by other
+// means, like those of ReceiveMessageContext and CancelReceive, still apply.
+//
+// The timeout only applies to the receives of the Messager created with it,
+// and not to other Messagers on the same connection. Connections returned by
+// AdaptNetConn extend the timeout with every read from the socket. A receive
+// that times out partway through a frame on them returns a *PartialFrameError
+// wrapping ErrIdleTimeout, and the next receive continues the frame. Other
+// connections, like websockets, read whole messages, so for them the timeout
+// bounds the wait for each message. Connections that do not support read
+// deadlines are left alone.
+func WithIdleTimeout(d time.Duration) MessagerOption {
+	return func(o *messagerOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// withIdleTimeout returns conn with an idle timeout of d on its reads. Only
+// the reads through the returned Connection time out, so the timeout applies
+// to the Messager that reads through it, and not to others on conn.
+func withIdleTimeout(conn Connection, d time.Duration) Connection {
+	if sf, ok := conn.(streamFormatter); ok {
+		return sf.withStreamFormat(func(f *streamFormat) {
+			f.idleTimeout = d
+		})
+	}
+	if k, ok := conn.(deadlineKeeper); ok && k.keptDeadline() != nil {
+		// Share the deadline that conn keeps, so that deadlines set on conn
+		// directly still apply.
+		return &idleConnection{wrappedConnection: wrappedConnection{Connection: conn}, timeout: d, idle: k.keptDeadline()}
+	}
+	rd, ok := conn.(readDeadliner)
+	if !ok {
+		return conn
+	}
+	return &idleConnection{wrappedConnection: wrappedConnection{Connection: conn}, timeout: d, idle: &readDeadline{rd: rd}}
+}
+
+// readDeadline manages the read deadline of a connection. It keeps the
+// deadline set from outside, so that the earlier of that deadline and the idle
+// timeout, if any, applies to every read, and the outside deadline is back in
+// force between reads. A receive can also be interrupted with a deadline in
+// the past, after which the outside deadline is put back, so that interrupting
+// a receive never loses a deadline set by the caller.
+type readDeadline struct {
+	rd readDeadliner
+	// mu makes setting the outside deadline, which may happen from another
+	// goroutine to unblock a read, atomic with extending the deadline.
+	mu    sync.Mutex
+	outer time.Time
+	// interrupts is the number of interruptions in force, during which reads
+	// fail at once.
+	interrupts int
+}
+
+// setReadDeadline sets the outside deadline to t. It takes effect once no
+// interruption is in force.
+func (d *readDeadline) setReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.outer = t
+	if d.interrupts > 0 {
+		return nil
+	}
+	return d.rd.SetReadDeadline(t)
+}
+
+// extend sets the deadline for a read that starts now with an idle timeout,
+// and returns whether the idle timeout, rather than the outside deadline or an
+// interruption, is the one in force.
+func (d *readDeadline) extend(timeout time.Duration) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.interrupts > 0 {
+		return false, nil
+	}
+	t := time.Now().Add(timeout)
+	if !d.outer.IsZero() && !d.outer.After(t) {
+		return false, d.rd.SetReadDeadline(d.outer)
+	}
+	return true, d.rd.SetReadDeadline(t)
+}
+
+// restore puts the outside deadline back in force once a read is over.
+func (d *readDeadline) restore() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.interrupts == 0 {
+		d.rd.SetReadDeadline(d.outer)
+	}
+}
+
+// interrupt makes reads fail at once, until resume is called.
+func (d *readDeadline) interrupt() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.interrupts++
+	// Setting a deadline in the past unblocks any pending read.
+	return d.rd.SetReadDeadline(time.Now())
+}
+
+// resume ends an interruption, putting the outside deadline back in force once
+// no other interruption is.
+func (d *readDeadline) resume() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.interrupts == 0 {
+		return nil
+	}
+	d.interrupts--
+	if d.interrupts > 0 {
+		return nil
+	}
+	return d.rd.SetReadDeadline(d.outer)
+}
+
+// check returns ErrIdleTimeout in place of err if the read failed because the
+// idle timeout, which was in force if idle is true, expired.
+func (d *readDeadline) check(err error, idle bool) error {
+	var ne net.Error
+	if idle && errors.As(err, &ne) && ne.Timeout() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+// deadlineKeeper is implemented by connections that keep track of their read
+// deadline with a readDeadline, which may be nil if they have none.
+type deadlineKeeper interface {
+	keptDeadline() *readDeadline
+}
+
+// readInterrupter is implemented by connections that keep track of the read
+// deadline set from outside, so that a read can be interrupted without losing
+// it.
+type readInterrupter interface {
+	interruptRead() error
+	resumeRead() error
+}
+
+// interruptRead unblocks any read from conn, and makes further reads fail at
+// once, until resumeRead is called.
+func interruptRead(conn Connection) error {
+	if ri, ok := conn.(readInterrupter); ok {
+		return ri.interruptRead()
+	}
+	rd, ok := conn.(readDeadliner)
+	if !ok {
+		return fmt.Errorf("connection %s does not support read deadlines", conn.String())
+	}
+	// Setting a deadline in the past unblocks any pending read.
+	return rd.SetReadDeadline(time.Now())
+}
+
+// resumeRead undoes interruptRead, putting back the read deadline that was in
+// force before. Connections that do not keep track of their read deadline are
+// left without one.
+func resumeRead(conn Connection) error {
+	if ri, ok := conn.(readInterrupter); ok {
+		return ri.resumeRead()
+	}
+	rd, ok := conn.(readDeadliner)
+	if !ok {
+		return fmt.Errorf("connection %s does not support read deadlines", conn.String())
+	}
+	return rd.SetReadDeadline(time.Time{})
+}
+
+// idleReader extends the idle timeout before every read from a byte stream.
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	idle    *readDeadline
+}
+
+func (ir *idleReader) Read(b []byte) (int, error) {
+	idle, err := ir.idle.extend(ir.timeout)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ir.r.Read(b)
+	return n, ir.idle.check(err, idle)
+}
+
+// idleConnection applies an idle timeout to each message read from a
+// connection that reads whole messages.
+type idleConnection struct {
+	wrappedConnection
+	timeout time.Duration
+	idle    *readDeadline
+}
+
+func (ic *idleConnection) SetReadDeadline(t time.Time) error {
+	return ic.idle.setReadDeadline(t)
+}
+
+func (ic *idleConnection) interruptRead() error {
+	return ic.idle.interrupt()
+}
+
+func (ic *idleConnection) resumeRead() error {
+	return ic.idle.resume()
+}
+
+func (ic *idleConnection) ReadMessage() (int, []byte, error) {
+	idle, err := ic.idle.extend(ic.timeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ic.idle.restore()
+	kind, b, err := ic.Connection.ReadMessage()
+	return kind, b, ic.idle.check(err, idle)
+}
+
+// Keepalive sends an empty MsgKeepalive message on m every interval until stop
+// is closed, so that NAT gateways do not drop a control connection that is
+// idle between tests. Receivers skip keepalives unless they ask for them, so
+// they do not disturb the expected sequence of messages.
+//
+// Keepalive sends from the calling goroutine, usually one started just for it,
+// while the connection would otherwise be idle. Nothing else may send on m
+// until stop is closed and Keepalive has returned, unless m is safe for
+// concurrent sends. Keepalive returns nil once stop is closed, or the error
+// from the first send that fails.
+func Keepalive(m Messager, interval time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			err := m.SendMessage(MsgKeepalive, []byte{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
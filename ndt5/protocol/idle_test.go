@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV} {
+		t.Run(enc.String(), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			const idle = 150 * time.Millisecond
+			m := enc.Messager(AdaptNetConn(server, server), WithIdleTimeout(idle))
+
+			// Record the frame, and drip it byte by byte, taking far longer
+			// than the idle timeout in all, but never pausing for as long.
+			lc := &loopbackConnection{}
+			enc.Messager(lc).SendMessage(TestMsg, []byte("slow but steady"))
+			frame := lc.frames[0]
+			go func() {
+				for i := range frame {
+					time.Sleep(20 * time.Millisecond)
+					if _, err := client.Write(frame[i : i+1]); err != nil {
+						return
+					}
+				}
+			}()
+			start := time.Now()
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "slow but steady" {
+				t.Fatalf("ReceiveMessage() of a dripped message = %q, %v", b, err)
+			}
+			if elapsed := time.Since(start); elapsed < idle {
+				t.Fatalf("the message took %v, want longer than the idle timeout", elapsed)
+			}
+
+			// A client that stops sending times out, in the middle of the
+			// frame.
+			go client.Write(frame[:2])
+			start = time.Now()
+			var pe *PartialFrameError
+			if _, err := m.ReceiveMessage(TestMsg); !errors.As(err, &pe) || pe.Err != ErrIdleTimeout {
+				t.Errorf("ReceiveMessage() from an idle client = %v, want a *PartialFrameError of ErrIdleTimeout", err)
+			}
+			if elapsed := time.Since(start); elapsed < idle {
+				t.Errorf("ReceiveMessage() timed out after %v, want at least %v", elapsed, idle)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutKeepsOtherDeadlines(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server), WithIdleTimeout(time.Hour))
+
+	// An earlier deadline still applies, and is not reported as idleness.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.ReceiveMessageContext(ctx, TestMsg); err != context.DeadlineExceeded {
+		t.Errorf("ReceiveMessageContext() = %v, want context.DeadlineExceeded", err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := m.ReceiveMessage(TestMsg)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.CancelReceive()
+	select {
+	case err := <-errs:
+		if err != ErrReceiveCancelled {
+			t.Errorf("cancelled ReceiveMessage() = %v, want ErrReceiveCancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CancelReceive() did not unblock ReceiveMessage()")
+	}
+}
+
+func TestIdleTimeoutWholeMessages(t *testing.T) {
+	fc := &fakeDeadlineConnection{}
+	m := TLV.Messager(fc, WithIdleTimeout(time.Minute))
+	m.SendMessage(TestMsg, []byte("hi"))
+	before := time.Now()
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Fatalf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if len(fc.deadlines) != 2 || fc.deadlines[0].Before(before.Add(time.Minute)) || !fc.deadlines[1].IsZero() {
+		t.Errorf("read deadlines set = %v, want one a minute away, then none", fc.deadlines)
+	}
+
+	// Connections without read deadlines are left alone.
+	lc := &loopbackConnection{}
+	m = TLV.Messager(lc, WithIdleTimeout(time.Minute))
+	m.SendMessage(TestMsg, []byte("hi"))
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() without read deadlines = %q, %v", b, err)
+	}
+}
+
+func TestIdleTimeoutStaysWithMessager(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := AdaptNetConn(server, server)
+	idle := TLV.Messager(conn, WithIdleTimeout(30*time.Millisecond))
+	if _, err := idle.ReceiveMessage(TestMsg); err != ErrIdleTimeout {
+		t.Fatalf("ReceiveMessage() with an idle timeout = %v, want ErrIdleTimeout", err)
+	}
+
+	// A Messager created without the option waits as long as it takes.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte{byte(TestMsg), 0, 2, 'h', 'i'})
+	}()
+	m := TLV.Messager(conn)
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() without an idle timeout = %q, %v", b, err)
+	}
+}
+
+// fakeDeadlineConnection is a loopbackConnection that records the read
+// deadlines set on it.
+type fakeDeadlineConnection struct {
+	loopbackConnection
+	deadlines []time.Time
+}
+
+func (fc *fakeDeadlineConnection) SetReadDeadline(t time.Time) error {
+	fc.deadlines = append(fc.deadlines, t)
+	return nil
+}
+
+func TestKeepalive(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := AdaptNetConn(serverConn, serverConn)
+	client := AdaptNetConn(clientConn, clientConn)
+	sm := TLV.Messager(server)
+	cm := TLV.Messager(client)
+
+	stop := make(chan struct{})
+	keepaliveDone := make(chan error)
+	go func() {
+		keepaliveDone <- Keepalive(sm, time.Millisecond, stop)
+	}()
+
+	// The server waits for the client while the keepalives are being sent.
+	received := make(chan string)
+	go func() {
+		b, err := sm.ReceiveMessage(TestMsg)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- string(b)
+	}()
+
+	for i := 0; i < 3; i++ {
+		b, err := cm.ReceiveMessage(MsgKeepalive)
+		if err != nil || len(b) != 0 {
+			t.Fatalf("ReceiveMessage(MsgKeepalive) = %q, %v", b, err)
+		}
+	}
+	// Keepalives from the client must not disturb the server either.
+	go func() {
+		cm.SendMessage(MsgKeepalive, []byte{})
+		cm.SendMessage(TestMsg, []byte("done"))
+		// Keep reading so that no keepalive is left blocked on the pipe.
+		for {
+			if _, _, err := cm.ReceiveAnyMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if got := <-received; got != "done" {
+		t.Errorf("ReceiveMessage(TestMsg) = %q, want %q", got, "done")
+	}
+
+	close(stop)
+	if err := <-keepaliveDone; err != nil {
+		t.Errorf("Keepalive() = %v", err)
+	}
+	serverConn.Close()
+	clientConn.Close()
+}
+
+func TestKeepaliveSendError(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	clientConn.Close()
+	err := Keepalive(TLV.Messager(AdaptNetConn(serverConn, serverConn)), time.Millisecond, make(chan struct{}))
+	if err == nil {
+		t.Error("Keepalive() should return the send error")
+	}
+}
+
+func TestKeepaliveSkippedUnlessExpected(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		lc := &loopbackConnection{}
+		m := enc.Messager(lc)
+		m.SendMessage(MsgKeepalive, []byte{})
+		m.SendMessage(MsgKeepalive, []byte{})
+		m.SendMessage(MsgResults, []byte("results"))
+		m.SendMessage(MsgKeepalive, []byte{})
+		b, err := m.ReceiveMessage(MsgResults)
+		if err != nil || string(b) != "results" {
+			t.Errorf("%v: ReceiveMessage() = %q, %v", enc, b, err)
+		}
+		kind, _, err := m.ReceiveOneOf(MsgKeepalive, TestMsg)
+		if err != nil || kind != MsgKeepalive {
+			t.Errorf("%v: ReceiveOneOf(MsgKeepalive, TestMsg) = %v, %v", enc, kind, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MessagerMetrics holds the Prometheus metrics updated by InstrumentedMessagers.
+type MessagerMetrics struct {
+	// Messages counts the messages sent and received, labeled by direction
+	// ("send" or "receive"), message type, and encoding.
+	Messages *prometheus.CounterVec
+	// MessageBytes is the distribution of message payload sizes, labeled by
+	// direction and encoding.
+	MessageBytes *prometheus.HistogramVec
+}
+
+// InstrumentedMessager wraps another Messager, forwarding all calls to it
+// unchanged and counting every message that is successfully sent or received.
+type InstrumentedMessager struct {
+	Messager
+	metrics *MessagerMetrics
+}
+
+// NewInstrumentedMessager creates an InstrumentedMessager that forwards to m
+// and updates mm, or metrics.ControlMessages and metrics.ControlMessageBytes
+// if mm is nil.
+func NewInstrumentedMessager(m Messager, mm *MessagerMetrics) *InstrumentedMessager {
+	if mm == nil {
+		mm = &MessagerMetrics{
+			Messages:     metrics.ControlMessages,
+			MessageBytes: metrics.ControlMessageBytes,
+		}
+	}
+	return &InstrumentedMessager{Messager: m, metrics: mm}
+}
+
+func (im *InstrumentedMessager) observe(direction string, kind MessageType, size int) {
+	enc := im.Encoding().String()
+	im.metrics.Messages.WithLabelValues(direction, kind.String(), enc).Inc()
+	im.metrics.MessageBytes.WithLabelValues(direction, enc).Observe(float64(size))
+}
+
+// SendMessage forwards the message and counts it if it was sent.
+func (im *InstrumentedMessager) SendMessage(kind MessageType, contents []byte) error {
+	err := im.Messager.SendMessage(kind, contents)
+	if err == nil {
+		im.observe("send", kind, len(contents))
+	}
+	return err
+}
+
+// SendMessageString forwards the message and counts it if it was sent.
+func (im *InstrumentedMessager) SendMessageString(kind MessageType, s string) error {
+	err := im.Messager.SendMessageString(kind, s)
+	if err == nil {
+		im.observe("send", kind, len(s))
+	}
+	return err
+}
+
+// SendS2CResults forwards the results and counts them as a TestMsg if they
+// were sent. Their size is that of the TLV serialization.
+func (im *InstrumentedMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	err := im.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+	if err == nil {
+		r := &S2CResult{
+			ThroughputKbps: throughputKbps,
+			UnsentBytes:    unsentBytes,
+			TotalSentBytes: totalSentBytes,
+		}
+		im.observe("send", TestMsg, len(r.TLV()))
+	}
+	return err
+}
+
+// ReceiveMessage forwards the call and counts the message if one was received.
+func (im *InstrumentedMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	b, err := im.Messager.ReceiveMessage(kind)
+	if err == nil {
+		im.observe("receive", kind, len(b))
+	}
+	return b, err
+}
+
+// ReceiveOneOf forwards the call and counts the message if one was received.
+func (im *InstrumentedMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	kind, b, err := im.Messager.ReceiveOneOf(kinds...)
+	if err == nil {
+		im.observe("receive", kind, len(b))
+	}
+	return kind, b, err
+}
+
+// ReceiveAnyMessage forwards the call and counts the message if one was
+// received.
+func (im *InstrumentedMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	kind, b, err := im.Messager.ReceiveAnyMessage()
+	if err == nil {
+		im.observe("receive", kind, len(b))
+	}
+	return kind, b, err
+}
+
+// ReceiveMessageContext forwards the call and counts the message if one was
+// received.
+func (im *InstrumentedMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	b, err := im.Messager.ReceiveMessageContext(ctx, kind)
+	if err == nil {
+		im.observe("receive", kind, len(b))
+	}
+	return b, err
+}
+
+// ReceiveAnyMessageContext forwards the call and counts the message if one was
+// received.
+func (im *InstrumentedMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	kind, b, err := im.Messager.ReceiveAnyMessageContext(ctx)
+	if err == nil {
+		im.observe("receive", kind, len(b))
+	}
+	return kind, b, err
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func assertInstrumentedMessagerIsMessager(im *InstrumentedMessager) {
+	func(m Messager) {}(im)
+}
+
+func TestInstrumentedMessager(t *testing.T) {
+	mm := &MessagerMetrics{
+		Messages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "messages"}, []string{"direction", "type", "encoding"}),
+		MessageBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{Name: "bytes"}, []string{"direction", "encoding"}),
+	}
+	n := NewNopMessager(TLV)
+	n.AddResponse(MsgLogin, []byte("v5.0"))
+	n.AddResponse(TestMsg, []byte("12345"))
+	n.AddError(errors.New("closed"))
+	im := NewInstrumentedMessager(n, mm)
+
+	im.SendMessage(SrvQueue, []byte("0"))
+	im.SendMessage(TestMsg, []byte("rate"))
+	im.SendMessage(TestMsg, []byte("rate"))
+	im.SendS2CResults(1, 2, 3)
+	if _, err := im.ReceiveMessage(MsgLogin); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := im.ReceiveAnyMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.ReceiveMessage(TestMsg); err == nil {
+		t.Fatal("ReceiveMessage() should have failed")
+	}
+
+	tests := []struct {
+		direction string
+		kind      MessageType
+		want      float64
+	}{
+		{"send", SrvQueue, 1},
+		{"send", TestMsg, 3},
+		{"send", MsgLogin, 0},
+		{"receive", MsgLogin, 1},
+		{"receive", TestMsg, 1},
+	}
+	for _, tt := range tests {
+		got := testutil.ToFloat64(mm.Messages.WithLabelValues(tt.direction, tt.kind.String(), "TLV"))
+		if got != tt.want {
+			t.Errorf("Messages{%s, %v} = %v, want %v", tt.direction, tt.kind, got, tt.want)
+		}
+	}
+	// Every call was forwarded unchanged.
+	if n.Sent(TestMsg) != 3 || n.Sent(SrvQueue) != 1 || im.Encoding() != TLV {
+		t.Errorf("calls were not forwarded: %d TestMsg, %d SrvQueue", n.Sent(TestMsg), n.Sent(SrvQueue))
+	}
+}
+
+func TestNewInstrumentedMessagerDefaultMetrics(t *testing.T) {
+	im := NewInstrumentedMessager(NewNopMessager(JSON), nil)
+	if im.metrics.Messages != metrics.ControlMessages || im.metrics.MessageBytes != metrics.ControlMessageBytes {
+		t.Error("nil metrics should use the ndt5 control message metrics")
+	}
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import "log"
+
+// Logger is the interface through which this package logs diagnostics. It is
+// implemented by *log.Logger, and is easily adapted to structured loggers.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// stdLogger logs through the standard library's default logger, so that
+// changes made with log.SetOutput and log.SetFlags still apply.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+func (stdLogger) Println(v ...interface{})               { log.Println(v...) }
+
+// logger is the Logger used throughout this package.
+var logger Logger = stdLogger{}
+
+// SetLogger routes all of this package's diagnostics to l, or back to the
+// standard library's default logger if l is nil. It is meant to be called
+// during startup, before any connections are handled.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	logger = l
+}
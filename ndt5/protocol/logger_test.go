@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type capturingLogger struct {
+	lines []string
+}
+
+func (c *capturingLogger) Printf(format string, v ...interface{}) {
+	c.lines = append(c.lines, fmt.Sprintf(format, v...))
+}
+
+func (c *capturingLogger) Println(v ...interface{}) {
+	c.lines = append(c.lines, fmt.Sprintln(v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	c := &capturingLogger{}
+	SetLogger(c)
+	defer SetLogger(nil)
+
+	data := struct {
+		Count   int
+		Channel chan int
+	}{Count: 1}
+	err := SendMetrics(data, &fakeMessager{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.lines) != 1 || !strings.HasPrefix(c.lines[0], "Unhandled case in SendMetrics: chan") {
+		t.Errorf("logged %q, want the unhandled case", c.lines)
+	}
+
+	Unknown.Messager(&loopbackConnection{})
+	if len(c.lines) != 2 {
+		t.Errorf("logged %q, want the Messager() error too", c.lines)
+	}
+}
+
+func TestSetLoggerNilRestoresDefault(t *testing.T) {
+	SetLogger(&capturingLogger{})
+	SetLogger(nil)
+	if _, ok := logger.(stdLogger); !ok {
+		t.Errorf("logger = %T, want stdLogger", logger)
+	}
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Login holds the contents of the login message that starts every ndt5
+// session.
+type Login struct {
+	// Tests is the bitmask of the tests requested by the client.
+	Tests int
+	// Version is the version the client reports, such as "v3.5.5". It is
+	// only sent in a MsgExtendedLogin, and is empty otherwise.
+	Version string
+}
+
+// ParseLogin parses the payload of a login message of the given type, such as
+// the payload returned by DetectEncoding. A MsgLogin holds the tests as a
+// single byte, and a MsgExtendedLogin is a JSON object with the version in
+// "msg" and the tests, as a decimal string, in "tests".
+func ParseLogin(kind MessageType, payload []byte) (Login, error) {
+	switch kind {
+	case MsgLogin:
+		if len(payload) != 1 {
+			return Login{}, errors.New("MsgLogin requires a 1-byte message")
+		}
+		return Login{Tests: int(payload[0])}, nil
+	case MsgExtendedLogin:
+		msg := JSONMessage{}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return Login{}, err
+		}
+		return extendedLogin(&msg)
+	}
+	return Login{}, fmt.Errorf("%v is not a login message", kind)
+}
+
+// extendedLogin converts a decoded MsgExtendedLogin into a Login.
+func extendedLogin(msg *JSONMessage) (Login, error) {
+	tests, err := strconv.Atoi(msg.Tests)
+	if err != nil {
+		return Login{}, fmt.Errorf("bad tests in MsgExtendedLogin: %v", err)
+	}
+	return Login{Tests: tests, Version: msg.Msg}, nil
+}
+
+// ReadLogin receives the login message from m and parses it. A TLV Messager
+// accepts both a MsgLogin and a MsgExtendedLogin, whose JSON it parses
+// itself. Other Messagers decode the MsgExtendedLogin in their own encoding,
+// and must therefore implement ExtendedMessager.
+func ReadLogin(m Messager) (Login, error) {
+	if m.Encoding() == TLV {
+		kind, b, err := m.ReceiveOneOf(MsgLogin, MsgExtendedLogin)
+		if err != nil {
+			return Login{}, err
+		}
+		return ParseLogin(kind, b)
+	}
+	dm, ok := m.(ExtendedMessager)
+	if !ok {
+		return Login{}, fmt.Errorf("cannot decode a MsgExtendedLogin with a %T", m)
+	}
+	msg := JSONMessage{}
+	if err := dm.ReceiveMessageInto(MsgExtendedLogin, &msg); err != nil {
+		return Login{}, err
+	}
+	return extendedLogin(&msg)
+}
+
+// LoginAckError is returned by SendLoginAck when one of the messages that
+// answer a login could not be sent.
+type LoginAckError struct {
+	// Step names the message that could not be sent: "SrvQueue",
+	// "MsgLoginVersion" or "MsgLoginTests".
+	Step string
+	Err  error
+}
+
+func (e *LoginAckError) Error() string {
+	return fmt.Sprintf("could not send %s: %v", e.Step, e.Err)
+}
+
+// Unwrap returns the error returned by the Messager.
+func (e *LoginAckError) Unwrap() error {
+	return e.Err
+}
+
+// SendLoginAck sends the messages that answer a login, in the order clients
+// expect them: a SrvQueue of "0" telling the client to go ahead, a MsgLogin
+// with serverVersion, and a MsgLogin listing the tests the server will run.
+// The tests bitmask is sent as the space-separated decimal value of each of
+// its bits, lowest first, like "2 4 32" for C2S, S2C and META. If a message
+// cannot be sent, the error is a *LoginAckError naming it.
+func SendLoginAck(m Messager, serverVersion string, tests int) error {
+	if err := m.SendMessage(SrvQueue, []byte("0")); err != nil {
+		return &LoginAckError{Step: "SrvQueue", Err: err}
+	}
+	if err := m.SendMessage(MsgLogin, []byte(serverVersion)); err != nil {
+		return &LoginAckError{Step: "MsgLoginVersion", Err: err}
+	}
+	ids := []string{}
+	for bit := 1; bit > 0 && bit <= tests; bit <<= 1 {
+		if tests&bit != 0 {
+			ids = append(ids, strconv.Itoa(bit))
+		}
+	}
+	if err := m.SendMessage(MsgLogin, []byte(strings.Join(ids, " "))); err != nil {
+		return &LoginAckError{Step: "MsgLoginTests", Err: err}
+	}
+	return nil
+}
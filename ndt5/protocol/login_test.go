@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReadLogin(t *testing.T) {
+	want := Login{Tests: 22, Version: "v3.5.5"}
+	extended := &JSONMessage{Msg: "v3.5.5", Tests: "22"}
+	tests := []struct {
+		name string
+		enc  Encoding
+		send func(lc *loopbackConnection)
+		want Login
+	}{
+		{
+			name: "TLV MsgLogin",
+			enc:  TLV,
+			send: func(lc *loopbackConnection) { WriteTLVMessage(lc, MsgLogin, string([]byte{22})) },
+			want: Login{Tests: 22},
+		},
+		{
+			name: "TLV MsgExtendedLogin",
+			enc:  TLV,
+			send: func(lc *loopbackConnection) { writeJSONFrame(lc, MsgExtendedLogin, extended) },
+			want: want,
+		},
+		{
+			name: "JSON",
+			enc:  JSON,
+			send: func(lc *loopbackConnection) { writeJSONFrame(lc, MsgExtendedLogin, extended) },
+			want: want,
+		},
+		{
+			name: "MessagePack",
+			enc:  MessagePack,
+			send: func(lc *loopbackConnection) {
+				b, err := encodeMsgpack(extended)
+				if err != nil {
+					t.Fatal(err)
+				}
+				WriteTLVMessage(lc, MsgExtendedLogin, string(b))
+			},
+			want: want,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &loopbackConnection{}
+			tt.send(lc)
+			got, err := ReadLogin(tt.enc.Messager(lc))
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadLogin() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLoginErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    MessageType
+		payload string
+	}{
+		{name: "long MsgLogin", kind: MsgLogin, payload: "22"},
+		{name: "empty MsgLogin", kind: MsgLogin},
+		{name: "bad JSON", kind: MsgExtendedLogin, payload: "{"},
+		{name: "bad tests", kind: MsgExtendedLogin, payload: `{"msg": "v3.5.5", "tests": "all"}`},
+		{name: "not a login", kind: TestMsg, payload: "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if l, err := ParseLogin(tt.kind, []byte(tt.payload)); err == nil {
+				t.Errorf("ParseLogin() = %+v, want an error", l)
+			}
+		})
+	}
+	if _, err := ReadLogin(NewNopMessager(JSON)); err == nil {
+		t.Error("ReadLogin() of a NopMessager succeeded")
+	}
+}
+
+func TestSendLoginAck(t *testing.T) {
+	for _, tt := range []struct {
+		enc  Encoding
+		want [][]byte
+	}{
+		{TLV, [][]byte{
+			append([]byte{byte(SrvQueue), 0, 1}, "0"...),
+			append([]byte{byte(MsgLogin), 0, 12}, "v5.0-NDTinGO"...),
+			append([]byte{byte(MsgLogin), 0, 6}, "2 4 32"...),
+		}},
+		{JSON, [][]byte{
+			append([]byte{byte(SrvQueue), 0, 11}, `{"msg":"0"}`...),
+			append([]byte{byte(MsgLogin), 0, 22}, `{"msg":"v5.0-NDTinGO"}`...),
+			append([]byte{byte(MsgLogin), 0, 16}, `{"msg":"2 4 32"}`...),
+		}},
+	} {
+		lc := &loopbackConnection{}
+		if err := SendLoginAck(tt.enc.Messager(lc), "v5.0-NDTinGO", 2|4|32); err != nil {
+			t.Fatalf("%v: SendLoginAck() = %v", tt.enc, err)
+		}
+		if !reflect.DeepEqual(lc.frames, tt.want) {
+			t.Errorf("%v: SendLoginAck() sent %q, want %q", tt.enc, lc.frames, tt.want)
+		}
+	}
+
+	// With no tests to run, the list is empty.
+	lc := &loopbackConnection{}
+	SendLoginAck(TLV.Messager(lc), "v5.0-NDTinGO", 0)
+	if len(lc.frames) != 3 || !bytes.Equal(lc.frames[2], []byte{byte(MsgLogin), 0, 0}) {
+		t.Errorf("SendLoginAck() with no tests sent %q", lc.frames)
+	}
+
+	// The first error stops the handshake.
+	s := NewScriptedMessager(TLV, ScriptStep{Send: SrvQueue}, ScriptStep{Send: TestPrepare})
+	var se *ScriptError
+	err := SendLoginAck(s, "v5.0-NDTinGO", 2)
+	if !errors.As(err, &se) || se.Step != 1 {
+		t.Errorf("SendLoginAck() against a different script = %v, want a *ScriptError at step 1", err)
+	}
+	var ae *LoginAckError
+	if !errors.As(err, &ae) || ae.Step != "MsgLoginVersion" {
+		t.Errorf("SendLoginAck() against a different script = %v, want a *LoginAckError for MsgLoginVersion", err)
+	}
+}
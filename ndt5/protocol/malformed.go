@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"sync/atomic"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+)
+
+// malformedCounter counts the malformed messages received by a Messager, and
+// adds them to metrics.MalformedMessages. A nil *malformedCounter counts
+// nothing.
+type malformedCounter struct {
+	n int64
+	// active, if not nil, tells the encoding of the Messager.
+	active *activeMessager
+}
+
+// add counts a malformed message.
+func (c *malformedCounter) add() {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.n, 1)
+	metrics.MalformedMessages.WithLabelValues(c.active.current().String()).Inc()
+}
+
+func (c *malformedCounter) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
+
+// countMalformed counts a malformed message if err, the error from decoding a
+// received message, is not nil, and returns err.
+func (o *messagerOptions) countMalformed(err error) error {
+	if err != nil {
+		o.malformed.add()
+	}
+	return err
+}
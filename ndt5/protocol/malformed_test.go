@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func assertMalformedCount(t *testing.T, m Messager, want int64) {
+	t.Helper()
+	if got := m.(ExtendedMessager).MalformedCount(); got != want {
+		t.Errorf("MalformedCount() = %d, want %d", got, want)
+	}
+}
+
+func TestMalformedCount(t *testing.T) {
+	before := testutil.ToFloat64(metrics.MalformedMessages.WithLabelValues("JSON"))
+	lc := &loopbackConnection{}
+	m := JSON.Messager(lc, WithMaxMessageSize(64))
+	m.SendMessage(TestMsg, []byte("fine"))
+	if _, err := m.ReceiveMessage(TestMsg); err != nil {
+		t.Fatal(err)
+	}
+	assertMalformedCount(t, m, 0)
+
+	// A frame whose length does not match its payload.
+	lc.frames = append(lc.frames, []byte{byte(TestMsg), 0, 5, '{'})
+	// A payload that is not JSON.
+	lc.frames = append(lc.frames, []byte{byte(TestMsg), 0, 3, 'n', 'o', 't'})
+	// A message over the maximum size.
+	m.SendMessage(TestMsg, make([]byte, 100))
+	for i := 0; i < 3; i++ {
+		if _, err := m.ReceiveMessage(TestMsg); err == nil {
+			t.Fatalf("ReceiveMessage() of malformed message %d succeeded", i)
+		}
+	}
+	assertMalformedCount(t, m, 3)
+
+	// Running out of messages is not the fault of the client.
+	if _, err := m.ReceiveMessage(TestMsg); err != io.EOF {
+		t.Fatalf("ReceiveMessage() = %v, want io.EOF", err)
+	}
+	assertMalformedCount(t, m, 3)
+	if got := testutil.ToFloat64(metrics.MalformedMessages.WithLabelValues("JSON")) - before; got != 3 {
+		t.Errorf("MalformedMessages for JSON went up by %v, want 3", got)
+	}
+}
+
+func TestMalformedCountEncodings(t *testing.T) {
+	for _, enc := range []Encoding{TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc)
+			lc.frames = append(lc.frames, []byte{byte(TestMsg), 0})
+			if _, _, err := m.ReceiveAnyMessage(); err == nil {
+				t.Fatal("ReceiveAnyMessage() of a truncated header succeeded")
+			}
+			assertMalformedCount(t, m, 1)
+		})
+	}
+}
+
+func TestMalformedCountSkipsWrongType(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			before := testutil.ToFloat64(metrics.MalformedMessages.WithLabelValues(enc.String()))
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc, WithTypeOrder(MsgLogin, TestMsg))
+			m.SendMessage(TestStart, nil)
+			if _, err := m.ReceiveMessage(TestMsg); err == nil {
+				t.Fatal("ReceiveMessage() of the wrong type succeeded")
+			}
+			m.SendMessage(TestMsg, []byte("early"))
+			if _, _, err := m.ReceiveAnyMessage(); err == nil {
+				t.Fatal("ReceiveAnyMessage() of a message out of order succeeded")
+			}
+			assertMalformedCount(t, m, 0)
+			if got := testutil.ToFloat64(metrics.MalformedMessages.WithLabelValues(enc.String())) - before; got != 0 {
+				t.Errorf("MalformedMessages for %v went up by %v, want 0", enc, got)
+			}
+		})
+	}
+}
+
+func TestMalformedCountOversizedHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	input := &headerOnlyReader{t: t, header: []byte{byte(TestMsg), 0xFF, 0xFF}}
+	m := TLV.Messager(AdaptNetConn(server, input), WithMaxMessageSize(1024))
+	if _, err := m.ReceiveMessage(TestMsg); err == nil {
+		t.Fatal("ReceiveMessage() should reject an oversized message")
+	}
+	assertMalformedCount(t, m, 1)
+}
@@ -1,12 +1,18 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"reflect"
+	"hash/crc32"
+	"io"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Encoding encodes the communication methods we support.
@@ -15,10 +21,14 @@ type Encoding int
 // The different message types we support. This is initially Unknown for plain
 // ndt5 connections and becomes JSON or TLV depending on the whether we
 // receive MsgLogin or MsgExtendedLogin, but is always JSON for WS and WSS.
+// MessagePack and CBOR are never negotiated by the login and must be chosen
+// explicitly.
 const (
 	Unknown Encoding = iota // Unknown is the zero-value for Encoding
 	JSON
 	TLV
+	MessagePack
+	CBOR
 )
 
 func (e Encoding) String() string {
@@ -29,143 +39,1358 @@ func (e Encoding) String() string {
 		return "JSON"
 	case TLV:
 		return "TLV"
+	case MessagePack:
+		return "MessagePack"
+	case CBOR:
+		return "CBOR"
 	}
 	return fmt.Sprintf("Bad Encoding value: %d", int(e))
 }
 
+// ParseEncoding returns the Encoding whose String() matches s, ignoring case.
+func ParseEncoding(s string) (Encoding, error) {
+	for _, e := range []Encoding{Unknown, JSON, TLV, MessagePack, CBOR} {
+		if strings.EqualFold(s, e.String()) {
+			return e, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown encoding %q", s)
+}
+
+// DetectEncoding reads the login message that starts every ndt5 session and
+// returns the Encoding it selects along with the login payload, so that the
+// caller can still parse the login. MsgLogin selects TLV and MsgExtendedLogin
+// selects JSON. If conn already has an Encoding, like the always-JSON WS and
+// WSS connections, only the login for that Encoding is accepted.
+func DetectEncoding(conn Connection) (Encoding, []byte, error) {
+	var expected []MessageType
+	switch conn.Encoding() {
+	case Unknown:
+		expected = []MessageType{MsgLogin, MsgExtendedLogin}
+	case TLV:
+		expected = []MessageType{MsgLogin}
+	default:
+		expected = []MessageType{MsgExtendedLogin}
+	}
+	b, kind, err := ReadTLVMessage(conn, expected...)
+	if err != nil {
+		return Unknown, nil, err
+	}
+	if kind == MsgLogin {
+		return TLV, b, nil
+	}
+	return JSON, b, nil
+}
+
+// DefaultMaxMessageSize is the default limit on the length of a single
+// received message. It leaves room for messages that WriteTLVMessageChunked
+// splits into several frames, like dumps of extended metrics.
+const DefaultMaxMessageSize = 256 * 1024
+
+// messagerOptions holds the optional settings shared by all Messager
+// implementations.
+type messagerOptions struct {
+	maxMessageSize int
+	s2cChecksum    bool
+	s2cExtended    bool
+	s2cValidate    bool
+	logoutOnClose  bool
+	idleTimeout    time.Duration
+	sequenced      bool
+	typeWidth      int
+	chunked        bool
+	strictJSON     bool
+	utf8Mode       UTF8Mode
+	// byteOrder is the byte order of the length in TLV headers on the wire,
+	// or nil for network byte order.
+	byteOrder binary.ByteOrder
+	onSend    func(MessageType, int)
+	onReceive func(MessageType, int, error)
+	// budget is set by WithReadBudget. Each Messager gets its own, because
+	// newMessagerOptions is called once for every Messager.
+	budget    *readBudget
+	peeked    *peekedMessage
+	order     *typeOrder
+	counts    *byteCounts
+	gate      *receiveGate
+	cancel    *receiveCanceller
+	malformed *malformedCounter
+	active    *activeMessager
+	// opts are the options the Messager was created with, so that it can
+	// be reset to its initial state.
+	opts []MessagerOption
+	// raw is the Connection the Messager was created for, before it was
+	// wrapped as the options require.
+	raw Connection
+}
+
+// MessagerOption configures a Messager created by Encoding.Messager.
+type MessagerOption func(*messagerOptions)
+
+// WithMaxMessageSize limits the length of any single received message to n
+// bytes, including messages reassembled from several frames. A message whose
+// header announces a longer length is rejected without reading its contents.
+func WithMaxMessageSize(n int) MessagerOption {
+	return func(o *messagerOptions) {
+		o.maxMessageSize = n
+	}
+}
+
+// WithS2CChecksum makes SendS2CResults include a CRC32 checksum of the
+// results, so that clients can detect results that were corrupted in transit.
+// Older clients may not expect the extra value, so it is off by default.
+func WithS2CChecksum() MessagerOption {
+	return func(o *messagerOptions) {
+		o.s2cChecksum = true
+	}
+}
+
+// WithS2CValidation makes SendS2CResults return a *NegativeS2CResultError,
+// without sending anything, if any of the values is negative, to keep results
+// miscalculated upstream from reaching clients. It is off by default, since
+// some callers send negative values on purpose, as sentinels.
+func WithS2CValidation() MessagerOption {
+	return func(o *messagerOptions) {
+		o.s2cValidate = true
+	}
+}
+
+// WithExtendedS2CResults makes SendS2CResults also send the throughput in
+// Mbps and the unit of the standard throughput value, which is kbps, for tools
+// that read raw control channel logs. Older clients may not expect the extra
+// values, so they are off by default.
+func WithExtendedS2CResults() MessagerOption {
+	return func(o *messagerOptions) {
+		o.s2cExtended = true
+	}
+}
+
+// WithLogoutOnClose makes Close send an empty MsgLogout before closing the
+// connection, for handlers that end the ndt5 session by closing the Messager.
+func WithLogoutOnClose() MessagerOption {
+	return func(o *messagerOptions) {
+		o.logoutOnClose = true
+	}
+}
+
+// WithReadBudget limits the total number of bytes, including headers, that the
+// Messager reads over the lifetime of its connection. Once the budget is
+// exceeded, every receive returns a *BudgetExceededError without reading.
+func WithReadBudget(n int64) MessagerOption {
+	return func(o *messagerOptions) {
+		o.budget = &readBudget{limit: n}
+	}
+}
+
+// WithStrictJSON makes a JSON Messager reject received messages with unknown
+// or duplicate top-level keys, which are otherwise silently ignored. It is
+// meant for interop testing, where such messages point to client bugs.
+func WithStrictJSON() MessagerOption {
+	return func(o *messagerOptions) {
+		o.strictJSON = true
+	}
+}
+
+// UTF8Mode selects how a JSON Messager handles invalid UTF-8 in received
+// messages.
+type UTF8Mode int
+
+const (
+	// UTF8Unchecked leaves invalid UTF-8 to encoding/json, which replaces it
+	// within strings and fails with a syntax error elsewhere.
+	UTF8Unchecked UTF8Mode = iota
+	// UTF8Reject rejects messages with invalid UTF-8 with an *InvalidUTF8Error.
+	UTF8Reject
+	// UTF8Replace replaces every run of invalid bytes with the replacement
+	// rune, U+FFFD, before decoding.
+	UTF8Replace
+)
+
+// WithUTF8Validation sets how a JSON Messager handles received messages that
+// are not valid UTF-8. The default is UTF8Unchecked.
+func WithUTF8Validation(mode UTF8Mode) MessagerOption {
+	return func(o *messagerOptions) {
+		o.utf8Mode = mode
+	}
+}
+
+func newMessagerOptions(opts []MessagerOption) messagerOptions {
+	o := messagerOptions{
+		maxMessageSize: DefaultMaxMessageSize,
+		typeWidth:      1,
+		peeked:         &peekedMessage{},
+		cancel:         &receiveCanceller{},
+		malformed:      &malformedCounter{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.opts = opts
+	return o
+}
+
+// s2cFormat returns the format in which SendS2CResults sends results.
+func (o *messagerOptions) s2cFormat() s2cFormat {
+	return s2cFormat{checksum: o.s2cChecksum, extended: o.s2cExtended}
+}
+
+// jsonDecoding returns how a JSON Messager decodes received messages.
+func (o *messagerOptions) jsonDecoding() jsonDecoding {
+	return jsonDecoding{strict: o.strictJSON, utf8Mode: o.utf8Mode}
+}
+
+// checkS2CResult returns an error for results that SendS2CResults must not
+// send.
+func (o *messagerOptions) checkS2CResult(r *S2CResult) error {
+	if !o.s2cValidate {
+		return nil
+	}
+	return r.Validate()
+}
+
+// limits returns the limits on every message read by a Messager.
+func (o *messagerOptions) limits() readLimits {
+	return readLimits{maxSize: o.maxMessageSize, budget: o.budget, peeked: o.peeked, order: o.order, gate: o.gate, cancel: o.cancel, malformed: o.malformed}
+}
+
+// BudgetExceededError is returned once a Messager has read more bytes than
+// allowed by WithReadBudget.
+type BudgetExceededError struct {
+	Budget int64
+	Read   int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("read %d bytes, exceeding the read budget of %d bytes", e.Read, e.Budget)
+}
+
+// readBudget counts the bytes read by a Messager. A nil *readBudget allows
+// unlimited reads.
+type readBudget struct {
+	limit int64
+	used  int64
+}
+
+// check returns an error if the budget has already been exceeded.
+func (b *readBudget) check() error {
+	if b == nil || b.used <= b.limit {
+		return nil
+	}
+	return &BudgetExceededError{Budget: b.limit, Read: b.used}
+}
+
+// charge counts n more bytes as read, and returns an error if that exceeds
+// the budget.
+func (b *readBudget) charge(n int) error {
+	if b == nil {
+		return nil
+	}
+	b.used += int64(n)
+	return b.check()
+}
+
 // Messager creates an object that can encode and decode messages in the
-// corresponding format and send them along the passed-in connection.
-func (e Encoding) Messager(conn Connection) Messager {
+// corresponding format and send them along the passed-in connection. It logs
+// and returns nil for Unknown and bad Encoding values; use MessagerE to get an
+// error instead.
+func (e Encoding) Messager(conn Connection, opts ...MessagerOption) Messager {
+	m, err := e.MessagerE(conn, opts...)
+	if err != nil {
+		logger.Println("Error:", err)
+		return nil
+	}
+	return m
+}
+
+// MessagerE is Messager, except that it returns an error for Unknown and bad
+// Encoding values instead of a nil Messager.
+func (e Encoding) MessagerE(conn Connection, opts ...MessagerOption) (Messager, error) {
+	o := newMessagerOptions(opts)
+	o.raw = conn
+	o.gate = receiveGateOf(conn)
+	conn, err := wrapConnection(e, conn, o)
+	if err != nil {
+		return nil, err
+	}
+	o.active = &activeMessager{encoding: e}
+	o.malformed.active = o.active
+	m, err := newMessager(e, conn, o)
+	if err != nil {
+		return nil, err
+	}
+	o.active.open()
+	return m, nil
+}
+
+// NewJSONMessager returns a JSON Messager for conn. Unlike Encoding.Messager,
+// it never returns nil, for callers that know the encoding in advance rather
+// than negotiating it.
+func NewJSONMessager(conn Connection) Messager {
+	conn, o := openMessager(JSON, conn, nil)
+	m, _ := newMessager(JSON, conn, o)
+	return m
+}
+
+// NewTLVMessager returns a TLV Messager for conn. Unlike Encoding.Messager, it
+// never returns nil, for callers that know the encoding in advance rather than
+// negotiating it.
+func NewTLVMessager(conn Connection) Messager {
+	conn, o := openMessager(TLV, conn, nil)
+	m, _ := newMessager(TLV, conn, o)
+	return m
+}
+
+// openMessager returns the connection and the options for a new Messager for
+// e on conn, given options that are known to be valid.
+func openMessager(e Encoding, conn Connection, opts []MessagerOption) (Connection, messagerOptions) {
+	o := newMessagerOptions(opts)
+	o.raw = conn
+	o.gate = receiveGateOf(conn)
+	conn, err := wrapConnection(e, conn, o)
+	if err != nil {
+		panic(err)
+	}
+	o.active = &activeMessager{encoding: e}
+	o.malformed.active = o.active
+	o.active.open()
+	return conn, o
+}
+
+// wrapConnection wraps conn as the options of a Messager for e require.
+func wrapConnection(e Encoding, conn Connection, o messagerOptions) (Connection, error) {
+	conn, err := adaptTypeWidth(conn, o.typeWidth)
+	if err != nil {
+		return nil, err
+	}
+	conn = AdaptTLVByteOrder(conn, o.byteOrder)
+	if o.chunked {
+		conn = AdaptTLVChunking(conn)
+	}
+	if o.idleTimeout > 0 {
+		conn = withIdleTimeout(conn, o.idleTimeout)
+	}
+	if o.counts != nil {
+		// The counts are of the frames on the wire, whose type may be wider.
+		conn = &countingConnection{wrappedConnection: wrappedConnection{Connection: conn}, counts: o.counts, extra: int64(o.typeWidth - 1)}
+	}
+	if o.sequenced {
+		conn = &sequencedConnection{wrappedConnection: wrappedConnection{Connection: conn, overhead: seqLen}}
+	}
+	if o.onSend != nil || o.onReceive != nil {
+		conn = &hookConnection{wrappedConnection: wrappedConnection{Connection: conn}, onSend: o.onSend, onReceive: o.onReceive}
+	}
+	if *debug {
+		conn = &debugConnection{wrappedConnection: wrappedConnection{Connection: conn}, encoding: e}
+	}
+	return conn, nil
+}
+
+// newMessager creates the Messager for e on conn, which must already be
+// wrapped as the options require.
+func newMessager(e Encoding, conn Connection, o messagerOptions) (Messager, error) {
+	var m interface {
+		Messager
+		base() *baseMessager
+	}
 	switch e {
 	case Unknown:
-		log.Println("Error: Messager() called for Unknown type")
-		return nil
+		return nil, errors.New("cannot create a Messager for the Unknown encoding")
 	case JSON:
-		return &jsonMessager{conn}
+		m = &jsonMessager{}
 	case TLV:
-		return &tlvMessager{conn}
+		m = &tlvMessager{}
+	case MessagePack:
+		m = &msgpackMessager{}
+	case CBOR:
+		m = &cborMessager{}
+	default:
+		return nil, fmt.Errorf("cannot create a Messager for bad Encoding value: %d", int(e))
 	}
-	log.Printf("Bad Encoding value: %d\n", int(e))
-	return nil
+	b := m.base()
+	b.conn, b.encoding, b.self, b.messagerOptions = conn, e, m, o
+	return m, nil
 }
 
 // Messager allows us to send JSON and non-JSON messages using a single unified
 // interface.
+//
+// The Messagers returned from Encoding.Messager are not safe for concurrent
+// use: two sends, or two receives, must never overlap. Wrap a Messager with
+// NewSyncMessager to share it between goroutines.
+//
+// They also implement ExtendedMessager, while the wrappers in this package
+// only implement Messager, forwarding every method to the Messager they wrap.
 type Messager interface {
 	SendMessage(MessageType, []byte) error
+	// SendMessageString is SendMessage for a message that is already a
+	// string, which saves a conversion for text messages.
+	SendMessageString(MessageType, string) error
 	SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error
 	ReceiveMessage(MessageType) ([]byte, error)
+	// ReceiveOneOf receives the next message, which may be of any of the
+	// given types, and returns its type along with the message. Messages of
+	// any other type cause an *UnexpectedMessageError.
+	ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error)
+	// ReceiveAnyMessage receives the next message, whatever its type, and
+	// returns the type observed on the wire along with the message.
+	ReceiveAnyMessage() (MessageType, []byte, error)
+	// ReceiveMessageContext is ReceiveMessage, but gives up once ctx is
+	// done, returning ctx.Err(). A blocked read is interrupted with a read
+	// deadline in the past, so it is only interrupted if the connection
+	// supports read deadlines. A receive that was interrupted partway
+	// through a message leaves the connection unfit for further reads.
+	ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error)
+	// ReceiveAnyMessageContext is ReceiveAnyMessage, but gives up once ctx
+	// is done, like ReceiveMessageContext.
+	ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error)
+	// CancelReceive makes the receive in progress return
+	// ErrReceiveCancelled, or the next one if there is no receive in
+	// progress, so that a cancellation is never lost to a race with the
+	// start of the receive. Receives after that one work as usual. A
+	// receive that is blocked reading is unblocked by setting a read
+	// deadline in the past, so it is only unblocked if the connection
+	// supports read deadlines.
+	CancelReceive()
+	// SetReadDeadline sets the read deadline of the Connection, which
+	// applies to every subsequent receive, and to a receive in progress,
+	// which fails once it passes. A zero time clears the deadline. It may
+	// be called while receiving.
+	SetReadDeadline(t time.Time) error
+	// SetWriteDeadline sets the deadline for every subsequent send. A zero
+	// time clears the deadline.
+	SetWriteDeadline(t time.Time) error
+	// Flush writes any buffered outbound data to the Connection. Handlers
+	// should flush before waiting for a reply to what they have sent.
+	Flush() error
+	// Release stops counting the Messager as active, for handlers that are
+	// done with it but leave its connection open for the rest of the
+	// session, like the ndt5 tests that share the control connection.
+	// Closing the Messager releases it too. Later calls do nothing.
+	Release()
+	// Close ends the session and closes the Connection. Only the first call
+	// does anything; later calls return nil.
+	Close() error
 	Encoding() Encoding
 }
 
+// ExtendedMessager is implemented by the Messagers returned from
+// Encoding.Messager, for callers that need more than Messager, like tests
+// that reproduce malformed clients and monitoring code. Methods that an
+// encoding cannot support return an error, like ErrNoObjectModel or
+// ErrBufferUnsupported, without reading or writing anything.
+type ExtendedMessager interface {
+	Messager
+
+	// SendRawFrame sends raw as a single frame of the given type. TLV
+	// messagers send raw verbatim, while the others wrap it in the smallest
+	// envelope their encoding allows, without escaping it.
+	SendRawFrame(kind MessageType, raw []byte) error
+	// SendJSON sends a JSON value that is already encoded, nested in the NDT
+	// message rather than escaped into a string. Because the "msg" value of
+	// the message is not a string, the receiver must decode it with
+	// ReceiveMessageInto rather than ReceiveMessage. Only the JSON encoding
+	// supports it; the others return ErrJSONUnsupported.
+	SendJSON(kind MessageType, rawJSON json.RawMessage) error
+
+	// ReceiveMessageInto receives a message of the given type and decodes
+	// the whole object carrying it, like {"msg": "v5.0", "tests": "20"} for a
+	// JSON login, into v. The TLV encoding returns ErrNoObjectModel.
+	ReceiveMessageInto(kind MessageType, v interface{}) error
+	// ReceiveTyped receives the next message, which must be of one of the
+	// given types, or an *UnexpectedMessageError is returned, along with
+	// its type and the object carrying it, for handlers that branch on the
+	// type of the message. Like the other receive methods, it skips
+	// MsgKeepalive messages.
+	ReceiveTyped(kinds ...MessageType) (Message, error)
+	// ReceiveMessages receives a single frame of the given type, and
+	// returns every message in it, in order, for clients that write several
+	// JSON objects, one after the other, at once, which ReceiveMessage
+	// rejects. Only the JSON encoding supports it; the others return
+	// ErrJSONUnsupported.
+	ReceiveMessages(kind MessageType) ([][]byte, error)
+	// ReceiveMessageIntoBuffer receives a message of the given type into buf
+	// and returns its length. If buf is too short, the message is discarded,
+	// and its length is returned along with io.ErrShortBuffer. Only the TLV
+	// encoding supports it; the others return ErrBufferUnsupported.
+	ReceiveMessageIntoBuffer(kind MessageType, buf []byte) (n int, err error)
+	// ReceiveMessageAppend receives a message of the given type, appends it
+	// to buf, growing buf as needed, and returns the extended buffer. Only
+	// the TLV encoding supports it; the others return ErrBufferUnsupported.
+	ReceiveMessageAppend(kind MessageType, buf []byte) ([]byte, error)
+	// ReceiveMessageMeta is ReceiveMessage, but also returns the type of the
+	// message that was read and the length declared by its TLV headers, even
+	// when the message could not be received, so that monitoring code can
+	// detect anomalies.
+	ReceiveMessageMeta(kind MessageType) (payload []byte, actualType MessageType, declaredLen int, err error)
+
+	// Peek reads the next message and returns its type, keeping the message
+	// to be returned by the next receive. Repeated calls return the same
+	// type until the message has been received. Unlike the receive methods,
+	// Peek does not skip MsgKeepalive messages.
+	Peek() (MessageType, error)
+	// HasBuffered returns whether a message read ahead by Peek is waiting to
+	// be received, in which case the next receive returns it without
+	// reading from the connection, and so without blocking.
+	HasBuffered() bool
+	// Trailing returns a copy of the bytes read from the connection beyond
+	// the last message, such as a pipelined message that arrived in the
+	// same read, exactly as they arrived. The next receive consumes them
+	// before reading from the connection again. Only connections that read
+	// through a buffer, as set up by AdaptBufferedNetConn, ever read ahead, so
+	// it returns nil for other connections. A message read ahead by Peek is
+	// reported by HasBuffered rather than here.
+	Trailing() []byte
+
+	// SetReceiveDisabled disables or re-enables receiving, so that the
+	// control channel is not read while a throughput test is running, which
+	// would disturb the timing of the test. While receiving is disabled,
+	// every receive returns ErrReceiveDisabled without reading, and sends
+	// work as usual. It may be called while receiving. Connections from
+	// AdaptNetConn and AdaptWsConn keep the setting for every Messager on
+	// them, so disabling receiving through one Messager disables it for all;
+	// on other connections it applies to this Messager only.
+	SetReceiveDisabled(disabled bool)
+
+	// BytesSent returns the number of bytes in the frames successfully
+	// written to the Connection. It may be called while sending. Bytes are
+	// only counted by Messagers created with WithByteCounts.
+	BytesSent() int64
+	// BytesReceived returns the number of bytes in the frames successfully
+	// read from the Connection. It may be called while receiving.
+	BytesReceived() int64
+	// MalformedCount returns the number of receives that failed because of
+	// what the peer sent: frames whose length is wrong or over the limits,
+	// messages continued with a frame of another type, and messages that
+	// could not be decoded, to tell clients that send garbage apart from
+	// clean ones. Well-formed messages of a type that was not expected or
+	// out of order are not counted, nor are failures of the connection
+	// itself, like timeouts and closed connections. It may be called while
+	// receiving.
+	MalformedCount() int64
+	// Sequence returns the sequence numbers of the last frame sent and of
+	// the last frame received in order. Both are zero until the first frame,
+	// and always zero without WithSequenceNumbers.
+	Sequence() (sent, received uint32)
+
+	// Conn returns the Connection the Messager was created or last reset
+	// for, rather than the wrappers added by the options, for middleware
+	// that needs the connection itself, for instance to log the address of
+	// the peer. Sending or receiving on it directly bypasses the Messager,
+	// so it is best used for what the Messager does not offer, like the
+	// addresses and the deadlines of the connection.
+	Conn() Connection
+	// Reset rebinds the Messager to conn, with the options it was created
+	// with, as if it had just been created for conn, for instance to keep
+	// Messagers in a sync.Pool. Everything it kept about its previous
+	// connection is dropped: peeked messages, sequence numbers, byte
+	// counts, read budgets, type orders, write deadlines, disabled and
+	// cancelled receives, and whether it was closed. The previous
+	// connection is not closed. Reset must not overlap with any other use
+	// of the Messager.
+	Reset(conn Connection)
+}
+
+// ErrBufferUnsupported is returned by ReceiveMessageIntoBuffer and
+// ReceiveMessageAppend for encodings whose messages must be decoded into new
+// memory.
+var ErrBufferUnsupported = errors.New("only the TLV encoding can receive messages into a buffer")
+
+// ErrJSONUnsupported is returned by SendJSON and ReceiveMessages for encodings
+// other than JSON.
+var ErrJSONUnsupported = errors.New("only the JSON encoding supports this method")
+
+// ErrNoObjectModel is returned by ReceiveMessageInto for encodings whose
+// messages are plain bytes rather than objects.
+var ErrNoObjectModel = errors.New("the encoding has no object model to decode messages into")
+
+// readDeadliner is implemented by connections that support read deadlines,
+// like both net.Conn and websocket.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// writeDeadliner is implemented by connections that support write deadlines,
+// like both net.Conn and websocket.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// flusher is implemented by connections that buffer outbound data.
+type flusher interface {
+	Flush() error
+}
+
+// flushConnection flushes conn if it buffers outbound data.
+func flushConnection(conn Connection) error {
+	if f, ok := conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// writeDeadline is the write deadline that a Messager applies to its
+// connection before each send.
+type writeDeadline struct {
+	t   time.Time
+	set bool
+}
+
+func (w *writeDeadline) setWriteDeadline(conn Connection, t time.Time) error {
+	if _, ok := conn.(writeDeadliner); !ok && !t.IsZero() {
+		return fmt.Errorf("connection %s does not support write deadlines", conn.String())
+	}
+	w.t = t
+	w.set = true
+	return nil
+}
+
+// applyWriteDeadline sets the write deadline on conn. Connections are left
+// alone until SetWriteDeadline has been called, so that deadlines set on the
+// connection by other code are not cleared.
+func (w *writeDeadline) applyWriteDeadline(conn Connection) error {
+	if !w.set {
+		return nil
+	}
+	wd, ok := conn.(writeDeadliner)
+	if !ok {
+		return nil
+	}
+	return wd.SetWriteDeadline(w.t)
+}
+
+// baseMessager holds the state of a Messager that does not depend on its
+// encoding, and implements the methods that only use that state. The Messager
+// of each encoding embeds it, and is kept in self so that the methods here can
+// send and receive in its encoding.
+type baseMessager struct {
+	conn     Connection
+	encoding Encoding
+	self     Messager
+	messagerOptions
+	writeDeadline
+	// closeOnce makes Close idempotent.
+	closeOnce sync.Once
+}
+
+func (b *baseMessager) base() *baseMessager {
+	return b
+}
+
+func (b *baseMessager) Encoding() Encoding {
+	return b.encoding
+}
+
+func (b *baseMessager) SetReadDeadline(t time.Time) error {
+	rd, ok := b.conn.(readDeadliner)
+	if !ok {
+		return fmt.Errorf("connection %s does not support read deadlines", b.conn.String())
+	}
+	return rd.SetReadDeadline(t)
+}
+
+func (b *baseMessager) SetWriteDeadline(t time.Time) error {
+	return b.setWriteDeadline(b.conn, t)
+}
+
+func (b *baseMessager) Flush() error {
+	return flushConnection(b.conn)
+}
+
+// Close sends an empty MsgLogout if the Messager was created with
+// WithLogoutOnClose, and then closes the connection, the first time it is
+// called. Later calls return nil.
+func (b *baseMessager) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		b.active.close()
+		if b.logoutOnClose {
+			err = b.self.SendMessage(MsgLogout, []byte{})
+		}
+		if cerr := b.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+func (b *baseMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	return receiveWithContext(ctx, b.conn, func() ([]byte, error) {
+		return b.self.ReceiveMessage(kind)
+	})
+}
+
+func (b *baseMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	var kind MessageType
+	msg, err := receiveWithContext(ctx, b.conn, func() (msg []byte, err error) {
+		kind, msg, err = b.self.ReceiveAnyMessage()
+		return msg, err
+	})
+	return kind, msg, err
+}
+
+func (b *baseMessager) CancelReceive() {
+	b.cancel.cancel(b.conn)
+}
+
+func (b *baseMessager) Release() {
+	b.active.close()
+}
+
+// SendJSON always returns ErrJSONUnsupported, without sending. The JSON
+// Messager overrides it.
+func (b *baseMessager) SendJSON(MessageType, json.RawMessage) error {
+	return ErrJSONUnsupported
+}
+
+// ReceiveMessages always returns ErrJSONUnsupported, without reading. The JSON
+// Messager overrides it.
+func (b *baseMessager) ReceiveMessages(MessageType) ([][]byte, error) {
+	return nil, ErrJSONUnsupported
+}
+
+func (b *baseMessager) SetReceiveDisabled(disabled bool) {
+	b.gate.set(disabled)
+}
+
+func (b *baseMessager) Peek() (MessageType, error) {
+	return peekTLVMessage(b.conn, b.limits())
+}
+
+func (b *baseMessager) HasBuffered() bool {
+	return b.peeked.pending()
+}
+
+func (b *baseMessager) Trailing() []byte {
+	return trailingBytes(b.conn)
+}
+
+// ReceiveMessageIntoBuffer returns ErrBufferUnsupported, without reading. The
+// TLV Messager overrides it.
+func (b *baseMessager) ReceiveMessageIntoBuffer(MessageType, []byte) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+// ReceiveMessageAppend returns ErrBufferUnsupported, without reading. The TLV
+// Messager overrides it.
+func (b *baseMessager) ReceiveMessageAppend(_ MessageType, buf []byte) ([]byte, error) {
+	return buf, ErrBufferUnsupported
+}
+
+func (b *baseMessager) BytesSent() int64 {
+	return b.counts.bytesSent()
+}
+
+func (b *baseMessager) BytesReceived() int64 {
+	return b.counts.bytesReceived()
+}
+
+func (b *baseMessager) MalformedCount() int64 {
+	return b.malformed.count()
+}
+
+func (b *baseMessager) Sequence() (sent, received uint32) {
+	return sequenceOf(b.conn)
+}
+
+func (b *baseMessager) Conn() Connection {
+	return b.raw
+}
+
+func (b *baseMessager) Reset(conn Connection) {
+	conn, o := resetMessager(b.encoding, conn, b.messagerOptions)
+	*b = baseMessager{conn: conn, encoding: b.encoding, self: b.self, messagerOptions: o}
+}
+
+func (b *baseMessager) withEncoding(e Encoding) (Messager, error) {
+	return switchEncoding(e, b.conn, b.messagerOptions)
+}
+
+// receiveWithContext runs receive, which must read from conn, and unblocks it
+// by setting a read deadline in the past on conn if ctx is done before receive
+// returns. A read that fails once ctx is done returns ctx.Err(), and because it
+// may have stopped partway through a message the connection should not be
+// used for further reads. A read that succeeds returns what it read, even if
+// ctx is done by then, so that the message is not lost. The read deadline in
+// force before the interruption is put back afterwards, for connections that
+// keep track of it, like those returned by AdaptNetConn and AdaptWsConn, so
+// that deadlines set by the caller stay in force. Other connections are left
+// without a read deadline.
+func receiveWithContext(ctx context.Context, conn Connection, receive func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		// The context can never be cancelled.
+		return receive()
+	}
+	if _, ok := conn.(readDeadliner); !ok {
+		return nil, fmt.Errorf("connection %s does not support read deadlines", conn.String())
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			interrupted <- interruptRead(conn) == nil
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	b, err := receive()
+	close(done)
+	if <-interrupted {
+		resumeRead(conn)
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return b, err
+}
+
 // jsonMessager has all the methods for sending JSON-format NDT messages along
 // the passed-in connection.
 type jsonMessager struct {
-	conn Connection
+	baseMessager
+}
+
+// S2CResult holds the results sent to the client at the end of an S2C test.
+// Every encoding serializes the results from this struct, so that the order of
+// the values cannot drift between encodings.
+type S2CResult struct {
+	ThroughputKbps int64
+	UnsentBytes    int64
+	TotalSentBytes int64
+}
+
+// ErrS2CChecksum is returned by ReceiveS2CResults when the received results
+// do not match their checksum.
+var ErrS2CChecksum = errors.New("S2C results do not match their checksum")
+
+// TLV serializes the results as the space-separated values sent to TLV
+// clients.
+func (r *S2CResult) TLV() string {
+	return fmt.Sprintf("%d %d %d", r.ThroughputKbps, r.UnsentBytes, r.TotalSentBytes)
+}
+
+// JSON serializes the results as the object sent to JSON clients, which for
+// historical reasons holds every value as a string.
+func (r *S2CResult) JSON() ([]byte, error) {
+	return r.json(s2cFormat{})
+}
+
+// Checksum returns the IEEE CRC32 of the results as serialized by TLV(), which
+// is the checksum sent by every encoding when WithS2CChecksum is set.
+func (r *S2CResult) Checksum() uint32 {
+	return crc32.ChecksumIEEE([]byte(r.TLV()))
+}
+
+// NegativeS2CResultError is returned by S2CResult.Validate for results holding
+// a negative value, which no correct measurement produces.
+type NegativeS2CResultError struct {
+	// Name is the name of the negative value, like "UnsentBytes".
+	Name  string
+	Value int64
+}
+
+func (e *NegativeS2CResultError) Error() string {
+	return fmt.Sprintf("S2C result %s is negative: %d", e.Name, e.Value)
+}
+
+// Validate returns a *NegativeS2CResultError for the first negative value of
+// the results, if any.
+func (r *S2CResult) Validate() error {
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"ThroughputKbps", r.ThroughputKbps},
+		{"UnsentBytes", r.UnsentBytes},
+		{"TotalSentBytes", r.TotalSentBytes},
+	} {
+		if v.value < 0 {
+			return &NegativeS2CResultError{Name: v.name, Value: v.value}
+		}
+	}
+	return nil
 }
 
+// ThroughputMbps returns the throughput in Mbps.
+func (r *S2CResult) ThroughputMbps() float64 {
+	return float64(r.ThroughputKbps) / 1000
+}
+
+// s2cFormat holds the optional parts of serialized S2C results.
+type s2cFormat struct {
+	checksum bool
+	extended bool
+}
+
+// mbpsSuffix marks the throughput in Mbps in extended TLV results.
+const mbpsSuffix = "Mbps"
+
+// tlv is TLV(), followed by the throughput in Mbps, like "1.500Mbps", if
+// extended results are requested, and then by the checksum, if requested.
+func (r *S2CResult) tlv(f s2cFormat) string {
+	s := r.TLV()
+	if f.extended {
+		s += " " + strconv.FormatFloat(r.ThroughputMbps(), 'f', 3, 64) + mbpsSuffix
+	}
+	if f.checksum {
+		s += " " + strconv.FormatUint(uint64(r.Checksum()), 10)
+	}
+	return s
+}
+
+// json is JSON(), with the throughput in Mbps and the unit of ThroughputValue
+// added if extended results are requested, and the checksum added as a
+// "Checksum" key if requested.
+func (r *S2CResult) json(f s2cFormat) ([]byte, error) {
+	v := &s2cResult{
+		ThroughputValue:  strconv.FormatInt(r.ThroughputKbps, 10),
+		UnsentDataAmount: strconv.FormatInt(r.UnsentBytes, 10),
+		TotalSentByte:    strconv.FormatInt(r.TotalSentBytes, 10),
+	}
+	if f.extended {
+		v.ThroughputMbps = strconv.FormatFloat(r.ThroughputMbps(), 'f', 3, 64)
+		v.ThroughputUnit = "kbps"
+	}
+	if f.checksum {
+		v.Checksum = strconv.FormatUint(uint64(r.Checksum()), 10)
+	}
+	return json.Marshal(v)
+}
+
+func (r *S2CResult) verify(checksum uint32) error {
+	if r.Checksum() != checksum {
+		return ErrS2CChecksum
+	}
+	return nil
+}
+
+// s2cResult is the JSON representation of an S2CResult.
 type s2cResult struct {
 	ThroughputValue  string
 	UnsentDataAmount string
 	TotalSentByte    string
+	ThroughputMbps   string `json:",omitempty"`
+	ThroughputUnit   string `json:",omitempty"`
+	Checksum         string `json:",omitempty"`
 }
 
+// marshalS2CValue marshals each value of JSON S2C results. It is a variable so
+// that tests can make it fail.
+var marshalS2CValue = json.Marshal
+
+// MarshalJSON writes the keys in a fixed order, which strict clients depend
+// on, rather than in the order in which the fields happen to be declared.
+// The optional keys are omitted when they are empty.
+func (r *s2cResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range []struct {
+		key, value string
+		optional   bool
+	}{
+		{"ThroughputValue", r.ThroughputValue, false},
+		{"UnsentDataAmount", r.UnsentDataAmount, false},
+		{"TotalSentByte", r.TotalSentByte, false},
+		{"ThroughputMbps", r.ThroughputMbps, true},
+		{"ThroughputUnit", r.ThroughputUnit, true},
+		{"Checksum", r.Checksum, true},
+	} {
+		if f.optional && f.value == "" {
+			continue
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value, err := marshalS2CValue(f.value)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%q:%s", f.key, value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// String returns the JSON of the results, or a description of the error that
+// kept them from being marshaled, so that the error is never mistaken for an
+// empty result.
 func (r *s2cResult) String() string {
-	b, _ := json.Marshal(r)
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Sprintf("<S2C results that cannot be marshaled: %v>", err)
+	}
 	return string(b)
 }
 
+// parseTLVS2CResult parses results serialized by S2CResult.tlv, verifying the
+// checksum if there is one.
+func parseTLVS2CResult(b []byte) (*S2CResult, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) > 3 && strings.HasSuffix(fields[3], mbpsSuffix) {
+		// The throughput in Mbps is derived from the throughput in kbps.
+		fields = append(fields[:3], fields[4:]...)
+	}
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, fmt.Errorf("malformed S2C results: %q", b)
+	}
+	r := &S2CResult{}
+	var err error
+	for i, v := range []*int64{&r.ThroughputKbps, &r.UnsentBytes, &r.TotalSentBytes} {
+		*v, err = strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) == 3 {
+		return r, nil
+	}
+	checksum, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return r, r.verify(uint32(checksum))
+}
+
+// parseJSONS2CResult parses results serialized by S2CResult.json, verifying
+// the checksum if there is one.
+func parseJSONS2CResult(b []byte) (*S2CResult, error) {
+	v := &s2cResult{}
+	err := json.Unmarshal(b, v)
+	if err != nil {
+		return nil, err
+	}
+	r := &S2CResult{}
+	for _, f := range []struct {
+		dst *int64
+		src string
+	}{
+		{&r.ThroughputKbps, v.ThroughputValue},
+		{&r.UnsentBytes, v.UnsentDataAmount},
+		{&r.TotalSentBytes, v.TotalSentByte},
+	} {
+		*f.dst, err = strconv.ParseInt(f.src, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v.Checksum == "" {
+		return r, nil
+	}
+	checksum, err := strconv.ParseUint(v.Checksum, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return r, r.verify(uint32(checksum))
+}
+
+// s2cReceiver is implemented by Messagers that can receive the results sent by
+// SendS2CResults, which are not always framed like other messages.
+type s2cReceiver interface {
+	receiveS2CResults() (*S2CResult, error)
+}
+
+// ReceiveS2CResults receives the results sent by SendS2CResults on the other
+// end of the connection. If the results include a checksum, it is verified and
+// ErrS2CChecksum is returned along with the results if they do not match.
+func ReceiveS2CResults(m Messager) (throughput, unsent, total int64, err error) {
+	var r *S2CResult
+	if sr, ok := m.(s2cReceiver); ok {
+		r, err = sr.receiveS2CResults()
+	} else if m.Encoding() == TLV {
+		var b []byte
+		b, err = m.ReceiveMessage(TestMsg)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		r, err = parseTLVS2CResult(b)
+	} else {
+		return 0, 0, 0, fmt.Errorf("cannot receive S2C results with %v encoding", m.Encoding())
+	}
+	if r == nil {
+		return 0, 0, 0, err
+	}
+	return r.ThroughputKbps, r.UnsentBytes, r.TotalSentBytes, err
+}
+
+// SendS2CComplete ends the S2C test by sending an empty TestFinalize, which is
+// what clients wait for once they have received the results and the web100
+// metrics. It is encoded like any other message, so JSON clients receive
+// {"msg":""}. The session itself is ended later, with a MsgLogout, once every
+// test has run.
+func SendS2CComplete(m Messager) error {
+	return m.SendMessage(TestFinalize, []byte{})
+}
+
 func (jm *jsonMessager) SendMessage(kind MessageType, contents []byte) error {
+	if err := jm.applyWriteDeadline(jm.conn); err != nil {
+		return err
+	}
 	return SendJSONMessage(kind, string(contents), jm.conn)
 }
 
+func (jm *jsonMessager) SendMessageString(kind MessageType, s string) error {
+	if err := jm.applyWriteDeadline(jm.conn); err != nil {
+		return err
+	}
+	return SendJSONMessage(kind, s, jm.conn)
+}
+
 func (jm *jsonMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
-	r := &s2cResult{
-		ThroughputValue:  strconv.FormatInt(throughputKbps, 10),
-		UnsentDataAmount: strconv.FormatInt(unsentBytes, 10),
-		TotalSentByte:    strconv.FormatInt(totalSentBytes, 10),
+	r := &S2CResult{
+		ThroughputKbps: throughputKbps,
+		UnsentBytes:    unsentBytes,
+		TotalSentBytes: totalSentBytes,
+	}
+	if err := jm.checkS2CResult(r); err != nil {
+		return err
+	}
+	b, err := r.json(jm.s2cFormat())
+	if err != nil {
+		return err
+	}
+	if err := jm.applyWriteDeadline(jm.conn); err != nil {
+		return err
 	}
-	return WriteTLVMessage(jm.conn, TestMsg, r.String())
+	return writeTLVMessage(jm.conn, TestMsg, b)
+}
+
+// SendJSON sends rawJSON as the value of "msg", after checking that it is
+// valid JSON.
+func (jm *jsonMessager) SendJSON(kind MessageType, rawJSON json.RawMessage) error {
+	if !json.Valid(rawJSON) {
+		return fmt.Errorf("cannot send invalid JSON: %.20q", rawJSON)
+	}
+	if err := jm.applyWriteDeadline(jm.conn); err != nil {
+		return err
+	}
+	return writeRawFrame(jm.conn, kind, []byte(`{"msg":`), rawJSON, []byte(`}`))
+}
+
+// SendRawFrame sends raw as the value of the "msg" string, without escaping it.
+func (jm *jsonMessager) SendRawFrame(kind MessageType, raw []byte) error {
+	if err := jm.applyWriteDeadline(jm.conn); err != nil {
+		return err
+	}
+	return writeRawFrame(jm.conn, kind, []byte(`{"msg":"`), raw, []byte(`"}`))
 }
 
 func (jm *jsonMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
-	msg, err := ReceiveJSONMessage(jm.conn, kind)
+	_, b, err := jm.ReceiveOneOf(kind)
+	return b, err
+}
+
+func (jm *jsonMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	b, kind, _, err := jm.receiveMeta(kinds...)
+	return kind, b, err
+}
+
+// ReceiveMessageMeta returns the length of the JSON declared by the TLV
+// headers, which is longer than the returned message.
+func (jm *jsonMessager) ReceiveMessageMeta(kind MessageType) ([]byte, MessageType, int, error) {
+	return jm.receiveMeta(kind)
+}
+
+func (jm *jsonMessager) receiveMeta(kinds ...MessageType) ([]byte, MessageType, int, error) {
+	msg, kind, declaredLen, err := receiveJSONMessage(jm.conn, jm.limits(), jm.jsonDecoding(), kinds...)
 	if msg == nil {
 		if err == nil {
-			return nil, errors.New("empty message received without error")
+			return nil, kind, declaredLen, errors.New("empty message received without error")
 		}
+		return nil, kind, declaredLen, err
+	}
+	return []byte(msg.Msg), kind, declaredLen, err
+}
+
+func (jm *jsonMessager) ReceiveMessageInto(kind MessageType, v interface{}) error {
+	b, _, err := readTLVMessage(jm.conn, jm.limits(), kind)
+	if err != nil {
+		return err
+	}
+	return jm.countMalformed(unmarshalJSON(b, v, jm.jsonDecoding()))
+}
+
+func (jm *jsonMessager) ReceiveTyped(kinds ...MessageType) (Message, error) {
+	d := jm.jsonDecoding()
+	decode := func(b []byte) ([]byte, error) {
+		msg := &JSONMessage{}
+		if err := unmarshalJSON(b, msg, d); err != nil {
+			return nil, err
+		}
+		return []byte(msg.Msg), nil
+	}
+	object := func(b []byte, v interface{}) error {
+		return unmarshalJSON(b, v, d)
+	}
+	return receiveTyped(jm.conn, jm.limits(), kinds, decode, object)
+}
+
+func (jm *jsonMessager) ReceiveMessages(kind MessageType) ([][]byte, error) {
+	b, _, err := readTLVMessage(jm.conn, jm.limits(), kind)
+	if err != nil {
 		return nil, err
 	}
-	return []byte(msg.Msg), err
+	msgs, err := unmarshalJSONMessages(b, jm.jsonDecoding())
+	if err != nil {
+		return nil, jm.countMalformed(err)
+	}
+	out := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		out[i] = []byte(msg.Msg)
+	}
+	return out, nil
 }
 
-func (jm *jsonMessager) Encoding() Encoding {
-	return JSON
+func (jm *jsonMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	b, kind, err := readAnyTLVMessage(jm.conn, jm.limits())
+	if err != nil {
+		return kind, nil, err
+	}
+	msg := &JSONMessage{}
+	err = unmarshalJSON(b, msg, jm.jsonDecoding())
+	if err != nil {
+		return kind, nil, jm.countMalformed(err)
+	}
+	return kind, []byte(msg.Msg), nil
+}
+
+func (jm *jsonMessager) receiveS2CResults() (*S2CResult, error) {
+	b, _, err := readTLVMessage(jm.conn, jm.limits(), TestMsg)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONS2CResult(b)
 }
 
 // tlvMessager has all the methods for sending tlv-format NDT messages along the
 // passed-in connection.
 type tlvMessager struct {
-	conn Connection
+	baseMessager
 }
 
 func (tm *tlvMessager) SendMessage(kind MessageType, contents []byte) error {
-	return WriteTLVMessage(tm.conn, kind, string(contents))
+	if err := tm.applyWriteDeadline(tm.conn); err != nil {
+		return err
+	}
+	return writeTLVMessage(tm.conn, kind, contents)
+}
+
+func (tm *tlvMessager) SendMessageString(kind MessageType, s string) error {
+	if err := tm.applyWriteDeadline(tm.conn); err != nil {
+		return err
+	}
+	return WriteTLVMessage(tm.conn, kind, s)
 }
 
 func (tm *tlvMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
-	msg := fmt.Sprintf("%d %d %d", throughputKbps, unsentBytes, totalSentBytes)
-	return WriteTLVMessage(tm.conn, TestMsg, msg)
+	r := &S2CResult{
+		ThroughputKbps: throughputKbps,
+		UnsentBytes:    unsentBytes,
+		TotalSentBytes: totalSentBytes,
+	}
+	if err := tm.checkS2CResult(r); err != nil {
+		return err
+	}
+	if err := tm.applyWriteDeadline(tm.conn); err != nil {
+		return err
+	}
+	return WriteTLVMessage(tm.conn, TestMsg, r.tlv(tm.s2cFormat()))
+}
+
+func (tm *tlvMessager) SendRawFrame(kind MessageType, raw []byte) error {
+	if err := tm.applyWriteDeadline(tm.conn); err != nil {
+		return err
+	}
+	return writeRawFrame(tm.conn, kind, nil, raw, nil)
 }
 
 func (tm *tlvMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
-	b, _, err := ReadTLVMessage(tm.conn, kind)
+	b, _, err := readTLVMessage(tm.conn, tm.limits(), kind)
 	return b, err
 }
 
-func (tm *tlvMessager) Encoding() Encoding {
-	return TLV
-}
-
-// SendMetrics sends all the required properties out along the NDT control channel.
-func SendMetrics(metrics interface{}, m Messager, prefix string) error {
-	v := reflect.ValueOf(metrics)
-	t := v.Type()
-	// Dereference all passed-in pointers
-	for t.Kind() == reflect.Ptr {
-		v = v.Elem()
-		t = v.Type()
-	}
-	for i := 0; i < v.NumField(); i++ {
-		name := t.Field(i).Name
-		switch t.Field(i).Type.Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			msg := fmt.Sprintf("%s%s: %v\n", prefix, name, v.Field(i).Interface())
-			err := m.SendMessage(TestMsg, []byte(msg))
-			if err != nil {
-				return err
-			}
-		case reflect.String:
-			msg := fmt.Sprintf("%s%s: %s\n", prefix, name, v.Field(i).String())
-			err := m.SendMessage(TestMsg, []byte(msg))
-			if err != nil {
-				return err
-			}
-		case reflect.Struct:
-			data := v.Field(i).Interface()
-			var err error
-			if s, ok := data.(fmt.Stringer); ok {
-				msg := fmt.Sprintf("%s%s: %s\n", prefix, name, s.String())
-				err = m.SendMessage(TestMsg, []byte(msg))
-			} else {
-				err = SendMetrics(v.Field(i).Interface(), m, prefix+name+".")
-			}
-			if err != nil {
-				return err
-			}
-		default:
-			log.Println("Unhandled case in SendMetrics:", t.Field(i).Type.Kind())
+func (tm *tlvMessager) ReceiveMessageMeta(kind MessageType) ([]byte, MessageType, int, error) {
+	return readTLVMessageMeta(tm.conn, tm.limits(), kind)
+}
+
+func (tm *tlvMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	b, kind, err := readTLVMessage(tm.conn, tm.limits(), kinds...)
+	return kind, b, err
+}
+
+func (tm *tlvMessager) ReceiveMessageIntoBuffer(kind MessageType, buf []byte) (int, error) {
+	b, _, err := readTLVMessage(tm.conn, tm.limits(), kind)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > len(buf) {
+		return len(b), io.ErrShortBuffer
+	}
+	return copy(buf, b), nil
+}
+
+func (tm *tlvMessager) ReceiveMessageAppend(kind MessageType, buf []byte) ([]byte, error) {
+	b, _, err := readTLVMessage(tm.conn, tm.limits(), kind)
+	if err != nil {
+		return buf, err
+	}
+	return append(buf, b...), nil
+}
+
+func (tm *tlvMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	b, kind, err := readAnyTLVMessage(tm.conn, tm.limits())
+	return kind, b, err
+}
+
+func (tm *tlvMessager) receiveS2CResults() (*S2CResult, error) {
+	b, err := tm.ReceiveMessage(TestMsg)
+	if err != nil {
+		return nil, err
+	}
+	return parseTLVS2CResult(b)
+}
+
+// ReceiveMessageInto always returns ErrNoObjectModel, without reading.
+func (tm *tlvMessager) ReceiveMessageInto(MessageType, interface{}) error {
+	return ErrNoObjectModel
+}
+
+func (tm *tlvMessager) ReceiveTyped(kinds ...MessageType) (Message, error) {
+	decode := func(b []byte) ([]byte, error) {
+		return b, nil
+	}
+	return receiveTyped(tm.conn, tm.limits(), kinds, decode, nil)
+}
+
+// ErrDrainDeadline is returned by DrainMessages when the deadline passes before
+// the sentinel message arrives.
+var ErrDrainDeadline = errors.New("deadline passed while draining messages")
+
+// DrainMessages reads and discards messages of any type until it receives a
+// message of type until or the deadline elapses. It returns the payload of the
+// last message it received, which is the payload of the until message when
+// draining succeeds. Once the deadline elapses, the read in progress is
+// interrupted by ReceiveAnyMessageContext, so nothing is left reading from the
+// connection once DrainMessages returns, provided that the connection
+// supports read deadlines.
+func DrainMessages(m Messager, until MessageType, deadline time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	var last []byte
+	for {
+		kind, msg, err := m.ReceiveAnyMessageContext(ctx)
+		if err == context.DeadlineExceeded {
+			return last, ErrDrainDeadline
+		}
+		if err != nil {
+			return last, err
+		}
+		last = msg
+		if kind == until {
+			return last, nil
 		}
 	}
-	return nil
 }
@@ -1,8 +1,18 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/m-lab/ndt-server/ndt5/web100"
 )
@@ -15,6 +25,49 @@ func assertTLVMessagerIsMessager(tm *tlvMessager) {
 	func(m Messager) {}(tm)
 }
 
+var (
+	_ ExtendedMessager = &jsonMessager{}
+	_ ExtendedMessager = &tlvMessager{}
+	_ ExtendedMessager = &msgpackMessager{}
+	_ ExtendedMessager = &cborMessager{}
+)
+
+// loopbackConnection is a Connection where every written frame becomes
+// available to be read back out, in order.
+type loopbackConnection struct {
+	frames [][]byte
+}
+
+func (lc *loopbackConnection) ReadMessage() (int, []byte, error) {
+	if len(lc.frames) == 0 {
+		return 0, nil, io.EOF
+	}
+	f := lc.frames[0]
+	lc.frames = lc.frames[1:]
+	return 0, f, nil
+}
+func (lc *loopbackConnection) WriteMessage(_ int, data []byte) error {
+	lc.frames = append(lc.frames, append([]byte{}, data...))
+	return nil
+}
+func (lc *loopbackConnection) ReadBytes() (int64, error) { return 0, nil }
+func (lc *loopbackConnection) FillUntil(time.Time, []byte) (int64, error) {
+	return 0, nil
+}
+func (lc *loopbackConnection) ServerIPAndPort() (string, int) { return "", 0 }
+func (lc *loopbackConnection) ClientIPAndPort() (string, int) { return "", 0 }
+func (lc *loopbackConnection) Close() error                   { return nil }
+func (lc *loopbackConnection) UUID() string                   { return "" }
+func (lc *loopbackConnection) String() string                 { return "loopback" }
+func (lc *loopbackConnection) Messager() Messager             { return nil }
+func (lc *loopbackConnection) Encoding() Encoding             { return Unknown }
+
+// allMessageTypes is every MessageType the ndt5 protocol defines.
+var allMessageTypes = []MessageType{
+	SrvQueue, MsgLogin, TestPrepare, TestStart, TestMsg, TestFinalize,
+	MsgError, MsgResults, MsgLogout, MsgWaiting, MsgExtendedLogin, MsgKeepalive,
+}
+
 type fakeMessager struct {
 	sentMessages []string
 	errorAfter   int
@@ -31,12 +84,39 @@ func (fm *fakeMessager) SendMessage(_ MessageType, msg []byte) error {
 	return nil
 }
 
+func (fm *fakeMessager) SendMessageString(kind MessageType, s string) error {
+	return fm.SendMessage(kind, []byte(s))
+}
+
 func (fm *fakeMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
 	return nil
 }
 
 func (fm *fakeMessager) ReceiveMessage(MessageType) ([]byte, error) { return []byte{}, nil }
 
+func (fm *fakeMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	return kinds[0], []byte{}, nil
+}
+
+func (fm *fakeMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	return MsgUnknown, []byte{}, nil
+}
+
+func (fm *fakeMessager) ReceiveMessageContext(context.Context, MessageType) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (fm *fakeMessager) ReceiveAnyMessageContext(context.Context) (MessageType, []byte, error) {
+	return MsgUnknown, []byte{}, nil
+}
+
+func (fm *fakeMessager) CancelReceive()                   {}
+func (fm *fakeMessager) SetReadDeadline(time.Time) error  { return nil }
+func (fm *fakeMessager) SetWriteDeadline(time.Time) error { return nil }
+func (fm *fakeMessager) Flush() error                     { return nil }
+func (fm *fakeMessager) Release()                         {}
+func (fm *fakeMessager) Close() error                     { return nil }
+
 func (fm *fakeMessager) Encoding() Encoding {
 	return Unknown
 }
@@ -58,6 +138,469 @@ func TestSendMetrics(t *testing.T) {
 	}
 }
 
+func TestSendMetricsBatched(t *testing.T) {
+	data := &web100.Metrics{MaxRTT: 12, MinRTT: 3}
+	perField := &fakeMessager{}
+	if err := SendMetrics(data, perField, "prefix."); err != nil {
+		t.Fatal(err)
+	}
+	batched := &fakeMessager{}
+	if err := SendMetricsBatched(data, batched, "prefix."); err != nil {
+		t.Fatal(err)
+	}
+	if len(batched.sentMessages) != 1 {
+		t.Fatalf("SendMetricsBatched() sent %d messages, want 1", len(batched.sentMessages))
+	}
+	if want := strings.Join(perField.sentMessages, ""); batched.sentMessages[0] != want {
+		t.Errorf("SendMetricsBatched() sent %q, want %q", batched.sentMessages[0], want)
+	}
+}
+
+func TestSendMetricsAs(t *testing.T) {
+	data := &web100.Metrics{}
+	r := NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsAs(data, r, "", MsgResults); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMetricsBatched(data, r, "", WithMetricsType(MsgResults)); err != nil {
+		t.Fatal(err)
+	}
+	sent := r.Sent()
+	if len(sent) < 2 {
+		t.Fatalf("only %d messages were sent", len(sent))
+	}
+	for _, f := range sent {
+		if f.Type != MsgResults {
+			t.Errorf("%q was sent as %v, want MsgResults", f.Data, f.Type)
+		}
+	}
+}
+
+func TestSendMetricsFiltered(t *testing.T) {
+	type inner struct {
+		RTT    int
+		Secret string
+	}
+	type outer struct {
+		Count   int
+		Host    string
+		Inner   inner
+		Samples []int
+	}
+	data := outer{Count: 1, Host: "h", Inner: inner{RTT: 2, Secret: "s"}, Samples: []int{3, 4}}
+	all := []string{"p.Count", "p.Host", "p.Inner.RTT", "p.Inner.Secret", "p.Samples[0]", "p.Samples[1]"}
+	tests := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{name: "no filter", want: all},
+		{name: "include leaf", include: []string{"p.Count"}, want: []string{"p.Count"}},
+		{name: "include struct", include: []string{"p.Inner"}, want: []string{"p.Inner.RTT", "p.Inner.Secret"}},
+		{name: "include nested leaf", include: []string{"p.Inner.RTT", "p.Host"}, want: []string{"p.Host", "p.Inner.RTT"}},
+		{name: "include slice", include: []string{"p.Samples"}, want: []string{"p.Samples[0]", "p.Samples[1]"}},
+		{name: "exclude nested leaf", exclude: []string{"p.Inner.Secret"}, want: []string{"p.Count", "p.Host", "p.Inner.RTT", "p.Samples[0]", "p.Samples[1]"}},
+		{name: "exclude struct", exclude: []string{"p.Inner"}, want: []string{"p.Count", "p.Host", "p.Samples[0]", "p.Samples[1]"}},
+		{name: "exclude element", exclude: []string{"p.Samples[1]"}, want: []string{"p.Count", "p.Host", "p.Inner.RTT", "p.Inner.Secret", "p.Samples[0]"}},
+		{name: "exclude within include", include: []string{"p.Inner"}, exclude: []string{"p.Inner.Secret"}, want: []string{"p.Inner.RTT"}},
+		{name: "exclude wins", include: []string{"p.Count"}, exclude: []string{"p.Count"}},
+		{name: "partial names do not match", include: []string{"p.Co", "p.Inner.R", "Count"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			r := NewRecordingMessager(NewNopMessager(TLV))
+			fn := func(name string, value interface{}) string {
+				got = append(got, name)
+				return name
+			}
+			err := SendMetricsWithOptions(data, r, "p.", WithMetricsFormatter(fn), WithMetricsFilter(tt.include, tt.exclude))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+			if len(r.Sent()) != len(tt.want) {
+				t.Errorf("sent %d messages, want %d", len(r.Sent()), len(tt.want))
+			}
+		})
+	}
+
+	fm := &fakeMessager{}
+	if err := SendMetricsFiltered(data, fm, "p.", []string{"p.Inner"}, []string{"p.Inner.Secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"p.Inner.RTT: 2\n"}; !reflect.DeepEqual(fm.sentMessages, want) {
+		t.Errorf("SendMetricsFiltered() sent %q, want %q", fm.sentMessages, want)
+	}
+}
+
+func TestSendMetricsLineTerminator(t *testing.T) {
+	type inner struct {
+		RTT int
+	}
+	type outer struct {
+		Count   int
+		Inner   inner
+		Samples []int
+	}
+	data := outer{Count: 1, Inner: inner{RTT: 2}, Samples: []int{3, 4}}
+	tests := []struct {
+		name string
+		opts []MetricsOption
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"p.Count: 1\n", "p.Inner.RTT: 2\n", "p.Samples[0]: 3\n", "p.Samples[1]: 4\n"},
+		},
+		{
+			name: "crlf",
+			opts: []MetricsOption{WithCRLF()},
+			want: []string{"p.Count: 1\r\n", "p.Inner.RTT: 2\r\n", "p.Samples[0]: 3\r\n", "p.Samples[1]: 4\r\n"},
+		},
+		{
+			name: "crlf with joined slices",
+			opts: []MetricsOption{WithCRLF(), WithJoinedSlices()},
+			want: []string{"p.Count: 1\r\n", "p.Inner.RTT: 2\r\n", "p.Samples: 3,4\r\n"},
+		},
+		{
+			name: "crlf with a formatter",
+			opts: []MetricsOption{WithCRLF(), WithMetricsFormatter(func(name string, value interface{}) string {
+				return fmt.Sprintf("%s=%v\n", name, value)
+			})},
+			want: []string{"p.Count=1\r\n", "p.Inner.RTT=2\r\n", "p.Samples[0]=3\r\n", "p.Samples[1]=4\r\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRecordingMessager(NewNopMessager(TLV))
+			if err := SendMetricsWithOptions(data, r, "p.", tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range r.Sent() {
+				got = append(got, string(f.Data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	r := NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsBatched(data, r, "p.", WithCRLF()); err != nil {
+		t.Fatal(err)
+	}
+	want := "p.Count: 1\r\np.Inner.RTT: 2\r\np.Samples[0]: 3\r\np.Samples[1]: 4\r\n"
+	if sent := r.Sent(); len(sent) != 1 || string(sent[0].Data) != want {
+		t.Errorf("SendMetricsBatched() sent %v, want the single message %q", sent, want)
+	}
+}
+
+func TestSendMetricsTee(t *testing.T) {
+	data := struct {
+		Count   int
+		Samples []int
+	}{1, []int{2, 3}}
+	var tee bytes.Buffer
+	r := NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsTee(data, r, "p.", &tee); err != nil {
+		t.Fatal(err)
+	}
+	var sent string
+	for _, f := range r.Sent() {
+		sent += string(f.Data)
+	}
+	if len(r.Sent()) != 3 || tee.String() != sent {
+		t.Errorf("tee holds %q, want the %d messages sent, %q", tee.String(), len(r.Sent()), sent)
+	}
+
+	tee.Reset()
+	r = NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsBatched(data, r, "p.", WithMetricsTee(&tee), WithCRLF()); err != nil {
+		t.Fatal(err)
+	}
+	if sent := r.Sent(); len(sent) != 1 || tee.String() != string(sent[0].Data) {
+		t.Errorf("tee holds %q after SendMetricsBatched(), want the message sent, %v", tee.String(), sent)
+	}
+
+	// A failing tee does not stop the metrics from being sent.
+	r = NewRecordingMessager(NewNopMessager(TLV))
+	err := SendMetricsTee(data, r, "p.", failingWriter{})
+	var teeErr *MetricsTeeError
+	if !errors.As(err, &teeErr) || teeErr.Err.Error() != "write failed" {
+		t.Errorf("SendMetricsTee() with a failing tee = %v, want a *MetricsTeeError", err)
+	}
+	if len(r.Sent()) != 3 {
+		t.Errorf("SendMetricsTee() with a failing tee sent %d messages, want 3", len(r.Sent()))
+	}
+}
+
+func TestSendMetricsSeparator(t *testing.T) {
+	type rtt struct {
+		Min, Max int
+	}
+	type tcpInfo struct {
+		RTT   rtt
+		Flows []rtt
+	}
+	data := struct {
+		Count   int
+		TCPInfo tcpInfo
+	}{1, tcpInfo{RTT: rtt{2, 3}, Flows: []rtt{{4, 5}}}}
+	tests := []struct {
+		name string
+		opts []MetricsOption
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"p.Count: 1\n", "p.TCPInfo.RTT.Min: 2\n", "p.TCPInfo.RTT.Max: 3\n",
+				"p.TCPInfo.Flows[0].Min: 4\n", "p.TCPInfo.Flows[0].Max: 5\n"},
+		},
+		{
+			name: "underscore",
+			opts: []MetricsOption{WithMetricsSeparator("_")},
+			want: []string{"p.Count: 1\n", "p.TCPInfo_RTT_Min: 2\n", "p.TCPInfo_RTT_Max: 3\n",
+				"p.TCPInfo_Flows[0]_Min: 4\n", "p.TCPInfo_Flows[0]_Max: 5\n"},
+		},
+		{
+			name: "slash with a filter",
+			opts: []MetricsOption{
+				WithMetricsSeparator("/"),
+				WithMetricsFilter([]string{"p.TCPInfo/RTT"}, []string{"p.TCPInfo/RTT/Max"}),
+			},
+			want: []string{"p.TCPInfo/RTT/Min: 2\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRecordingMessager(NewNopMessager(TLV))
+			if err := SendMetricsWithOptions(data, r, "p.", tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range r.Sent() {
+				got = append(got, string(f.Data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMetricsMaps(t *testing.T) {
+	type flow struct {
+		ID    int
+		Bytes uint32
+	}
+	data := struct {
+		Labels map[string]string
+		Extra  map[string]interface{}
+		Flows  map[int]flow
+		Empty  map[string]int
+	}{
+		Labels: map[string]string{"site": "lga03", "machine": "mlab1", "experiment": "ndt"},
+		Extra:  map[string]interface{}{"b": 2, "a": "one", "c": flow{ID: 3, Bytes: 4}, "nil": nil},
+		Flows:  map[int]flow{10: {ID: 10, Bytes: 100}, 2: {ID: 2, Bytes: 20}},
+	}
+	want := []string{
+		"Labels.experiment: ndt\n", "Labels.machine: mlab1\n", "Labels.site: lga03\n",
+		"Extra.a: one\n", "Extra.b: 2\n", "Extra.c.ID: 3\n", "Extra.c.Bytes: 4\n",
+		"Flows.2.ID: 2\n", "Flows.2.Bytes: 20\n", "Flows.10.ID: 10\n", "Flows.10.Bytes: 100\n",
+	}
+	// The order of the entries must not depend on the order of iteration
+	// over the maps, which varies from run to run.
+	for i := 0; i < 10; i++ {
+		r := NewRecordingMessager(NewNopMessager(TLV))
+		if err := SendMetrics(data, r, ""); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range r.Sent() {
+			got = append(got, string(f.Data))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("sent %q, want %q", got, want)
+		}
+	}
+
+	// Maps nested too deep are sent whole.
+	r := NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsDepth(struct{ Labels map[string]string }{data.Labels}, r, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if sent := r.Sent(); len(sent) != 1 || string(sent[0].Data) != "Labels: map[experiment:ndt machine:mlab1 site:lga03]\n" {
+		t.Errorf("SendMetricsDepth() sent %v, want the whole map", sent)
+	}
+}
+
+func TestSendMetricsMaxMetrics(t *testing.T) {
+	type metrics struct {
+		A, B    int
+		Samples []int
+	}
+	data := metrics{A: 1, B: 2, Samples: []int{3, 4, 5}}
+	sent := func(r *RecordingMessager) []string {
+		got := []string{}
+		for _, f := range r.Sent() {
+			got = append(got, string(f.Data))
+		}
+		return got
+	}
+	tests := []struct {
+		name    string
+		opts    []MetricsOption
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "default",
+			want: []string{"A: 1\n", "B: 2\n", "Samples[0]: 3\n", "Samples[1]: 4\n", "Samples[2]: 5\n"},
+		},
+		{
+			name: "at the limit",
+			opts: []MetricsOption{WithMaxMetrics(5)},
+			want: []string{"A: 1\n", "B: 2\n", "Samples[0]: 3\n", "Samples[1]: 4\n", "Samples[2]: 5\n"},
+		},
+		{
+			name:    "error",
+			opts:    []MetricsOption{WithMaxMetrics(3)},
+			want:    []string{"A: 1\n", "B: 2\n", "Samples[0]: 3\n"},
+			wantErr: ErrTooManyMetrics,
+		},
+		{
+			name: "truncated",
+			opts: []MetricsOption{WithMaxMetrics(3), WithTruncatedMetrics()},
+			want: []string{"A: 1\n", "B: 2\n", "Samples[0]: 3\n", "MetricsTruncated: true\n"},
+		},
+		{
+			name: "truncated with crlf",
+			opts: []MetricsOption{WithMaxMetrics(1), WithTruncatedMetrics(), WithCRLF()},
+			want: []string{"A: 1\r\n", "MetricsTruncated: true\r\n"},
+		},
+		{
+			name:    "filtered metrics are not counted",
+			opts:    []MetricsOption{WithMaxMetrics(2), WithMetricsFilter(nil, []string{"A", "Samples[0]"})},
+			want:    []string{"B: 2\n", "Samples[1]: 4\n"},
+			wantErr: ErrTooManyMetrics,
+		},
+		{
+			name: "no limit",
+			opts: []MetricsOption{WithMaxMetrics(0)},
+			want: []string{"A: 1\n", "B: 2\n", "Samples[0]: 3\n", "Samples[1]: 4\n", "Samples[2]: 5\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRecordingMessager(NewNopMessager(TLV))
+			err := SendMetricsWithOptions(data, r, "", tt.opts...)
+			if err != tt.wantErr {
+				t.Errorf("SendMetricsWithOptions() = %v, want %v", err, tt.wantErr)
+			}
+			if got := sent(r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SendMetricsWithOptions() sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	r := NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsBatched(data, r, "", WithMaxMetrics(2), WithTruncatedMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sent(r), []string{"A: 1\nB: 2\nMetricsTruncated: true\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SendMetricsBatched() sent %q, want %q", got, want)
+	}
+	r = NewRecordingMessager(NewNopMessager(TLV))
+	if err := SendMetricsBatched(data, r, "", WithMaxMetrics(2)); err != ErrTooManyMetrics {
+		t.Errorf("SendMetricsBatched() = %v, want ErrTooManyMetrics", err)
+	}
+	if len(r.Sent()) != 0 {
+		t.Errorf("SendMetricsBatched() over the limit sent %q", sent(r))
+	}
+}
+
+func TestResumeSendMetrics(t *testing.T) {
+	type inner struct {
+		RTT    int
+		hidden int
+		Loss   float64
+	}
+	type outer struct {
+		Count   int
+		Inner   inner
+		Samples []int
+		Inners  []inner
+	}
+	data := outer{Count: 1, Inner: inner{RTT: 2, Loss: 0.5}, Samples: []int{3, 4}, Inners: []inner{{RTT: 5}}}
+	all := []string{"Count: 1\n", "Inner.RTT: 2\n", "Inner.Loss: 0.5\n", "Samples[0]: 3\n", "Samples[1]: 4\n",
+		"Inners[0].RTT: 5\n", "Inners[0].Loss: 0\n"}
+	sent := func(r *RecordingMessager) []string {
+		got := []string{}
+		for _, f := range r.Sent() {
+			got = append(got, string(f.Data))
+		}
+		return got
+	}
+	broken := errors.New("connection reset")
+	for k := 1; k <= len(all); k++ {
+		t.Run(fmt.Sprint(k), func(t *testing.T) {
+			first := NewRecordingMessager(NewNopMessager(TLV))
+			f := NewFaultMessager(first)
+			f.FailSend(k, broken)
+			err := SendMetrics(data, f, "")
+			se, ok := err.(*MetricsSendError)
+			if !ok || !errors.Is(err, broken) {
+				t.Fatalf("SendMetrics() = %v, want a *MetricsSendError wrapping the send error", err)
+			}
+			if want := strings.TrimSuffix(all[k-1], "\n"); !strings.HasPrefix(want, se.Name+":") {
+				t.Errorf("MetricsSendError.Name = %q, want the name in %q", se.Name, want)
+			}
+			if got := sent(first); !reflect.DeepEqual(got, all[:k-1]) {
+				t.Errorf("SendMetrics() sent %q before failing, want %q", got, all[:k-1])
+			}
+
+			second := NewRecordingMessager(NewNopMessager(TLV))
+			if err := ResumeSendMetrics(data, second, "", se.Cursor); err != nil {
+				t.Fatalf("ResumeSendMetrics(%v) = %v", se.Cursor, err)
+			}
+			if got := sent(second); !reflect.DeepEqual(got, all[k-1:]) {
+				t.Errorf("ResumeSendMetrics(%v) sent %q, want %q", se.Cursor, got, all[k-1:])
+			}
+		})
+	}
+
+	// A failure while resuming returns a cursor that can be resumed from.
+	f := NewFaultMessager(NewNopMessager(TLV))
+	f.FailSend(2, broken)
+	err := ResumeSendMetrics(data, f, "", MetricsCursor{2, 0})
+	se, ok := err.(*MetricsSendError)
+	if !ok || !reflect.DeepEqual(se.Cursor, MetricsCursor{2, 1}) {
+		t.Errorf("ResumeSendMetrics() = %v, want a *MetricsSendError at [2 1]", err)
+	}
+}
+
+func BenchmarkSendMetrics(b *testing.B) {
+	data := &web100.Metrics{}
+	fm := &fakeMessager{}
+	for i := 0; i < b.N; i++ {
+		SendMetrics(data, fm, "")
+	}
+	b.ReportMetric(float64(len(fm.sentMessages))/float64(b.N), "sends/op")
+}
+
+func BenchmarkSendMetricsBatched(b *testing.B) {
+	data := &web100.Metrics{}
+	fm := &fakeMessager{}
+	for i := 0; i < b.N; i++ {
+		SendMetricsBatched(data, fm, "")
+	}
+	b.ReportMetric(float64(len(fm.sentMessages))/float64(b.N), "sends/op")
+}
+
 func TestSendMetricsWithErrors(t *testing.T) {
 	data := &web100.Metrics{}
 	// Erroring after 25 fields means that the error occurs inside the tcpinfo
@@ -73,3 +616,2232 @@ func TestSendMetricsWithErrors(t *testing.T) {
 		t.Error("Too many messages sent:", fm)
 	}
 }
+
+type stringerMetric struct {
+	value int
+}
+
+func (s stringerMetric) String() string {
+	return fmt.Sprintf("stringer-%d", s.value)
+}
+
+type innerMetrics struct {
+	Depth  int
+	Leaves struct {
+		Count uint32
+		Label string
+	}
+}
+
+type formatterMetrics struct {
+	Count    int64
+	Name     string
+	Stringer stringerMetric
+	Inner    innerMetrics
+}
+
+func TestSendMetricsWithFormatter(t *testing.T) {
+	data := &formatterMetrics{
+		Count:    -5,
+		Name:     "ndt",
+		Stringer: stringerMetric{value: 7},
+	}
+	data.Inner.Depth = 1
+	data.Inner.Leaves.Count = 2
+	data.Inner.Leaves.Label = "leaf"
+
+	tests := []struct {
+		name string
+		fn   func(string, interface{}) string
+		want []string
+	}{
+		{
+			name: "default",
+			fn:   defaultMetricsFormatter,
+			want: []string{
+				"p.Count: -5\n",
+				"p.Name: ndt\n",
+				"p.Stringer: stringer-7\n",
+				"p.Inner.Depth: 1\n",
+				"p.Inner.Leaves.Count: 2\n",
+				"p.Inner.Leaves.Label: leaf\n",
+			},
+		},
+		{
+			name: "equals",
+			fn: func(name string, value interface{}) string {
+				return fmt.Sprintf("%s=%v;", name, value)
+			},
+			want: []string{
+				"p.Count=-5;",
+				"p.Name=ndt;",
+				"p.Stringer=stringer-7;",
+				"p.Inner.Depth=1;",
+				"p.Inner.Leaves.Count=2;",
+				"p.Inner.Leaves.Label=leaf;",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm := &fakeMessager{}
+			err := SendMetricsWithFormatter(data, fm, "p.", tt.fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fm.sentMessages, tt.want) {
+				t.Errorf("SendMetricsWithFormatter() sent %q, want %q", fm.sentMessages, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMetricsMatchesDefaultFormatter(t *testing.T) {
+	data := &web100.Metrics{}
+	fm1 := &fakeMessager{}
+	fm2 := &fakeMessager{}
+	if err := SendMetrics(data, fm1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMetricsWithFormatter(data, fm2, "", defaultMetricsFormatter); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fm1.sentMessages, fm2.sentMessages) {
+		t.Error("SendMetrics and the default formatter disagree")
+	}
+}
+
+type kindsMetrics struct {
+	RTT       float64
+	Loss      float32
+	BBR       bool
+	Limited   bool
+	Nil       *innerMetrics
+	NilInt    *int
+	Pointer   *innerMetrics
+	PointerTo *float64
+}
+
+func TestSendMetricsFloatsBoolsAndPointers(t *testing.T) {
+	f := 0.25
+	data := &kindsMetrics{
+		RTT:       12.5,
+		Loss:      0.5,
+		BBR:       true,
+		Pointer:   &innerMetrics{Depth: 3},
+		PointerTo: &f,
+	}
+	fm := &fakeMessager{}
+	err := SendMetrics(data, fm, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"RTT: 12.5\n",
+		"Loss: 0.5\n",
+		"BBR: true\n",
+		"Limited: false\n",
+		"Pointer.Depth: 3\n",
+		"Pointer.Leaves.Count: 0\n",
+		"Pointer.Leaves.Label: \n",
+		"PointerTo: 0.25\n",
+	}
+	if !reflect.DeepEqual(fm.sentMessages, want) {
+		t.Errorf("SendMetrics() sent %q, want %q", fm.sentMessages, want)
+	}
+}
+
+func TestSendMetricsFloatPrecision(t *testing.T) {
+	data := struct {
+		Mbps    float64
+		RTT     float32
+		Samples []float64
+		Count   int
+		Label   string
+	}{94.12345678, 12.5, []float64{1, 0.0625}, 7, "3.14159"}
+	tests := []struct {
+		name string
+		opts []MetricsOption
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"Mbps: 94.12345678\n", "RTT: 12.5\n", "Samples[0]: 1\n", "Samples[1]: 0.0625\n", "Count: 7\n", "Label: 3.14159\n"},
+		},
+		{
+			name: "default precision",
+			opts: []MetricsOption{WithFloatPrecision(DefaultFloatPrecision)},
+			want: []string{"Mbps: 94.123\n", "RTT: 12.500\n", "Samples[0]: 1.000\n", "Samples[1]: 0.062\n", "Count: 7\n", "Label: 3.14159\n"},
+		},
+		{
+			name: "no decimals with joined slices",
+			opts: []MetricsOption{WithFloatPrecision(0), WithJoinedSlices()},
+			want: []string{"Mbps: 94\n", "RTT: 12\n", "Samples: 1,0\n", "Count: 7\n", "Label: 3.14159\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm := &fakeMessager{}
+			if err := SendMetricsWithOptions(data, fm, "", tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fm.sentMessages, tt.want) {
+				t.Errorf("SendMetricsWithOptions() sent %q, want %q", fm.sentMessages, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMetricsNilPointer(t *testing.T) {
+	var data *kindsMetrics
+	fm := &fakeMessager{}
+	err := SendMetrics(data, fm, "")
+	if err != nil {
+		t.Error("SendMetrics() of a nil pointer should not fail:", err)
+	}
+	if len(fm.sentMessages) != 0 {
+		t.Errorf("SendMetrics() of a nil pointer sent %q", fm.sentMessages)
+	}
+}
+
+func TestReceiveMessageContextCancelMidRead(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			m := enc.Messager(AdaptNetConn(server, server))
+			// Send only the header of a 10-byte message, so the read blocks partway
+			// through the frame.
+			go client.Write([]byte{byte(TestMsg), 0, 10})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+			}()
+			start := time.Now()
+			b, err := m.ReceiveMessageContext(ctx, TestMsg)
+			if err != context.Canceled {
+				t.Errorf("ReceiveMessageContext() error = %v, want %v", err, context.Canceled)
+			}
+			if b != nil {
+				t.Errorf("ReceiveMessageContext() returned partial data %q", b)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("ReceiveMessageContext() took %v to return after cancel", elapsed)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageConnectionClosed(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			m := enc.Messager(AdaptNetConn(server, server))
+			go func() {
+				enc.Messager(AdaptNetConn(client, client)).SendMessage(TestMsg, []byte("hi"))
+				client.Close()
+			}()
+			b, err := m.ReceiveMessage(TestMsg)
+			if err != nil || string(b) != "hi" {
+				t.Fatalf("ReceiveMessage() = %q, %v, want \"hi\"", b, err)
+			}
+			_, err = m.ReceiveMessage(TestMsg)
+			if err != ErrConnectionClosed {
+				t.Errorf("ReceiveMessage() after close = %v, want %v", err, ErrConnectionClosed)
+			}
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("ReceiveMessage() after close = %v, want an error wrapping io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageTruncated(t *testing.T) {
+	for name, partial := range map[string][]byte{
+		"header": {byte(TestMsg), 0},
+		"body":   {byte(TestMsg), 0, 10, 'h', 'i'},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			m := TLV.Messager(AdaptNetConn(server, server))
+			go func() {
+				client.Write(partial)
+				client.Close()
+			}()
+			_, err := m.ReceiveMessage(TestMsg)
+			if err != ErrTruncatedMessage {
+				t.Errorf("ReceiveMessage() = %v, want %v", err, ErrTruncatedMessage)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("ReceiveMessage() = %v, want an error wrapping io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageClosedBetweenFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server), WithChunkedMessages())
+	go func() {
+		// A full-size frame announces a continuation that never arrives.
+		client.Write(append([]byte{byte(TestMsg), 0xFF, 0xFF}, make([]byte, 0xFFFF)...))
+		client.Close()
+	}()
+	_, err := m.ReceiveMessage(TestMsg)
+	if err != ErrTruncatedMessage {
+		t.Errorf("ReceiveMessage() = %v, want %v", err, ErrTruncatedMessage)
+	}
+}
+
+func TestReceiveMessageContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := m.ReceiveMessageContext(ctx, TestMsg)
+	if err != context.DeadlineExceeded {
+		t.Errorf("ReceiveMessageContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReceiveMessageContextSuccess(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server))
+	go client.Write([]byte{byte(TestMsg), 0, 2, 'h', 'i'})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b, err := m.ReceiveMessageContext(ctx, TestMsg)
+	if err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessageContext() = %q, %v", b, err)
+	}
+	// The deadline must be cleared after the read completes.
+	go client.Write([]byte{byte(TestMsg), 0, 2, 'h', 'o'})
+	b, err = m.ReceiveMessage(TestMsg)
+	if err != nil || string(b) != "ho" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+}
+
+func TestReceiveMessageContextKeepsCallerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server))
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	go client.Write([]byte{byte(TestMsg), 0, 2, 'h', 'i'})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if b, err := m.ReceiveMessageContext(ctx, TestMsg); err != nil || string(b) != "hi" {
+		t.Fatalf("ReceiveMessageContext() = %q, %v", b, err)
+	}
+	// The deadline set before is still in force for the next read.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.ReceiveMessage(TestMsg)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if !isTransient(err) {
+			t.Errorf("ReceiveMessage() after the deadline = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveMessageContext() cleared the read deadline set by the caller")
+	}
+}
+
+func TestReceiveMessageContextInterruptedKeepsCallerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := AdaptNetConn(server, server)
+	m := TLV.Messager(conn)
+	conn.(readDeadliner).SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.ReceiveMessageContext(ctx, TestMsg); err != context.DeadlineExceeded {
+		t.Fatalf("ReceiveMessageContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Interrupting the read put back the deadline set by the caller.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.ReceiveMessage(TestMsg)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if !isTransient(err) {
+			t.Errorf("ReceiveMessage() after the deadline = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveMessageContext() cleared the read deadline set by the caller")
+	}
+}
+
+// cancellingConnection cancels a context as it returns each frame, as if the
+// context were cancelled just as a read completed.
+type cancellingConnection struct {
+	loopbackConnection
+	cancel context.CancelFunc
+}
+
+func (cc *cancellingConnection) ReadMessage() (int, []byte, error) {
+	cc.cancel()
+	return cc.loopbackConnection.ReadMessage()
+}
+
+func (cc *cancellingConnection) SetReadDeadline(time.Time) error { return nil }
+
+func TestReceiveMessageContextCancelledAfterRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cc := &cancellingConnection{cancel: cancel}
+	WriteTLVMessage(cc, TestMsg, "hi")
+	m := TLV.Messager(cc)
+	if b, err := m.ReceiveMessageContext(ctx, TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessageContext() of a message read as the context was cancelled = %q, %v", b, err)
+	}
+}
+
+func TestReceiveAnyMessage(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		for _, kind := range allMessageTypes {
+			m := enc.Messager(&loopbackConnection{})
+			if err := m.SendMessage(kind, []byte("payload")); err != nil {
+				t.Fatal(err)
+			}
+			got, b, err := m.ReceiveAnyMessage()
+			if err != nil {
+				t.Fatalf("%v: ReceiveAnyMessage() failed: %v", enc, err)
+			}
+			if got != kind || string(b) != "payload" {
+				t.Errorf("%v: ReceiveAnyMessage() = %v, %q; want %v, %q", enc, got, b, kind, "payload")
+			}
+		}
+	}
+}
+
+func TestReceiveAnyMessageErrors(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		m := enc.Messager(&loopbackConnection{})
+		if _, _, err := m.ReceiveAnyMessage(); err != io.EOF {
+			t.Errorf("%v: ReceiveAnyMessage() on a closed connection = %v, want io.EOF", enc, err)
+		}
+		m = enc.Messager(&loopbackConnection{frames: [][]byte{{byte(MsgError), 0, 5, 'x'}}})
+		if kind, _, err := m.ReceiveAnyMessage(); err == nil || kind != MsgError {
+			t.Errorf("%v: ReceiveAnyMessage() on a bad frame = %v, %v", enc, kind, err)
+		}
+	}
+}
+
+// headerOnlyReader yields a single TLV header and fails the test if anything
+// tries to read the message body.
+type headerOnlyReader struct {
+	t      *testing.T
+	header []byte
+}
+
+func (r *headerOnlyReader) Read(p []byte) (int, error) {
+	if r.header == nil {
+		r.t.Error("Message body was read after an oversized header")
+		return 0, io.EOF
+	}
+	n := copy(p, r.header)
+	r.header = nil
+	return n, nil
+}
+
+func TestMaxMessageSizeRejectsOversizedHeader(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			input := &headerOnlyReader{t: t, header: []byte{byte(TestMsg), 0xFF, 0xFF}}
+			m := enc.Messager(AdaptNetConn(server, input), WithMaxMessageSize(1024))
+			_, err := m.ReceiveMessage(TestMsg)
+			if err == nil {
+				t.Error("ReceiveMessage() should reject an oversized message")
+			}
+		})
+	}
+}
+
+func TestMaxMessageSizeWithoutReadLimiter(t *testing.T) {
+	lc := &loopbackConnection{}
+	if err := WriteTLVMessage(lc, TestMsg, "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTLVMessage(lc, TestMsg, "01234"); err != nil {
+		t.Fatal(err)
+	}
+	m := TLV.Messager(lc, WithMaxMessageSize(5))
+	if _, err := m.ReceiveMessage(TestMsg); err == nil || !strings.Contains(err.Error(), "maximum message size") {
+		t.Errorf("ReceiveMessage() of a 10-byte message = %v, want a maximum size error", err)
+	}
+	b, err := m.ReceiveMessage(TestMsg)
+	if err != nil || string(b) != "01234" {
+		t.Errorf("ReceiveMessage() of a 5-byte message = %q, %v", b, err)
+	}
+}
+
+func TestDefaultMaxMessageSize(t *testing.T) {
+	tm := TLV.Messager(&loopbackConnection{}).(*tlvMessager)
+	if tm.maxMessageSize != DefaultMaxMessageSize {
+		t.Errorf("maxMessageSize = %d, want %d", tm.maxMessageSize, DefaultMaxMessageSize)
+	}
+}
+
+// discardConnection is a Connection that drops everything written to it.
+type discardConnection struct {
+	loopbackConnection
+}
+
+func (dc *discardConnection) WriteMessage(int, []byte) error { return nil }
+
+// historicalTLVFrame builds a frame the way WriteTLVMessage did before frames
+// were built in pooled buffers.
+func historicalTLVFrame(kind MessageType, msg []byte) []byte {
+	return append([]byte{byte(kind), byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestPooledFramesMatchHistoricalWireFormat(t *testing.T) {
+	for _, payload := range []string{"", "0", "<b>&amp;</b>", "ünïcödé\n\t\"", strings.Repeat("x", 70000)[:65535]} {
+		lc := &loopbackConnection{}
+		if err := TLV.Messager(lc).SendMessage(TestMsg, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		want := [][]byte{historicalTLVFrame(TestMsg, []byte(payload))}
+		j, _ := json.Marshal(&JSONMessage{Msg: payload})
+		err := JSON.Messager(lc).SendMessage(MsgLogin, []byte(payload))
+		if len(j) > maxTLVFrameSize {
+			// The historical format silently overflowed the length.
+			if _, ok := err.(*MessageTooLongError); !ok {
+				t.Errorf("SendMessage() of %d bytes of JSON = %v", len(j), err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else {
+			want = append(want, historicalTLVFrame(MsgLogin, j))
+		}
+		if !reflect.DeepEqual(lc.frames, want) {
+			t.Errorf("Frames for %.20q differ from the historical wire format", payload)
+		}
+	}
+	lc := &loopbackConnection{}
+	if err := TLV.Messager(lc).SendS2CResults(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := JSON.Messager(lc).SendS2CResults(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{
+		historicalTLVFrame(TestMsg, []byte("1 2 3")),
+		historicalTLVFrame(TestMsg, []byte(`{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3"}`)),
+	}
+	if !reflect.DeepEqual(lc.frames, want) {
+		t.Errorf("S2C results frames = %q, want %q", lc.frames, want)
+	}
+}
+
+func benchmarkSendMessage(b *testing.B, enc Encoding) {
+	m := enc.Messager(&discardConnection{})
+	msg := []byte("MaxRTT: 12345\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.SendMessage(TestMsg, msg)
+	}
+}
+
+func BenchmarkTLVMessagerSendMessage(b *testing.B) {
+	benchmarkSendMessage(b, TLV)
+}
+
+func BenchmarkJSONMessagerSendMessage(b *testing.B) {
+	benchmarkSendMessage(b, JSON)
+}
+
+// The string benchmarks send a message that starts out as a string, as most
+// messages do, either by converting it for SendMessage or with
+// SendMessageString.
+func benchmarkSendString(b *testing.B, enc Encoding, asString bool) {
+	m := enc.Messager(&discardConnection{})
+	msg := fmt.Sprintf("MaxRTT: %d\n", 12345)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if asString {
+			m.SendMessageString(TestMsg, msg)
+		} else {
+			m.SendMessage(TestMsg, []byte(msg))
+		}
+	}
+}
+
+func BenchmarkJSONMessagerSendMessageFromString(b *testing.B) {
+	benchmarkSendString(b, JSON, false)
+}
+
+func BenchmarkJSONMessagerSendMessageString(b *testing.B) {
+	benchmarkSendString(b, JSON, true)
+}
+
+func BenchmarkTLVMessagerSendMessageString(b *testing.B) {
+	benchmarkSendString(b, TLV, true)
+}
+
+// BenchmarkUnpooledSendMessage measures building each frame in a newly
+// allocated buffer, as was done before frames came from a sync.Pool.
+func BenchmarkUnpooledSendMessage(b *testing.B) {
+	conn := &discardConnection{}
+	msg := []byte("MaxRTT: 12345\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := string(msg)
+		conn.WriteMessage(0, historicalTLVFrame(TestMsg, []byte(s)))
+	}
+}
+
+func TestS2CResultFormats(t *testing.T) {
+	tests := []struct {
+		r        S2CResult
+		wantTLV  string
+		wantJSON string
+	}{
+		{
+			r:        S2CResult{},
+			wantTLV:  "0 0 0",
+			wantJSON: `{"ThroughputValue":"0","UnsentDataAmount":"0","TotalSentByte":"0"}`,
+		},
+		{
+			r:        S2CResult{ThroughputKbps: 94123, UnsentBytes: 12, TotalSentBytes: 117653750},
+			wantTLV:  "94123 12 117653750",
+			wantJSON: `{"ThroughputValue":"94123","UnsentDataAmount":"12","TotalSentByte":"117653750"}`,
+		},
+		{
+			r:        S2CResult{ThroughputKbps: -1, UnsentBytes: 9223372036854775807, TotalSentBytes: 1},
+			wantTLV:  "-1 9223372036854775807 1",
+			wantJSON: `{"ThroughputValue":"-1","UnsentDataAmount":"9223372036854775807","TotalSentByte":"1"}`,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.r.TLV(); got != tt.wantTLV {
+			t.Errorf("%+v.TLV() = %q, want %q", tt.r, got, tt.wantTLV)
+		}
+		got, err := tt.r.JSON()
+		if err != nil || string(got) != tt.wantJSON {
+			t.Errorf("%+v.JSON() = %q, %v, want %q", tt.r, got, err, tt.wantJSON)
+		}
+		// The messagers must send exactly these serializations.
+		lc := &loopbackConnection{}
+		TLV.Messager(lc).SendS2CResults(tt.r.ThroughputKbps, tt.r.UnsentBytes, tt.r.TotalSentBytes)
+		JSON.Messager(lc).SendS2CResults(tt.r.ThroughputKbps, tt.r.UnsentBytes, tt.r.TotalSentBytes)
+		want := [][]byte{
+			historicalTLVFrame(TestMsg, []byte(tt.wantTLV)),
+			historicalTLVFrame(TestMsg, []byte(tt.wantJSON)),
+		}
+		if !reflect.DeepEqual(lc.frames, want) {
+			t.Errorf("SendS2CResults() frames = %q, want %q", lc.frames, want)
+		}
+	}
+}
+
+func TestExtendedS2CResults(t *testing.T) {
+	r := S2CResult{ThroughputKbps: 94123, UnsentBytes: 12, TotalSentBytes: 117653750}
+	tests := []struct {
+		name     string
+		opts     []MessagerOption
+		wantTLV  string
+		wantJSON string
+	}{
+		{
+			name:     "default",
+			wantTLV:  "94123 12 117653750",
+			wantJSON: `{"ThroughputValue":"94123","UnsentDataAmount":"12","TotalSentByte":"117653750"}`,
+		},
+		{
+			name:     "extended",
+			opts:     []MessagerOption{WithExtendedS2CResults()},
+			wantTLV:  "94123 12 117653750 94.123Mbps",
+			wantJSON: `{"ThroughputValue":"94123","UnsentDataAmount":"12","TotalSentByte":"117653750","ThroughputMbps":"94.123","ThroughputUnit":"kbps"}`,
+		},
+		{
+			name:     "extended-checksum",
+			opts:     []MessagerOption{WithExtendedS2CResults(), WithS2CChecksum()},
+			wantTLV:  fmt.Sprintf("94123 12 117653750 94.123Mbps %d", r.Checksum()),
+			wantJSON: fmt.Sprintf(`{"ThroughputValue":"94123","UnsentDataAmount":"12","TotalSentByte":"117653750","ThroughputMbps":"94.123","ThroughputUnit":"kbps","Checksum":"%d"}`, r.Checksum()),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, enc := range []Encoding{TLV, JSON, MessagePack} {
+				lc := &loopbackConnection{}
+				m := enc.Messager(lc, tt.opts...)
+				if err := m.SendS2CResults(r.ThroughputKbps, r.UnsentBytes, r.TotalSentBytes); err != nil {
+					t.Fatal(err)
+				}
+				switch enc {
+				case TLV:
+					if got := string(lc.frames[0][3:]); got != tt.wantTLV {
+						t.Errorf("TLV results = %q, want %q", got, tt.wantTLV)
+					}
+				case JSON:
+					if got := string(lc.frames[0][3:]); got != tt.wantJSON {
+						t.Errorf("JSON results = %q, want %q", got, tt.wantJSON)
+					}
+				}
+				// The extra values must not get in the way of receiving.
+				throughput, unsent, total, err := ReceiveS2CResults(enc.Messager(lc))
+				if err != nil || throughput != r.ThroughputKbps || unsent != r.UnsentBytes || total != r.TotalSentBytes {
+					t.Errorf("%v: ReceiveS2CResults() = %d, %d, %d, %v", enc, throughput, unsent, total, err)
+				}
+			}
+		})
+	}
+}
+
+func TestS2CValidation(t *testing.T) {
+	for _, enc := range []Encoding{TLV, JSON, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			// Negative values are sent as they are by default.
+			lc := &loopbackConnection{}
+			if err := enc.Messager(lc).SendS2CResults(94123, -1, 117653750); err != nil {
+				t.Fatal(err)
+			}
+			throughput, unsent, total, err := ReceiveS2CResults(enc.Messager(lc))
+			if err != nil || throughput != 94123 || unsent != -1 || total != 117653750 {
+				t.Errorf("ReceiveS2CResults() = %d, %d, %d, %v, want the negative value", throughput, unsent, total, err)
+			}
+
+			m := enc.Messager(lc, WithS2CValidation())
+			for _, tt := range []struct {
+				throughput, unsent, total int64
+				name                      string
+			}{
+				{-1, 12, 117653750, "ThroughputKbps"},
+				{94123, -12, 117653750, "UnsentBytes"},
+				{94123, 12, -117653750, "TotalSentBytes"},
+				{-1, -1, -1, "ThroughputKbps"},
+			} {
+				err := m.SendS2CResults(tt.throughput, tt.unsent, tt.total)
+				var ne *NegativeS2CResultError
+				if !errors.As(err, &ne) || ne.Name != tt.name {
+					t.Errorf("SendS2CResults(%d, %d, %d) = %v, want a *NegativeS2CResultError for %s",
+						tt.throughput, tt.unsent, tt.total, err, tt.name)
+				}
+			}
+			if len(lc.frames) != 0 {
+				t.Errorf("invalid results sent %d frames", len(lc.frames))
+			}
+			if err := m.SendS2CResults(0, 0, 0); err != nil || len(lc.frames) != 1 {
+				t.Errorf("SendS2CResults(0, 0, 0) = %v, sent %d frames, want 1", err, len(lc.frames))
+			}
+		})
+	}
+}
+
+func TestS2CResultKeyOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		v    *s2cResult
+		want string
+	}{
+		{
+			name: "required keys",
+			v:    &s2cResult{TotalSentByte: "3", UnsentDataAmount: "2", ThroughputValue: "1"},
+			want: `{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3"}`,
+		},
+		{
+			name: "empty values are still sent",
+			v:    &s2cResult{},
+			want: `{"ThroughputValue":"","UnsentDataAmount":"","TotalSentByte":""}`,
+		},
+		{
+			name: "optional keys",
+			v: &s2cResult{Checksum: "6", ThroughputUnit: "kbps", ThroughputMbps: "4",
+				TotalSentByte: "3", UnsentDataAmount: "2", ThroughputValue: "1"},
+			want: `{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3","ThroughputMbps":"4","ThroughputUnit":"kbps","Checksum":"6"}`,
+		},
+		{
+			name: "some optional keys",
+			v:    &s2cResult{ThroughputValue: "1", UnsentDataAmount: "2", TotalSentByte: "3", Checksum: "6"},
+			want: `{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3","Checksum":"6"}`,
+		},
+		{
+			name: "escaping",
+			v:    &s2cResult{ThroughputValue: "\"<", UnsentDataAmount: "\n", TotalSentByte: "\u00e9"},
+			want: `{"ThroughputValue":"\"\u003c","UnsentDataAmount":"\n","TotalSentByte":"é"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.v)
+			if err != nil || string(b) != tt.want {
+				t.Errorf("json.Marshal() = %s, %v, want %s", b, err, tt.want)
+			}
+			if got := tt.v.String(); got != tt.want {
+				t.Errorf("String() = %s, want %s", got, tt.want)
+			}
+			v := &s2cResult{}
+			if err := json.Unmarshal(b, v); err != nil || !reflect.DeepEqual(v, tt.v) {
+				t.Errorf("json.Unmarshal() = %+v, %v, want %+v", v, err, tt.v)
+			}
+		})
+	}
+}
+
+func TestS2CResultMarshalError(t *testing.T) {
+	errMarshal := errors.New("cannot marshal")
+	marshalS2CValue = func(interface{}) ([]byte, error) { return nil, errMarshal }
+	defer func() { marshalS2CValue = json.Marshal }()
+
+	lc := &loopbackConnection{}
+	if err := JSON.Messager(lc).SendS2CResults(1, 2, 3); !errors.Is(err, errMarshal) {
+		t.Errorf("SendS2CResults() = %v, want %v", err, errMarshal)
+	}
+	if len(lc.frames) != 0 {
+		t.Errorf("SendS2CResults() sent %q after failing to marshal", lc.frames)
+	}
+	if _, err := (&S2CResult{1, 2, 3}).JSON(); !errors.Is(err, errMarshal) {
+		t.Errorf("JSON() = %v, want %v", err, errMarshal)
+	}
+	if got := (&s2cResult{}).String(); !strings.Contains(got, errMarshal.Error()) {
+		t.Errorf("String() = %q, want it to report %v", got, errMarshal)
+	}
+}
+
+func TestDrainMessages(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV} {
+		m := enc.Messager(&fakeDeadlineConnection{})
+		m.SendMessage(TestMsg, []byte("one"))
+		m.SendMessage(MsgError, []byte("two"))
+		m.SendMessage(MsgResults, []byte("three"))
+		m.SendMessage(TestMsg, []byte("four"))
+		last, err := DrainMessages(m, MsgResults, time.Second)
+		if err != nil || string(last) != "three" {
+			t.Errorf("%v: DrainMessages() = %q, %v; want %q, nil", enc, last, err, "three")
+		}
+		// Draining must stop at the sentinel, leaving later messages unread.
+		b, err := m.ReceiveMessage(TestMsg)
+		if err != nil || string(b) != "four" {
+			t.Errorf("%v: ReceiveMessage() after draining = %q, %v", enc, b, err)
+		}
+	}
+}
+
+func TestDrainMessagesReadError(t *testing.T) {
+	m := TLV.Messager(&fakeDeadlineConnection{})
+	m.SendMessage(TestMsg, []byte("one"))
+	last, err := DrainMessages(m, MsgResults, time.Second)
+	if err != io.EOF || string(last) != "one" {
+		t.Errorf("DrainMessages() = %q, %v; want %q, %v", last, err, "one", io.EOF)
+	}
+}
+
+func TestDrainMessagesDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := JSON.Messager(AdaptNetConn(server, server))
+	go SendJSONMessage(TestMsg, "one", AdaptNetConn(client, client))
+	start := time.Now()
+	last, err := DrainMessages(m, MsgResults, 100*time.Millisecond)
+	if err != ErrDrainDeadline || string(last) != "one" {
+		t.Errorf("DrainMessages() = %q, %v; want %q, %v", last, err, "one", ErrDrainDeadline)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DrainMessages() took %v with a 100ms deadline", elapsed)
+	}
+}
+
+func TestDrainMessagesDeadlineLeavesNothingReading(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := TLV.Messager(AdaptNetConn(server, server))
+	cm := TLV.Messager(AdaptNetConn(client, client))
+	if _, err := DrainMessages(m, MsgResults, 10*time.Millisecond); err != ErrDrainDeadline {
+		t.Fatalf("DrainMessages() = %v, want %v", err, ErrDrainDeadline)
+	}
+
+	// The next message goes to the next receive, which waits for it however
+	// long it takes.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cm.SendMessage(TestMsg, []byte("after"))
+	}()
+	received := make(chan string)
+	go func() {
+		b, err := m.ReceiveMessage(TestMsg)
+		if err != nil {
+			t.Errorf("ReceiveMessage() after draining = %v", err)
+		}
+		received <- string(b)
+	}()
+	select {
+	case b := <-received:
+		if b != "after" {
+			t.Errorf("ReceiveMessage() after draining = %q, want \"after\"", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DrainMessages() left a read in progress that took the next message")
+	}
+}
+
+func TestDrainMessagesThroughWrappers(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := NewSyncMessager(NewInstrumentedMessager(TLV.Messager(AdaptNetConn(server, server)), nil))
+	cm := TLV.Messager(AdaptNetConn(client, client))
+	go func() {
+		cm.SendMessage(TestMsg, []byte("one"))
+		cm.SendMessage(MsgResults, []byte("two"))
+	}()
+	b, err := DrainMessages(m, MsgResults, 5*time.Second)
+	if err != nil || string(b) != "two" {
+		t.Errorf("DrainMessages() of a wrapped Messager = %q, %v, want \"two\", nil", b, err)
+	}
+	if _, err := DrainMessages(m, MsgResults, 10*time.Millisecond); err != ErrDrainDeadline {
+		t.Errorf("DrainMessages() of a wrapped Messager = %v, want %v", err, ErrDrainDeadline)
+	}
+}
+
+func TestDrainMessagesWithoutDeadlines(t *testing.T) {
+	if _, err := DrainMessages(TLV.Messager(&loopbackConnection{}), MsgResults, time.Second); err == nil {
+		t.Error("DrainMessages() on a connection without read deadlines should fail")
+	}
+}
+
+type taggedMetrics struct {
+	Exported   int
+	unexported int
+	Renamed    string `ndt:"AltName"`
+	Omitted    string `ndt:"-"`
+	EmptyTag   int    `ndt:""`
+	Inner      struct {
+		Kept    int `json:"ignored"`
+		dropped int
+		Gone    int `ndt:"-"`
+	} `ndt:"Nested"`
+	hidden innerMetrics
+}
+
+func TestSendMetricsTags(t *testing.T) {
+	data := &taggedMetrics{
+		Exported:   1,
+		unexported: 2,
+		Renamed:    "three",
+		Omitted:    "four",
+		EmptyTag:   5,
+	}
+	data.Inner.Kept = 6
+	data.Inner.dropped = 7
+	data.Inner.Gone = 8
+	fm := &fakeMessager{}
+	err := SendMetrics(data, fm, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Exported: 1\n",
+		"AltName: three\n",
+		"EmptyTag: 5\n",
+		"Nested.Kept: 6\n",
+	}
+	if !reflect.DeepEqual(fm.sentMessages, want) {
+		t.Errorf("SendMetrics() sent %q, want %q", fm.sentMessages, want)
+	}
+}
+
+func TestChunkedTLVMessages(t *testing.T) {
+	payload := make([]byte, 200*1024)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	for _, size := range []int{0, 10, maxTLVFrameSize - 1, maxTLVFrameSize, 2 * maxTLVFrameSize, len(payload)} {
+		lc := &loopbackConnection{}
+		err := WriteTLVMessageChunked(lc, TestMsg, string(payload[:size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantFrames := size/maxTLVFrameSize + 1; len(lc.frames) != wantFrames {
+			t.Errorf("%d bytes were sent in %d frames, want %d", size, len(lc.frames), wantFrames)
+		}
+		m := TLV.Messager(lc, WithMaxMessageSize(len(payload)), WithChunkedMessages())
+		b, err := m.ReceiveMessage(TestMsg)
+		if err != nil {
+			t.Fatalf("ReceiveMessage() of %d bytes failed: %v", size, err)
+		}
+		if !reflect.DeepEqual(b, payload[:size]) {
+			t.Errorf("ReceiveMessage() of %d bytes returned %d different bytes", size, len(b))
+		}
+		if len(lc.frames) != 0 {
+			t.Errorf("%d frames were left unread", len(lc.frames))
+		}
+	}
+}
+
+func TestChunkedTLVMessageOverNetConnection(t *testing.T) {
+	payload := strings.Repeat("0123456789", 20*1024)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go WriteTLVMessageChunked(AdaptNetConn(client, client), MsgResults, payload)
+	m := TLV.Messager(AdaptNetConn(server, server), WithMaxMessageSize(len(payload)), WithChunkedMessages())
+	b, err := m.ReceiveMessage(MsgResults)
+	if err != nil || string(b) != payload {
+		t.Errorf("ReceiveMessage() = %d bytes, %v; want %d bytes", len(b), err, len(payload))
+	}
+}
+
+func TestChunkedTLVMessageDefaultLimit(t *testing.T) {
+	payload := strings.Repeat("x", 200*1024)
+	lc := &loopbackConnection{}
+	WriteTLVMessageChunked(lc, TestMsg, payload)
+	if b, _, err := ReadTLVMessage(AdaptTLVChunking(lc), TestMsg); err != nil || string(b) != payload {
+		t.Errorf("ReadTLVMessage() = %d bytes, %v; want %d bytes", len(b), err, len(payload))
+	}
+}
+
+func TestFullFrameMessages(t *testing.T) {
+	payload := strings.Repeat("x", maxTLVFrameSize)
+	for _, chunked := range []bool{false, true} {
+		var opts []MessagerOption
+		adapt := func(conn Connection) Connection { return conn }
+		if chunked {
+			opts = []MessagerOption{WithChunkedMessages()}
+			adapt = AdaptTLVChunking
+		}
+		sends := map[string]func(Connection) error{
+			"WriteTLVMessage": func(conn Connection) error {
+				return WriteTLVMessage(adapt(conn), TestMsg, payload)
+			},
+			"SendMessage": func(conn Connection) error {
+				return TLV.Messager(conn, opts...).SendMessage(TestMsg, []byte(payload))
+			},
+			"SendMessageString": func(conn Connection) error {
+				return TLV.Messager(conn, opts...).SendMessageString(TestMsg, payload)
+			},
+			"SendRawFrame": func(conn Connection) error {
+				return TLV.Messager(conn, opts...).(ExtendedMessager).SendRawFrame(TestMsg, []byte(payload))
+			},
+		}
+		if chunked {
+			sends["WriteTLVMessageChunked"] = func(conn Connection) error {
+				return WriteTLVMessageChunked(conn, TestMsg, payload)
+			}
+		}
+		for name, send := range sends {
+			t.Run(fmt.Sprintf("%s/chunked=%v", name, chunked), func(t *testing.T) {
+				client, server := net.Pipe()
+				defer client.Close()
+				defer server.Close()
+				// A message that is not ended waits for the next frame.
+				server.SetReadDeadline(time.Now().Add(5 * time.Second))
+				go func() {
+					conn := AdaptNetConn(client, client)
+					send(conn)
+					WriteTLVMessage(adapt(conn), TestMsg, "next")
+				}()
+				m := TLV.Messager(AdaptNetConn(server, server), opts...)
+				if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != payload {
+					t.Errorf("ReceiveMessage() = %d bytes, %v; want %d bytes", len(b), err, len(payload))
+				}
+				if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "next" {
+					t.Errorf("ReceiveMessage() after a full frame = %q, %v", b, err)
+				}
+			})
+		}
+	}
+}
+
+func TestChunkedMessagesThroughMessager(t *testing.T) {
+	payload := strings.Repeat("0123456789", 20*1024)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sender := TLV.Messager(AdaptNetConn(client, client), WithChunkedMessages())
+	receiver := TLV.Messager(AdaptNetConn(server, server), WithChunkedMessages(), WithMaxMessageSize(2*len(payload)))
+	errs := make(chan error, 1)
+	go func() {
+		if err := sender.SendMessage(TestMsg, []byte(payload)); err != nil {
+			errs <- err
+			return
+		}
+		if err := sender.SendMessageString(MsgResults, payload[:2*maxTLVFrameSize]); err != nil {
+			errs <- err
+			return
+		}
+		errs <- SendMetrics(&struct{ Dump string }{Dump: payload}, sender, "")
+	}()
+	for _, want := range []struct {
+		kind    MessageType
+		payload string
+	}{
+		{TestMsg, payload},
+		{MsgResults, payload[:2*maxTLVFrameSize]},
+		{TestMsg, "Dump: " + payload + "\n"},
+	} {
+		if b, err := receiver.ReceiveMessage(want.kind); err != nil || string(b) != want.payload {
+			t.Fatalf("ReceiveMessage(%v) = %d bytes, %v; want %d bytes", want.kind, len(b), err, len(want.payload))
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("sending = %v", err)
+	}
+
+	// Without the option, the sender refuses such messages.
+	if err := TLV.Messager(AdaptNetConn(client, client)).SendMessage(TestMsg, []byte(payload)); err == nil {
+		t.Error("SendMessage() of a long message without WithChunkedMessages() succeeded")
+	}
+}
+
+func TestChunkedTLVMessageErrors(t *testing.T) {
+	payload := strings.Repeat("x", 200*1024)
+
+	// Reassembly must stop once the message grows past the maximum size.
+	lc := &loopbackConnection{}
+	WriteTLVMessageChunked(lc, TestMsg, payload)
+	m := TLV.Messager(lc, WithMaxMessageSize(100*1024), WithChunkedMessages())
+	if _, err := m.ReceiveMessage(TestMsg); err == nil || !strings.Contains(err.Error(), "maximum message size") {
+		t.Errorf("ReceiveMessage() = %v, want a maximum size error", err)
+	}
+	if len(lc.frames) != 2 {
+		t.Errorf("Reading continued after the maximum size: %d frames left, want 2", len(lc.frames))
+	}
+
+	// The default limit also applies to multi-frame messages.
+	lc = &loopbackConnection{}
+	WriteTLVMessageChunked(lc, TestMsg, strings.Repeat("x", DefaultMaxMessageSize+1))
+	if _, _, err := ReadTLVMessage(AdaptTLVChunking(lc), TestMsg); err == nil {
+		t.Error("ReadTLVMessage() should apply the default maximum message size")
+	}
+
+	// All the frames of a message must have the same type.
+	lc = &loopbackConnection{frames: [][]byte{historicalTLVFrame(TestMsg, []byte(payload[:maxTLVFrameSize]))}}
+	WriteTLVMessage(lc, MsgError, "oops")
+	m = TLV.Messager(lc, WithMaxMessageSize(len(payload)), WithChunkedMessages())
+	if _, err := m.ReceiveMessage(TestMsg); err == nil {
+		t.Error("ReceiveMessage() should reject a continuation of a different type")
+	}
+}
+
+type cyclicMetrics struct {
+	Value int
+	Next  *cyclicMetrics
+}
+
+func TestSendMetricsDepth(t *testing.T) {
+	node := &cyclicMetrics{Value: 1}
+	node.Next = node
+	fm := &fakeMessager{}
+	err := SendMetricsDepth(node, fm, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Value: 1\n",
+		"Next.Value: 1\n",
+		"Next.Next.Value: 1\n",
+		"Next.Next.Next.Value: 1\n",
+	}
+	if len(fm.sentMessages) != len(want)+1 {
+		t.Fatalf("SendMetricsDepth() sent %d messages, want %d", len(fm.sentMessages), len(want)+1)
+	}
+	if !reflect.DeepEqual(fm.sentMessages[:len(want)], want) {
+		t.Errorf("SendMetricsDepth() sent %q, want %q", fm.sentMessages[:len(want)], want)
+	}
+	last := fm.sentMessages[len(want)]
+	if !strings.HasPrefix(last, "Next.Next.Next.Next: {1 0x") {
+		t.Errorf("SendMetricsDepth() sent %q as the depth-limited field", last)
+	}
+
+	// Stringers are still used when the limit is hit.
+	data := struct {
+		Inner struct{ S stringerMetric }
+	}{}
+	data.Inner.S.value = 7
+	fm = &fakeMessager{}
+	err = SendMetricsDepth(data, fm, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Inner: {stringer-7}\n"}; !reflect.DeepEqual(fm.sentMessages, want) {
+		t.Errorf("SendMetricsDepth() sent %q, want %q", fm.sentMessages, want)
+	}
+}
+
+func TestSendMetricsDefaultDepth(t *testing.T) {
+	node := &cyclicMetrics{Value: 2}
+	node.Next = node
+	fm := &fakeMessager{}
+	err := SendMetrics(node, fm, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fm.sentMessages), DefaultMetricsDepth+2; got != want {
+		t.Errorf("SendMetrics() sent %d messages, want %d", got, want)
+	}
+}
+
+// blockingConnection is a Connection whose writes block, like those to a
+// client whose receive window is stuck, until the write deadline passes or
+// release is closed.
+type blockingConnection struct {
+	loopbackConnection
+	deadline time.Time
+	release  chan struct{}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "write timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (bc *blockingConnection) SetWriteDeadline(t time.Time) error {
+	bc.deadline = t
+	return nil
+}
+func (bc *blockingConnection) WriteMessage(messageType int, data []byte) error {
+	var timeout <-chan time.Time
+	if !bc.deadline.IsZero() {
+		timeout = time.After(time.Until(bc.deadline))
+	}
+	select {
+	case <-bc.release:
+		return bc.loopbackConnection.WriteMessage(messageType, data)
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+func TestSetWriteDeadline(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			bc := &blockingConnection{release: make(chan struct{})}
+			m := enc.Messager(bc)
+			err := m.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = m.SendMessage(TestMsg, []byte("stuck"))
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Errorf("SendMessage() = %v, want a timeout", err)
+			}
+			err = m.SendS2CResults(1, 2, 3)
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Errorf("SendS2CResults() = %v, want a timeout", err)
+			}
+
+			// A zero time clears the deadline on the connection.
+			err = m.SetWriteDeadline(time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			close(bc.release)
+			err = m.SendMessage(TestMsg, []byte("unstuck"))
+			if err != nil {
+				t.Errorf("SendMessage() = %v after clearing the deadline", err)
+			}
+			if !bc.deadline.IsZero() {
+				t.Errorf("connection deadline is %v, want it cleared", bc.deadline)
+			}
+		})
+	}
+}
+
+func TestSetWriteDeadlineUnsupported(t *testing.T) {
+	m := JSON.Messager(&loopbackConnection{})
+	if m.SetWriteDeadline(time.Now()) == nil {
+		t.Error("SetWriteDeadline() succeeded on a connection without write deadlines")
+	}
+	if err := m.SetWriteDeadline(time.Time{}); err != nil {
+		t.Errorf("SetWriteDeadline(zero) = %v", err)
+	}
+	if err := m.SendMessage(TestMsg, []byte("hi")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetWriteDeadlineLeavesConnectionAlone(t *testing.T) {
+	// Until SetWriteDeadline is called, deadlines set directly on the
+	// connection must not be overwritten.
+	bc := &blockingConnection{release: make(chan struct{})}
+	close(bc.release)
+	deadline := time.Now().Add(time.Hour)
+	bc.SetWriteDeadline(deadline)
+	m := TLV.Messager(bc)
+	if err := m.SendMessage(TestMsg, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if !bc.deadline.Equal(deadline) {
+		t.Errorf("connection deadline is %v, want %v", bc.deadline, deadline)
+	}
+}
+
+// bufferedConnection holds written frames until it is flushed.
+type bufferedConnection struct {
+	loopbackConnection
+	pending [][]byte
+}
+
+func (bc *bufferedConnection) WriteMessage(_ int, data []byte) error {
+	bc.pending = append(bc.pending, append([]byte{}, data...))
+	return nil
+}
+
+func (bc *bufferedConnection) Flush() error {
+	bc.frames = append(bc.frames, bc.pending...)
+	bc.pending = nil
+	return nil
+}
+
+func TestFlush(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			bc := &bufferedConnection{}
+			m := enc.Messager(bc)
+			if err := m.SendMessage(TestMsg, []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+			if len(bc.frames) != 0 {
+				t.Fatal("the message was written before Flush")
+			}
+			if err := m.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := enc.Messager(bc).ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+				t.Errorf("ReceiveMessage() after Flush = %q, %v", b, err)
+			}
+		})
+	}
+	if err := TLV.Messager(&loopbackConnection{}).Flush(); err != nil {
+		t.Errorf("Flush() on an unbuffered connection = %v", err)
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Encoding
+		wantErr bool
+	}{
+		{in: "JSON", want: JSON},
+		{in: "json", want: JSON},
+		{in: "TLV", want: TLV},
+		{in: "tlv", want: TLV},
+		{in: "Unknown", want: Unknown},
+		{in: "unknown", want: Unknown},
+		{in: "messagepack", want: MessagePack},
+		{in: "cbor", want: CBOR},
+		{in: "", wantErr: true},
+		{in: "xml", wantErr: true},
+		{in: " json", wantErr: true},
+		{in: "Bad Encoding value: 7", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseEncoding(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseEncoding(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseEncoding(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, e := range []Encoding{Unknown, JSON, TLV, MessagePack, CBOR} {
+		if got, err := ParseEncoding(e.String()); err != nil || got != e {
+			t.Errorf("ParseEncoding(%q) = %v, %v; want %v", e.String(), got, err, e)
+		}
+	}
+}
+
+func TestS2CResultChecksum(t *testing.T) {
+	r := S2CResult{ThroughputKbps: 94123, UnsentBytes: 12, TotalSentBytes: 117653750}
+	sum := crc32.ChecksumIEEE([]byte("94123 12 117653750"))
+	lc := &loopbackConnection{}
+	TLV.Messager(lc, WithS2CChecksum()).SendS2CResults(r.ThroughputKbps, r.UnsentBytes, r.TotalSentBytes)
+	JSON.Messager(lc, WithS2CChecksum()).SendS2CResults(r.ThroughputKbps, r.UnsentBytes, r.TotalSentBytes)
+	want := [][]byte{
+		historicalTLVFrame(TestMsg, []byte(fmt.Sprintf("94123 12 117653750 %d", sum))),
+		historicalTLVFrame(TestMsg, []byte(fmt.Sprintf(
+			`{"ThroughputValue":"94123","UnsentDataAmount":"12","TotalSentByte":"117653750","Checksum":"%d"}`, sum))),
+	}
+	if !reflect.DeepEqual(lc.frames, want) {
+		t.Errorf("SendS2CResults() frames = %q, want %q", lc.frames, want)
+	}
+}
+
+func TestReceiveS2CResults(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		for _, checksum := range []bool{false, true} {
+			var opts []MessagerOption
+			if checksum {
+				opts = append(opts, WithS2CChecksum())
+			}
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc, opts...)
+			err := m.SendS2CResults(94123, 12, 117653750)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The receiver verifies checksums whether or not it sends them.
+			throughput, unsent, total, err := ReceiveS2CResults(enc.Messager(lc))
+			if err != nil || throughput != 94123 || unsent != 12 || total != 117653750 {
+				t.Errorf("%v, checksum %v: ReceiveS2CResults() = %d, %d, %d, %v",
+					enc, checksum, throughput, unsent, total, err)
+			}
+		}
+	}
+}
+
+func TestSendS2CComplete(t *testing.T) {
+	for _, tt := range []struct {
+		enc  Encoding
+		want []byte
+	}{
+		{TLV, []byte{byte(TestFinalize), 0, 0}},
+		{JSON, append([]byte{byte(TestFinalize), 0, 10}, `{"msg":""}`...)},
+		{MessagePack, nil},
+		{CBOR, nil},
+	} {
+		lc := &loopbackConnection{}
+		if err := SendS2CComplete(tt.enc.Messager(lc)); err != nil {
+			t.Fatalf("%v: SendS2CComplete() = %v", tt.enc, err)
+		}
+		if len(lc.frames) != 1 || (tt.want != nil && !bytes.Equal(lc.frames[0], tt.want)) {
+			t.Errorf("%v: SendS2CComplete() sent %q, want %q", tt.enc, lc.frames, tt.want)
+		}
+		if b, err := tt.enc.Messager(lc).ReceiveMessage(TestFinalize); err != nil || len(b) != 0 {
+			t.Errorf("%v: ReceiveMessage(TestFinalize) = %q, %v, want an empty message", tt.enc, b, err)
+		}
+	}
+}
+
+func TestReceiveS2CResultsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		enc     Encoding
+		payload string
+		wantErr error
+	}{
+		{name: "tlv-bad-checksum", enc: TLV, payload: "1 2 3 4", wantErr: ErrS2CChecksum},
+		{name: "json-bad-checksum", enc: JSON, wantErr: ErrS2CChecksum,
+			payload: `{"ThroughputValue":"1","UnsentDataAmount":"2","TotalSentByte":"3","Checksum":"4"}`},
+		{name: "tlv-too-few", enc: TLV, payload: "1 2"},
+		{name: "tlv-too-many", enc: TLV, payload: "1 2 3 4 5"},
+		{name: "tlv-not-a-number", enc: TLV, payload: "1 two 3"},
+		{name: "tlv-checksum-overflow", enc: TLV, payload: "1 2 3 4294967296"},
+		{name: "json-not-a-number", enc: JSON,
+			payload: `{"ThroughputValue":"1","UnsentDataAmount":"","TotalSentByte":"3"}`},
+		{name: "json-malformed", enc: JSON, payload: `{"ThroughputValue":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &loopbackConnection{}
+			WriteTLVMessage(lc, TestMsg, tt.payload)
+			_, _, _, err := ReceiveS2CResults(tt.enc.Messager(lc))
+			if err == nil || (tt.wantErr != nil && err != tt.wantErr) {
+				t.Errorf("ReceiveS2CResults(%q) = %v, want %v", tt.payload, err, tt.wantErr)
+			}
+		})
+	}
+	if _, _, _, err := ReceiveS2CResults(NewNopMessager(JSON)); err == nil {
+		t.Error("ReceiveS2CResults() succeeded on a Messager that cannot receive results")
+	}
+}
+
+func TestUnexpectedMessageError(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc)
+			err := m.SendMessage(MsgError, []byte("server is busy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = m.ReceiveMessage(TestMsg)
+			var ue *UnexpectedMessageError
+			if !errors.As(err, &ue) {
+				t.Fatalf("ReceiveMessage() = %v, want an *UnexpectedMessageError", err)
+			}
+			if ue.Expected != TestMsg || ue.Got != MsgError || string(ue.Payload) != "server is busy" {
+				t.Errorf("ReceiveMessage() = %+v", ue)
+			}
+		})
+	}
+}
+
+func TestUnexpectedMessageErrorRawPayload(t *testing.T) {
+	// A JSON messager falls back to the raw payload when it is not JSON.
+	lc := &loopbackConnection{}
+	WriteTLVMessage(lc, MsgLogout, "not json")
+	_, err := JSON.Messager(lc).ReceiveMessage(TestMsg)
+	ue, ok := err.(*UnexpectedMessageError)
+	if !ok || string(ue.Payload) != "not json" {
+		t.Errorf("ReceiveMessage() = %v, want an *UnexpectedMessageError with the raw payload", err)
+	}
+	WriteTLVMessage(lc, MsgLogout, "bye")
+	_, _, err = ReadTLVMessage(lc, TestMsg, MsgResults)
+	ue, ok = err.(*UnexpectedMessageError)
+	if !ok || ue.Expected != TestMsg || !reflect.DeepEqual(ue.ExpectedOneOf, []MessageType{TestMsg, MsgResults}) {
+		t.Errorf("ReadTLVMessage() with two expected types = %v", err)
+	}
+	WriteTLVMessage(lc, MsgLogout, "bye")
+	if _, _, err = ReadTLVMessage(lc); err == nil {
+		t.Error("ReadTLVMessage() with no expected types succeeded")
+	}
+}
+
+func TestReceiveOneOf(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc)
+			m.SendMessage(MsgError, []byte("test aborted"))
+			m.SendMessage(MsgResults, []byte("results"))
+			m.SendMessage(MsgLogout, []byte("bye"))
+
+			kind, b, err := m.ReceiveOneOf(MsgResults, MsgError)
+			if err != nil || kind != MsgError || string(b) != "test aborted" {
+				t.Errorf("ReceiveOneOf() = %v, %q, %v", kind, b, err)
+			}
+			kind, b, err = m.ReceiveOneOf(MsgResults, MsgError)
+			if err != nil || kind != MsgResults || string(b) != "results" {
+				t.Errorf("ReceiveOneOf() = %v, %q, %v", kind, b, err)
+			}
+			kind, _, err = m.ReceiveOneOf(MsgResults, MsgError)
+			ue, ok := err.(*UnexpectedMessageError)
+			if !ok || kind != MsgLogout {
+				t.Fatalf("ReceiveOneOf() = %v, %v, want an *UnexpectedMessageError", kind, err)
+			}
+			want := &UnexpectedMessageError{
+				Expected:      MsgResults,
+				ExpectedOneOf: []MessageType{MsgResults, MsgError},
+				Got:           MsgLogout,
+				Payload:       []byte("bye"),
+			}
+			if !reflect.DeepEqual(ue, want) {
+				t.Errorf("ReceiveOneOf() error = %+v, want %+v", ue, want)
+			}
+		})
+	}
+}
+
+func TestSendRawFrame(t *testing.T) {
+	tests := []struct {
+		enc  Encoding
+		raw  string
+		want string
+	}{
+		{enc: TLV, raw: "\x00\xffnot text", want: "\x00\xffnot text"},
+		{enc: TLV, raw: "", want: ""},
+		{enc: JSON, raw: `unescaped " quote \u12`, want: `{"msg":"unescaped " quote \u12"}`},
+		{enc: JSON, raw: "", want: `{"msg":""}`},
+		{enc: MessagePack, raw: "\xc0", want: "\x81\xa3msg\xc0"},
+	}
+	for _, tt := range tests {
+		lc := &loopbackConnection{}
+		m := tt.enc.Messager(lc).(ExtendedMessager)
+		err := m.SendRawFrame(MsgLogin, []byte(tt.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]byte{historicalTLVFrame(MsgLogin, []byte(tt.want))}
+		if !reflect.DeepEqual(lc.frames, want) {
+			t.Errorf("%v: SendRawFrame(%q) sent %q, want %q", tt.enc, tt.raw, lc.frames, want)
+		}
+	}
+	// Frames that do not fit are rejected rather than sent with a bad length.
+	lc := &loopbackConnection{}
+	if err := TLV.Messager(lc).(ExtendedMessager).SendRawFrame(TestMsg, make([]byte, maxTLVFrameSize+1)); err == nil {
+		t.Error("SendRawFrame() accepted a frame that is too long")
+	}
+	if err := JSON.Messager(lc).(ExtendedMessager).SendRawFrame(TestMsg, make([]byte, maxTLVFrameSize-5)); err == nil {
+		t.Error("SendRawFrame() accepted a frame whose envelope makes it too long")
+	}
+	if len(lc.frames) != 0 {
+		t.Errorf("%d frames were sent", len(lc.frames))
+	}
+}
+
+func TestMessagerE(t *testing.T) {
+	for _, enc := range []Encoding{Unknown, Encoding(-1), Encoding(99)} {
+		m, err := enc.MessagerE(&loopbackConnection{})
+		if err == nil || m != nil {
+			t.Errorf("%v.MessagerE() = %v, %v, want an error", enc, m, err)
+		}
+		if m := enc.Messager(&loopbackConnection{}); m != nil {
+			t.Errorf("%v.Messager() = %v, want nil", enc, m)
+		}
+	}
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		m, err := enc.MessagerE(&loopbackConnection{})
+		if err != nil || m == nil || m.Encoding() != enc {
+			t.Errorf("%v.MessagerE() = %v, %v", enc, m, err)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		lc := &loopbackConnection{}
+		// The options wrap the connection, but Conn returns it unwrapped.
+		m := enc.Messager(lc, WithSequenceNumbers(), WithByteCounts()).(ExtendedMessager)
+		if got := m.Conn(); got != lc {
+			t.Errorf("%v: Conn() = %v, want the connection passed to Messager()", enc, got)
+		}
+		other := &loopbackConnection{}
+		m.(ExtendedMessager).Reset(other)
+		if got := m.Conn(); got != other {
+			t.Errorf("%v: Conn() after Reset() = %v, want the new connection", enc, got)
+		}
+	}
+	lc := &loopbackConnection{}
+	if got := NewTLVMessager(lc).(ExtendedMessager).Conn(); got != lc {
+		t.Errorf("NewTLVMessager().Conn() = %v, want the connection passed to it", got)
+	}
+}
+
+func TestTypedConstructors(t *testing.T) {
+	for _, tt := range []struct {
+		enc Encoding
+		new func(Connection) Messager
+	}{
+		{JSON, NewJSONMessager},
+		{TLV, NewTLVMessager},
+	} {
+		lc := &loopbackConnection{}
+		m := tt.new(lc)
+		if m.Encoding() != tt.enc {
+			t.Errorf("Encoding() = %v, want %v", m.Encoding(), tt.enc)
+		}
+		// The Messager interoperates with one from the factory.
+		if err := m.SendMessage(TestMsg, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := tt.enc.Messager(lc).ReceiveMessage(TestMsg); err != nil || string(b) != "hello" {
+			t.Errorf("%v: ReceiveMessage() = %q, %v, want \"hello\"", tt.enc, b, err)
+		}
+	}
+}
+
+type sliceMetrics struct {
+	Samples []int64
+	Labels  [2]string
+	Empty   []float64
+	Flows   []struct {
+		ID    int
+		Bytes uint32
+	}
+}
+
+func TestSendMetricsSlices(t *testing.T) {
+	data := &sliceMetrics{
+		Samples: []int64{12, 34, 56},
+		Labels:  [2]string{"a", "b c"},
+		Empty:   []float64{},
+	}
+	data.Flows = append(data.Flows, struct {
+		ID    int
+		Bytes uint32
+	}{ID: 1, Bytes: 100})
+	tests := []struct {
+		name string
+		opts []MetricsOption
+		want []string
+	}{
+		{
+			name: "per-element",
+			want: []string{
+				"Samples[0]: 12\n", "Samples[1]: 34\n", "Samples[2]: 56\n",
+				"Labels[0]: a\n", "Labels[1]: b c\n",
+				"Flows[0].ID: 1\n", "Flows[0].Bytes: 100\n",
+			},
+		},
+		{
+			name: "joined",
+			opts: []MetricsOption{WithJoinedSlices()},
+			want: []string{
+				"Samples: 12,34,56\n",
+				"Labels: a,b c\n",
+				"Empty: \n",
+				"Flows[0].ID: 1\n", "Flows[0].Bytes: 100\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm := &fakeMessager{}
+			err := SendMetricsWithOptions(data, fm, "", tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fm.sentMessages, tt.want) {
+				t.Errorf("SendMetricsWithOptions() sent %q, want %q", fm.sentMessages, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMetricsSliceErrors(t *testing.T) {
+	data := &sliceMetrics{Samples: []int64{1, 2, 3}}
+	fm := &fakeMessager{errorAfter: 2}
+	if err := SendMetrics(data, fm, ""); err == nil {
+		t.Error("SendMetrics() should return the send error")
+	}
+	if len(fm.sentMessages) != 2 {
+		t.Errorf("SendMetrics() kept sending after an error: %q", fm.sentMessages)
+	}
+}
+
+type timeMetrics struct {
+	RTT   time.Duration
+	Start time.Time
+	End   *time.Time
+}
+
+func TestSendMetricsTimes(t *testing.T) {
+	// time.Now includes a monotonic clock reading, which must not be sent.
+	start := time.Now()
+	start = start.Add(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC).Sub(start))
+	end := time.Date(2019, 3, 4, 5, 6, 8, 500000000, time.UTC)
+	data := &timeMetrics{RTT: 1500 * time.Microsecond, Start: start, End: &end}
+	tests := []struct {
+		name string
+		opts []MetricsOption
+		want []string
+	}{
+		{
+			name: "rfc3339",
+			want: []string{"RTT: 1.5ms\n", "Start: 2019-03-04T05:06:07Z\n", "End: 2019-03-04T05:06:08Z\n"},
+		},
+		{
+			name: "unix-millis",
+			opts: []MetricsOption{WithUnixMillis()},
+			want: []string{"RTT: 1.5ms\n", "Start: 1551675967000\n", "End: 1551675968500\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm := &fakeMessager{}
+			if err := SendMetricsWithOptions(data, fm, "", tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fm.sentMessages, tt.want) {
+				t.Errorf("SendMetricsWithOptions() sent %q, want %q", fm.sentMessages, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageMeta(t *testing.T) {
+	chunked := strings.Repeat("x", 70000)
+	tests := []struct {
+		name     string
+		enc      Encoding
+		kind     MessageType
+		payload  string
+		wantLen  int
+		wantType MessageType
+		wantErr  bool
+	}{
+		{name: "tlv", enc: TLV, kind: TestMsg, payload: "12345", wantLen: 5, wantType: TestMsg},
+		{name: "tlv-empty", enc: TLV, kind: TestMsg, payload: "", wantLen: 0, wantType: TestMsg},
+		{name: "tlv-chunked", enc: TLV, kind: TestMsg, payload: chunked, wantLen: 70000, wantType: TestMsg},
+		{name: "tlv-wrong-type", enc: TLV, kind: MsgError, payload: "oops", wantLen: 4, wantType: MsgError, wantErr: true},
+		{name: "json", enc: JSON, kind: TestMsg, payload: "12345", wantLen: len(`{"msg":"12345"}`), wantType: TestMsg},
+		{name: "json-wrong-type", enc: JSON, kind: MsgError, payload: "oops", wantLen: len(`{"msg":"oops"}`), wantType: MsgError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := tt.enc.Messager(lc, WithMaxMessageSize(1<<20), WithChunkedMessages())
+			if tt.enc == TLV {
+				WriteTLVMessageChunked(lc, tt.kind, tt.payload)
+			} else {
+				m.SendMessage(tt.kind, []byte(tt.payload))
+			}
+			b, kind, declaredLen, err := m.(ExtendedMessager).ReceiveMessageMeta(TestMsg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReceiveMessageMeta() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if kind != tt.wantType || declaredLen != tt.wantLen {
+				t.Errorf("ReceiveMessageMeta() = %v, %d, want %v, %d", kind, declaredLen, tt.wantType, tt.wantLen)
+			}
+			if !tt.wantErr && string(b) != tt.payload {
+				t.Errorf("ReceiveMessageMeta() payload = %q, want %q", b, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageMetaLengthMismatch(t *testing.T) {
+	// The declared length is reported even when it does not match the data.
+	lc := &loopbackConnection{frames: [][]byte{{byte(TestMsg), 0, 10, 'a', 'b'}}}
+	_, kind, declaredLen, err := TLV.Messager(lc).(ExtendedMessager).ReceiveMessageMeta(TestMsg)
+	if err == nil || kind != TestMsg || declaredLen != 10 {
+		t.Errorf("ReceiveMessageMeta() = %v, %d, %v, want TestMsg, 10, and an error", kind, declaredLen, err)
+	}
+}
+
+func TestReadBudget(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			sender := enc.Messager(lc)
+			for i := 0; i < 4; i++ {
+				sender.SendMessage(TestMsg, []byte("12345"))
+			}
+			frameLen := int64(len(lc.frames[0]))
+			// The budget allows exactly two messages, so the third crosses it.
+			m := enc.Messager(lc, WithReadBudget(2*frameLen))
+			for i := 0; i < 2; i++ {
+				if _, err := m.ReceiveMessage(TestMsg); err != nil {
+					t.Fatalf("ReceiveMessage() #%d = %v", i, err)
+				}
+			}
+			_, err := m.ReceiveMessage(TestMsg)
+			be, ok := err.(*BudgetExceededError)
+			if !ok || be.Budget != 2*frameLen || be.Read != 3*frameLen {
+				t.Fatalf("ReceiveMessage() = %v, want a *BudgetExceededError", err)
+			}
+			// Once the budget is exceeded, nothing more is read.
+			if _, _, err := m.ReceiveAnyMessage(); err == nil {
+				t.Error("ReceiveAnyMessage() succeeded after the budget was exceeded")
+			}
+			if len(lc.frames) != 1 {
+				t.Errorf("%d frames left unread, want 1", len(lc.frames))
+			}
+		})
+	}
+}
+
+func TestReadBudgetCountsSkippedKeepalives(t *testing.T) {
+	lc := &loopbackConnection{}
+	for i := 0; i < 10; i++ {
+		WriteTLVMessage(lc, MsgKeepalive, "")
+	}
+	WriteTLVMessage(lc, TestMsg, "x")
+	_, err := TLV.Messager(lc, WithReadBudget(15)).ReceiveMessage(TestMsg)
+	if _, ok := err.(*BudgetExceededError); !ok {
+		t.Errorf("ReceiveMessage() = %v, want a *BudgetExceededError", err)
+	}
+}
+
+func TestSendMessageString(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		viaBytes := &loopbackConnection{}
+		viaString := &loopbackConnection{}
+		for _, msg := range []string{"", "MaxRTT: 12345\n", `"quoted"`} {
+			enc.Messager(viaBytes).SendMessage(TestMsg, []byte(msg))
+			if err := enc.Messager(viaString).SendMessageString(TestMsg, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(viaString.frames, viaBytes.frames) {
+			t.Errorf("%v: SendMessageString() sent %q, want %q", enc, viaString.frames, viaBytes.frames)
+		}
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "unknown key", json: `{"msg": "hi", "extra": 1}`},
+		{name: "duplicate key", json: `{"msg": "hi", "msg": "hi"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := historicalTLVFrame(TestMsg, []byte(tt.json))
+			lenient := JSON.Messager(&loopbackConnection{frames: [][]byte{frame, frame}})
+			if b, err := lenient.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+				t.Errorf("ReceiveMessage() = %q, %v", b, err)
+			}
+			if _, b, err := lenient.ReceiveAnyMessage(); err != nil || string(b) != "hi" {
+				t.Errorf("ReceiveAnyMessage() = %q, %v", b, err)
+			}
+
+			strict := JSON.Messager(&loopbackConnection{frames: [][]byte{frame, frame}}, WithStrictJSON())
+			if _, err := strict.ReceiveMessage(TestMsg); err == nil {
+				t.Error("ReceiveMessage() succeeded in strict mode")
+			}
+			if _, _, err := strict.ReceiveAnyMessage(); err == nil {
+				t.Error("ReceiveAnyMessage() succeeded in strict mode")
+			}
+		})
+	}
+	strict := JSON.Messager(&loopbackConnection{frames: [][]byte{historicalTLVFrame(TestMsg, []byte(`{"msg": "hi", "tests": "4"}`))}}, WithStrictJSON())
+	if b, err := strict.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() of a valid message in strict mode = %q, %v", b, err)
+	}
+}
+
+func TestUTF8Validation(t *testing.T) {
+	frame := historicalTLVFrame(TestMsg, []byte("{\"msg\": \"a\xff\xfeb\"}"))
+	tests := []struct {
+		name string
+		opts []MessagerOption
+		want string
+	}{
+		{name: "unchecked", want: "a\ufffd\ufffdb"},
+		{name: "replace", opts: []MessagerOption{WithUTF8Validation(UTF8Replace)}, want: "a\ufffdb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := JSON.Messager(&loopbackConnection{frames: [][]byte{frame, frame}}, tt.opts...)
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != tt.want {
+				t.Errorf("ReceiveMessage() = %q, %v, want %q", b, err, tt.want)
+			}
+			if _, b, err := m.ReceiveAnyMessage(); err != nil || string(b) != tt.want {
+				t.Errorf("ReceiveAnyMessage() = %q, %v, want %q", b, err, tt.want)
+			}
+		})
+	}
+	t.Run("reject", func(t *testing.T) {
+		m := JSON.Messager(&loopbackConnection{frames: [][]byte{frame, frame}}, WithUTF8Validation(UTF8Reject))
+		_, err := m.ReceiveMessage(TestMsg)
+		var ue *InvalidUTF8Error
+		if !errors.As(err, &ue) || ue.Offset != 10 {
+			t.Errorf("ReceiveMessage() error = %v, want an *InvalidUTF8Error at byte 10", err)
+		}
+		var v JSONMessage
+		if err := m.(ExtendedMessager).ReceiveMessageInto(TestMsg, &v); !errors.As(err, &ue) {
+			t.Errorf("ReceiveMessageInto() error = %v, want an *InvalidUTF8Error", err)
+		}
+	})
+	valid := JSON.Messager(&loopbackConnection{frames: [][]byte{historicalTLVFrame(TestMsg, []byte(`{"msg": "h\u00e9"}`))}}, WithUTF8Validation(UTF8Reject))
+	if b, err := valid.ReceiveMessage(TestMsg); err != nil || string(b) != "h\u00e9" {
+		t.Errorf("ReceiveMessage() of a valid message = %q, %v", b, err)
+	}
+}
+
+func TestReceiveMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		opts    []MessagerOption
+		want    []string
+		wantErr bool
+	}{
+		{name: "one", payload: `{"msg":"one"}`, want: []string{"one"}},
+		{name: "two", payload: `{"msg":"one"}{"msg":"two"}`, want: []string{"one", "two"}},
+		{name: "whitespace", payload: "{\"msg\":\"one\"}\n {\"msg\":\"two\",\"tests\":\"16\"}\n", want: []string{"one", "two"}},
+		{name: "empty", payload: ``, wantErr: true},
+		{name: "trailing garbage", payload: `{"msg":"one"}x`, wantErr: true},
+		{name: "truncated", payload: `{"msg":"one"}{"msg":`, wantErr: true},
+		{name: "strict", payload: `{"msg":"one"}{"msg":"two","extra":1}`, opts: []MessagerOption{WithStrictJSON()}, wantErr: true},
+		{name: "strict duplicate", payload: `{"msg":"one"}{"msg":"two","msg":"three"}`, opts: []MessagerOption{WithStrictJSON()}, wantErr: true},
+		{name: "not strict", payload: `{"msg":"one"}{"msg":"two","extra":1}`, want: []string{"one", "two"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &loopbackConnection{}
+			WriteTLVMessage(lc, TestMsg, tt.payload)
+			m := JSON.Messager(lc, tt.opts...).(ExtendedMessager)
+			msgs, err := m.ReceiveMessages(TestMsg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ReceiveMessages() = %q, want an error", msgs)
+				}
+				return
+			}
+			var got []string
+			for _, b := range msgs {
+				got = append(got, string(b))
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReceiveMessages() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	lc := &loopbackConnection{}
+	WriteTLVMessage(lc, MsgLogin, `{"msg":"one"}{"msg":"two"}`)
+	if _, err := JSON.Messager(lc).(ExtendedMessager).ReceiveMessages(TestMsg); err == nil {
+		t.Error("ReceiveMessages() of the wrong type succeeded")
+	}
+	for _, enc := range []Encoding{TLV, MessagePack, CBOR} {
+		if _, err := enc.Messager(lc).(ExtendedMessager).ReceiveMessages(MsgLogin); err != ErrJSONUnsupported {
+			t.Errorf("ReceiveMessages() of the %v Messager = %v, want ErrJSONUnsupported", enc, err)
+		}
+	}
+}
+
+func TestReceiveMessageInto(t *testing.T) {
+	type login struct {
+		Msg   string `json:"msg"`
+		Tests string `json:"tests"`
+	}
+	want := login{Msg: "v5.0", Tests: "22"}
+	for _, enc := range []Encoding{JSON, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			var b []byte
+			var err error
+			if enc == JSON {
+				b, err = json.Marshal(&JSONMessage{Msg: "v5.0", Tests: "22"})
+			} else {
+				b, err = encodeMsgpack(&JSONMessage{Msg: "v5.0", Tests: "22"})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			lc := &loopbackConnection{frames: [][]byte{historicalTLVFrame(MsgExtendedLogin, b)}}
+			var got login
+			err = enc.Messager(lc).(ExtendedMessager).ReceiveMessageInto(MsgExtendedLogin, &got)
+			if err != nil || got != want {
+				t.Errorf("ReceiveMessageInto() = %+v, %v, want %+v", got, err, want)
+			}
+		})
+	}
+	lc := &loopbackConnection{frames: [][]byte{historicalTLVFrame(MsgExtendedLogin, []byte("v5.0"))}}
+	var got login
+	if err := TLV.Messager(lc).(ExtendedMessager).ReceiveMessageInto(MsgExtendedLogin, &got); err != ErrNoObjectModel {
+		t.Errorf("ReceiveMessageInto() for TLV = %v, want ErrNoObjectModel", err)
+	}
+}
+
+// jsonOnlyConnection is a loopbackConnection with a fixed JSON encoding, like
+// the WS and WSS connections.
+type jsonOnlyConnection struct {
+	loopbackConnection
+}
+
+func (jc *jsonOnlyConnection) Encoding() Encoding { return JSON }
+
+func TestDetectEncoding(t *testing.T) {
+	jsonLogin := []byte(`{"msg": "v5.0", "tests": "22"}`)
+	tests := []struct {
+		name    string
+		conn    Connection
+		want    Encoding
+		payload []byte
+		wantErr bool
+	}{
+		{
+			name:    "MsgLogin",
+			conn:    &loopbackConnection{frames: [][]byte{historicalTLVFrame(MsgLogin, []byte{22})}},
+			want:    TLV,
+			payload: []byte{22},
+		},
+		{
+			name:    "MsgExtendedLogin",
+			conn:    &loopbackConnection{frames: [][]byte{historicalTLVFrame(MsgExtendedLogin, jsonLogin)}},
+			want:    JSON,
+			payload: jsonLogin,
+		},
+		{
+			name:    "ws-MsgExtendedLogin",
+			conn:    &jsonOnlyConnection{loopbackConnection{frames: [][]byte{historicalTLVFrame(MsgExtendedLogin, jsonLogin)}}},
+			want:    JSON,
+			payload: jsonLogin,
+		},
+		{
+			name:    "ws-MsgLogin",
+			conn:    &jsonOnlyConnection{loopbackConnection{frames: [][]byte{historicalTLVFrame(MsgLogin, []byte{22})}}},
+			wantErr: true,
+		},
+		{
+			name:    "wrong-type",
+			conn:    &loopbackConnection{frames: [][]byte{historicalTLVFrame(TestMsg, []byte("hi"))}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, b, err := DetectEncoding(tt.conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetectEncoding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if enc != tt.want || !bytes.Equal(b, tt.payload) {
+				t.Errorf("DetectEncoding() = %v, %q, want %v, %q", enc, b, tt.want, tt.payload)
+			}
+		})
+	}
+}
+
+func TestSendMessageTooLong(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc)
+			huge := strings.Repeat("x", maxTLVFrameSize+1)
+			for _, err := range []error{m.SendMessage(TestMsg, []byte(huge)), m.SendMessageString(TestMsg, huge)} {
+				if te, ok := err.(*MessageTooLongError); !ok || te.Size != len(huge) || te.Type != TestMsg {
+					t.Errorf("sending %d bytes returned %v, want a *MessageTooLongError", len(huge), err)
+				}
+			}
+			// A message that fits on its own may still be too long once
+			// encoded.
+			if enc != TLV {
+				err := m.SendMessageString(TestMsg, huge[:maxTLVFrameSize])
+				if _, ok := err.(*MessageTooLongError); !ok {
+					t.Errorf("sending an encoded message that is too long returned %v", err)
+				}
+			}
+			if len(lc.frames) != 0 {
+				t.Errorf("%d frames were sent", len(lc.frames))
+			}
+		})
+	}
+}
+
+func TestPeek(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			sender := enc.Messager(lc)
+			sender.SendMessage(MsgLogin, []byte("v5.0"))
+			sender.SendMessage(TestMsg, []byte("rate"))
+
+			m := enc.Messager(lc).(ExtendedMessager)
+			for i := 0; i < 2; i++ {
+				if kind, err := m.Peek(); err != nil || kind != MsgLogin {
+					t.Fatalf("Peek() = %v, %v, want MsgLogin", kind, err)
+				}
+			}
+			if len(lc.frames) != 1 {
+				t.Errorf("Peek() read %d messages, want 1", 2-len(lc.frames))
+			}
+			if b, err := m.ReceiveMessage(MsgLogin); err != nil || string(b) != "v5.0" {
+				t.Errorf("ReceiveMessage() after Peek() = %q, %v", b, err)
+			}
+			if kind, err := m.Peek(); err != nil || kind != TestMsg {
+				t.Fatalf("Peek() = %v, %v, want TestMsg", kind, err)
+			}
+			if kind, b, err := m.ReceiveAnyMessage(); err != nil || kind != TestMsg || string(b) != "rate" {
+				t.Errorf("ReceiveAnyMessage() after Peek() = %v, %q, %v", kind, b, err)
+			}
+			if _, err := m.Peek(); err != io.EOF {
+				t.Errorf("Peek() at the end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestHasBuffered(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			sender := enc.Messager(lc)
+			sender.SendMessage(TestMsg, []byte("one"))
+			sender.SendMessage(TestMsg, []byte("two"))
+
+			m := enc.Messager(lc).(ExtendedMessager)
+			if m.HasBuffered() {
+				t.Error("HasBuffered() before Peek() = true")
+			}
+			if _, err := m.Peek(); err != nil {
+				t.Fatal(err)
+			}
+			if !m.HasBuffered() {
+				t.Error("HasBuffered() after Peek() = false")
+			}
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "one" {
+				t.Errorf("ReceiveMessage() = %q, %v, want \"one\"", b, err)
+			}
+			if m.HasBuffered() {
+				t.Error("HasBuffered() after receiving the peeked message = true")
+			}
+			// Receiving without peeking buffers nothing.
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "two" {
+				t.Errorf("ReceiveMessage() = %q, %v, want \"two\"", b, err)
+			}
+			if m.HasBuffered() {
+				t.Error("HasBuffered() after ReceiveMessage() = true")
+			}
+			// A failed peek leaves nothing behind.
+			if _, err := m.Peek(); err != io.EOF {
+				t.Errorf("Peek() at the end = %v, want io.EOF", err)
+			}
+			if m.HasBuffered() {
+				t.Error("HasBuffered() after a failed Peek() = true")
+			}
+		})
+	}
+}
+
+// closeCountingConnection is a loopbackConnection that counts calls to Close.
+type closeCountingConnection struct {
+	loopbackConnection
+	closes int
+}
+
+func (cc *closeCountingConnection) Close() error {
+	cc.closes++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			cc := &closeCountingConnection{}
+			m := enc.Messager(cc)
+			for i := 0; i < 2; i++ {
+				if err := m.Close(); err != nil {
+					t.Errorf("Close() #%d = %v", i+1, err)
+				}
+			}
+			if cc.closes != 1 || len(cc.frames) != 0 {
+				t.Errorf("Close() twice closed the connection %d times and sent %d frames", cc.closes, len(cc.frames))
+			}
+
+			cc = &closeCountingConnection{}
+			m = enc.Messager(cc, WithLogoutOnClose())
+			m.Close()
+			m.Close()
+			if cc.closes != 1 {
+				t.Errorf("Close() twice closed the connection %d times", cc.closes)
+			}
+			if _, err := enc.Messager(&cc.loopbackConnection).ReceiveMessage(MsgLogout); err != nil || len(cc.frames) != 0 {
+				t.Errorf("Close() did not send exactly one MsgLogout: %v, %d frames left", err, len(cc.frames))
+			}
+		})
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := JSON.Messager(lc).(ExtendedMessager)
+	raw := json.RawMessage(`{"MinRTT": 3, "Flows": [1, 2]}`)
+	if err := m.SendJSON(MsgResults, raw); err != nil {
+		t.Fatal(err)
+	}
+	want := historicalTLVFrame(MsgResults, []byte(`{"msg":{"MinRTT": 3, "Flows": [1, 2]}}`))
+	if !bytes.Equal(lc.frames[0], want) {
+		t.Errorf("SendJSON() sent %q, want %q", lc.frames[0], want)
+	}
+
+	var got struct {
+		Msg struct {
+			MinRTT int
+			Flows  []int
+		} `json:"msg"`
+	}
+	if err := JSON.Messager(lc).(ExtendedMessager).ReceiveMessageInto(MsgResults, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Msg.MinRTT != 3 || !reflect.DeepEqual(got.Msg.Flows, []int{1, 2}) {
+		t.Errorf("ReceiveMessageInto() = %+v", got)
+	}
+
+	if err := m.SendJSON(MsgResults, json.RawMessage(`{"MinRTT": `)); err == nil {
+		t.Error("SendJSON() of invalid JSON succeeded")
+	}
+	if len(lc.frames) != 0 {
+		t.Errorf("invalid JSON was sent: %q", lc.frames)
+	}
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+)
+
+// MessagerConn adapts a Messager into an io.ReadWriter, so that code written
+// for byte streams can be run over the control channel. Each Write is sent as
+// a single TestMsg, and Read returns the contents of the TestMsg messages
+// received, in order. A MessagerConn is not safe for concurrent reads.
+type MessagerConn struct {
+	m Messager
+	// unread is what is left of the last message received.
+	unread []byte
+}
+
+// NewMessagerConn creates a MessagerConn that sends and receives through m.
+func NewMessagerConn(m Messager) *MessagerConn {
+	return &MessagerConn{m: m}
+}
+
+// Write sends p as a single TestMsg. Writing nothing sends nothing, and p must
+// fit in a single message, or a *MessageTooLongError is returned.
+func (c *MessagerConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := c.m.SendMessage(TestMsg, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read fills p with the contents of the next TestMsg, keeping whatever does
+// not fit to be returned by the following reads. Empty messages are skipped.
+// It returns io.EOF once the peer has closed the connection between messages.
+func (c *MessagerConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(c.unread) == 0 {
+		msg, err := c.m.ReceiveMessage(TestMsg)
+		if errors.Is(err, io.EOF) {
+			// io.Reader requires io.EOF itself, not an error wrapping it.
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.unread = msg
+	}
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestMessagerConn(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			w := NewMessagerConn(enc.Messager(lc))
+			writes := []string{"hello", "", " world", ", ünïcode"}
+			for _, s := range writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			// Every non-empty write is sent as a single message.
+			if len(lc.frames) != 3 {
+				t.Fatalf("sent %d messages, want 3", len(lc.frames))
+			}
+			sent := append([][]byte{}, lc.frames...)
+			r := enc.Messager(lc)
+			for _, s := range writes {
+				if s == "" {
+					continue
+				}
+				if b, err := r.ReceiveMessage(TestMsg); err != nil || string(b) != s {
+					t.Errorf("ReceiveMessage() = %q, %v, want %q", b, err, s)
+				}
+			}
+
+			// Reading in small pieces reassembles the stream.
+			lc.frames = sent
+			rc := NewMessagerConn(enc.Messager(lc))
+			var got bytes.Buffer
+			buf := make([]byte, 4)
+			for {
+				n, err := rc.Read(buf)
+				got.Write(buf[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read() = %v", err)
+				}
+				if n == 0 {
+					t.Fatal("Read() returned no data and no error")
+				}
+			}
+			if want := "hello world, ünïcode"; got.String() != want {
+				t.Errorf("Read() returned %q, want %q", got.String(), want)
+			}
+		})
+	}
+}
+
+func TestMessagerConnWriteTooLong(t *testing.T) {
+	lc := &loopbackConnection{}
+	c := NewMessagerConn(TLV.Messager(lc))
+	huge := make([]byte, maxTLVFrameSize+1)
+	if n, err := c.Write(huge); n != 0 || err == nil {
+		t.Errorf("Write() of %d bytes = %d, %v, want an error", len(huge), n, err)
+	}
+	if len(lc.frames) != 0 {
+		t.Errorf("a failed Write() sent %d messages", len(lc.frames))
+	}
+}
+
+func TestMessagerConnOverNetwork(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	want := bytes.Repeat([]byte("0123456789"), 1000)
+	go func() {
+		w := NewMessagerConn(TLV.Messager(AdaptNetConn(client, client)))
+		io.Copy(w, bytes.NewReader(want))
+		client.Close()
+	}()
+	// The peer closing the connection between messages ends the stream.
+	got, err := ioutil.ReadAll(NewMessagerConn(TLV.Messager(AdaptNetConn(server, server))))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("ReadAll() = %d bytes, %v, want %d bytes", len(got), err, len(want))
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Metric records are the binary form of the metrics sent with
+// WithMetricRecords. Each record is a typed key/value pair, and the records
+// are laid out back to back, one per message, or all in one message for
+// SendMetricsBatched. Every integer is big-endian. A record is
+//
+//	type     1 byte, one of the metricRecord values below
+//	name     2-byte length, then that many bytes of UTF-8
+//	value    8 bytes for int64, uint64 and float64 (IEEE 754 bits),
+//	         1 byte, 0 or 1, for bool,
+//	         2-byte length, then that many bytes of UTF-8, for string
+//
+// Clients written in Go can decode the records with ParseMetricRecords.
+const (
+	metricRecordInt64   byte = 1
+	metricRecordUint64  byte = 2
+	metricRecordFloat64 byte = 3
+	metricRecordBool    byte = 4
+	metricRecordString  byte = 5
+)
+
+// WithMetricRecords sends every metric as a binary record rather than as
+// "Name: value" text, which saves space and spares clients from parsing
+// strings. Records can only be sent by a TLV Messager; other Messagers fail
+// without sending anything. Integers, floats, bools and strings keep their
+// types, widened to 64 bits, and any other value, like a time.Duration or a
+// struct too deeply nested to be sent field by field, is sent as a string
+// rendered through %v. The other options still apply, so floats rendered by
+// WithFloatPrecision and slices joined by WithJoinedSlices are strings. The
+// formatter and WithCRLF are ignored.
+func WithMetricRecords() MetricsOption {
+	return func(s *metricsSender) {
+		s.records = true
+	}
+}
+
+// MetricRecord is a single metric decoded by ParseMetricRecords. Value is an
+// int64, a uint64, a float64, a bool or a string.
+type MetricRecord struct {
+	Name  string
+	Value interface{}
+}
+
+// ErrTruncatedMetricRecord is returned by ParseMetricRecords for a message
+// that ends in the middle of a record.
+var ErrTruncatedMetricRecord = errors.New("truncated metric record")
+
+// appendMetricRecord appends the record for value, named name, to b.
+func appendMetricRecord(b []byte, name string, value interface{}) []byte {
+	v := reflect.ValueOf(value)
+	var kind reflect.Kind
+	if v.IsValid() {
+		kind = v.Kind()
+	}
+	var word [8]byte
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = appendMetricString(append(b, metricRecordInt64), name)
+		binary.BigEndian.PutUint64(word[:], uint64(v.Int()))
+		return append(b, word[:]...)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b = appendMetricString(append(b, metricRecordUint64), name)
+		binary.BigEndian.PutUint64(word[:], v.Uint())
+		return append(b, word[:]...)
+	case reflect.Float32, reflect.Float64:
+		b = appendMetricString(append(b, metricRecordFloat64), name)
+		binary.BigEndian.PutUint64(word[:], math.Float64bits(v.Float()))
+		return append(b, word[:]...)
+	case reflect.Bool:
+		b = appendMetricString(append(b, metricRecordBool), name)
+		if v.Bool() {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case reflect.String:
+		return appendMetricString(appendMetricString(append(b, metricRecordString), name), v.String())
+	}
+	return appendMetricString(appendMetricString(append(b, metricRecordString), name), fmt.Sprint(value))
+}
+
+// appendMetricString appends s to b, preceded by its 2-byte length. Longer
+// strings could never fit in a TLV frame anyway, so they are cut short.
+func appendMetricString(b []byte, s string) []byte {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// ParseMetricRecords decodes the records in b, a message sent with
+// WithMetricRecords.
+func ParseMetricRecords(b []byte) ([]MetricRecord, error) {
+	records := []MetricRecord{}
+	for len(b) > 0 {
+		kind := b[0]
+		name, rest, err := parseMetricString(b[1:])
+		if err != nil {
+			return records, err
+		}
+		r := MetricRecord{Name: name}
+		switch kind {
+		case metricRecordInt64, metricRecordUint64, metricRecordFloat64:
+			if len(rest) < 8 {
+				return records, ErrTruncatedMetricRecord
+			}
+			word := binary.BigEndian.Uint64(rest)
+			switch kind {
+			case metricRecordInt64:
+				r.Value = int64(word)
+			case metricRecordUint64:
+				r.Value = word
+			default:
+				r.Value = math.Float64frombits(word)
+			}
+			rest = rest[8:]
+		case metricRecordBool:
+			if len(rest) < 1 {
+				return records, ErrTruncatedMetricRecord
+			}
+			if rest[0] > 1 {
+				return records, fmt.Errorf("bad bool %d in metric record %s", rest[0], name)
+			}
+			r.Value = rest[0] == 1
+			rest = rest[1:]
+		case metricRecordString:
+			if r.Value, rest, err = parseMetricString(rest); err != nil {
+				return records, err
+			}
+		default:
+			return records, fmt.Errorf("unknown type %d of metric record %s", kind, name)
+		}
+		records = append(records, r)
+		b = rest
+	}
+	return records, nil
+}
+
+// parseMetricString decodes a string preceded by its 2-byte length from the
+// start of b, and returns it along with the bytes that follow it.
+func parseMetricString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, ErrTruncatedMetricRecord
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, ErrTruncatedMetricRecord
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// render formats a single metric as the options require, as text or as a
+// record.
+func (s *metricsSender) render(name string, value interface{}) string {
+	if s.records {
+		return string(appendMetricRecord(nil, name, value))
+	}
+	return s.format(name, value)
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordMetrics struct {
+	Count    int32
+	Bytes    uint64
+	Rate     float32
+	Min      float64
+	Negative int64
+	Done     bool
+	Name     string
+	Elapsed  time.Duration
+	Inner    struct{ RTT uint8 }
+}
+
+var recordMetricsValue = recordMetrics{
+	Count:    -7,
+	Bytes:    math.MaxUint64,
+	Rate:     1.5,
+	Min:      math.SmallestNonzeroFloat64,
+	Negative: math.MinInt64,
+	Done:     true,
+	Name:     "lga03\n",
+	Elapsed:  1500 * time.Microsecond,
+	Inner:    struct{ RTT uint8 }{RTT: 200},
+}
+
+var recordMetricsWant = []MetricRecord{
+	{"x.Count", int64(-7)},
+	{"x.Bytes", uint64(math.MaxUint64)},
+	{"x.Rate", float64(1.5)},
+	{"x.Min", math.SmallestNonzeroFloat64},
+	{"x.Negative", int64(math.MinInt64)},
+	{"x.Done", true},
+	{"x.Name", "lga03\n"},
+	{"x.Elapsed", "1.5ms"},
+	{"x.Inner.RTT", uint64(200)},
+}
+
+func TestSendMetricRecords(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc)
+	if err := SendMetricsWithOptions(recordMetricsValue, m, "x.", WithMetricRecords(), WithCRLF()); err != nil {
+		t.Fatal(err)
+	}
+	got := []MetricRecord{}
+	for len(lc.frames) > 0 {
+		b, err := m.ReceiveMessage(TestMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := ParseMetricRecords(b)
+		if err != nil || len(records) != 1 {
+			t.Fatalf("ParseMetricRecords(%q) = %v, %v, want a single record", b, records, err)
+		}
+		got = append(got, records...)
+	}
+	if !reflect.DeepEqual(got, recordMetricsWant) {
+		t.Errorf("metric records = %v, want %v", got, recordMetricsWant)
+	}
+}
+
+func TestSendMetricRecordsBatched(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc)
+	if err := SendMetricsBatched(recordMetricsValue, m, "x.", WithMetricRecords(), WithMaxMetrics(3), WithTruncatedMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.ReceiveMessage(TestMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]MetricRecord{}, recordMetricsWant[:3]...), MetricRecord{"MetricsTruncated", true})
+	if got, err := ParseMetricRecords(b); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseMetricRecords() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestSendMetricRecordsEncodings(t *testing.T) {
+	for _, enc := range []Encoding{JSON, MessagePack, CBOR} {
+		lc := &loopbackConnection{}
+		if err := SendMetricsWithOptions(recordMetricsValue, enc.Messager(lc), "", WithMetricRecords()); err == nil {
+			t.Errorf("%v: SendMetricsWithOptions() of metric records succeeded", enc)
+		}
+		if len(lc.frames) != 0 {
+			t.Errorf("%v: SendMetricsWithOptions() sent %d frames", enc, len(lc.frames))
+		}
+	}
+}
+
+func TestParseMetricRecordsErrors(t *testing.T) {
+	valid := appendMetricRecord(nil, "RTT", 12.5)
+	for i := 1; i < len(valid); i++ {
+		if _, err := ParseMetricRecords(valid[:i]); err != ErrTruncatedMetricRecord {
+			t.Errorf("ParseMetricRecords() of %d bytes = %v, want ErrTruncatedMetricRecord", i, err)
+		}
+	}
+	for _, b := range [][]byte{
+		{9, 0, 1, 'x'},
+		{metricRecordBool, 0, 1, 'x', 2},
+	} {
+		if _, err := ParseMetricRecords(b); err == nil || err == ErrTruncatedMetricRecord {
+			t.Errorf("ParseMetricRecords(%v) = %v, want an error", b, err)
+		}
+	}
+	if records, err := ParseMetricRecords(nil); err != nil || len(records) != 0 {
+		t.Errorf("ParseMetricRecords(nil) = %v, %v", records, err)
+	}
+}
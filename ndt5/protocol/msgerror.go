@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errorCodePrefix starts the contents of a MsgError that carries an error
+// code, as in "error 42: too many tests".
+const errorCodePrefix = "error "
+
+// SendError sends a MsgError with the given code and message, so that clients
+// can act on the code rather than on the wording of the message. The code and
+// the message are sent as "error <code>: <message>", in every encoding. A
+// code of 0 sends the message alone, as ndt5 errors were sent before codes.
+func SendError(m Messager, code int, message string) error {
+	if code == 0 {
+		return m.SendMessageString(MsgError, message)
+	}
+	return m.SendMessageString(MsgError, fmt.Sprintf("%s%d: %s", errorCodePrefix, code, message))
+}
+
+// ReceiveError receives a MsgError and returns its code and message. An error
+// without a code, such as one sent by an older server, is returned whole as
+// the message, with a code of 0.
+func ReceiveError(m Messager) (code int, message string, err error) {
+	b, err := m.ReceiveMessage(MsgError)
+	if err != nil {
+		return 0, "", err
+	}
+	code, message = parseError(string(b))
+	return code, message, nil
+}
+
+// parseError splits the contents of a MsgError into its code and message.
+func parseError(s string) (int, string) {
+	if !strings.HasPrefix(s, errorCodePrefix) {
+		return 0, s
+	}
+	rest := s[len(errorCodePrefix):]
+	i := strings.Index(rest, ": ")
+	if i < 0 {
+		return 0, s
+	}
+	code, err := strconv.Atoi(rest[:i])
+	if err != nil || code == 0 {
+		return 0, s
+	}
+	return code, rest[i+2:]
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import "testing"
+
+func TestSendError(t *testing.T) {
+	tests := []struct {
+		code    int
+		message string
+	}{
+		{code: 1, message: "unsupported client version"},
+		{code: 42, message: "too many tests: 3"},
+		{code: -7, message: ""},
+		{code: 0, message: "no code"},
+	}
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc)
+			for _, tt := range tests {
+				if err := SendError(m, tt.code, tt.message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				code, message, err := ReceiveError(m)
+				if err != nil || code != tt.code || message != tt.message {
+					t.Errorf("ReceiveError() = %d, %q, %v, want %d, %q", code, message, err, tt.code, tt.message)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveErrorLegacy(t *testing.T) {
+	tests := []string{
+		"Invalid login message",
+		"error: no code",
+		"error x: bad code",
+		"error 12 missing separator",
+		"error 0: zero is not a code",
+	}
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc)
+	for _, s := range tests {
+		m.SendMessageString(MsgError, s)
+	}
+	for _, s := range tests {
+		code, message, err := ReceiveError(m)
+		if err != nil || code != 0 || message != s {
+			t.Errorf("ReceiveError() = %d, %q, %v, want 0, %q", code, message, err, s)
+		}
+	}
+}
+
+func TestReceiveErrorWrongType(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc)
+	m.SendMessage(TestMsg, []byte("error 1: nope"))
+	if _, _, err := ReceiveError(m); err == nil {
+		t.Error("ReceiveError() of a TestMsg succeeded")
+	}
+}
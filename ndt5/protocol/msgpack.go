@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/ugorji/go/codec"
+)
+
+// msgpackHandle configures the MessagePack codec to use the str and bin types
+// from the current MessagePack spec.
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// msgpackMessager has all the methods for sending MessagePack-format NDT
+// messages along the passed-in connection. Just like the JSON encoding, each
+// message is a map with a "msg" key carried inside a TLV frame.
+type msgpackMessager struct {
+	baseMessager
+}
+
+// msgpackS2CResult is the MessagePack and CBOR representation of an
+// S2CResult. It uses the same keys as the JSON encoding, but keeps the values
+// as integers.
+type msgpackS2CResult struct {
+	ThroughputValue  int64
+	UnsentDataAmount int64
+	TotalSentByte    int64
+	ThroughputMbps   *float64 `json:",omitempty"`
+	ThroughputUnit   string   `json:",omitempty"`
+	Checksum         *uint32  `json:",omitempty"`
+}
+
+// msgpack serializes the results as the map sent to MessagePack clients, with
+// the same optional keys as the JSON encoding.
+func (r *S2CResult) msgpack(f s2cFormat) ([]byte, error) {
+	return encodeMsgpack(r.codecS2CResult(f))
+}
+
+// codecS2CResult returns the map of results sent to MessagePack and CBOR
+// clients.
+func (r *S2CResult) codecS2CResult(f s2cFormat) *msgpackS2CResult {
+	v := &msgpackS2CResult{
+		ThroughputValue:  r.ThroughputKbps,
+		UnsentDataAmount: r.UnsentBytes,
+		TotalSentByte:    r.TotalSentBytes,
+	}
+	if f.extended {
+		mbps := r.ThroughputMbps()
+		v.ThroughputMbps = &mbps
+		v.ThroughputUnit = "kbps"
+	}
+	if f.checksum {
+		c := r.Checksum()
+		v.Checksum = &c
+	}
+	return v
+}
+
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(v)
+	return b, err
+}
+
+func (mm *msgpackMessager) SendMessage(kind MessageType, contents []byte) error {
+	return mm.SendMessageString(kind, string(contents))
+}
+
+func (mm *msgpackMessager) SendMessageString(kind MessageType, s string) error {
+	if err := checkMessageSize(kind, len(s)); err != nil {
+		return err
+	}
+	b, err := encodeMsgpack(&JSONMessage{Msg: s})
+	if err != nil {
+		return err
+	}
+	if err := mm.applyWriteDeadline(mm.conn); err != nil {
+		return err
+	}
+	return writeTLVMessage(mm.conn, kind, b)
+}
+
+func (mm *msgpackMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	r := &S2CResult{
+		ThroughputKbps: throughputKbps,
+		UnsentBytes:    unsentBytes,
+		TotalSentBytes: totalSentBytes,
+	}
+	if err := mm.checkS2CResult(r); err != nil {
+		return err
+	}
+	b, err := r.msgpack(mm.s2cFormat())
+	if err != nil {
+		return err
+	}
+	if err := mm.applyWriteDeadline(mm.conn); err != nil {
+		return err
+	}
+	return writeTLVMessage(mm.conn, TestMsg, b)
+}
+
+// msgpackEnvelope is the MessagePack encoding of the start of a map with a
+// single "msg" key, which is followed by the encoded value.
+var msgpackEnvelope = []byte{0x81, 0xa3, 'm', 's', 'g'}
+
+// SendRawFrame sends raw, which should be an encoded MessagePack value, as the
+// value of the "msg" key.
+func (mm *msgpackMessager) SendRawFrame(kind MessageType, raw []byte) error {
+	if err := mm.applyWriteDeadline(mm.conn); err != nil {
+		return err
+	}
+	return writeRawFrame(mm.conn, kind, msgpackEnvelope, raw, nil)
+}
+
+func (mm *msgpackMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	_, b, err := mm.ReceiveOneOf(kind)
+	return b, err
+}
+
+func (mm *msgpackMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	b, kind, _, err := mm.receiveMeta(kinds...)
+	return kind, b, err
+}
+
+// ReceiveMessageMeta returns the length of the encoded map declared by the TLV
+// headers, which is longer than the returned message.
+func (mm *msgpackMessager) ReceiveMessageMeta(kind MessageType) ([]byte, MessageType, int, error) {
+	return mm.receiveMeta(kind)
+}
+
+func (mm *msgpackMessager) receiveMeta(kinds ...MessageType) ([]byte, MessageType, int, error) {
+	b, kind, declaredLen, err := readTLVMessageMeta(mm.conn, mm.limits(), kinds...)
+	if err != nil {
+		if ue, ok := err.(*UnexpectedMessageError); ok {
+			if msg, derr := decodeMsgpackMessage(ue.Payload); derr == nil {
+				ue.Payload = msg
+			}
+		}
+		return nil, kind, declaredLen, err
+	}
+	msg, err := decodeMsgpackMessage(b)
+	return msg, kind, declaredLen, mm.countMalformed(err)
+}
+
+func (mm *msgpackMessager) ReceiveMessageInto(kind MessageType, v interface{}) error {
+	b, _, err := readTLVMessage(mm.conn, mm.limits(), kind)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return mm.countMalformed(errors.New("empty MessagePack message received"))
+	}
+	return mm.countMalformed(codec.NewDecoderBytes(b, msgpackHandle).Decode(v))
+}
+
+func (mm *msgpackMessager) ReceiveTyped(kinds ...MessageType) (Message, error) {
+	object := func(b []byte, v interface{}) error {
+		return codec.NewDecoderBytes(b, msgpackHandle).Decode(v)
+	}
+	return receiveTyped(mm.conn, mm.limits(), kinds, decodeMsgpackMessage, object)
+}
+
+func (mm *msgpackMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	b, kind, err := readAnyTLVMessage(mm.conn, mm.limits())
+	if err != nil {
+		return kind, nil, err
+	}
+	msg, err := decodeMsgpackMessage(b)
+	return kind, msg, mm.countMalformed(err)
+}
+
+func (mm *msgpackMessager) receiveS2CResults() (*S2CResult, error) {
+	b, _, err := readTLVMessage(mm.conn, mm.limits(), TestMsg)
+	if err != nil {
+		return nil, err
+	}
+	v := &msgpackS2CResult{}
+	err = codec.NewDecoderBytes(b, msgpackHandle).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	r := &S2CResult{
+		ThroughputKbps: v.ThroughputValue,
+		UnsentBytes:    v.UnsentDataAmount,
+		TotalSentBytes: v.TotalSentByte,
+	}
+	if v.Checksum == nil {
+		return r, nil
+	}
+	return r, r.verify(*v.Checksum)
+}
+
+func decodeMsgpackMessage(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty MessagePack message received")
+	}
+	msg := &JSONMessage{}
+	err := codec.NewDecoderBytes(b, msgpackHandle).Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(msg.Msg), nil
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func assertMsgpackMessagerIsMessager(mm *msgpackMessager) {
+	func(m Messager) {}(mm)
+}
+
+func TestMessagePackEncoding(t *testing.T) {
+	if MessagePack.String() != "MessagePack" {
+		t.Errorf("MessagePack.String() = %q", MessagePack.String())
+	}
+	m := MessagePack.Messager(&loopbackConnection{})
+	if m == nil || m.Encoding() != MessagePack {
+		t.Errorf("Messager() for MessagePack returned %v", m)
+	}
+}
+
+func TestMsgpackMessagerRoundTrip(t *testing.T) {
+	for _, kind := range allMessageTypes {
+		for _, payload := range []string{"", "0", "v5.0-NDTinGO", "2 4 32", "line\nwith \"quotes\"\n"} {
+			m := MessagePack.Messager(&loopbackConnection{})
+			err := m.SendMessage(kind, []byte(payload))
+			if err != nil {
+				t.Fatalf("SendMessage(%v, %q) failed: %v", kind, payload, err)
+			}
+			got, err := m.ReceiveMessage(kind)
+			if err != nil {
+				t.Fatalf("ReceiveMessage(%v) failed: %v", kind, err)
+			}
+			if string(got) != payload {
+				t.Errorf("ReceiveMessage(%v) = %q, want %q", kind, got, payload)
+			}
+		}
+	}
+}
+
+func TestMsgpackMessagerWrongType(t *testing.T) {
+	m := MessagePack.Messager(&loopbackConnection{})
+	if err := m.SendMessage(MsgError, []byte("oops")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReceiveMessage(MsgResults); err == nil {
+		t.Error("ReceiveMessage should fail for the wrong message type")
+	}
+}
+
+func TestMsgpackMessagerSendS2CResults(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := MessagePack.Messager(lc)
+	err := m.SendS2CResults(1000, 20, 3000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, kind, err := ReadTLVMessage(lc, TestMsg)
+	if err != nil || kind != TestMsg {
+		t.Fatal("Could not read S2C results frame", kind, err)
+	}
+	r := map[string]int64{}
+	err = codec.NewDecoderBytes(b, msgpackHandle).Decode(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{
+		"ThroughputValue":  1000,
+		"UnsentDataAmount": 20,
+		"TotalSentByte":    3000000000,
+	}
+	for k, v := range want {
+		if r[k] != v {
+			t.Errorf("results[%q] = %d, want %d", k, r[k], v)
+		}
+	}
+}
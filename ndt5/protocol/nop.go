@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// NopMessager is a Messager with no Connection. It discards everything sent to
+// it, counting the messages of each type, and receives canned responses. It
+// is meant for testing code that needs a Messager.
+type NopMessager struct {
+	mu        sync.Mutex
+	encoding  Encoding
+	sent      map[MessageType]int
+	responses []nopResponse
+	cancelled bool
+}
+
+type nopResponse struct {
+	kind MessageType
+	msg  []byte
+	err  error
+}
+
+// NewNopMessager creates a NopMessager that reports the given encoding.
+func NewNopMessager(enc Encoding) *NopMessager {
+	return &NopMessager{
+		encoding: enc,
+		sent:     make(map[MessageType]int),
+	}
+}
+
+// AddResponse queues a message of the given type to be received after all
+// previously queued responses.
+func (n *NopMessager) AddResponse(kind MessageType, msg []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.responses = append(n.responses, nopResponse{kind: kind, msg: msg})
+}
+
+// AddError queues an error to be returned by a receive after all previously
+// queued responses.
+func (n *NopMessager) AddError(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.responses = append(n.responses, nopResponse{err: err})
+}
+
+// SetEncoding changes the encoding reported by Encoding().
+func (n *NopMessager) SetEncoding(enc Encoding) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.encoding = enc
+}
+
+// Sent returns the number of messages of the given type that have been sent.
+// S2C results are counted as TestMsg messages.
+func (n *NopMessager) Sent(kind MessageType) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sent[kind]
+}
+
+// SentTotal returns the number of messages of any type that have been sent.
+func (n *NopMessager) SentTotal() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	total := 0
+	for _, c := range n.sent {
+		total += c
+	}
+	return total
+}
+
+// SendMessage counts and discards the message.
+func (n *NopMessager) SendMessage(kind MessageType, _ []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent[kind]++
+	return nil
+}
+
+// SendMessageString counts and discards the message.
+func (n *NopMessager) SendMessageString(kind MessageType, _ string) error {
+	return n.SendMessage(kind, nil)
+}
+
+// SendS2CResults counts and discards the results.
+func (n *NopMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	return n.SendMessage(TestMsg, nil)
+}
+
+// ReceiveMessage returns the next queued response, or an
+// *UnexpectedMessageError if that response is not of the given type. Once the
+// queued responses run out, it returns io.EOF, just like a closed connection.
+func (n *NopMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	_, msg, err := n.ReceiveOneOf(kind)
+	return msg, err
+}
+
+// ReceiveOneOf returns the next queued response, or an
+// *UnexpectedMessageError if that response is not of one of the given types.
+func (n *NopMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	got, msg, err := n.ReceiveAnyMessage()
+	if err != nil {
+		return got, nil, err
+	}
+	for _, kind := range kinds {
+		if got == kind {
+			return got, msg, nil
+		}
+	}
+	ue := &UnexpectedMessageError{Got: got, Payload: msg}
+	if len(kinds) > 0 {
+		ue.Expected = kinds[0]
+	}
+	if len(kinds) > 1 {
+		ue.ExpectedOneOf = append([]MessageType{}, kinds...)
+	}
+	return got, nil, ue
+}
+
+// ReceiveAnyMessage returns the next queued response. Once the queued
+// responses run out, it returns io.EOF, just like a closed connection.
+func (n *NopMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.cancelled {
+		n.cancelled = false
+		return MsgUnknown, nil, ErrReceiveCancelled
+	}
+	if len(n.responses) == 0 {
+		return MsgUnknown, nil, io.EOF
+	}
+	r := n.responses[0]
+	n.responses = n.responses[1:]
+	return r.kind, r.msg, r.err
+}
+
+// ReceiveMessageContext is ReceiveMessage, but returns ctx.Err() without
+// receiving if ctx is already done. Receives from a NopMessager never block.
+func (n *NopMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return n.ReceiveMessage(kind)
+}
+
+// ReceiveAnyMessageContext is ReceiveAnyMessage, but returns ctx.Err() without
+// receiving if ctx is already done.
+func (n *NopMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return MsgUnknown, nil, err
+	}
+	return n.ReceiveAnyMessage()
+}
+
+// CancelReceive makes the next receive return ErrReceiveCancelled instead of
+// the next queued response.
+func (n *NopMessager) CancelReceive() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cancelled = true
+}
+
+// SetReadDeadline does nothing, because receives from a NopMessager never
+// block.
+func (n *NopMessager) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline does nothing, because sends to a NopMessager never block.
+func (n *NopMessager) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Flush does nothing, because a NopMessager buffers nothing.
+func (n *NopMessager) Flush() error {
+	return nil
+}
+
+// Release does nothing, because a NopMessager is not counted as active.
+func (n *NopMessager) Release() {}
+
+// Close does nothing, because a NopMessager has no Connection to close.
+func (n *NopMessager) Close() error {
+	return nil
+}
+
+// Encoding returns the encoding the NopMessager was created with.
+func (n *NopMessager) Encoding() Encoding {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.encoding
+}
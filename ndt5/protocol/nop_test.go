@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt5/web100"
+)
+
+func assertNopMessagerIsMessager(n *NopMessager) {
+	func(m Messager) {}(n)
+}
+
+func TestNopMessagerCountsSends(t *testing.T) {
+	n := NewNopMessager(TLV)
+	n.SendMessage(SrvQueue, []byte("0"))
+	n.SendMessage(MsgLogin, []byte("v5.0-NDTinGO"))
+	n.SendMessage(MsgLogin, []byte("2 4"))
+	n.SendS2CResults(1, 2, 3)
+	if n.Sent(SrvQueue) != 1 || n.Sent(MsgLogin) != 2 || n.Sent(TestMsg) != 1 || n.Sent(MsgResults) != 0 {
+		t.Errorf("Bad counts: SrvQueue=%d MsgLogin=%d TestMsg=%d MsgResults=%d",
+			n.Sent(SrvQueue), n.Sent(MsgLogin), n.Sent(TestMsg), n.Sent(MsgResults))
+	}
+	if n.SentTotal() != 4 {
+		t.Errorf("SentTotal() = %d, want 4", n.SentTotal())
+	}
+}
+
+func TestNopMessagerWithSendMetrics(t *testing.T) {
+	n := NewNopMessager(JSON)
+	err := SendMetrics(&web100.Metrics{}, n, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// See TestSendMetrics for why 73 is a lower bound.
+	if n.Sent(TestMsg) < 73 || n.Sent(TestMsg) != n.SentTotal() {
+		t.Errorf("SendMetrics() sent %d TestMsg of %d messages", n.Sent(TestMsg), n.SentTotal())
+	}
+}
+
+func TestNopMessagerResponses(t *testing.T) {
+	n := NewNopMessager(JSON)
+	testErr := errors.New("canned error")
+	n.AddResponse(TestMsg, []byte("one"))
+	n.AddResponse(MsgError, []byte("two"))
+	n.AddError(testErr)
+	n.AddResponse(MsgResults, []byte("three"))
+
+	if b, err := n.ReceiveMessage(TestMsg); err != nil || string(b) != "one" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if _, err := n.ReceiveMessage(MsgResults); err == nil {
+		t.Error("ReceiveMessage() of the wrong type should fail")
+	}
+	if _, err := n.ReceiveMessage(TestMsg); err != testErr {
+		t.Errorf("ReceiveMessage() = %v, want %v", err, testErr)
+	}
+	if kind, b, err := n.ReceiveAnyMessage(); err != nil || kind != MsgResults || string(b) != "three" {
+		t.Errorf("ReceiveAnyMessage() = %v, %q, %v", kind, b, err)
+	}
+	if _, err := n.ReceiveMessage(TestMsg); err != io.EOF {
+		t.Errorf("ReceiveMessage() with no responses = %v, want io.EOF", err)
+	}
+}
+
+func TestNopMessagerEncoding(t *testing.T) {
+	n := NewNopMessager(TLV)
+	if n.Encoding() != TLV {
+		t.Errorf("Encoding() = %v, want TLV", n.Encoding())
+	}
+	n.SetEncoding(JSON)
+	if n.Encoding() != JSON {
+		t.Errorf("Encoding() = %v, want JSON", n.Encoding())
+	}
+}
+
+func TestNopMessagerReceiveOneOf(t *testing.T) {
+	n := NewNopMessager(JSON)
+	n.AddResponse(MsgError, []byte("oops"))
+	n.AddResponse(MsgLogout, nil)
+	kind, b, err := n.ReceiveOneOf(MsgResults, MsgError)
+	if err != nil || kind != MsgError || string(b) != "oops" {
+		t.Errorf("ReceiveOneOf() = %v, %q, %v", kind, b, err)
+	}
+	_, _, err = n.ReceiveOneOf(MsgResults, MsgError)
+	if ue, ok := err.(*UnexpectedMessageError); !ok || ue.Got != MsgLogout || len(ue.ExpectedOneOf) != 2 {
+		t.Errorf("ReceiveOneOf() = %v, want an *UnexpectedMessageError", err)
+	}
+}
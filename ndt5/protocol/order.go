@@ -0,0 +1,48 @@
+package protocol
+
+import "fmt"
+
+// WithTypeOrder makes the Messager check that the messages it receives have
+// the given types, in the given order, for conformance tests of clients.
+// MsgKeepalive messages may arrive at any point and are not checked, and once
+// every type in the order has been received, messages of any type are
+// accepted. Production servers should not use it, because clients that
+// deviate from the expected order are otherwise tolerated.
+func WithTypeOrder(kinds ...MessageType) MessagerOption {
+	return func(o *messagerOptions) {
+		o.order = &typeOrder{kinds: append([]MessageType{}, kinds...)}
+	}
+}
+
+// OrderError is returned when a Messager created with WithTypeOrder receives
+// a message of a type other than the next one in the order.
+type OrderError struct {
+	// Index is the position of the message in the order.
+	Index    int
+	Expected MessageType
+	Got      MessageType
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("message %d is out of order: expected %v, got %v", e.Index, e.Expected, e.Got)
+}
+
+// typeOrder tracks the position of a Messager in the order set by
+// WithTypeOrder. A nil *typeOrder accepts every message.
+type typeOrder struct {
+	kinds []MessageType
+	next  int
+}
+
+// check returns an *OrderError if kind is out of order, and otherwise moves to
+// the next position in the order.
+func (t *typeOrder) check(kind MessageType) error {
+	if t == nil || kind == MsgKeepalive || t.next >= len(t.kinds) {
+		return nil
+	}
+	if kind != t.kinds[t.next] {
+		return &OrderError{Index: t.next, Expected: t.kinds[t.next], Got: kind}
+	}
+	t.next++
+	return nil
+}
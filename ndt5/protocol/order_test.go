@@ -0,0 +1,37 @@
+package protocol
+
+import "testing"
+
+func TestTypeOrder(t *testing.T) {
+	order := []MessageType{MsgExtendedLogin, TestPrepare, TestMsg}
+	send := func(kinds ...MessageType) *loopbackConnection {
+		lc := &loopbackConnection{}
+		m := TLV.Messager(lc)
+		for _, kind := range kinds {
+			m.SendMessage(kind, []byte("x"))
+		}
+		return lc
+	}
+
+	lc := send(MsgExtendedLogin, MsgKeepalive, TestPrepare, TestMsg, MsgLogout)
+	m := TLV.Messager(lc, WithTypeOrder(order...))
+	if _, err := m.ReceiveMessage(MsgExtendedLogin); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if kind, _, err := m.ReceiveAnyMessage(); err != nil {
+			t.Errorf("ReceiveAnyMessage() of %v in order = %v", kind, err)
+		}
+	}
+
+	m = TLV.Messager(send(MsgExtendedLogin, TestMsg), WithTypeOrder(order...))
+	m.ReceiveMessage(MsgExtendedLogin)
+	_, err := m.ReceiveMessage(TestMsg)
+	oe, ok := err.(*OrderError)
+	if !ok {
+		t.Fatalf("ReceiveMessage() out of order = %v, want an *OrderError", err)
+	}
+	if oe.Index != 1 || oe.Expected != TestPrepare || oe.Got != TestMsg {
+		t.Errorf("OrderError = %+v", oe)
+	}
+}
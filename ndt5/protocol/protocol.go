@@ -1,18 +1,22 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/m-lab/ndt-server/fdcache"
 	"github.com/m-lab/ndt-server/ndt5/web100"
@@ -52,6 +56,9 @@ const (
 	MsgWaiting
 	// MsgExtendedLogin is used to signal advanced capabilities.
 	MsgExtendedLogin
+	// MsgKeepalive carries no information and keeps idle connections open.
+	// Unless it is explicitly expected, it is skipped when received.
+	MsgKeepalive
 )
 
 func (m MessageType) String() string {
@@ -78,11 +85,25 @@ func (m MessageType) String() string {
 		return "MsgWaiting"
 	case MsgExtendedLogin:
 		return "MsgExtendedLogin"
+	case MsgKeepalive:
+		return "MsgKeepalive"
 	default:
 		return fmt.Sprintf("UnknownMessage(0x%X)", byte(m))
 	}
 }
 
+// ParseMessageType returns the MessageType whose String() is name. Every
+// MessageType round-trips, including those without a name of their own, like
+// "UnknownMessage(0xFF)".
+func ParseMessageType(name string) (MessageType, error) {
+	for i := 0; i <= 0xFF; i++ {
+		if MessageType(i).String() == name {
+			return MessageType(i), nil
+		}
+	}
+	return MsgUnknown, fmt.Errorf("unknown message type %q", name)
+}
+
 // Connection is a general system over which we might be able to read an NDT
 // message. It contains a subset of the methods of websocket.Conn, in order to
 // allow non-websocket-based NDT tests in support of plain TCP clients.
@@ -97,6 +118,9 @@ type Connection interface {
 	UUID() string
 	String() string
 	Messager() Messager
+	// Encoding returns the encoding negotiated for the connection, which is
+	// Unknown until the login message has been received.
+	Encoding() Encoding
 }
 
 var badUUID = "ERROR_DISCOVERING_UUID"
@@ -106,7 +130,7 @@ func UUIDToFile(dir, uuid string) (*os.File, error) {
 	if uuid == badUUID {
 		f, err := ioutil.TempFile(dir, badUUID+"*.json")
 		if err != nil {
-			log.Println("Could not create filename for data")
+			logger.Println("Could not create filename for data")
 			return nil, err
 		}
 		return f, nil
@@ -173,11 +197,37 @@ func (m *measurer) StopMeasuring() (*web100.Metrics, error) {
 type wsConnection struct {
 	*websocket.Conn
 	*measurer
+	// deadline keeps the read deadline of the websocket.
+	deadline *readDeadline
+	// gate disables the receives of every Messager on the connection.
+	gate *receiveGate
 }
 
 // AdaptWsConn turns a websocket Connection into a struct which implements both Measurer and Connection
 func AdaptWsConn(ws *websocket.Conn) MeasuredConnection {
-	return &wsConnection{Conn: ws, measurer: newMeasurer()}
+	return &wsConnection{Conn: ws, measurer: newMeasurer(), deadline: &readDeadline{rd: ws}, gate: &receiveGate{}}
+}
+
+// SetReadDeadline sets the read deadline of the websocket, which is kept apart
+// from interrupted reads.
+func (ws *wsConnection) SetReadDeadline(t time.Time) error {
+	return ws.deadline.setReadDeadline(t)
+}
+
+func (ws *wsConnection) keptDeadline() *readDeadline {
+	return ws.deadline
+}
+
+func (ws *wsConnection) keptReceiveGate() *receiveGate {
+	return ws.gate
+}
+
+func (ws *wsConnection) interruptRead() error {
+	return ws.deadline.interrupt()
+}
+
+func (ws *wsConnection) resumeRead() error {
+	return ws.deadline.resume()
 }
 
 func (ws *wsConnection) FillUntil(t time.Time, bytes []byte) (bytesWritten int64, err error) {
@@ -203,7 +253,7 @@ func (ws *wsConnection) StartMeasuring(ctx context.Context) {
 func (ws *wsConnection) UUID() string {
 	id, err := fdcache.GetUUID(ws.UnderlyingConn())
 	if err != nil {
-		log.Println("Could not discover UUID:", err)
+		logger.Println("Could not discover UUID:", err)
 		// TODO: increment a metric
 		return badUUID
 	}
@@ -239,6 +289,18 @@ func (ws *wsConnection) Messager() Messager {
 	return JSON.Messager(ws)
 }
 
+// Encoding returns JSON, because WS and WSS connections only support JSON.
+func (ws *wsConnection) Encoding() Encoding {
+	return JSON
+}
+
+// framesMessages returns true, because every NDT message is sent as a single
+// binary websocket message, and every websocket message read is a single NDT
+// message.
+func (ws *wsConnection) framesMessages() bool {
+	return true
+}
+
 // netConnection is a utility struct that allows us to use OS sockets and
 // Websockets using the same set of methods. Its second element is a Reader
 // because we want to allow the input channel to be buffered.
@@ -248,26 +310,211 @@ type netConnection struct {
 	input     io.Reader
 	c2sBuffer []byte
 	encoding  Encoding
+	readLimit int64
+	// deadline keeps the read deadline of the socket, if there is one.
+	deadline *readDeadline
+	// gate disables the receives of every Messager on the connection.
+	gate *receiveGate
+	// partial holds the bytes of a frame whose read timed out, which the
+	// next read continues.
+	partial []byte
+}
+
+// ErrConnectionClosed is returned when the peer closes the connection cleanly,
+// between two messages. It wraps io.EOF.
+var ErrConnectionClosed = fmt.Errorf("connection closed by the peer: %w", io.EOF)
+
+// ErrTruncatedMessage is returned when the peer closes the connection in the
+// middle of a message. It wraps io.ErrUnexpectedEOF.
+var ErrTruncatedMessage = fmt.Errorf("connection closed in the middle of a message: %w", io.ErrUnexpectedEOF)
+
+// PartialFrameError is returned when a read times out in the middle of a
+// frame, as opposed to between frames. Err is the timeout. The bytes of the
+// frame read so far are kept, and the next read continues the frame, so the
+// connection can still be read, but the peer stalled in the middle of a
+// message rather than being slow to send the next one, and ReceiveMessageWithin
+// does not retry the receive.
+type PartialFrameError struct {
+	Err error
+}
+
+func (e *PartialFrameError) Error() string {
+	return fmt.Sprintf("timed out in the middle of a frame: %v", e.Err)
+}
+
+func (e *PartialFrameError) Unwrap() error {
+	return e.Err
 }
 
+// ReadMessage reads a single TLV frame with the standard ndt5 header. If the
+// peer closes the connection, it returns ErrConnectionClosed at the boundary
+// of a frame, and ErrTruncatedMessage within a frame.
 func (nc *netConnection) ReadMessage() (int, []byte, error) {
-	firstThree := make([]byte, 3)
-	_, err := nc.input.Read(firstThree)
+	return nc.readFrame(streamFormat{})
+}
+
+// readFrame is ReadMessage for frames in the format f.
+func (nc *netConnection) readFrame(f streamFormat) (int, []byte, error) {
+	input := nc.input
+	if f.idleTimeout > 0 && nc.deadline != nil {
+		input = &idleReader{r: nc.input, timeout: f.idleTimeout, idle: nc.deadline}
+		defer nc.deadline.restore()
+	}
+	headerLen := 3
+	if f.wideType {
+		// Read the high byte of the type along with the standard header.
+		headerLen = 4
+	}
+	frame := nc.partial
+	nc.partial = nil
+	frame, err := readUntil(input, frame, headerLen)
+	if err == io.EOF {
+		return 0, []byte{}, ErrConnectionClosed
+	}
 	if err != nil {
-		return 0, []byte{}, err
+		return 0, []byte{}, nc.frameError(frame, err)
+	}
+	var typeErr error
+	header := frame[:headerLen]
+	if f.wideType {
+		typeErr = checkWideType(header[0], header[1])
+		header = header[1:]
+	}
+	size := int64(header[1])<<8 + int64(header[2])
+	if f.byteOrder != nil {
+		size = int64(f.byteOrder.Uint16(header[1:]))
+	}
+	if nc.readLimit > 0 && 3+size > nc.readLimit {
+		return 0, []byte{}, &readLimitError{length: 3 + size, limit: nc.readLimit}
 	}
-	size := int64(firstThree[1])<<8 + int64(firstThree[2])
-	bytes := make([]byte, size)
-	_, err = nc.input.Read(bytes)
-	return 0, append(firstThree, bytes...), err
+	frame, err = readUntil(input, frame, headerLen+int(size))
+	if err != nil {
+		return 0, []byte{}, nc.frameError(frame, err)
+	}
+	if typeErr != nil {
+		// The whole frame was read, so the next one can still be read.
+		return 0, []byte{}, typeErr
+	}
+	// Return the frame with the standard header, like every other frame.
+	frame = frame[headerLen-3:]
+	binary.BigEndian.PutUint16(frame[1:3], uint16(size))
+	return 0, frame, nil
 }
 
+// readUntil reads from input into the bytes of buf beyond its length, until
+// it holds n bytes, and returns it with the bytes that were read even if it
+// fails. It returns io.EOF only if nothing was read into an empty buf.
+func readUntil(input io.Reader, buf []byte, n int) ([]byte, error) {
+	if len(buf) >= n {
+		return buf, nil
+	}
+	if cap(buf) < n {
+		buf = append(make([]byte, 0, n), buf...)
+	}
+	read, err := io.ReadFull(input, buf[len(buf):n])
+	if err == io.EOF && len(buf) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf[:len(buf)+read], err
+}
+
+// frameError returns the error for a read of frame that failed with err. A
+// timeout in the middle of the frame keeps the bytes read so far for the next
+// read, rather than leaving it to read the rest of the frame as a new one.
+func (nc *netConnection) frameError(frame []byte, err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return ErrTruncatedMessage
+	}
+	if len(frame) > 0 && isTimeout(err) {
+		nc.partial = frame
+		return &PartialFrameError{Err: err}
+	}
+	return err
+}
+
+// trailing returns a copy of the bytes in the input buffer, which were read
+// beyond the last frame returned by ReadMessage.
+func (nc *netConnection) trailing() []byte {
+	br, ok := nc.input.(*bufio.Reader)
+	if !ok || br.Buffered() == 0 {
+		return nil
+	}
+	b, _ := br.Peek(br.Buffered())
+	return append([]byte(nil), b...)
+}
+
+// readLimitError is returned by ReadMessage for a message over the read limit.
+type readLimitError struct {
+	length, limit int64
+}
+
+func (e *readLimitError) Error() string {
+	return fmt.Sprintf("Message length (%d) exceeds the read limit (%d)", e.length, e.limit)
+}
+
+// SetReadLimit sets the maximum size, including the header, of a message read
+// by ReadMessage. Longer messages are rejected before their contents are read.
+// A limit of zero means no limit.
+func (nc *netConnection) SetReadLimit(limit int64) {
+	nc.readLimit = limit
+}
+
+// WriteMessage writes a TLV frame with the standard ndt5 header.
 func (nc *netConnection) WriteMessage(_messageType int, data []byte) error {
 	// _messageType is ignored because it is meaningless for a net.Conn
+	return nc.writeFrame(streamFormat{}, data)
+}
+
+// writeFrame is WriteMessage for frames in the format f.
+func (nc *netConnection) writeFrame(f streamFormat, data []byte) error {
+	if f.byteOrder != nil {
+		frame, err := reorderTLVHeader(data, binary.BigEndian, f.byteOrder)
+		if err != nil {
+			return err
+		}
+		data = frame
+	}
+	if f.wideType {
+		if len(data) < 3 {
+			return errors.New("Message is too short")
+		}
+		data = append([]byte{0}, data...)
+	}
 	_, err := nc.Write(data)
 	return err
 }
 
+func (nc *netConnection) keptDeadline() *readDeadline {
+	return nc.deadline
+}
+
+func (nc *netConnection) keptReceiveGate() *receiveGate {
+	return nc.gate
+}
+
+// SetReadDeadline sets the read deadline of the socket, which is kept apart
+// from the idle timeout, if there is one, and from interrupted reads.
+func (nc *netConnection) SetReadDeadline(t time.Time) error {
+	if nc.deadline == nil {
+		return nc.Conn.SetReadDeadline(t)
+	}
+	return nc.deadline.setReadDeadline(t)
+}
+
+func (nc *netConnection) interruptRead() error {
+	if nc.deadline == nil {
+		return nc.Conn.SetReadDeadline(time.Now())
+	}
+	return nc.deadline.interrupt()
+}
+
+func (nc *netConnection) resumeRead() error {
+	if nc.deadline == nil {
+		return nc.Conn.SetReadDeadline(time.Time{})
+	}
+	return nc.deadline.resume()
+}
+
 func (nc *netConnection) ReadBytes() (bytesRead int64, err error) {
 	n, err := nc.input.Read(nc.c2sBuffer)
 	return int64(n), err
@@ -292,12 +539,12 @@ func (nc *netConnection) StartMeasuring(ctx context.Context) {
 func (nc *netConnection) UUID() string {
 	tcpc, ok := nc.Conn.(*net.TCPConn)
 	if !ok {
-		log.Println("Connection is not a TCPConn")
+		logger.Println("Connection is not a TCPConn")
 		return badUUID
 	}
 	id, err := uuid.FromTCPConn(tcpc)
 	if err != nil {
-		log.Println("Could not discover UUID")
+		logger.Println("Could not discover UUID")
 		// TODO: increment a metric
 		return badUUID
 	}
@@ -326,6 +573,10 @@ func (nc *netConnection) Messager() Messager {
 	return nc.encoding.Messager(nc)
 }
 
+func (nc *netConnection) Encoding() Encoding {
+	return nc.encoding
+}
+
 // MeasuredFlexibleConnection allows a MeasuredConnection to switch between TLV or JSON encoding.
 type MeasuredFlexibleConnection interface {
 	MeasuredConnection
@@ -334,48 +585,551 @@ type MeasuredFlexibleConnection interface {
 
 // AdaptNetConn turns a non-WS-based TCP connection into a protocol.MeasuredConnection that can have its encoding set on the fly.
 func AdaptNetConn(conn net.Conn, input io.Reader) MeasuredFlexibleConnection {
-	return &netConnection{Conn: conn, measurer: newMeasurer(), input: input, c2sBuffer: make([]byte, 8192)}
+	nc := &netConnection{Conn: conn, measurer: newMeasurer(), input: input, c2sBuffer: make([]byte, 8192), gate: &receiveGate{}}
+	if conn != nil {
+		nc.deadline = &readDeadline{rd: conn}
+	}
+	return nc
+}
+
+// AdaptBufferedNetConn is AdaptNetConn, but reads messages from input through a
+// buffer of at least size bytes, so that small messages do not each take
+// several reads. The buffer belongs to the connection, not to any Messager:
+// every Messager on the connection reads through it, and bytes that one
+// Messager's read pulled in ahead of its frame are received by the next.
+// Passing a *bufio.Reader as the input to AdaptNetConn works the same way.
+func AdaptBufferedNetConn(conn net.Conn, input io.Reader, size int) MeasuredFlexibleConnection {
+	return AdaptNetConn(conn, bufio.NewReaderSize(input, size))
+}
+
+// UnexpectedMessageError is returned when a message of one type was expected
+// but a message of another type was received. Payload holds the contents of
+// the unexpected message, decoded as far as the encoding allows, so that
+// callers can act on it; for instance by reporting an early MsgError.
+type UnexpectedMessageError struct {
+	Expected MessageType
+	// ExpectedOneOf holds every acceptable type when more than one was
+	// expected, in which case Expected is the first of them.
+	ExpectedOneOf []MessageType
+	Got           MessageType
+	Payload       []byte
+}
+
+func (e *UnexpectedMessageError) Error() string {
+	if len(e.ExpectedOneOf) > 1 {
+		return fmt.Sprintf("Read wrong message type. Wanted one of %v, got %v", e.ExpectedOneOf, e.Got)
+	}
+	return fmt.Sprintf("Read wrong message type. Wanted %v, got %v", e.Expected, e.Got)
 }
 
-// ReadTLVMessage reads a single NDT message out of the connection.
+// ReadTLVMessage reads a single NDT message out of the connection. If a
+// message of a type other than the expected types is received, the error is
+// an *UnexpectedMessageError.
 func ReadTLVMessage(ws Connection, expectedTypes ...MessageType) ([]byte, MessageType, error) {
+	return readTLVMessage(ws, readLimits{}, expectedTypes...)
+}
+
+// readTLVMessage reads a single NDT message of one of the expected types out
+// of the connection, within the given limits.
+// Keepalive messages are skipped unless MsgKeepalive is one of the expected
+// types.
+func readTLVMessage(ws Connection, lim readLimits, expectedTypes ...MessageType) ([]byte, MessageType, error) {
+	b, kind, _, err := readTLVMessageMeta(ws, lim, expectedTypes...)
+	return b, kind, err
+}
+
+// readTLVMessageMeta is readTLVMessage, but also returns the length declared
+// by the headers of the message, even if the message could not be read.
+func readTLVMessageMeta(ws Connection, lim readLimits, expectedTypes ...MessageType) ([]byte, MessageType, int, error) {
+	for {
+		b, kind, declaredLen, err := readAnyTLVMessageMeta(ws, lim)
+		if err != nil {
+			return nil, kind, declaredLen, err
+		}
+		foundType := false
+		for _, t := range expectedTypes {
+			foundType = foundType || (kind == t)
+		}
+		if foundType {
+			return b, kind, declaredLen, nil
+		}
+		if kind == MsgKeepalive {
+			continue
+		}
+		if len(expectedTypes) == 0 {
+			return nil, kind, declaredLen, fmt.Errorf("Read message type %q, but no types were expected", kind)
+		}
+		ue := &UnexpectedMessageError{Expected: expectedTypes[0], Got: kind, Payload: b}
+		if len(expectedTypes) > 1 {
+			ue.ExpectedOneOf = append([]MessageType{}, expectedTypes...)
+		}
+		return nil, kind, declaredLen, ue
+	}
+}
+
+// readLimiter is implemented by connections that can refuse to read messages
+// over a given size before allocating space for them.
+type readLimiter interface {
+	SetReadLimit(limit int64)
+}
+
+// messageFramer is implemented by connections whose transport preserves the
+// boundaries of the messages written to it, like websockets. Every NDT
+// message is carried by exactly one transport message on such a connection,
+// so a frame is never continued by the next one, whatever its size.
+type messageFramer interface {
+	framesMessages() bool
+}
+
+// framesMessages returns whether conn preserves the boundaries of messages.
+func framesMessages(conn Connection) bool {
+	mf, ok := conn.(messageFramer)
+	return ok && mf.framesMessages()
+}
+
+// trailingReader is implemented by connections that may read bytes beyond
+// the frame they return, and keep them for the next read.
+type trailingReader interface {
+	trailing() []byte
+}
+
+// trailingBytes returns the bytes that conn has read beyond the last frame it
+// returned, if any.
+func trailingBytes(conn Connection) []byte {
+	if tr, ok := conn.(trailingReader); ok {
+		return tr.trailing()
+	}
+	return nil
+}
+
+// maxTLVFrameSize is the largest message that fits in a single TLV frame.
+// Longer messages are split into chunks on connections adapted by
+// AdaptTLVChunking.
+const maxTLVFrameSize = 0xFFFF
+
+// MessageTooLongError is returned when asked to send a message that does not
+// fit in a single TLV frame. Such messages can only be sent on connections
+// adapted by AdaptTLVChunking, as with WriteTLVMessageChunked.
+type MessageTooLongError struct {
+	Type MessageType
+	Size int
+}
+
+func (e *MessageTooLongError) Error() string {
+	return fmt.Sprintf("%v message of %d bytes does not fit in a TLV frame of at most %d bytes", e.Type, e.Size, maxTLVFrameSize)
+}
+
+// checkMessageSize returns a *MessageTooLongError if a message of size bytes
+// cannot be sent in a single frame. Encoders call it before encoding, so that
+// a huge message is rejected without first being copied.
+func checkMessageSize(msgType MessageType, size int) error {
+	if size > maxTLVFrameSize {
+		return &MessageTooLongError{Type: msgType, Size: size}
+	}
+	return nil
+}
+
+// checkFrameSize is checkMessageSize for a message about to be written to ws,
+// which may carry it in several frames.
+func checkFrameSize(ws Connection, msgType MessageType, size int) error {
+	if chunksMessages(ws) {
+		return nil
+	}
+	return checkMessageSize(msgType, size)
+}
+
+// readLimits bounds what reading a message may consume.
+type readLimits struct {
+	// maxSize is the longest message that may be read, or
+	// DefaultMaxMessageSize if it is not positive.
+	maxSize int
+	// budget, if not nil, is charged for every frame that is read.
+	budget *readBudget
+	// peeked, if not nil, holds the message read ahead by peekTLVMessage.
+	peeked *peekedMessage
+	// order, if not nil, checks the type of every message that is read.
+	order *typeOrder
+	// gate, if not nil, can disable reading altogether.
+	gate *receiveGate
+	// cancel, if not nil, can cancel reading from another goroutine.
+	cancel *receiveCanceller
+	// malformed, if not nil, counts the messages that are rejected because
+	// of what the peer sent.
+	malformed *malformedCounter
+}
+
+// peekedMessage is a message that was read ahead, to be returned by the next
+// read.
+type peekedMessage struct {
+	full        bool
+	msg         []byte
+	kind        MessageType
+	declaredLen int
+}
+
+// pending returns whether a message has been read ahead and not yet returned.
+// It is safe to call on a nil *peekedMessage.
+func (p *peekedMessage) pending() bool {
+	return p != nil && p.full
+}
+
+// peekTLVMessage reads the next message, if it has not been read ahead
+// already, and keeps it to be returned by the next read with the same limits.
+// It returns the type of the message.
+func peekTLVMessage(ws Connection, lim readLimits) (MessageType, error) {
+	if lim.peeked == nil {
+		return MsgUnknown, errors.New("peeking is not supported without a buffer for the message")
+	}
+	if lim.peeked.full {
+		return lim.peeked.kind, nil
+	}
+	msg, kind, declaredLen, err := readAnyTLVMessageMeta(ws, lim)
+	if err != nil {
+		return kind, err
+	}
+	*lim.peeked = peekedMessage{full: true, msg: msg, kind: kind, declaredLen: declaredLen}
+	return kind, nil
+}
+
+// readAnyTLVMessage reads a single NDT message of any type out of the
+// connection, reassembling messages that were split into several frames. It
+// rejects messages that exceed the given limits.
+func readAnyTLVMessage(ws Connection, lim readLimits) ([]byte, MessageType, error) {
+	msg, kind, _, err := readAnyTLVMessageMeta(ws, lim)
+	return msg, kind, err
+}
+
+// readAnyTLVMessageMeta is readAnyTLVMessage, but also returns the total
+// length declared by the headers of every frame of the message, even if the
+// message could not be read.
+func readAnyTLVMessageMeta(ws Connection, lim readLimits) ([]byte, MessageType, int, error) {
+	if err := lim.gate.check(); err != nil {
+		return nil, MsgUnknown, 0, err
+	}
+	if err := lim.cancel.start(ws); err != nil {
+		return nil, MsgUnknown, 0, err
+	}
+	defer lim.cancel.stop()
+	if p := lim.peeked; p.pending() {
+		msg, kind, declaredLen := p.msg, p.kind, p.declaredLen
+		*p = peekedMessage{}
+		return msg, kind, declaredLen, nil
+	}
+	maxSize := lim.maxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	msg, kind, declaredLen, err := readTLVFrame(ws, maxSize, lim)
+	if err = lim.cancel.done(ws, err); err != nil {
+		return nil, kind, declaredLen, err
+	}
+	// On connections that chunk messages, a frame of the largest possible
+	// size is followed by the rest of the message. Each continuation frame is
+	// only allowed to be as large as the space remaining under maxSize.
+	for last := len(msg); last == maxTLVFrameSize && chunksMessages(ws); {
+		frame, k, frameLen, err := readTLVFrame(ws, maxSize-len(msg), lim)
+		declaredLen += frameLen
+		err = lim.cancel.done(ws, err)
+		if err == ErrConnectionClosed {
+			// The connection was closed between the frames of a message.
+			err = ErrTruncatedMessage
+		}
+		if err != nil {
+			return nil, k, declaredLen, err
+		}
+		if k != kind {
+			lim.malformed.add()
+			return nil, k, declaredLen, fmt.Errorf("Message of type %v was continued with a message of type %v", kind, k)
+		}
+		msg = append(msg, frame...)
+		last = len(frame)
+	}
+	if err := lim.order.check(kind); err != nil {
+		return nil, kind, declaredLen, err
+	}
+	return msg, kind, declaredLen, nil
+}
+
+// readTLVFrame reads a single TLV frame out of the connection, rejecting
+// frames longer than maxSize and charging the frame to the budget of lim, if
+// there is one. It also returns the length declared by the header of the
+// frame, if there was one.
+func readTLVFrame(ws Connection, maxSize int, lim readLimits) ([]byte, MessageType, int, error) {
+	budget := lim.budget
+	if err := budget.check(); err != nil {
+		return nil, MsgUnknown, 0, err
+	}
+	if rl, ok := ws.(readLimiter); ok {
+		// Leave room for the type and length header.
+		rl.SetReadLimit(int64(maxSize + 3))
+	}
 	_, inbuff, err := ws.ReadMessage()
 	if err != nil {
-		return nil, MsgUnknown, err
+		var rle *readLimitError
+		if errors.As(err, &rle) {
+			lim.malformed.add()
+		}
+		return nil, MsgUnknown, 0, err
 	}
-	if len(inbuff) < 3 {
-		return nil, MsgUnknown, errors.New("Message is too short")
+	if err := budget.charge(len(inbuff)); err != nil {
+		return nil, MsgUnknown, 0, err
 	}
-	foundType := false
-	for _, t := range expectedTypes {
-		foundType = foundType || (MessageType(inbuff[0]) == t)
+	msg, kind, declaredLen, err := parseTLVFrame(inbuff, maxSize)
+	if err != nil {
+		lim.malformed.add()
 	}
-	if !foundType {
-		return nil, MessageType(inbuff[0]), fmt.Errorf("Read wrong message type. Wanted one of %v, got %q", expectedTypes, MessageType(inbuff[0]))
+	return msg, kind, declaredLen, err
+}
+
+// ParseTLVFrame parses data as a single complete TLV frame and returns its type
+// and payload. The payload shares memory with data. It returns an error for
+// frames that are truncated or that have data beyond the length in their
+// header, and never panics, whatever the input.
+func ParseTLVFrame(data []byte) (MessageType, []byte, error) {
+	payload, kind, _, err := parseTLVFrame(data, maxTLVFrameSize)
+	return kind, payload, err
+}
+
+// parseTLVFrame is ParseTLVFrame, but also rejects frames longer than maxSize
+// and returns the length declared by the header of the frame, if there was
+// one.
+func parseTLVFrame(data []byte, maxSize int) ([]byte, MessageType, int, error) {
+	kind, expectedLen, err := parseTLVHeader(data)
+	if err != nil {
+		return nil, kind, 0, err
 	}
 	// Verify that the expected length matches the given data.
-	expectedLen := int(inbuff[1])<<8 + int(inbuff[2])
-	if expectedLen != len(inbuff[3:]) {
-		return nil, MessageType(inbuff[0]), fmt.Errorf("Message length (%d) does not match length of data received (%d)",
-			expectedLen, len(inbuff[3:]))
+	if expectedLen > maxSize {
+		return nil, MessageType(data[0]), expectedLen, fmt.Errorf("Message length (%d) exceeds the maximum message size (%d)", expectedLen, maxSize)
+	}
+	if expectedLen != len(data[3:]) {
+		return nil, MessageType(data[0]), expectedLen, fmt.Errorf("Message length (%d) does not match length of data received (%d)",
+			expectedLen, len(data[3:]))
+	}
+	return data[3:], MessageType(data[0]), expectedLen, nil
+}
+
+// parseTLVHeader returns the type and the declared length of the frame that
+// starts data. The length is in network byte order, big-endian.
+func parseTLVHeader(data []byte) (MessageType, int, error) {
+	if len(data) < 3 {
+		return MsgUnknown, 0, errors.New("Message is too short")
+	}
+	return MessageType(data[0]), int(data[1])<<8 + int(data[2]), nil
+}
+
+// putTLVHeader fills in the header of frame, whose first three bytes are
+// reserved for it. The length is written in network byte order, big-endian.
+func putTLVHeader(frame []byte, msgType MessageType) error {
+	size := len(frame) - 3
+	if err := checkMessageSize(msgType, size); err != nil {
+		// The length would not fit in the header.
+		return err
+	}
+	frame[0] = byte(msgType)
+	frame[1] = byte((size >> 8) & 0xFF)
+	frame[2] = byte(size & 0xFF)
+	return nil
+}
+
+// EncodeTLV returns the TLV frame that carries payload as a message of the
+// given type, as WriteTLVMessage would write it. Payloads that do not fit in
+// a single frame return a *MessageTooLongError. On connections adapted by
+// AdaptTLVChunking, a frame that carries the largest possible payload must be
+// followed by an empty frame of the same type, which WriteTLVMessage adds but
+// EncodeTLV does not.
+func EncodeTLV(kind MessageType, payload []byte) ([]byte, error) {
+	frame := make([]byte, 3, 3+len(payload))
+	frame = append(frame, payload...)
+	if err := putTLVHeader(frame, kind); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// DecodeTLV decodes the TLV frame at the start of data, and returns its type,
+// its payload, and the number of bytes of data that the frame takes up, so
+// that several frames can be decoded from the same buffer. The payload shares
+// memory with data. It returns an error if data is shorter than the frame.
+func DecodeTLV(data []byte) (MessageType, []byte, int, error) {
+	kind, size, err := parseTLVHeader(data)
+	if err != nil {
+		return kind, nil, 0, err
+	}
+	if len(data) < 3+size {
+		return kind, nil, 0, fmt.Errorf("frame of %d bytes is truncated to %d bytes", 3+size, len(data))
+	}
+	return kind, data[3 : 3+size], 3 + size, nil
+}
+
+// EncodeJSON returns the TLV frame that carries payload in the "msg" field of
+// a JSON object, as a JSON Messager would send it.
+func EncodeJSON(kind MessageType, payload []byte) ([]byte, error) {
+	if err := checkMessageSize(kind, len(payload)); err != nil {
+		return nil, err
+	}
+	frame := bytes.NewBuffer(make([]byte, 3, 3+len(payload)+len(`{"msg":""}`)))
+	if err := encodeJSON(frame, &JSONMessage{Msg: string(payload)}); err != nil {
+		return nil, err
+	}
+	if err := putTLVHeader(frame.Bytes(), kind); err != nil {
+		return nil, err
+	}
+	return frame.Bytes(), nil
+}
+
+// DecodeJSON decodes the TLV frame at the start of data, like DecodeTLV, and
+// returns the "msg" field of the JSON object it carries as the payload.
+func DecodeJSON(data []byte) (MessageType, []byte, int, error) {
+	kind, b, n, err := DecodeTLV(data)
+	if err != nil {
+		return kind, nil, n, err
+	}
+	msg := &JSONMessage{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return kind, nil, n, err
+	}
+	return kind, []byte(msg.Msg), n, nil
+}
+
+// framePool holds the buffers used to build outgoing messages, so that a
+// server with many concurrent clients does not allocate a new buffer for
+// every message it sends.
+var framePool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooledFrameSize is the capacity above which buffers are not returned to
+// the pool, to avoid pinning the memory used by unusually large messages.
+const maxPooledFrameSize = 64*1024 + 3
+
+// emptyHeader reserves space for the header of a frame, which is filled in
+// once the length of the message is known.
+var emptyHeader [3]byte
+
+// newFrame returns an empty buffer from the pool with space reserved for the
+// header of a TLV frame. The message contents should be appended to it.
+func newFrame() *bytes.Buffer {
+	frame := framePool.Get().(*bytes.Buffer)
+	frame.Reset()
+	frame.Write(emptyHeader[:])
+	return frame
+}
+
+// writeFrame fills in the header of a frame built by newFrame, writes it to
+// the connection, and returns the buffer to the pool. On connections that
+// chunk messages, a message that does not fit in a frame is split into as
+// many as it needs, and one that fills its last frame is followed by an empty
+// frame, which ends it.
+func writeFrame(ws Connection, msgType MessageType, frame *bytes.Buffer) error {
+	if frame.Len()-3 < maxTLVFrameSize || !chunksMessages(ws) {
+		return writeChunk(ws, msgType, frame)
+	}
+	defer func() {
+		if frame.Cap() <= maxPooledFrameSize {
+			framePool.Put(frame)
+		}
+	}()
+	message := frame.Bytes()[3:]
+	for {
+		n := len(message)
+		if n > maxTLVFrameSize {
+			n = maxTLVFrameSize
+		}
+		chunk := newFrame()
+		chunk.Write(message[:n])
+		if err := writeChunk(ws, msgType, chunk); err != nil {
+			return err
+		}
+		if n < maxTLVFrameSize {
+			return nil
+		}
+		message = message[n:]
 	}
-	return inbuff[3:], MessageType(inbuff[0]), nil
+}
+
+// writeChunk writes a frame built by newFrame as a single frame, whether or
+// not another frame continues it.
+func writeChunk(ws Connection, msgType MessageType, frame *bytes.Buffer) error {
+	defer func() {
+		if frame.Cap() <= maxPooledFrameSize {
+			framePool.Put(frame)
+		}
+	}()
+	outbuff := frame.Bytes()
+	if err := putTLVHeader(outbuff, msgType); err != nil {
+		return err
+	}
+	if *verbose {
+		logger.Printf("%s is getting sent a TLV of: %s, %d, %q\n", ws.String(), msgType.String(), len(outbuff)-3, outbuff[3:])
+	}
+	return ws.WriteMessage(websocket.BinaryMessage, outbuff)
 }
 
 // WriteTLVMessage write a single NDT message to the connection.
 func WriteTLVMessage(ws Connection, msgType MessageType, message string) error {
-	msgBytes := []byte(message)
-	if *verbose {
-		log.Printf("%s is getting sent a TLV of: %s, %d, %q\n", ws.String(), msgType.String(), len(msgBytes), message)
+	if err := checkFrameSize(ws, msgType, len(message)); err != nil {
+		return err
 	}
-	outbuff := make([]byte, 3+len(msgBytes))
-	outbuff[0] = byte(msgType)
-	outbuff[1] = byte((len(msgBytes) >> 8) & 0xFF)
-	outbuff[2] = byte(len(msgBytes) & 0xFF)
-	for i := range msgBytes {
-		outbuff[i+3] = msgBytes[i]
+	frame := newFrame()
+	frame.WriteString(message)
+	return writeFrame(ws, msgType, frame)
+}
+
+// WriteTLVMessageChunked writes a single NDT message to the connection,
+// splitting it into as many frames as needed to carry messages longer than a
+// single frame allows, as WriteTLVMessage does on a connection adapted by
+// AdaptTLVChunking. The peer must read it from a connection adapted the same
+// way. Connections that preserve message boundaries, like websockets, cannot
+// carry messages longer than a single frame.
+func WriteTLVMessageChunked(ws Connection, msgType MessageType, message string) error {
+	return WriteTLVMessage(AdaptTLVChunking(ws), msgType, message)
+}
+
+// writeTLVMessage is WriteTLVMessage for a message that is already a byte
+// slice.
+func writeTLVMessage(ws Connection, msgType MessageType, message []byte) error {
+	if err := checkFrameSize(ws, msgType, len(message)); err != nil {
+		return err
 	}
-	return ws.WriteMessage(websocket.BinaryMessage, outbuff)
+	frame := newFrame()
+	frame.Write(message)
+	return writeFrame(ws, msgType, frame)
+}
+
+// writeRawFrame writes prefix, raw, and suffix to the connection as a single
+// frame, without checking that they form a valid message.
+func writeRawFrame(ws Connection, msgType MessageType, prefix, raw, suffix []byte) error {
+	size := len(prefix) + len(raw) + len(suffix)
+	if size > maxTLVFrameSize {
+		return fmt.Errorf("raw frame of %d bytes does not fit in a single frame", size)
+	}
+	frame := newFrame()
+	frame.Write(prefix)
+	frame.Write(raw)
+	frame.Write(suffix)
+	return writeFrame(ws, msgType, frame)
+}
+
+// writeJSONFrame writes v to the connection as a single NDT message containing
+// the JSON encoding of v.
+func writeJSONFrame(ws Connection, msgType MessageType, v interface{}) error {
+	frame := newFrame()
+	if err := encodeJSON(frame, v); err != nil {
+		framePool.Put(frame)
+		return err
+	}
+	return writeFrame(ws, msgType, frame)
+}
+
+// encodeJSON appends the JSON encoding of v to frame.
+func encodeJSON(frame *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(frame).Encode(v); err != nil {
+		return err
+	}
+	// Unlike json.Marshal, Encode adds a trailing newline.
+	frame.Truncate(frame.Len() - 1)
+	return nil
 }
 
 // JSONMessage holds the JSON messages we can receive from the server. We
@@ -394,20 +1148,148 @@ func (n *JSONMessage) String() string {
 
 // ReceiveJSONMessage reads a single NDT message in JSON format.
 func ReceiveJSONMessage(ws Connection, expectedType MessageType) (*JSONMessage, error) {
-	message := &JSONMessage{}
-	jsonString, _, err := ReadTLVMessage(ws, expectedType)
+	message, _, _, err := receiveJSONMessage(ws, readLimits{}, jsonDecoding{}, expectedType)
+	return message, err
+}
+
+// InvalidUTF8Error is returned for a received JSON message that is not valid
+// UTF-8, when UTF8Reject is set with WithUTF8Validation.
+type InvalidUTF8Error struct {
+	// Offset is the position of the first invalid byte in the message.
+	Offset int
+}
+
+func (e *InvalidUTF8Error) Error() string {
+	return fmt.Sprintf("JSON message has invalid UTF-8 at byte %d", e.Offset)
+}
+
+// jsonDecoding holds the settings used to decode received JSON messages.
+type jsonDecoding struct {
+	strict   bool
+	utf8Mode UTF8Mode
+}
+
+// checkUTF8 applies the UTF8Mode to b. It returns b itself unless invalid
+// UTF-8 is replaced.
+func (d jsonDecoding) checkUTF8(b []byte) ([]byte, error) {
+	if d.utf8Mode == UTF8Unchecked || utf8.Valid(b) {
+		return b, nil
+	}
+	if d.utf8Mode == UTF8Replace {
+		return bytes.ToValidUTF8(b, []byte(string(utf8.RuneError))), nil
+	}
+	offset := 0
+	for offset < len(b) {
+		r, size := utf8.DecodeRune(b[offset:])
+		if r == utf8.RuneError && size == 1 {
+			break
+		}
+		offset += size
+	}
+	return nil, &InvalidUTF8Error{Offset: offset}
+}
+
+// unmarshalJSON decodes b into v. In strict mode, unknown and duplicate
+// top-level keys are errors.
+func unmarshalJSON(b []byte, v interface{}, d jsonDecoding) error {
+	b, err := d.checkUTF8(b)
+	if err != nil {
+		return err
+	}
+	if !d.strict {
+		return json.Unmarshal(b, v)
+	}
+	if err := checkDuplicateJSONKeys(b); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// unmarshalJSONMessages decodes b, which holds one or more JSON objects one
+// after the other, as sent by clients that coalesce several messages into a
+// single frame. Each object is decoded like unmarshalJSON decodes a message
+// on its own.
+func unmarshalJSONMessages(b []byte, d jsonDecoding) ([]*JSONMessage, error) {
+	b, err := d.checkUTF8(b)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(jsonString, &message)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var msgs []*JSONMessage
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg := &JSONMessage{}
+		if err := unmarshalJSON(raw, msg, d); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return nil, errors.New("no JSON object in the message")
+	}
+	return msgs, nil
+}
+
+// checkDuplicateJSONKeys returns an error if the JSON object in b has the same
+// top-level key more than once. Anything other than an object is left for the
+// decoder to reject.
+func checkDuplicateJSONKeys(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		key := tok.(string)
+		if seen[key] {
+			return fmt.Errorf("duplicate key %q in JSON message", key)
+		}
+		seen[key] = true
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// receiveJSONMessage reads a single NDT message of one of the expected types
+// in JSON format, within the given limits. It also returns the length of the
+// JSON declared by the TLV headers.
+func receiveJSONMessage(ws Connection, lim readLimits, d jsonDecoding, expectedTypes ...MessageType) (*JSONMessage, MessageType, int, error) {
+	message := &JSONMessage{}
+	jsonString, kind, declaredLen, err := readTLVMessageMeta(ws, lim, expectedTypes...)
 	if err != nil {
-		return &JSONMessage{Msg: string(jsonString)}, err
+		if ue, ok := err.(*UnexpectedMessageError); ok && json.Unmarshal(ue.Payload, message) == nil {
+			ue.Payload = []byte(message.Msg)
+		}
+		return nil, kind, declaredLen, err
+	}
+	err = unmarshalJSON(jsonString, message, d)
+	if err != nil {
+		lim.malformed.add()
+		return &JSONMessage{Msg: string(jsonString)}, kind, declaredLen, err
 	}
-	return message, nil
+	return message, kind, declaredLen, nil
 }
 
 // SendJSONMessage writes a single NDT message in JSON format.
 func SendJSONMessage(msgType MessageType, msg string, ws Connection) error {
-	message := &JSONMessage{Msg: msg}
-	return WriteTLVMessage(ws, msgType, message.String())
+	if err := checkMessageSize(msgType, len(msg)); err != nil {
+		return err
+	}
+	return writeJSONFrame(ws, msgType, &JSONMessage{Msg: msg})
 }
@@ -32,10 +32,28 @@ func Test_verifyStringConversions(t *testing.T) {
 		{protocol.MsgLogout, "MsgLogout"},
 		{protocol.MsgWaiting, "MsgWaiting"},
 		{protocol.MsgExtendedLogin, "MsgExtendedLogin"},
+		{protocol.MsgKeepalive, "MsgKeepalive"},
 	} {
 		if subtest.mt.String() != subtest.str {
 			t.Errorf("%q != %q", subtest.mt.String(), subtest.str)
 		}
+		if mt, err := protocol.ParseMessageType(subtest.str); err != nil || mt != subtest.mt {
+			t.Errorf("ParseMessageType(%q) = %v, %v, want %v", subtest.str, mt, err, subtest.mt)
+		}
+	}
+}
+
+func TestParseMessageType(t *testing.T) {
+	for i := 0; i <= 0xFF; i++ {
+		m := protocol.MessageType(i)
+		if got, err := protocol.ParseMessageType(m.String()); err != nil || got != m {
+			t.Errorf("ParseMessageType(%q) = %v, %v, want %v", m.String(), got, err, m)
+		}
+	}
+	for _, name := range []string{"", "testmsg", "MsgNothing", "UnknownMessage(0x100)"} {
+		if _, err := protocol.ParseMessageType(name); err == nil {
+			t.Errorf("ParseMessageType(%q) succeeded", name)
+		}
 	}
 }
 
@@ -90,6 +108,7 @@ func (fc *fakeConnection) Close() error                   { return nil }
 func (fc *fakeConnection) UUID() string                   { return "" }
 func (fc *fakeConnection) String() string                 { return "" }
 func (fc *fakeConnection) Messager() protocol.Messager    { return nil }
+func (fc *fakeConnection) Encoding() protocol.Encoding    { return protocol.Unknown }
 
 func assertFakeConnectionIsConnection(fc *fakeConnection) {
 	func(c protocol.Connection) {}(fc)
@@ -157,3 +176,31 @@ func Test_ReceiveJSONMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTLVFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		kind    protocol.MessageType
+		payload []byte
+		wantErr bool
+	}{
+		{name: "empty-payload", data: []byte{byte(protocol.MsgLogin), 0, 0}, kind: protocol.MsgLogin, payload: []byte{}},
+		{name: "payload", data: []byte{byte(protocol.TestMsg), 0, 2, 'h', 'i'}, kind: protocol.TestMsg, payload: []byte("hi")},
+		{name: "nil", data: nil, wantErr: true},
+		{name: "short-header", data: []byte{byte(protocol.TestMsg), 0}, wantErr: true},
+		{name: "truncated", data: []byte{byte(protocol.TestMsg), 0, 3, 'h', 'i'}, wantErr: true},
+		{name: "oversized", data: []byte{byte(protocol.TestMsg), 0, 1, 'h', 'i'}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, payload, err := protocol.ParseTLVFrame(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTLVFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (kind != tt.kind || !reflect.DeepEqual(payload, tt.payload)) {
+				t.Errorf("ParseTLVFrame() = %v, %q, want %v, %q", kind, payload, tt.kind, tt.payload)
+			}
+		})
+	}
+}
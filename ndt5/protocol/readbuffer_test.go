@@ -0,0 +1,217 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// countingReader counts the calls to Read of the reader it wraps.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.Reader.Read(p)
+}
+
+func TestReadBufferSize(t *testing.T) {
+	payloads := []string{"", "a", strings.Repeat("b", 13), strings.Repeat("c", 17), strings.Repeat("d", 100), "e"}
+	var wire bytes.Buffer
+	for _, p := range payloads {
+		wire.Write(historicalTLVFrame(TestMsg, []byte(p)))
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	read := func(size int) int {
+		cr := &countingReader{Reader: bytes.NewReader(wire.Bytes())}
+		conn := AdaptNetConn(server, cr)
+		if size > 0 {
+			conn = AdaptBufferedNetConn(server, cr, size)
+		}
+		m := TLV.Messager(conn)
+		for _, want := range payloads {
+			// The smallest buffer makes frames span refills.
+			if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != want {
+				t.Fatalf("ReceiveMessage() = %q, %v, want %q", b, err, want)
+			}
+		}
+		if _, err := m.ReceiveMessage(TestMsg); err != ErrConnectionClosed {
+			t.Errorf("ReceiveMessage() at the end = %v, want ErrConnectionClosed", err)
+		}
+		return cr.reads
+	}
+	unbuffered := read(0)
+	read(16)
+	buffered := read(4096)
+	if buffered >= unbuffered {
+		t.Errorf("buffered reads = %d, want fewer than %d unbuffered reads", buffered, unbuffered)
+	}
+}
+
+func TestTrailing(t *testing.T) {
+	second := historicalTLVFrame(MsgLogin, []byte("pipelined"))
+	extra := []byte{byte(TestMsg), 0}
+	var wire bytes.Buffer
+	wire.Write(historicalTLVFrame(TestMsg, []byte("first")))
+	wire.Write(second)
+	wire.Write(extra)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	m := TLV.Messager(AdaptBufferedNetConn(server, bytes.NewReader(wire.Bytes()), 64)).(ExtendedMessager)
+	if b := m.Trailing(); b != nil {
+		t.Errorf("Trailing() before receiving = %q, want nil", b)
+	}
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "first" {
+		t.Fatalf("ReceiveMessage() = %q, %v, want \"first\"", b, err)
+	}
+	want := append(append([]byte(nil), second...), extra...)
+	got := m.Trailing()
+	if !bytes.Equal(got, want) {
+		t.Errorf("Trailing() = %q, want %q", got, want)
+	}
+	// Trailing returns a copy, which the next receive does not disturb.
+	got[0] = 0
+	if b, err := m.ReceiveMessage(MsgLogin); err != nil || string(b) != "pipelined" {
+		t.Fatalf("ReceiveMessage() of the trailing message = %q, %v, want \"pipelined\"", b, err)
+	}
+	if b := m.Trailing(); !bytes.Equal(b, extra) {
+		t.Errorf("Trailing() after the pipelined message = %q, want %q", b, extra)
+	}
+
+	// Unbuffered connections never read ahead.
+	m = TLV.Messager(AdaptNetConn(server, bytes.NewReader(wire.Bytes()))).(ExtendedMessager)
+	m.ReceiveMessage(TestMsg)
+	if b := m.Trailing(); b != nil {
+		t.Errorf("Trailing() without a read buffer = %q, want nil", b)
+	}
+	lc := &loopbackConnection{}
+	lm := JSON.Messager(lc).(ExtendedMessager)
+	lm.SendMessage(TestMsg, []byte("one"))
+	lm.SendMessage(TestMsg, []byte("two"))
+	lm.ReceiveMessage(TestMsg)
+	if b := lm.Trailing(); b != nil {
+		t.Errorf("Trailing() on a connection that reads whole frames = %q, want nil", b)
+	}
+}
+
+func TestReadBufferSharedByMessagers(t *testing.T) {
+	var wire bytes.Buffer
+	wire.Write(historicalTLVFrame(TestMsg, []byte("first")))
+	wire.Write(historicalTLVFrame(MsgLogin, []byte("pipelined")))
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The first Messager reads both frames into the buffer, and the second,
+	// created later on the same connection, receives the one read ahead.
+	conn := AdaptBufferedNetConn(server, bytes.NewReader(wire.Bytes()), 64)
+	first := TLV.Messager(conn)
+	if b, err := first.ReceiveMessage(TestMsg); err != nil || string(b) != "first" {
+		t.Fatalf("ReceiveMessage() = %q, %v, want \"first\"", b, err)
+	}
+	second := TLV.Messager(conn).(ExtendedMessager)
+	if b := second.Trailing(); b == nil {
+		t.Error("Trailing() on a second Messager = nil, want the pipelined frame")
+	}
+	if b, err := second.ReceiveMessage(MsgLogin); err != nil || string(b) != "pipelined" {
+		t.Errorf("ReceiveMessage() on a second Messager = %q, %v, want \"pipelined\"", b, err)
+	}
+}
+
+func benchmarkReadBuffer(b *testing.B, size int) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	frame := historicalTLVFrame(TestMsg, []byte("MaxRTT: 12345\n"))
+	go func() {
+		// Write in batches, as a client sending several messages at once.
+		batch := bytes.Repeat(frame, 16)
+		for {
+			if _, err := client.Write(batch); err != nil {
+				return
+			}
+		}
+	}()
+	cr := &countingReader{Reader: server}
+	conn := AdaptNetConn(server, cr)
+	if size > 0 {
+		conn = AdaptBufferedNetConn(server, cr, size)
+	}
+	m := TLV.Messager(conn)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.ReceiveMessage(TestMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(cr.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkReceiveMessageUnbuffered(b *testing.B) {
+	benchmarkReadBuffer(b, 0)
+}
+
+func BenchmarkReceiveMessageBuffered(b *testing.B) {
+	benchmarkReadBuffer(b, 4096)
+}
+
+// repeatingConnection returns the same frame from every read, without
+// allocating.
+type repeatingConnection struct {
+	loopbackConnection
+	frame []byte
+}
+
+func (rc *repeatingConnection) ReadMessage() (int, []byte, error) {
+	return 0, rc.frame, nil
+}
+
+func TestReceiveMessageIntoBuffer(t *testing.T) {
+	rc := &repeatingConnection{frame: historicalTLVFrame(TestMsg, []byte("MaxRTT: 12345\n"))}
+	m := TLV.Messager(rc).(ExtendedMessager)
+
+	buf := make([]byte, 14)
+	n, err := m.ReceiveMessageIntoBuffer(TestMsg, buf)
+	if err != nil || string(buf[:n]) != "MaxRTT: 12345\n" {
+		t.Errorf("ReceiveMessageIntoBuffer() = %q, %v", buf[:n], err)
+	}
+	if n, err := m.ReceiveMessageIntoBuffer(TestMsg, buf[:10]); err != io.ErrShortBuffer || n != 14 {
+		t.Errorf("ReceiveMessageIntoBuffer() with a short buffer = %d, %v, want 14, io.ErrShortBuffer", n, err)
+	}
+	grown, err := m.ReceiveMessageAppend(TestMsg, buf[:0:10])
+	if err != nil || string(grown) != "MaxRTT: 12345\n" {
+		t.Errorf("ReceiveMessageAppend() = %q, %v", grown, err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		m.ReceiveMessageIntoBuffer(TestMsg, buf)
+		buf, _ = m.ReceiveMessageAppend(TestMsg, buf[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("receiving into a buffer made %v allocations, want 0", allocs)
+	}
+
+	for _, enc := range []Encoding{JSON, MessagePack} {
+		lc := &loopbackConnection{}
+		enc.Messager(lc).SendMessage(TestMsg, []byte("hi"))
+		br := enc.Messager(lc).(ExtendedMessager)
+		if _, err := br.ReceiveMessageIntoBuffer(TestMsg, buf); err != ErrBufferUnsupported {
+			t.Errorf("%v: ReceiveMessageIntoBuffer() = %v, want ErrBufferUnsupported", enc, err)
+		}
+		if _, err := br.ReceiveMessageAppend(TestMsg, buf); err != ErrBufferUnsupported {
+			t.Errorf("%v: ReceiveMessageAppend() = %v, want ErrBufferUnsupported", enc, err)
+		}
+		if len(lc.frames) != 1 {
+			t.Errorf("%v: the message was read", enc)
+		}
+	}
+}
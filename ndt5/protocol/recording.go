@@ -0,0 +1,75 @@
+package protocol
+
+import "sync"
+
+// SentFrame is a message that was sent through a RecordingMessager.
+type SentFrame struct {
+	Type MessageType
+	Data []byte
+	// S2CResults holds the results when the frame was sent by SendS2CResults,
+	// in which case Data is nil.
+	S2CResults *S2CResult
+}
+
+// RecordingMessager wraps another Messager, forwarding all calls to it and
+// recording every message that is successfully sent. It is safe to send from
+// multiple goroutines at once: sends are made one at a time, so that the
+// frames are recorded in the order they were sent.
+type RecordingMessager struct {
+	Messager
+	mu   sync.Mutex
+	sent []SentFrame
+}
+
+// NewRecordingMessager creates a RecordingMessager that forwards to m.
+func NewRecordingMessager(m Messager) *RecordingMessager {
+	return &RecordingMessager{Messager: m}
+}
+
+// SendMessage forwards the message and records it if it was sent.
+func (r *RecordingMessager) SendMessage(kind MessageType, contents []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.Messager.SendMessage(kind, contents)
+	if err == nil {
+		r.sent = append(r.sent, SentFrame{Type: kind, Data: append([]byte{}, contents...)})
+	}
+	return err
+}
+
+// SendMessageString forwards the message and records it if it was sent.
+func (r *RecordingMessager) SendMessageString(kind MessageType, s string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.Messager.SendMessageString(kind, s)
+	if err == nil {
+		r.sent = append(r.sent, SentFrame{Type: kind, Data: []byte(s)})
+	}
+	return err
+}
+
+// SendS2CResults forwards the results and records them if they were sent.
+func (r *RecordingMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+	if err == nil {
+		r.sent = append(r.sent, SentFrame{
+			Type: TestMsg,
+			S2CResults: &S2CResult{
+				ThroughputKbps: throughputKbps,
+				UnsentBytes:    unsentBytes,
+				TotalSentBytes: totalSentBytes,
+			},
+		})
+	}
+	return err
+}
+
+// Sent returns a copy of the frames sent so far, in the order they were sent.
+// It waits for a send in progress to finish.
+func (r *RecordingMessager) Sent() []SentFrame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SentFrame{}, r.sent...)
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func assertRecordingMessagerIsMessager(r *RecordingMessager) {
+	func(m Messager) {}(r)
+}
+
+func TestRecordingMessager(t *testing.T) {
+	n := NewNopMessager(TLV)
+	n.AddResponse(TestMsg, []byte("rate"))
+	r := NewRecordingMessager(n)
+
+	buf := []byte("0")
+	r.SendMessage(SrvQueue, buf)
+	buf[0] = 'X' // Reusing the buffer must not change the recording.
+	r.SendMessage(MsgLogin, []byte("v5.0-NDTinGO"))
+	r.SendS2CResults(100, 0, 12345)
+	b, err := r.ReceiveMessage(TestMsg)
+	if err != nil || string(b) != "rate" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+	r.SendMessage(MsgLogout, []byte{})
+
+	want := []SentFrame{
+		{Type: SrvQueue, Data: []byte("0")},
+		{Type: MsgLogin, Data: []byte("v5.0-NDTinGO")},
+		{Type: TestMsg, S2CResults: &S2CResult{ThroughputKbps: 100, TotalSentBytes: 12345}},
+		{Type: MsgLogout, Data: []byte{}},
+	}
+	if got := r.Sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sent() = %+v, want %+v", got, want)
+	}
+	if n.SentTotal() != 4 || r.Encoding() != TLV {
+		t.Errorf("Calls were not forwarded: sent %d, encoding %v", n.SentTotal(), r.Encoding())
+	}
+}
+
+type failingMessager struct {
+	NopMessager
+}
+
+func (f *failingMessager) SendMessage(MessageType, []byte) error {
+	return errors.New("send failed")
+}
+
+func TestRecordingMessagerSkipsFailedSends(t *testing.T) {
+	r := NewRecordingMessager(&failingMessager{})
+	if err := r.SendMessage(TestMsg, []byte("x")); err == nil {
+		t.Error("SendMessage() should return the inner error")
+	}
+	if len(r.Sent()) != 0 {
+		t.Errorf("Sent() = %+v, want no frames", r.Sent())
+	}
+}
+
+func TestRecordingMessagerConcurrentSends(t *testing.T) {
+	r := NewRecordingMessager(NewNopMessager(JSON))
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.SendMessage(TestMsg, []byte("x"))
+			}
+		}()
+	}
+	wg.Wait()
+	if len(r.Sent()) != 1000 {
+		t.Errorf("len(Sent()) = %d, want 1000", len(r.Sent()))
+	}
+}
+
+func TestRecordingMessagerRecordsWireOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	r := NewRecordingMessager(TLV.Messager(AdaptNetConn(server, server)))
+	peer := TLV.Messager(AdaptNetConn(client, client))
+
+	const senders, sends = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				switch j % 3 {
+				case 0:
+					r.SendMessage(TestMsg, []byte(fmt.Sprintf("%d.%d", i, j)))
+				case 1:
+					r.SendMessageString(MsgLogin, fmt.Sprintf("%d.%d", i, j))
+				default:
+					r.SendS2CResults(int64(i), int64(j), 0)
+				}
+			}
+		}(i)
+	}
+	received := make([]SentFrame, senders*sends)
+	for i := range received {
+		kind, b, err := peer.ReceiveAnyMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[i] = SentFrame{Type: kind, Data: b}
+	}
+	wg.Wait()
+
+	sent := r.Sent()
+	if len(sent) != len(received) {
+		t.Fatalf("len(Sent()) = %d, want %d", len(sent), len(received))
+	}
+	for i, f := range sent {
+		if f.S2CResults != nil {
+			// Encode the results as they went over the wire.
+			lc := &loopbackConnection{}
+			m := TLV.Messager(lc)
+			m.SendS2CResults(f.S2CResults.ThroughputKbps, f.S2CResults.UnsentBytes, f.S2CResults.TotalSentBytes)
+			b, _ := m.ReceiveMessage(TestMsg)
+			f = SentFrame{Type: TestMsg, Data: b}
+		}
+		if !reflect.DeepEqual(f, received[i]) {
+			t.Fatalf("Sent()[%d] = %q, but the peer received %q", i, f.Data, received[i].Data)
+		}
+	}
+}
+
+func TestRecordingMessagerSendMessageString(t *testing.T) {
+	r := NewRecordingMessager(NewNopMessager(JSON))
+	r.SendMessageString(MsgLogin, "v5.0")
+	want := []SentFrame{{Type: MsgLogin, Data: []byte("v5.0")}}
+	if got := r.Sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sent() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,9 @@
+package protocol
+
+// resetMessager returns the connection and the options for a Messager for e
+// that is reset to use conn, given the options it had before.
+func resetMessager(e Encoding, conn Connection, old messagerOptions) (Connection, messagerOptions) {
+	old.active.close()
+	// The same options were accepted when the Messager was created.
+	return openMessager(e, conn, old.opts)
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import "testing"
+
+func TestReset(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			first := &closeCountingConnection{}
+			m := enc.Messager(first, WithByteCounts(), WithSequenceNumbers(), WithReadBudget(1000),
+				WithTypeOrder(MsgLogin, TestMsg)).(ExtendedMessager)
+			m.SendMessage(MsgLogin, []byte("one"))
+			m.SendMessage(TestMsg, []byte("two"))
+			if _, err := m.ReceiveMessage(MsgLogin); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.(ExtendedMessager).Peek(); err != nil {
+				t.Fatal(err)
+			}
+			m.(ExtendedMessager).SetReceiveDisabled(true)
+			m.CancelReceive()
+			m.Close()
+
+			second := &closeCountingConnection{}
+			m.Reset(second)
+
+			if m.(ExtendedMessager).HasBuffered() {
+				t.Error("HasBuffered() after Reset() = true")
+			}
+			cm := m.(ExtendedMessager)
+			if cm.BytesSent() != 0 || cm.BytesReceived() != 0 {
+				t.Errorf("byte counts after Reset() = %d, %d, want 0, 0", cm.BytesSent(), cm.BytesReceived())
+			}
+			if sent, received := m.(ExtendedMessager).Sequence(); sent != 0 || received != 0 {
+				t.Errorf("Sequence() after Reset() = %d, %d, want 0, 0", sent, received)
+			}
+
+			// The Messager uses the new connection only, with its options
+			// applied afresh: the type order starts over, and receiving
+			// works again.
+			if err := m.SendMessage(MsgLogin, []byte("three")); err != nil {
+				t.Fatal(err)
+			}
+			if len(first.frames) != 0 || len(second.frames) != 1 {
+				t.Fatalf("connections hold %d and %d frames, want 0 and 1", len(first.frames), len(second.frames))
+			}
+			if b, err := m.ReceiveMessage(MsgLogin); err != nil || string(b) != "three" {
+				t.Errorf("ReceiveMessage() after Reset() = %q, %v, want \"three\"", b, err)
+			}
+			if sent, received := m.(ExtendedMessager).Sequence(); sent != 1 || received != 1 {
+				t.Errorf("Sequence() = %d, %d, want 1, 1", sent, received)
+			}
+			if cm.BytesSent() == 0 || cm.BytesSent() != cm.BytesReceived() {
+				t.Errorf("byte counts = %d, %d, want the same number of bytes both ways", cm.BytesSent(), cm.BytesReceived())
+			}
+
+			// Closing again closes the new connection.
+			m.Close()
+			if first.closes != 1 || second.closes != 1 {
+				t.Errorf("connections were closed %d and %d times, want once each", first.closes, second.closes)
+			}
+		})
+	}
+}
+
+func TestResetReadBudget(t *testing.T) {
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc, WithReadBudget(5)).(ExtendedMessager)
+	m.SendMessage(TestMsg, []byte("0123456789"))
+	if _, err := m.ReceiveMessage(TestMsg); err == nil {
+		t.Fatal("ReceiveMessage() over the budget succeeded")
+	}
+	m.Reset(lc)
+	m.SendMessage(TestMsg, []byte("01"))
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "01" {
+		t.Errorf("ReceiveMessage() within a fresh budget = %q, %v", b, err)
+	}
+}
+
+func TestResetActiveMessagers(t *testing.T) {
+	before := activeMessagers()
+	m := TLV.Messager(&loopbackConnection{}).(ExtendedMessager)
+	m.Close()
+	m.Reset(&loopbackConnection{})
+	if after := activeMessagers(); after[TLV] != before[TLV]+1 {
+		t.Errorf("%v more active TLV Messagers after Reset(), want 1", after[TLV]-before[TLV])
+	}
+	m.Reset(&loopbackConnection{})
+	m.Close()
+	if after := activeMessagers(); after[TLV] != before[TLV] {
+		t.Errorf("%v more active TLV Messagers after Close(), want 0", after[TLV]-before[TLV])
+	}
+}
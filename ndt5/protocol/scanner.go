@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+)
+
+// TLVScanner reads consecutive TLV frames from an io.Reader, such as a file
+// holding a captured session, in the manner of bufio.Scanner. Each call to
+// Scan reads a single frame, without reassembling messages that were split
+// into several frames. Scanning stops at the end of the input or at the first
+// error.
+type TLVScanner struct {
+	r       io.Reader
+	maxSize int
+	header  [3]byte
+	buf     []byte
+	kind    MessageType
+	payload []byte
+	err     error
+}
+
+// NewTLVScanner returns a TLVScanner that reads from r.
+func NewTLVScanner(r io.Reader) *TLVScanner {
+	return &TLVScanner{r: r, maxSize: maxTLVFrameSize}
+}
+
+// MaxSize limits the payload of every frame to n bytes. A frame whose header
+// announces a longer payload stops the scan with an error, before the payload
+// is read. The default, and the largest possible limit, is the longest
+// payload a frame can hold. It must be called before scanning starts.
+func (s *TLVScanner) MaxSize(n int) {
+	s.maxSize = n
+}
+
+// Scan reads the next frame, which is then available through Frame. It
+// returns false when the scan stops, either at the end of the input or
+// because of an error, which is then returned by Err.
+func (s *TLVScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	s.kind, s.payload = MsgUnknown, nil
+	_, err := io.ReadFull(s.r, s.header[:])
+	if err == io.EOF {
+		// The input ended cleanly, between two frames.
+		s.err = io.EOF
+		return false
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = ErrTruncatedMessage
+	}
+	if err != nil {
+		s.err = err
+		return false
+	}
+	kind, size, _ := parseTLVHeader(s.header[:])
+	if size > s.maxSize {
+		s.err = fmt.Errorf("Message length (%d) exceeds the maximum message size (%d)", size, s.maxSize)
+		return false
+	}
+	if cap(s.buf) < size {
+		s.buf = make([]byte, size)
+	}
+	s.buf = s.buf[:size]
+	_, err = io.ReadFull(s.r, s.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncatedMessage
+	}
+	if err != nil {
+		s.err = err
+		return false
+	}
+	s.kind, s.payload = kind, s.buf
+	return true
+}
+
+// Frame returns the type and payload of the frame read by the last call to
+// Scan. The payload may be overwritten by the next call to Scan.
+func (s *TLVScanner) Frame() (MessageType, []byte) {
+	return s.kind, s.payload
+}
+
+// Err returns the first error that stopped the scan, or nil if the scan
+// reached the end of the input.
+func (s *TLVScanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type scannedFrame struct {
+	kind    MessageType
+	payload string
+}
+
+// scanAll returns every frame in data, and the error that stopped the scan.
+func scanAll(data []byte, maxSize int) ([]scannedFrame, error) {
+	s := NewTLVScanner(bytes.NewReader(data))
+	if maxSize > 0 {
+		s.MaxSize(maxSize)
+	}
+	var frames []scannedFrame
+	for s.Scan() {
+		kind, payload := s.Frame()
+		frames = append(frames, scannedFrame{kind, string(payload)})
+	}
+	return frames, s.Err()
+}
+
+func TestTLVScanner(t *testing.T) {
+	want := []scannedFrame{
+		{MsgLogin, string([]byte{22})},
+		{TestMsg, ""},
+		{TestMsg, strings.Repeat("x", maxTLVFrameSize)},
+		{MsgExtendedLogin, `{"msg":"v5.0"}`},
+	}
+	var data []byte
+	for _, f := range want {
+		frame, err := EncodeTLV(f.kind, []byte(f.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, frame...)
+	}
+	frames, err := scanAll(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("scanned %d frames, want %d", len(frames), len(want))
+	}
+	for i := range want {
+		if frames[i] != want[i] {
+			t.Errorf("frame %d = %v, %d bytes, want %v, %d bytes", i, frames[i].kind, len(frames[i].payload), want[i].kind, len(want[i].payload))
+		}
+	}
+
+	if frames, err := scanAll(nil, 0); err != nil || len(frames) != 0 {
+		t.Errorf("scanning no input = %v, %v", frames, err)
+	}
+}
+
+func TestTLVScannerErrors(t *testing.T) {
+	one, _ := EncodeTLV(TestMsg, []byte("one"))
+	long, _ := EncodeTLV(TestMsg, []byte("too long"))
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+		frames  int
+		wantErr error
+	}{
+		{name: "truncated header", data: append(one, byte(TestMsg), 0), frames: 1, wantErr: ErrTruncatedMessage},
+		{name: "truncated payload", data: append(one, byte(TestMsg), 0, 5, 'a'), frames: 1, wantErr: ErrTruncatedMessage},
+		{name: "too long", data: append(one, long...), maxSize: 4, frames: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := scanAll(tt.data, tt.maxSize)
+			if len(frames) != tt.frames {
+				t.Errorf("scanned %d frames, want %d", len(frames), tt.frames)
+			}
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("Err() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLVScannerStopsAtError(t *testing.T) {
+	s := NewTLVScanner(bytes.NewReader([]byte{byte(TestMsg), 0}))
+	if s.Scan() || s.Scan() {
+		t.Error("Scan() succeeded on a truncated frame")
+	}
+	if kind, payload := s.Frame(); kind != MsgUnknown || payload != nil {
+		t.Errorf("Frame() after a failed scan = %v, %q", kind, payload)
+	}
+}
@@ -0,0 +1,251 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ScriptStep is a single step of the script of a ScriptedMessager: a message
+// that the code under test must send, followed by the reply that it then
+// receives. Either half may be left out by setting its type to MsgUnknown,
+// for instance for a step that only receives the first message of a client.
+type ScriptStep struct {
+	Send        MessageType
+	ReceiveType MessageType
+	Receive     []byte
+}
+
+// ScriptError is returned by a ScriptedMessager that is not used as its script
+// says, and by every call after that.
+type ScriptError struct {
+	// Step is the index within the script of the step that was not followed.
+	Step int
+	Want string
+	Got  string
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("script step %d: got %s, want %s", e.Step, e.Got, e.Want)
+}
+
+// ScriptedMessager is a Messager with no Connection that plays the part of a
+// client following a script, for testing that handlers exchange the messages
+// of the protocol in the right order. Each message sent must be of the type
+// that the script expects next, and each receive returns the next reply of
+// the script, once the message that comes before it has been sent. Any
+// deviation is reported as a *ScriptError, and fails every later call, so
+// that it cannot go unnoticed.
+type ScriptedMessager struct {
+	mu       sync.Mutex
+	encoding Encoding
+	steps    []ScriptStep
+	// step is the index of the current step, and sent is whether its
+	// message has been sent.
+	step int
+	sent bool
+	err  error
+	// cancelled is whether CancelReceive was called since the last
+	// receive.
+	cancelled bool
+}
+
+// NewScriptedMessager creates a ScriptedMessager that reports the given
+// encoding and follows steps in order.
+func NewScriptedMessager(enc Encoding, steps ...ScriptStep) *ScriptedMessager {
+	s := &ScriptedMessager{encoding: enc, steps: steps}
+	s.skipEmpty()
+	return s
+}
+
+// skipEmpty moves past the halves of steps that have been left out.
+func (s *ScriptedMessager) skipEmpty() {
+	for s.step < len(s.steps) {
+		st := s.steps[s.step]
+		if !s.sent && st.Send == MsgUnknown {
+			s.sent = true
+		}
+		if !s.sent || st.ReceiveType != MsgUnknown {
+			return
+		}
+		s.step++
+		s.sent = false
+	}
+}
+
+// want describes what the script expects next.
+func (s *ScriptedMessager) want() string {
+	if s.step >= len(s.steps) {
+		return "the end of the script"
+	}
+	st := s.steps[s.step]
+	if !s.sent {
+		return "a send of " + st.Send.String()
+	}
+	return "a receive of " + st.ReceiveType.String()
+}
+
+// fail records the first deviation from the script, and returns it.
+func (s *ScriptedMessager) fail(got string) error {
+	if s.err == nil {
+		s.err = &ScriptError{Step: s.step, Want: s.want(), Got: got}
+	}
+	return s.err
+}
+
+// SendMessage checks that a message of the given type is the next one the
+// script expects, and discards it.
+func (s *ScriptedMessager) SendMessage(kind MessageType, _ []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.step >= len(s.steps) || s.sent || s.steps[s.step].Send != kind {
+		return s.fail("a send of " + kind.String())
+	}
+	s.sent = true
+	s.skipEmpty()
+	return nil
+}
+
+// SendMessageString is SendMessage.
+func (s *ScriptedMessager) SendMessageString(kind MessageType, _ string) error {
+	return s.SendMessage(kind, nil)
+}
+
+// SendS2CResults checks that a TestMsg is the next message the script expects.
+func (s *ScriptedMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	return s.SendMessage(TestMsg, nil)
+}
+
+// ReceiveMessage returns the next reply of the script, or an
+// *UnexpectedMessageError if that reply is not of the given type.
+func (s *ScriptedMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	_, msg, err := s.ReceiveOneOf(kind)
+	return msg, err
+}
+
+// ReceiveOneOf returns the next reply of the script, or an
+// *UnexpectedMessageError if that reply is not of one of the given types.
+func (s *ScriptedMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	got, msg, err := s.ReceiveAnyMessage()
+	if err != nil {
+		return got, nil, err
+	}
+	for _, kind := range kinds {
+		if got == kind {
+			return got, msg, nil
+		}
+	}
+	ue := &UnexpectedMessageError{Got: got, Payload: msg}
+	if len(kinds) > 0 {
+		ue.Expected = kinds[0]
+	}
+	if len(kinds) > 1 {
+		ue.ExpectedOneOf = append([]MessageType{}, kinds...)
+	}
+	return got, nil, ue
+}
+
+// ReceiveAnyMessage returns the next reply of the script. Once the script has
+// run out, it returns io.EOF, just like a closed connection.
+func (s *ScriptedMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return MsgUnknown, nil, s.err
+	}
+	if s.cancelled {
+		s.cancelled = false
+		return MsgUnknown, nil, ErrReceiveCancelled
+	}
+	if s.step >= len(s.steps) {
+		return MsgUnknown, nil, io.EOF
+	}
+	if !s.sent {
+		return MsgUnknown, nil, s.fail("a receive")
+	}
+	st := s.steps[s.step]
+	s.step++
+	s.sent = false
+	s.skipEmpty()
+	return st.ReceiveType, st.Receive, nil
+}
+
+// ReceiveMessageContext is ReceiveMessage, but returns ctx.Err() without
+// receiving if ctx is already done. Receives from a ScriptedMessager never
+// block.
+func (s *ScriptedMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.ReceiveMessage(kind)
+}
+
+// ReceiveAnyMessageContext is ReceiveAnyMessage, but returns ctx.Err() without
+// receiving if ctx is already done.
+func (s *ScriptedMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return MsgUnknown, nil, err
+	}
+	return s.ReceiveAnyMessage()
+}
+
+// CancelReceive makes the next receive return ErrReceiveCancelled, without
+// moving on in the script.
+func (s *ScriptedMessager) CancelReceive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled = true
+}
+
+// Err returns the first deviation from the script, if any.
+func (s *ScriptedMessager) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Done returns the first deviation from the script, or a *ScriptError if the
+// script has not been followed to its end.
+func (s *ScriptedMessager) Done() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || s.step >= len(s.steps) {
+		return s.err
+	}
+	return s.fail("no more calls")
+}
+
+// SetReadDeadline does nothing, because receives from a ScriptedMessager never
+// block.
+func (s *ScriptedMessager) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline does nothing, because sends to a ScriptedMessager never
+// block.
+func (s *ScriptedMessager) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Flush does nothing, because a ScriptedMessager buffers nothing.
+func (s *ScriptedMessager) Flush() error {
+	return nil
+}
+
+// Release does nothing, because a ScriptedMessager is not counted as active.
+func (s *ScriptedMessager) Release() {}
+
+// Close does nothing, because a ScriptedMessager has no Connection to close.
+func (s *ScriptedMessager) Close() error {
+	return nil
+}
+
+// Encoding returns the encoding the ScriptedMessager was created with.
+func (s *ScriptedMessager) Encoding() Encoding {
+	return s.encoding
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func assertScriptedMessagerIsMessager(s *ScriptedMessager) {
+	func(m Messager) {}(s)
+}
+
+// scriptedHandler logs the client in and runs a short test, the way the
+// handlers do.
+func scriptedHandler(m Messager) error {
+	if _, err := m.ReceiveMessage(MsgExtendedLogin); err != nil {
+		return err
+	}
+	if err := m.SendMessage(SrvQueue, []byte("0")); err != nil {
+		return err
+	}
+	if err := m.SendMessage(MsgLogin, []byte("v5.0-NDTinGO")); err != nil {
+		return err
+	}
+	if err := m.SendMessage(TestPrepare, []byte("3010")); err != nil {
+		return err
+	}
+	if _, err := m.ReceiveMessage(TestStart); err != nil {
+		return err
+	}
+	return m.SendS2CResults(1, 2, 3)
+}
+
+func TestScriptedMessager(t *testing.T) {
+	s := NewScriptedMessager(JSON,
+		ScriptStep{ReceiveType: MsgExtendedLogin, Receive: []byte(`{"msg":"v5.0","tests":"4"}`)},
+		ScriptStep{Send: SrvQueue},
+		ScriptStep{Send: MsgLogin},
+		ScriptStep{Send: TestPrepare, ReceiveType: TestStart},
+		ScriptStep{Send: TestMsg},
+	)
+	if err := scriptedHandler(s); err != nil {
+		t.Fatalf("handler following the script = %v", err)
+	}
+	if err := s.Done(); err != nil {
+		t.Errorf("Done() = %v", err)
+	}
+	if _, err := s.ReceiveMessage(TestMsg); err != io.EOF {
+		t.Errorf("ReceiveMessage() after the script = %v, want io.EOF", err)
+	}
+	if s.Encoding() != JSON {
+		t.Errorf("Encoding() = %v, want JSON", s.Encoding())
+	}
+}
+
+func TestScriptedMessagerDeviations(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []ScriptStep
+		want  ScriptError
+	}{
+		{
+			name: "wrong send",
+			steps: []ScriptStep{
+				{ReceiveType: MsgExtendedLogin},
+				{Send: SrvQueue},
+				{Send: MsgWaiting},
+			},
+			want: ScriptError{Step: 2, Want: "a send of MsgWaiting", Got: "a send of MsgLogin"},
+		},
+		{
+			name: "send when a receive is expected",
+			steps: []ScriptStep{
+				{ReceiveType: MsgExtendedLogin},
+				{Send: SrvQueue, ReceiveType: MsgLogin},
+				{Send: MsgLogin},
+			},
+			want: ScriptError{Step: 1, Want: "a receive of MsgLogin", Got: "a send of MsgLogin"},
+		},
+		{
+			name: "send past the end",
+			steps: []ScriptStep{
+				{ReceiveType: MsgExtendedLogin},
+			},
+			want: ScriptError{Step: 1, Want: "the end of the script", Got: "a send of SrvQueue"},
+		},
+		{
+			name: "receive before the send",
+			steps: []ScriptStep{
+				{Send: SrvQueue, ReceiveType: MsgExtendedLogin},
+			},
+			want: ScriptError{Step: 0, Want: "a send of SrvQueue", Got: "a receive"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScriptedMessager(TLV, tt.steps...)
+			err := scriptedHandler(s)
+			var se *ScriptError
+			if !errors.As(err, &se) || *se != tt.want {
+				t.Fatalf("handler deviating from the script = %v, want %v", err, &tt.want)
+			}
+			// The deviation sticks, even if the handler ignores it.
+			if err := s.SendMessage(MsgLogout, nil); err != se {
+				t.Errorf("SendMessage() after a deviation = %v, want %v", err, se)
+			}
+			if err := s.Done(); err != se {
+				t.Errorf("Done() = %v, want %v", err, se)
+			}
+		})
+	}
+}
+
+func TestScriptedMessagerUnfinished(t *testing.T) {
+	s := NewScriptedMessager(TLV, ScriptStep{Send: SrvQueue}, ScriptStep{Send: MsgLogin})
+	if err := s.SendMessage(SrvQueue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("Err() partway through = %v", err)
+	}
+	want := ScriptError{Step: 1, Want: "a send of MsgLogin", Got: "no more calls"}
+	var se *ScriptError
+	if err := s.Done(); !errors.As(err, &se) || *se != want {
+		t.Errorf("Done() partway through = %v, want %v", err, &want)
+	}
+}
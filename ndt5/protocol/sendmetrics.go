@@ -0,0 +1,652 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMetricsDepth is the number of levels of nested structs that
+// SendMetrics descends into before sending a nested struct as a single value.
+const DefaultMetricsDepth = 32
+
+// DefaultMaxMetrics is the number of metrics that SendMetrics sends at most,
+// which is far more than any struct that is sent in practice holds.
+const DefaultMaxMetrics = 4096
+
+// ErrTooManyMetrics is returned by the SendMetrics functions when there are
+// more metrics to send than allowed by WithMaxMetrics. The metrics up to the
+// limit have been sent.
+var ErrTooManyMetrics = errors.New("too many metrics to send")
+
+// truncatedMetricName is the name of the metric that marks the end of
+// metrics that were truncated by WithTruncatedMetrics.
+const truncatedMetricName = "MetricsTruncated"
+
+// errMetricsTruncated stops sending metrics once the truncation marker has
+// been sent.
+var errMetricsTruncated = errors.New("metrics truncated")
+
+// metricName returns the name under which a struct field should be sent by
+// SendMetrics, and whether it should be sent at all.
+func metricName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		// The field is unexported.
+		return "", false
+	}
+	tag, ok := field.Tag.Lookup("ndt")
+	switch {
+	case !ok || tag == "":
+		return field.Name, true
+	case tag == "-":
+		return "", false
+	default:
+		return tag, true
+	}
+}
+
+// defaultMetricsFormatter renders a single metric in the "Name: value" line
+// format that ndt5 clients expect. Through %v, floats are rendered as %g and
+// bools as %t.
+func defaultMetricsFormatter(name string, value interface{}) string {
+	return fmt.Sprintf("%s: %v\n", name, value)
+}
+
+// metricsSender holds the settings for a single SendMetrics call.
+type metricsSender struct {
+	m          Messager
+	kind       MessageType
+	format     func(name string, value interface{}) string
+	maxDepth   int
+	joinSlices bool
+	unixMillis bool
+	crlf       bool
+	// floatPrecision is the number of digits after the decimal point of
+	// floats, or -1 to render them through %v.
+	floatPrecision int
+	maxMetrics     int
+	truncate       bool
+	include        []string
+	exclude        []string
+	// records, if set, sends binary metric records rather than text.
+	records bool
+	// separator joins the names of nested structs and their fields.
+	separator string
+	// sent is the number of metrics sent so far.
+	sent int
+	// resume, if not nil, is the first metric to send. Every metric before
+	// it is skipped.
+	resume MetricsCursor
+	// path holds the indices leading to the value being sent.
+	path []int
+	// batch, if not nil, collects the formatted leaves instead of sending
+	// each of them.
+	batch *strings.Builder
+	// tee, if not nil, receives a copy of everything that is sent.
+	tee io.Writer
+	// teeErr is the first error returned by tee.
+	teeErr error
+}
+
+func newMetricsSender(m Messager, opts []MetricsOption) *metricsSender {
+	s := &metricsSender{
+		m:              m,
+		kind:           TestMsg,
+		format:         defaultMetricsFormatter,
+		maxDepth:       DefaultMetricsDepth,
+		maxMetrics:     DefaultMaxMetrics,
+		separator:      ".",
+		floatPrecision: -1,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// MetricsOption configures how SendMetricsWithOptions sends metrics.
+type MetricsOption func(*metricsSender)
+
+// WithMetricsType sends every metric as a message of the given type, rather
+// than as a TestMsg.
+func WithMetricsType(kind MessageType) MetricsOption {
+	return func(s *metricsSender) {
+		s.kind = kind
+	}
+}
+
+// WithMetricsFormatter renders each leaf field into a message with fn, as
+// described for SendMetricsWithFormatter.
+func WithMetricsFormatter(fn func(name string, value interface{}) string) MetricsOption {
+	return func(s *metricsSender) {
+		s.format = fn
+	}
+}
+
+// WithMetricsDepth limits the nesting of structs, as described for
+// SendMetricsDepth.
+func WithMetricsDepth(maxDepth int) MetricsOption {
+	return func(s *metricsSender) {
+		s.maxDepth = maxDepth
+	}
+}
+
+// WithJoinedSlices sends each slice or array of primitive values as a single
+// message holding the comma-separated values, like "Samples: 1,2,3", rather
+// than as one message per element, like "Samples[0]: 1".
+func WithJoinedSlices() MetricsOption {
+	return func(s *metricsSender) {
+		s.joinSlices = true
+	}
+}
+
+// WithUnixMillis sends time.Time values as the number of milliseconds since
+// the Unix epoch, rather than in RFC 3339 format.
+func WithUnixMillis() MetricsOption {
+	return func(s *metricsSender) {
+		s.unixMillis = true
+	}
+}
+
+// DefaultFloatPrecision is a precision for WithFloatPrecision that keeps
+// throughputs and RTTs to a microsecond or a kbps without noisy digits.
+const DefaultFloatPrecision = 3
+
+// WithFloatPrecision renders float32 and float64 values with exactly digits
+// after the decimal point, like "12.500" for a precision of 3, instead of in
+// the shortest form that %v produces. Values of other kinds are left as they
+// are. The rendered float is passed to the formatter as a string, and also
+// applies to slices joined by WithJoinedSlices. A negative precision restores
+// the default.
+func WithFloatPrecision(digits int) MetricsOption {
+	return func(s *metricsSender) {
+		s.floatPrecision = digits
+	}
+}
+
+// WithCRLF ends every formatted metric with "\r\n" rather than "\n", for
+// legacy clients that expect CRLF line endings on the control channel. It
+// replaces the newline that ends the output of the formatter, so it also
+// applies to custom formatters that end their lines with "\n".
+func WithCRLF() MetricsOption {
+	return func(s *metricsSender) {
+		s.crlf = true
+	}
+}
+
+// WithMaxMetrics limits the number of metrics sent to n, instead of
+// DefaultMaxMetrics, so that a pathological struct cannot flood the control
+// channel. Once the limit is reached, ErrTooManyMetrics is returned, unless
+// WithTruncatedMetrics is given. A limit of zero or less removes the limit.
+// Metrics left out by WithMetricsFilter are not counted.
+func WithMaxMetrics(n int) MetricsOption {
+	return func(s *metricsSender) {
+		s.maxMetrics = n
+	}
+}
+
+// WithTruncatedMetrics stops sending metrics once the limit set by
+// WithMaxMetrics is reached, without an error, and marks the truncation by
+// sending a final "MetricsTruncated: true" metric, rendered by the formatter.
+func WithTruncatedMetrics() MetricsOption {
+	return func(s *metricsSender) {
+		s.truncate = true
+	}
+}
+
+// WithMetricsSeparator joins the name of a nested struct and the names of its
+// fields with separator, rather than ".", at every level of nesting, so that
+// a nested field is sent as "TCPInfo_RTT" with a separator of "_". The
+// separator also applies to the names matched by WithMetricsFilter. It is not
+// added to the prefix, which is used as it is given.
+func WithMetricsSeparator(separator string) MetricsOption {
+	return func(s *metricsSender) {
+		s.separator = separator
+	}
+}
+
+// WithMetricsFilter only sends the metrics whose names match an entry of
+// include, or every metric if include is empty, and that do not match an
+// entry of exclude. Names are matched in full, including the prefix and the
+// names of the enclosing structs, as passed to the formatter. An entry also
+// matches every field nested within the field it names, so "TCPInfo" matches
+// "TCPInfo.RTT", and "Samples" matches "Samples[0]". Nested names are matched
+// with the separator set by WithMetricsSeparator.
+func WithMetricsFilter(include, exclude []string) MetricsOption {
+	return func(s *metricsSender) {
+		s.include = include
+		s.exclude = exclude
+	}
+}
+
+// WithMetricsTee writes a copy of every message sent to w, such as a log of
+// what a client was told. Only the messages that were sent successfully are
+// written. An error from w does not stop the metrics from being sent; it is
+// returned in a *MetricsTeeError once they all have been.
+func WithMetricsTee(w io.Writer) MetricsOption {
+	return func(s *metricsSender) {
+		s.tee = w
+	}
+}
+
+// MetricsTeeError is returned by the SendMetrics functions when every metric
+// was sent, but writing them to the io.Writer given to WithMetricsTee failed.
+type MetricsTeeError struct {
+	// Err is the first error returned by the io.Writer.
+	Err error
+}
+
+func (e *MetricsTeeError) Error() string {
+	return fmt.Sprintf("metrics were sent, but could not be written to the tee: %v", e.Err)
+}
+
+// Unwrap returns the error returned by the io.Writer.
+func (e *MetricsTeeError) Unwrap() error {
+	return e.Err
+}
+
+// MetricsCursor identifies a single metric within the metrics passed to
+// SendMetrics by the path of indices leading to it: the index of the field
+// within each enclosing struct and, for slices and arrays, of the element.
+type MetricsCursor []int
+
+// before returns whether c comes before other in the order in which metrics
+// are sent.
+func (c MetricsCursor) before(other MetricsCursor) bool {
+	for i := 0; i < len(c) && i < len(other); i++ {
+		if c[i] != other[i] {
+			return c[i] < other[i]
+		}
+	}
+	return len(c) < len(other)
+}
+
+// MetricsSendError is returned by the SendMetrics functions when sending a
+// metric fails. Every metric before the one at Cursor has been sent, so
+// passing Cursor to ResumeSendMetrics sends the rest.
+type MetricsSendError struct {
+	// Name is the name of the metric that could not be sent.
+	Name   string
+	Cursor MetricsCursor
+	Err    error
+}
+
+func (e *MetricsSendError) Error() string {
+	return fmt.Sprintf("could not send metric %s: %v", e.Name, e.Err)
+}
+
+// Unwrap returns the error returned by the Messager.
+func (e *MetricsSendError) Unwrap() error {
+	return e.Err
+}
+
+// WithResumeFrom skips every metric before cursor, which was returned in a
+// *MetricsSendError by an earlier call with the same metrics and options.
+func WithResumeFrom(cursor MetricsCursor) MetricsOption {
+	return func(s *metricsSender) {
+		s.resume = cursor
+	}
+}
+
+// SendMetrics sends all the required properties out along the NDT control channel.
+func SendMetrics(metrics interface{}, m Messager, prefix string) error {
+	return SendMetricsWithOptions(metrics, m, prefix)
+}
+
+// ResumeSendMetrics is SendMetrics, except that it starts with the metric at
+// cursor, as returned in a *MetricsSendError by SendMetrics, rather than
+// sending again the metrics that were already sent.
+func ResumeSendMetrics(metrics interface{}, m Messager, prefix string, cursor MetricsCursor) error {
+	return SendMetricsWithOptions(metrics, m, prefix, WithResumeFrom(cursor))
+}
+
+// SendMetricsTee is SendMetrics, except that every message sent is also
+// written to tee, as described for WithMetricsTee.
+func SendMetricsTee(metrics interface{}, m Messager, prefix string, tee io.Writer) error {
+	return SendMetricsWithOptions(metrics, m, prefix, WithMetricsTee(tee))
+}
+
+// SendMetricsAs is SendMetrics, except that every metric is sent as a message
+// of the given type rather than as a TestMsg.
+func SendMetricsAs(metrics interface{}, m Messager, prefix string, kind MessageType) error {
+	return SendMetricsWithOptions(metrics, m, prefix, WithMetricsType(kind))
+}
+
+// SendMetricsFiltered is SendMetrics, except that it only sends the metrics
+// allowed by include and exclude, as described for WithMetricsFilter.
+func SendMetricsFiltered(metrics interface{}, m Messager, prefix string, include, exclude []string) error {
+	return SendMetricsWithOptions(metrics, m, prefix, WithMetricsFilter(include, exclude))
+}
+
+// SendMetricsWithFormatter sends all the required properties out along the NDT
+// control channel, using fn to render each leaf field into a message. The name
+// passed to fn includes the prefix and the names of all enclosing structs.
+// Structs that implement fmt.Stringer are passed to fn as a single leaf.
+//
+// Unexported fields are never sent. The name of an exported field may be
+// overridden with a tag like `ndt:"OtherName"`, and the field may be omitted
+// entirely with the tag `ndt:"-"`.
+func SendMetricsWithFormatter(metrics interface{}, m Messager, prefix string, fn func(name string, value interface{}) string) error {
+	return SendMetricsWithOptions(metrics, m, prefix, WithMetricsFormatter(fn))
+}
+
+// SendMetricsDepth is SendMetrics, except that structs nested more than
+// maxDepth levels below metrics are sent as a single value rather than field
+// by field. This bounds the recursion for deeply nested or cyclic structs.
+func SendMetricsDepth(metrics interface{}, m Messager, prefix string, maxDepth int) error {
+	return SendMetricsWithOptions(metrics, m, prefix, WithMetricsDepth(maxDepth))
+}
+
+// SendMetricsWithOptions is SendMetrics, configured by opts.
+//
+// Slices and arrays of primitive values are sent one element at a time, with
+// the index appended to the name, unless WithJoinedSlices is given. Slices and
+// arrays of structs are always sent one element at a time, and each element
+// is sent just like a nested struct.
+//
+// Maps are sent one entry at a time, sorted by key, with each entry named like
+// a field of a nested struct, as in "Labels.site: lga03". Keys that are not
+// strings are rendered through %v, and values are sent just like fields.
+//
+// A time.Duration is sent as a string like "1.5ms", and a time.Time is sent
+// in RFC 3339 format unless WithUnixMillis is given.
+//
+// If sending a metric fails, the error is a *MetricsSendError, which tells
+// where to resume.
+func SendMetricsWithOptions(metrics interface{}, m Messager, prefix string, opts ...MetricsOption) error {
+	return newMetricsSender(m, opts).sendAll(metrics, prefix)
+}
+
+// SendMetricsBatched is SendMetricsWithOptions, except that the formatted
+// metrics are joined into a single message, which is sent with one call to
+// m.SendMessage instead of one call per field. The message must fit in a
+// single frame, or a *MessageTooLongError is returned and nothing is sent.
+func SendMetricsBatched(metrics interface{}, m Messager, prefix string, opts ...MetricsOption) error {
+	s := newMetricsSender(m, opts)
+	s.batch = &strings.Builder{}
+	batch := s.batch
+	if err := s.sendAll(metrics, prefix); err != nil {
+		return err
+	}
+	s.batch = nil
+	if err := s.sendMessage([]byte(batch.String())); err != nil {
+		return err
+	}
+	return s.teeError()
+}
+
+// sendAll sends every field of the top-level metrics.
+func (s *metricsSender) sendAll(metrics interface{}, prefix string) error {
+	if s.records && s.m.Encoding() != TLV {
+		return fmt.Errorf("cannot send metric records with the %v encoding", s.m.Encoding())
+	}
+	err := s.send(metrics, prefix, 0)
+	if err == errMetricsTruncated {
+		err = nil
+	}
+	if err != nil || s.batch != nil {
+		return err
+	}
+	return s.teeError()
+}
+
+// sendMessage sends b and copies it to the tee, if there is one.
+func (s *metricsSender) sendMessage(b []byte) error {
+	if err := s.m.SendMessage(s.kind, b); err != nil {
+		return err
+	}
+	if s.tee != nil {
+		if _, err := s.tee.Write(b); err != nil && s.teeErr == nil {
+			s.teeErr = err
+		}
+	}
+	return nil
+}
+
+// teeError returns the first error from the tee, if any.
+func (s *metricsSender) teeError() error {
+	if s.teeErr != nil {
+		return &MetricsTeeError{Err: s.teeErr}
+	}
+	return nil
+}
+
+// send sends every field of metrics, which is a struct nested depth levels
+// below the top-level metrics.
+func (s *metricsSender) send(metrics interface{}, prefix string, depth int) error {
+	v := reflect.ValueOf(metrics)
+	// Dereference all passed-in pointers
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		name, ok := metricName(t.Field(i))
+		if !ok {
+			continue
+		}
+		s.path = append(s.path, i)
+		err := s.sendValue(prefix+name, v.Field(i), depth)
+		s.path = s.path[:len(s.path)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesMetric returns whether name is entry, or is nested within the field
+// that entry names, given the separator of nested names.
+func matchesMetric(name, entry, separator string) bool {
+	if !strings.HasPrefix(name, entry) {
+		return false
+	}
+	rest := name[len(entry):]
+	return rest == "" || rest[0] == '[' || (separator != "" && strings.HasPrefix(rest, separator))
+}
+
+// allowed returns whether the metric with the given name passes the filter.
+func (s *metricsSender) allowed(name string) bool {
+	included := len(s.include) == 0
+	for _, entry := range s.include {
+		if matchesMetric(name, entry, s.separator) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, entry := range s.exclude {
+		if matchesMetric(name, entry, s.separator) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *metricsSender) sendLeaf(name string, value interface{}) error {
+	if !s.allowed(name) {
+		return nil
+	}
+	cursor := MetricsCursor(s.path)
+	if s.resume != nil && cursor.before(s.resume) {
+		return nil
+	}
+	if s.maxMetrics > 0 && s.sent >= s.maxMetrics {
+		if !s.truncate {
+			return ErrTooManyMetrics
+		}
+		if err := s.sendLine(name, cursor, s.render(truncatedMetricName, true)); err != nil {
+			return err
+		}
+		return errMetricsTruncated
+	}
+	s.sent++
+	return s.sendLine(name, cursor, s.render(name, value))
+}
+
+// sendLine sends line, the formatted metric with the given name and cursor.
+func (s *metricsSender) sendLine(name string, cursor MetricsCursor, line string) error {
+	if s.crlf && !s.records && strings.HasSuffix(line, "\n") && !strings.HasSuffix(line, "\r\n") {
+		line = line[:len(line)-1] + "\r\n"
+	}
+	if s.batch != nil {
+		s.batch.WriteString(line)
+		return nil
+	}
+	if err := s.sendMessage([]byte(line)); err != nil {
+		return &MetricsSendError{Name: name, Cursor: append(MetricsCursor{}, cursor...), Err: err}
+	}
+	return nil
+}
+
+// isPrimitiveMetric returns whether values of kind k are sent as a single
+// message.
+func isPrimitiveMetric(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return true
+	}
+	return false
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// sendTime sends t in the format chosen by the options.
+func (s *metricsSender) sendTime(name string, t time.Time) error {
+	if s.unixMillis {
+		return s.sendLeaf(name, t.UnixNano()/int64(time.Millisecond))
+	}
+	return s.sendLeaf(name, t.Format(time.RFC3339))
+}
+
+// sendValue sends f, a field or element found depth levels below the
+// top-level metrics, under the given name.
+func (s *metricsSender) sendValue(name string, f reflect.Value, depth int) error {
+	// Dereference pointers and interfaces, like the values of a
+	// map[string]interface{}, leaving nil ones as they are.
+	for (f.Kind() == reflect.Ptr || f.Kind() == reflect.Interface) && !f.IsNil() {
+		f = f.Elem()
+	}
+	switch f.Type() {
+	case durationType:
+		return s.sendLeaf(name, time.Duration(f.Int()).String())
+	case timeType:
+		// Checked before the generic struct handling, because the String
+		// method of time.Time includes the unstable monotonic clock reading.
+		return s.sendTime(name, f.Interface().(time.Time))
+	}
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return s.sendLeaf(name, s.primitive(f))
+	case reflect.String:
+		return s.sendLeaf(name, f.String())
+	case reflect.Struct:
+		data := f.Interface()
+		if str, ok := data.(fmt.Stringer); ok {
+			return s.sendLeaf(name, str)
+		} else if depth >= s.maxDepth {
+			// Too deep to descend any further, so fall back to %v.
+			return s.sendLeaf(name, data)
+		}
+		return s.send(data, name+s.separator, depth+1)
+	case reflect.Slice, reflect.Array:
+		return s.sendSlice(name, f, depth)
+	case reflect.Map:
+		if depth >= s.maxDepth {
+			return s.sendLeaf(name, f.Interface())
+		}
+		return s.sendMap(name, f, depth+1)
+	case reflect.Ptr, reflect.Interface:
+		// Only nil pointers and interfaces make it here, and they have no
+		// value to send.
+	default:
+		logger.Println("Unhandled case in SendMetrics:", f.Kind())
+	}
+	return nil
+}
+
+// primitive returns the value of f, a primitive metric, to be passed to the
+// formatter, rendering floats with the precision chosen by the options.
+func (s *metricsSender) primitive(f reflect.Value) interface{} {
+	switch f.Kind() {
+	case reflect.Float32:
+		if s.floatPrecision >= 0 {
+			return strconv.FormatFloat(f.Float(), 'f', s.floatPrecision, 32)
+		}
+	case reflect.Float64:
+		if s.floatPrecision >= 0 {
+			return strconv.FormatFloat(f.Float(), 'f', s.floatPrecision, 64)
+		}
+	}
+	return f.Interface()
+}
+
+// sendSlice sends the elements of f, a slice or array.
+func (s *metricsSender) sendSlice(name string, f reflect.Value, depth int) error {
+	if s.joinSlices && isPrimitiveMetric(f.Type().Elem().Kind()) {
+		values := make([]string, f.Len())
+		for i := range values {
+			values[i] = fmt.Sprint(s.primitive(f.Index(i)))
+		}
+		return s.sendLeaf(name, strings.Join(values, ","))
+	}
+	for i := 0; i < f.Len(); i++ {
+		s.path = append(s.path, i)
+		err := s.sendValue(fmt.Sprintf("%s[%d]", name, i), f.Index(i), depth)
+		s.path = s.path[:len(s.path)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendMap sends the entries of f, a map found depth levels below the
+// top-level metrics, in the order of their keys. Each entry is named like a
+// field of a nested struct, with the key rendered through %v.
+func (s *metricsSender) sendMap(name string, f reflect.Value, depth int) error {
+	keys := f.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return lessMapKey(keys[i], keys[j])
+	})
+	for i, k := range keys {
+		s.path = append(s.path, i)
+		err := s.sendValue(fmt.Sprintf("%s%s%v", name, s.separator, k.Interface()), f.MapIndex(k), depth)
+		s.path = s.path[:len(s.path)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lessMapKey returns whether map key a sorts before b. Numbers are sorted by
+// value, and other keys by their rendering through %v.
+func lessMapKey(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// WithSequenceNumbers tags every frame sent with a sequence number, and checks
+// the sequence number of every frame received, so that duplicated or lost
+// frames are detected; for instance after a proxy reconnects the control
+// channel. Both ends of the connection must use sequence numbers, so they are
+// off by default.
+//
+// The sequence number is sent as four big-endian bytes at the start of the
+// contents of each frame, and is counted in its length. Messages are
+// therefore limited to four bytes less than a single frame, and cannot be
+// split across frames.
+func WithSequenceNumbers() MessagerOption {
+	return func(o *messagerOptions) {
+		o.sequenced = true
+	}
+}
+
+// SequenceError is returned when a frame arrives with a sequence number other
+// than the one after that of the last frame received. If Got is less than
+// Expected, the frame is a duplicate; otherwise frames were lost.
+type SequenceError struct {
+	Expected uint32
+	Got      uint32
+}
+
+// Duplicate returns whether the frame was a duplicate of one already received.
+func (e *SequenceError) Duplicate() bool {
+	return e.Got < e.Expected
+}
+
+func (e *SequenceError) Error() string {
+	if e.Duplicate() {
+		return fmt.Sprintf("received duplicate frame %d, expected frame %d", e.Got, e.Expected)
+	}
+	return fmt.Sprintf("received frame %d, but frames %d to %d were lost", e.Got, e.Expected, e.Got-1)
+}
+
+// seqLen is the length of a sequence number on the wire.
+const seqLen = 4
+
+// sequencedConnection adds sequence numbers to the frames written to another
+// Connection, and checks and removes them from the frames read from it.
+type sequencedConnection struct {
+	wrappedConnection
+	sent     uint32
+	received uint32
+}
+
+func (sc *sequencedConnection) WriteMessage(messageType int, data []byte) error {
+	if len(data) < 3 {
+		return errors.New("Message is too short")
+	}
+	size := len(data) - 3 + seqLen
+	if size > maxTLVFrameSize {
+		return fmt.Errorf("message of %d bytes is too long to send with a sequence number", len(data)-3)
+	}
+	buf := make([]byte, 3+size)
+	buf[0] = data[0]
+	buf[1] = byte((size >> 8) & 0xFF)
+	buf[2] = byte(size & 0xFF)
+	binary.BigEndian.PutUint32(buf[3:], sc.sent+1)
+	copy(buf[3+seqLen:], data[3:])
+	err := sc.Connection.WriteMessage(messageType, buf)
+	if err == nil {
+		sc.sent++
+	}
+	return err
+}
+
+// ReadMessage reads a frame and checks its sequence number. A frame that was
+// lost resynchronizes the sequence, so that only the first frame after the
+// loss returns an error, while duplicates are rejected without changing it.
+func (sc *sequencedConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := sc.Connection.ReadMessage()
+	if err != nil {
+		return messageType, data, err
+	}
+	if len(data) < 3+seqLen {
+		return messageType, nil, errors.New("Message is too short to hold a sequence number")
+	}
+	seq := binary.BigEndian.Uint32(data[3:])
+	if seq != sc.received+1 {
+		serr := &SequenceError{Expected: sc.received + 1, Got: seq}
+		if !serr.Duplicate() {
+			sc.received = seq
+		}
+		return messageType, nil, serr
+	}
+	sc.received = seq
+	// Remove the sequence number, leaving a frame whose header declares the
+	// remaining length, even if the original header was inconsistent.
+	size := int(data[1])<<8 + int(data[2]) - seqLen
+	if size < 0 {
+		size = 0
+	}
+	out := make([]byte, 3, len(data)-seqLen)
+	out[0] = data[0]
+	out[1] = byte((size >> 8) & 0xFF)
+	out[2] = byte(size & 0xFF)
+	return messageType, append(out, data[3+seqLen:]...), nil
+}
+
+// sequenceOf returns the sequence numbers of conn, if it adds them.
+func sequenceOf(conn Connection) (sent, received uint32) {
+	if sc, ok := conn.(*sequencedConnection); ok {
+		return sc.sent, sc.received
+	}
+	return 0, 0
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			sender := enc.Messager(lc, WithSequenceNumbers())
+			sender.SendMessage(MsgLogin, []byte("v5.0"))
+			sender.SendMessageString(TestMsg, "rate")
+			sender.SendS2CResults(1, 2, 3)
+			if sent, received := sender.(ExtendedMessager).Sequence(); sent != 3 || received != 0 {
+				t.Errorf("Sequence() = %d, %d, want 3, 0", sent, received)
+			}
+			if got := lc.frames[1][3:7]; !reflect.DeepEqual(got, []byte{0, 0, 0, 2}) {
+				t.Errorf("second frame has sequence number %v", got)
+			}
+
+			receiver := enc.Messager(lc, WithSequenceNumbers())
+			if b, err := receiver.ReceiveMessage(MsgLogin); err != nil || string(b) != "v5.0" {
+				t.Errorf("ReceiveMessage() = %q, %v", b, err)
+			}
+			if b, err := receiver.ReceiveMessage(TestMsg); err != nil || string(b) != "rate" {
+				t.Errorf("ReceiveMessage() = %q, %v", b, err)
+			}
+			if _, _, _, err := ReceiveS2CResults(receiver); err != nil {
+				t.Error(err)
+			}
+			if sent, received := receiver.(ExtendedMessager).Sequence(); sent != 0 || received != 3 {
+				t.Errorf("Sequence() = %d, %d, want 0, 3", sent, received)
+			}
+		})
+	}
+}
+
+func sequencedFrames(t *testing.T, n int) [][]byte {
+	lc := &loopbackConnection{}
+	m := TLV.Messager(lc, WithSequenceNumbers())
+	for i := 1; i <= n; i++ {
+		if err := m.SendMessage(TestMsg, []byte{byte('0' + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return lc.frames
+}
+
+func TestSequenceNumbersDuplicate(t *testing.T) {
+	f := sequencedFrames(t, 2)
+	lc := &loopbackConnection{frames: [][]byte{f[0], f[0], f[1]}}
+	m := TLV.Messager(lc, WithSequenceNumbers())
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "1" {
+		t.Fatalf("ReceiveMessage() = %q, %v", b, err)
+	}
+	_, err := m.ReceiveMessage(TestMsg)
+	serr, ok := err.(*SequenceError)
+	if !ok || !serr.Duplicate() || serr.Expected != 2 || serr.Got != 1 {
+		t.Fatalf("ReceiveMessage() = %v, want a duplicate *SequenceError", err)
+	}
+	if !strings.Contains(serr.Error(), "duplicate") {
+		t.Errorf("Error() = %q", serr.Error())
+	}
+	// The duplicate does not disturb the sequence.
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "2" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+}
+
+func TestSequenceNumbersGap(t *testing.T) {
+	f := sequencedFrames(t, 4)
+	lc := &loopbackConnection{frames: [][]byte{f[0], f[2], f[3]}}
+	m := TLV.Messager(lc, WithSequenceNumbers())
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "1" {
+		t.Fatalf("ReceiveMessage() = %q, %v", b, err)
+	}
+	_, err := m.ReceiveMessage(TestMsg)
+	serr, ok := err.(*SequenceError)
+	if !ok || serr.Duplicate() || serr.Expected != 2 || serr.Got != 3 {
+		t.Fatalf("ReceiveMessage() = %v, want a gap *SequenceError", err)
+	}
+	// The sequence resumes after the lost frame.
+	if b, err := m.ReceiveMessage(TestMsg); err != nil || string(b) != "4" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+}
+
+func TestSequenceNumbersErrors(t *testing.T) {
+	m := TLV.Messager(&loopbackConnection{}, WithSequenceNumbers())
+	if err := m.SendMessage(TestMsg, make([]byte, maxTLVFrameSize-3)); err == nil {
+		t.Error("SendMessage() accepted a message with no room for the sequence number")
+	}
+	if sent, _ := m.(ExtendedMessager).Sequence(); sent != 0 {
+		t.Errorf("a failed send advanced the sequence to %d", sent)
+	}
+	// Frames without a sequence number are rejected.
+	lc := &loopbackConnection{}
+	WriteTLVMessage(lc, TestMsg, "1")
+	if _, err := TLV.Messager(lc, WithSequenceNumbers()).ReceiveMessage(TestMsg); err == nil {
+		t.Error("ReceiveMessage() accepted a frame without a sequence number")
+	}
+	if sent, received := TLV.Messager(&loopbackConnection{}).(ExtendedMessager).Sequence(); sent != 0 || received != 0 {
+		t.Errorf("Sequence() = %d, %d without sequence numbers", sent, received)
+	}
+}
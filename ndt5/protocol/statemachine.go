@@ -0,0 +1,292 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInvalidState is returned by a StateMachineMessager for a message that the
+// ndt5 protocol does not allow at that point of the session.
+var ErrInvalidState = errors.New("message not allowed in this state")
+
+// sessionState is a state of the ndt5 session, as seen by the server.
+type sessionState int
+
+const (
+	// stateLogin waits for the login of the client.
+	stateLogin sessionState = iota
+	// stateQueue sends SrvQueue messages until the client may start.
+	stateQueue
+	// stateVersion has sent the server version, and is to send the tests.
+	stateVersion
+	// stateTests is between tests, before the results.
+	stateTests
+	// statePrepared has sent TestPrepare, and is to send TestStart.
+	statePrepared
+	// stateRunning exchanges TestMsg messages until TestFinalize.
+	stateRunning
+	// stateResults sends the MsgResults messages that end the session.
+	stateResults
+	// stateDone has sent MsgLogout, after which nothing may be exchanged.
+	stateDone
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case stateLogin:
+		return "login"
+	case stateQueue:
+		return "queue"
+	case stateVersion:
+		return "version"
+	case stateTests:
+		return "tests"
+	case statePrepared:
+		return "prepared"
+	case stateRunning:
+		return "running"
+	case stateResults:
+		return "results"
+	case stateDone:
+		return "done"
+	}
+	return fmt.Sprintf("sessionState(%d)", int(s))
+}
+
+// sendTransition returns the state after sending a message of the given type
+// in state s, and whether the message may be sent at all.
+func (s sessionState) sendTransition(kind MessageType) (sessionState, bool) {
+	if s == stateDone {
+		return s, false
+	}
+	if kind == MsgKeepalive || kind == MsgError {
+		return s, true
+	}
+	switch {
+	case (s == stateLogin || s == stateQueue) && kind == SrvQueue:
+		return stateQueue, true
+	case s == stateQueue && kind == MsgLogin:
+		return stateVersion, true
+	case s == stateVersion && kind == MsgLogin:
+		return stateTests, true
+	case s == stateTests && kind == TestPrepare:
+		return statePrepared, true
+	case s == statePrepared && kind == TestStart:
+		return stateRunning, true
+	case s == stateRunning && kind == TestMsg:
+		return stateRunning, true
+	case s == stateRunning && kind == TestFinalize:
+		return stateTests, true
+	case (s == stateTests || s == stateResults) && kind == MsgResults:
+		return stateResults, true
+	case (s == stateTests || s == stateResults) && kind == MsgLogout:
+		return stateDone, true
+	}
+	return s, false
+}
+
+// receiveTransition returns the state after receiving a message of the given
+// type in state s, and whether the message may be received at all.
+func (s sessionState) receiveTransition(kind MessageType) (sessionState, bool) {
+	switch {
+	case s == stateDone:
+		return s, false
+	case kind == MsgKeepalive:
+		return s, true
+	case s == stateLogin && (kind == MsgLogin || kind == MsgExtendedLogin):
+		return stateQueue, true
+	case s == stateRunning && kind == TestMsg:
+		return stateRunning, true
+	}
+	return s, false
+}
+
+// StateMachineMessager wraps another Messager to check that the server side
+// of the ndt5 protocol is followed, for catching protocol bugs in tests and
+// staging. It starts in the login state, moves to the next state on each
+// message, and rejects a message that is not allowed in the current state
+// with an error wrapping ErrInvalidState, without forwarding it.
+//
+// The session it models is: the login is received, SrvQueue is sent any
+// number of times, MsgLogin is sent with the version and then with the tests,
+// each test is TestPrepare, TestStart, TestMsg messages in either direction,
+// and TestFinalize, and the session ends with MsgResults and MsgLogout. The
+// first SrvQueue may also start the session, for a login read before the
+// Messager was created, as with DetectEncoding. MsgKeepalive and, from the
+// server, MsgError are allowed until MsgLogout. SendS2CResults sends a
+// TestMsg. A receive is checked against the types it accepts before it is
+// forwarded, and ReceiveAnyMessage and ReceiveAnyMessageContext against the
+// type they received, which is then consumed even when it is rejected.
+// Everything else is forwarded unchanged.
+type StateMachineMessager struct {
+	Messager
+	mu    sync.Mutex
+	state sessionState
+}
+
+// NewStateMachineMessager creates a StateMachineMessager in the login state
+// that forwards to m.
+func NewStateMachineMessager(m Messager) *StateMachineMessager {
+	return &StateMachineMessager{Messager: m}
+}
+
+// State returns the name of the current state, like "login" or "running".
+func (s *StateMachineMessager) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.String()
+}
+
+// checkSend returns an error if a message of the given type may not be sent.
+func (s *StateMachineMessager) checkSend(kind MessageType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.sendTransition(kind); !ok {
+		return fmt.Errorf("%w: cannot send %v in the %v state", ErrInvalidState, kind, s.state)
+	}
+	return nil
+}
+
+// checkReceive returns an error if a message of any of the given types may
+// not be received.
+func (s *StateMachineMessager) checkReceive(kinds ...MessageType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, kind := range kinds {
+		if _, ok := s.state.receiveTransition(kind); !ok {
+			return fmt.Errorf("%w: cannot receive %v in the %v state", ErrInvalidState, kind, s.state)
+		}
+	}
+	return nil
+}
+
+// sent moves to the state after a message of the given type was sent.
+func (s *StateMachineMessager) sent(kind MessageType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, _ = s.state.sendTransition(kind)
+}
+
+// received moves to the state after a message of the given type was received,
+// or returns an error if it may not be received.
+func (s *StateMachineMessager) received(kind MessageType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, ok := s.state.receiveTransition(kind)
+	if !ok {
+		return fmt.Errorf("%w: received %v in the %v state", ErrInvalidState, kind, s.state)
+	}
+	s.state = next
+	return nil
+}
+
+// SendMessage forwards the message, if it may be sent.
+func (s *StateMachineMessager) SendMessage(kind MessageType, contents []byte) error {
+	if err := s.checkSend(kind); err != nil {
+		return err
+	}
+	if err := s.Messager.SendMessage(kind, contents); err != nil {
+		return err
+	}
+	s.sent(kind)
+	return nil
+}
+
+// SendMessageString forwards the message, if it may be sent.
+func (s *StateMachineMessager) SendMessageString(kind MessageType, str string) error {
+	if err := s.checkSend(kind); err != nil {
+		return err
+	}
+	if err := s.Messager.SendMessageString(kind, str); err != nil {
+		return err
+	}
+	s.sent(kind)
+	return nil
+}
+
+// SendS2CResults forwards the results, if a TestMsg may be sent.
+func (s *StateMachineMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	if err := s.checkSend(TestMsg); err != nil {
+		return err
+	}
+	if err := s.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes); err != nil {
+		return err
+	}
+	s.sent(TestMsg)
+	return nil
+}
+
+// ReceiveMessage receives a message, if one of the given type may be received.
+func (s *StateMachineMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	if err := s.checkReceive(kind); err != nil {
+		return nil, err
+	}
+	b, err := s.Messager.ReceiveMessage(kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.received(kind); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReceiveOneOf receives a message, if messages of all the given types may be
+// received.
+func (s *StateMachineMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	if err := s.checkReceive(kinds...); err != nil {
+		return MsgUnknown, nil, err
+	}
+	kind, b, err := s.Messager.ReceiveOneOf(kinds...)
+	if err != nil {
+		return kind, nil, err
+	}
+	if err := s.received(kind); err != nil {
+		return kind, nil, err
+	}
+	return kind, b, nil
+}
+
+// ReceiveAnyMessage receives a message, and rejects it if a message of its
+// type may not be received.
+func (s *StateMachineMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	kind, b, err := s.Messager.ReceiveAnyMessage()
+	if err != nil {
+		return kind, nil, err
+	}
+	if err := s.received(kind); err != nil {
+		return kind, nil, err
+	}
+	return kind, b, nil
+}
+
+// ReceiveMessageContext receives a message, if one of the given type may be
+// received.
+func (s *StateMachineMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	if err := s.checkReceive(kind); err != nil {
+		return nil, err
+	}
+	b, err := s.Messager.ReceiveMessageContext(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.received(kind); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReceiveAnyMessageContext receives a message, and rejects it if a message of
+// its type may not be received.
+func (s *StateMachineMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	kind, b, err := s.Messager.ReceiveAnyMessageContext(ctx)
+	if err != nil {
+		return kind, nil, err
+	}
+	if err := s.received(kind); err != nil {
+		return kind, nil, err
+	}
+	return kind, b, nil
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func assertStateMachineMessagerIsMessager(s *StateMachineMessager) {
+	func(m Messager) {}(s)
+}
+
+func TestStateMachineMessager(t *testing.T) {
+	script := NewScriptedMessager(TLV,
+		ScriptStep{ReceiveType: MsgLogin, Receive: []byte{16 | 4}},
+		ScriptStep{Send: SrvQueue},
+		ScriptStep{Send: MsgLogin},
+		ScriptStep{Send: MsgLogin},
+		ScriptStep{Send: TestPrepare},
+		ScriptStep{Send: TestStart},
+		ScriptStep{Send: TestMsg, ReceiveType: TestMsg},
+		ScriptStep{Send: TestMsg},
+		ScriptStep{Send: TestFinalize},
+		ScriptStep{Send: MsgResults},
+		ScriptStep{Send: MsgResults},
+		ScriptStep{Send: MsgLogout},
+	)
+	s := NewStateMachineMessager(script)
+	if _, _, err := s.ReceiveOneOf(MsgLogin, MsgExtendedLogin); err != nil {
+		t.Fatalf("ReceiveOneOf() of the login = %v", err)
+	}
+	if err := SendLoginAck(s, "v5.0-NDTinGO", 4); err != nil {
+		t.Fatalf("SendLoginAck() = %v", err)
+	}
+	for _, step := range []struct {
+		name string
+		f    func() error
+	}{
+		{"TestPrepare", func() error { return s.SendMessage(TestPrepare, []byte("3010")) }},
+		{"TestStart", func() error { return s.SendMessage(TestStart, nil) }},
+		{"S2C results", func() error { return s.SendS2CResults(1, 2, 3) }},
+		{"client rate", func() error { _, err := s.ReceiveMessage(TestMsg); return err }},
+		{"metrics", func() error { return s.SendMessageString(TestMsg, "a: 1\n") }},
+		{"TestFinalize", func() error { return SendS2CComplete(s) }},
+		{"results", func() error { return s.SendMessage(MsgResults, []byte("1")) }},
+		{"more results", func() error { return s.SendMessage(MsgResults, []byte("2")) }},
+		{"MsgLogout", func() error { return s.SendMessage(MsgLogout, nil) }},
+	} {
+		if err := step.f(); err != nil {
+			t.Fatalf("%s in the %s state = %v", step.name, s.State(), err)
+		}
+	}
+	if err := script.Done(); err != nil {
+		t.Errorf("script.Done() = %v", err)
+	}
+	if s.State() != "done" {
+		t.Errorf("State() = %q, want done", s.State())
+	}
+}
+
+func TestStateMachineMessagerRejects(t *testing.T) {
+	n := NewNopMessager(TLV)
+	s := NewStateMachineMessager(n)
+
+	// Results before the login has completed are rejected, and not sent.
+	if err := s.SendS2CResults(1, 2, 3); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("SendS2CResults() before the login = %v, want ErrInvalidState", err)
+	}
+	if err := s.SendMessage(MsgResults, nil); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("SendMessage(MsgResults) before the login = %v, want ErrInvalidState", err)
+	}
+	if n.Sent(TestMsg) != 0 || n.Sent(MsgResults) != 0 {
+		t.Error("rejected messages were sent")
+	}
+	if s.State() != "login" {
+		t.Errorf("State() after rejected sends = %q, want login", s.State())
+	}
+
+	// A receive is rejected before it is forwarded.
+	n.AddResponse(TestStart, nil)
+	if _, err := s.ReceiveMessage(TestStart); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("ReceiveMessage(TestStart) = %v, want ErrInvalidState", err)
+	}
+	if _, _, err := s.ReceiveOneOf(MsgLogin, TestStart); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("ReceiveOneOf(MsgLogin, TestStart) = %v, want ErrInvalidState", err)
+	}
+	// ReceiveAnyMessage can only reject the type it received.
+	if kind, _, err := s.ReceiveAnyMessage(); kind != TestStart || !errors.Is(err, ErrInvalidState) {
+		t.Errorf("ReceiveAnyMessage() = %v, %v, want TestStart and ErrInvalidState", kind, err)
+	}
+
+	// A login read beforehand lets the session start with SrvQueue, and
+	// keepalives and errors are allowed throughout.
+	for _, kind := range []MessageType{SrvQueue, MsgKeepalive, SrvQueue, MsgLogin, MsgError, MsgLogin, MsgLogout} {
+		if err := s.SendMessage(kind, nil); err != nil {
+			t.Fatalf("SendMessage(%v) in the %s state = %v", kind, s.State(), err)
+		}
+	}
+	for _, kind := range []MessageType{MsgKeepalive, MsgError, SrvQueue} {
+		if err := s.SendMessage(kind, nil); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("SendMessage(%v) after MsgLogout = %v, want ErrInvalidState", kind, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// streamFormat is the format of the TLV frames on a byte stream, and how they
+// are read, as set up by the options of a Messager. The zero streamFormat is
+// the standard ndt5 header, read without an idle timeout.
+type streamFormat struct {
+	// byteOrder is the byte order of the length in TLV headers on the wire,
+	// or nil for network byte order.
+	byteOrder binary.ByteOrder
+	// wideType is whether the type in TLV headers on the wire is 2 bytes
+	// wide, as set up by WithTypeWidth.
+	wideType bool
+	// idleTimeout, if not zero, is the idle timeout of reads by ReadMessage,
+	// which extend the read deadline by idleTimeout before every read from
+	// the socket.
+	idleTimeout time.Duration
+	// chunked is whether messages longer than a single frame are split into
+	// several frames, as set up by AdaptTLVChunking.
+	chunked bool
+}
+
+// streamFormatter is implemented by connections that read frames from a byte
+// stream, which need to know the format of the frames to find where each of
+// them ends.
+type streamFormatter interface {
+	// withStreamFormat returns a view of the connection that reads and
+	// writes frames in its format as changed by set, leaving the
+	// connection itself, and every other view of it, as it is.
+	withStreamFormat(set func(*streamFormat)) Connection
+}
+
+// streamConnection is the view of a netConnection that one Messager reads and
+// writes through, in the format set up by its options, so that the options of
+// one Messager never apply to another on the same connection. Everything else
+// is shared with the netConnection.
+type streamConnection struct {
+	*netConnection
+	format streamFormat
+}
+
+func (nc *netConnection) withStreamFormat(set func(*streamFormat)) Connection {
+	sc := &streamConnection{netConnection: nc}
+	set(&sc.format)
+	return sc
+}
+
+func (sc *streamConnection) withStreamFormat(set func(*streamFormat)) Connection {
+	view := &streamConnection{netConnection: sc.netConnection, format: sc.format}
+	set(&view.format)
+	return view
+}
+
+func (sc *streamConnection) ReadMessage() (int, []byte, error) {
+	return sc.readFrame(sc.format)
+}
+
+func (sc *streamConnection) WriteMessage(_ int, data []byte) error {
+	return sc.writeFrame(sc.format, data)
+}
+
+func (sc *streamConnection) chunksMessages() bool {
+	return sc.format.chunked
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMessagePending is returned when switching the encoding of a Messager that
+// has read ahead a message, with Peek, that has not been received yet.
+var ErrMessagePending = errors.New("cannot switch encodings with a message read ahead but not received")
+
+// encodingSwitcher is implemented by Messagers that can create a Messager for
+// another encoding that shares their connection and state.
+type encodingSwitcher interface {
+	withEncoding(Encoding) (Messager, error)
+}
+
+// switchEncoding creates a Messager for e that takes over conn, with its
+// wrappers, and the options of the Messager it replaces.
+func switchEncoding(e Encoding, conn Connection, o messagerOptions) (Messager, error) {
+	if o.peeked.pending() {
+		return nil, ErrMessagePending
+	}
+	if dc, ok := conn.(*debugConnection); ok {
+		dc.encoding = e
+	}
+	m, err := newMessager(e, conn, o)
+	if err != nil {
+		return nil, err
+	}
+	o.active.switchTo(e)
+	return m, nil
+}
+
+// SwitchingMessager wraps a Messager created by Encoding.Messager so that its
+// encoding can be changed in place, for instance when a client reconnects
+// with another encoding. Like the Messager it wraps, it is not safe for
+// concurrent use, and SetEncoding must not overlap with sends or receives.
+type SwitchingMessager struct {
+	Messager
+}
+
+// NewSwitchingMessager creates a SwitchingMessager that starts out forwarding
+// to m.
+func NewSwitchingMessager(m Messager) *SwitchingMessager {
+	return &SwitchingMessager{Messager: m}
+}
+
+// SetEncoding replaces the wrapped Messager with one for e, which shares its
+// Connection and the state kept by its options, such as sequence numbers,
+// read budgets, and byte counts. Anything buffered for sending is flushed
+// first. It fails with ErrMessagePending if a message has been peeked at but
+// not received, since it was encoded for the old encoding.
+func (s *SwitchingMessager) SetEncoding(e Encoding) error {
+	if e == s.Messager.Encoding() {
+		return nil
+	}
+	sw, ok := s.Messager.(encodingSwitcher)
+	if !ok {
+		return fmt.Errorf("cannot switch the encoding of a %T", s.Messager)
+	}
+	if err := s.Messager.Flush(); err != nil {
+		return err
+	}
+	m, err := sw.withEncoding(e)
+	if err != nil {
+		return err
+	}
+	s.Messager = m
+	return nil
+}
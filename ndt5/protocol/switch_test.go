@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func assertSwitchingMessagerIsMessager(s *SwitchingMessager) {
+	func(m Messager) {}(s)
+}
+
+func TestSwitchingMessager(t *testing.T) {
+	lc := &loopbackConnection{}
+	m, err := TLV.MessagerE(lc, WithSequenceNumbers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSwitchingMessager(m)
+	s.SendMessage(TestMsg, []byte("hi"))
+	if err := s.SetEncoding(JSON); err != nil {
+		t.Fatal(err)
+	}
+	if s.Encoding() != JSON {
+		t.Errorf("Encoding() = %v, want JSON", s.Encoding())
+	}
+	s.SendMessage(TestMsg, []byte("hi"))
+
+	if len(lc.frames) != 2 {
+		t.Fatalf("sent %d frames, want 2", len(lc.frames))
+	}
+	if got := lc.frames[0][3+seqLen:]; string(got) != "hi" {
+		t.Errorf("TLV frame has contents %q, want \"hi\"", got)
+	}
+	// The sequence numbers carry on across the switch.
+	if got := lc.frames[1][3 : 3+seqLen]; !reflect.DeepEqual(got, []byte{0, 0, 0, 2}) {
+		t.Errorf("JSON frame has sequence number %v, want 2", got)
+	}
+	var msg JSONMessage
+	if err := json.Unmarshal(lc.frames[1][3+seqLen:], &msg); err != nil || msg.Msg != "hi" {
+		t.Errorf("JSON frame has contents %q, %v", lc.frames[1][3+seqLen:], err)
+	}
+	if sent, _ := s.Messager.(ExtendedMessager).Sequence(); sent != 2 {
+		t.Errorf("Sequence() = %d, want 2", sent)
+	}
+
+	// The receive side switches as well.
+	r := NewSwitchingMessager(TLV.Messager(lc, WithSequenceNumbers()))
+	if b, err := r.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if err := r.SetEncoding(JSON); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := r.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() after switching = %q, %v", b, err)
+	}
+}
+
+func TestSwitchingMessagerPeeked(t *testing.T) {
+	lc := &loopbackConnection{}
+	TLV.Messager(lc).SendMessage(TestMsg, []byte("hi"))
+	s := NewSwitchingMessager(TLV.Messager(lc))
+	if _, err := s.Messager.(ExtendedMessager).Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetEncoding(JSON); err != ErrMessagePending {
+		t.Errorf("SetEncoding() = %v, want ErrMessagePending", err)
+	}
+	if s.Encoding() != TLV {
+		t.Errorf("Encoding() = %v after a failed switch, want TLV", s.Encoding())
+	}
+	if b, err := s.ReceiveMessage(TestMsg); err != nil || string(b) != "hi" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if err := s.SetEncoding(JSON); err != nil {
+		t.Errorf("SetEncoding() after receiving = %v", err)
+	}
+}
+
+func TestSwitchingMessagerErrors(t *testing.T) {
+	s := NewSwitchingMessager(TLV.Messager(&loopbackConnection{}))
+	if err := s.SetEncoding(TLV); err != nil {
+		t.Errorf("SetEncoding() to the same encoding = %v", err)
+	}
+	if err := s.SetEncoding(Unknown); err == nil {
+		t.Error("SetEncoding(Unknown) succeeded")
+	}
+	s = NewSwitchingMessager(NewNopMessager(TLV))
+	if err := s.SetEncoding(JSON); err == nil {
+		t.Error("SetEncoding() of a NopMessager succeeded")
+	}
+}
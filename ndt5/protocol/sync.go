@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SyncMessager wraps another Messager so that it can be used from several
+// goroutines at once. Sends are serialized with one lock and receives with
+// another, so that a send can proceed while another goroutine is blocked
+// waiting for a message.
+type SyncMessager struct {
+	Messager
+	sendMu    sync.Mutex
+	receiveMu sync.Mutex
+}
+
+// NewSyncMessager creates a SyncMessager that forwards to m.
+func NewSyncMessager(m Messager) *SyncMessager {
+	return &SyncMessager{Messager: m}
+}
+
+// SendMessage forwards the message while holding the send lock.
+func (s *SyncMessager) SendMessage(kind MessageType, contents []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.Messager.SendMessage(kind, contents)
+}
+
+// SendMessageString forwards the message while holding the send lock.
+func (s *SyncMessager) SendMessageString(kind MessageType, str string) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.Messager.SendMessageString(kind, str)
+}
+
+// SendS2CResults forwards the results while holding the send lock.
+func (s *SyncMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+}
+
+// SetWriteDeadline forwards the deadline while holding the send lock, because
+// it changes the state used by every send.
+func (s *SyncMessager) SetWriteDeadline(t time.Time) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.Messager.SetWriteDeadline(t)
+}
+
+// Flush forwards to the wrapped Messager while holding the send lock.
+func (s *SyncMessager) Flush() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.Messager.Flush()
+}
+
+// Close closes the wrapped Messager while holding the send lock, so that it
+// does not interrupt a send. It does not wait for receives, so that closing
+// can unblock a goroutine waiting for a message.
+func (s *SyncMessager) Close() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.Messager.Close()
+}
+
+// ReceiveMessage receives a message while holding the receive lock.
+func (s *SyncMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	s.receiveMu.Lock()
+	defer s.receiveMu.Unlock()
+	return s.Messager.ReceiveMessage(kind)
+}
+
+// ReceiveOneOf receives a message while holding the receive lock.
+func (s *SyncMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	s.receiveMu.Lock()
+	defer s.receiveMu.Unlock()
+	return s.Messager.ReceiveOneOf(kinds...)
+}
+
+// ReceiveAnyMessage receives a message while holding the receive lock.
+func (s *SyncMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	s.receiveMu.Lock()
+	defer s.receiveMu.Unlock()
+	return s.Messager.ReceiveAnyMessage()
+}
+
+// ReceiveMessageContext receives a message while holding the receive lock.
+func (s *SyncMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	s.receiveMu.Lock()
+	defer s.receiveMu.Unlock()
+	return s.Messager.ReceiveMessageContext(ctx, kind)
+}
+
+// ReceiveAnyMessageContext receives a message while holding the receive lock.
+func (s *SyncMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	s.receiveMu.Lock()
+	defer s.receiveMu.Unlock()
+	return s.Messager.ReceiveAnyMessageContext(ctx)
+}
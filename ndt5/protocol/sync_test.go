@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+)
+
+func assertSyncMessagerIsMessager(s *SyncMessager) {
+	func(m Messager) {}(s)
+}
+
+func TestSyncMessagerConcurrentSends(t *testing.T) {
+	// Run with -race: without the wrapper, the two goroutines race on the
+	// connection's frames.
+	lc := &loopbackConnection{}
+	s := NewSyncMessager(TLV.Messager(lc))
+	const perSender = 100
+	var wg sync.WaitGroup
+	for _, kind := range []MessageType{TestMsg, MsgResults} {
+		wg.Add(1)
+		go func(kind MessageType) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				if err := s.SendMessage(kind, []byte("x")); err != nil {
+					t.Error(err)
+				}
+			}
+		}(kind)
+	}
+	wg.Wait()
+	if len(lc.frames) != 2*perSender {
+		t.Fatalf("sent %d frames, want %d", len(lc.frames), 2*perSender)
+	}
+	for i := 0; i < 2*perSender; i++ {
+		if _, b, err := s.ReceiveAnyMessage(); err != nil || string(b) != "x" {
+			t.Errorf("ReceiveAnyMessage() = %q, %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ThrottledMessager wraps another Messager to limit the rate at which it
+// sends, so that slow control channels can be reproduced. It is a token
+// bucket that starts empty and never fills beyond what the next send needs:
+// each send waits until the bucket has refilled for the bytes it sends,
+// without bursts. The bytes counted are those of the message contents, not of
+// its encoding. Receives are not throttled.
+type ThrottledMessager struct {
+	Messager
+	bytesPerSecond int64
+
+	mu sync.Mutex
+	// next is the time at which the bucket will have refilled for every
+	// send so far.
+	next  time.Time
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewThrottledMessager creates a ThrottledMessager that forwards to m and
+// sends at most bytesPerSecond bytes per second. A rate of zero or less
+// leaves sends unlimited.
+func NewThrottledMessager(m Messager, bytesPerSecond int64) *ThrottledMessager {
+	return &ThrottledMessager{Messager: m, bytesPerSecond: bytesPerSecond, now: time.Now, sleep: time.Sleep}
+}
+
+// wait blocks until n more bytes may be sent.
+func (t *ThrottledMessager) wait(n int) {
+	if t.bytesPerSecond <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := t.now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.bytesPerSecond))
+	d := t.next.Sub(now)
+	t.mu.Unlock()
+	t.sleep(d)
+}
+
+// SendMessage forwards the message once the rate allows it.
+func (t *ThrottledMessager) SendMessage(kind MessageType, contents []byte) error {
+	t.wait(len(contents))
+	return t.Messager.SendMessage(kind, contents)
+}
+
+// SendMessageString forwards the message once the rate allows it.
+func (t *ThrottledMessager) SendMessageString(kind MessageType, s string) error {
+	t.wait(len(s))
+	return t.Messager.SendMessageString(kind, s)
+}
+
+// SendS2CResults forwards the results once the rate allows it. They are
+// counted as the three values separated by spaces.
+func (t *ThrottledMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	t.wait(len(fmt.Sprintf("%d %d %d", throughputKbps, unsentBytes, totalSentBytes)))
+	return t.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func assertThrottledMessagerIsMessager(t *ThrottledMessager) {
+	func(m Messager) {}(t)
+}
+
+func TestThrottledMessager(t *testing.T) {
+	const rate = 1000
+	lc := &loopbackConnection{}
+	m := NewThrottledMessager(TLV.Messager(lc), rate)
+	contents := make([]byte, 20)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := m.SendMessage(TestMsg, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 200 bytes at 1000 bytes per second.
+	want := 200 * time.Millisecond
+	if elapsed := time.Since(start); elapsed < want*9/10 || elapsed > want*2 {
+		t.Errorf("sending 200 bytes took %v, want about %v", elapsed, want)
+	}
+	if len(lc.frames) != 10 {
+		t.Errorf("sent %d frames, want 10", len(lc.frames))
+	}
+
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := m.ReceiveMessage(TestMsg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > want/2 {
+		t.Errorf("receiving took %v, but receives should not be throttled", elapsed)
+	}
+}
+
+func TestThrottledMessagerRate(t *testing.T) {
+	var slept time.Duration
+	now := time.Unix(0, 0)
+	m := NewThrottledMessager(TLV.Messager(&loopbackConnection{}), 100)
+	m.now = func() time.Time { return now }
+	m.sleep = func(d time.Duration) { slept += d }
+
+	m.SendMessageString(TestMsg, "0123456789")
+	if slept != 100*time.Millisecond {
+		t.Errorf("slept %v for the first send, want 100ms", slept)
+	}
+	// Time that passes without sending is not saved up for later.
+	now = now.Add(time.Second)
+	slept = 0
+	m.SendMessageString(TestMsg, "0123456789")
+	if slept != 100*time.Millisecond {
+		t.Errorf("slept %v after an idle second, want 100ms", slept)
+	}
+}
+
+func TestThrottledMessagerUnlimited(t *testing.T) {
+	m := NewThrottledMessager(TLV.Messager(&loopbackConnection{}), 0)
+	m.sleep = func(d time.Duration) { t.Errorf("sleep(%v) with an unlimited rate", d) }
+	m.SendMessage(TestMsg, make([]byte, 1000))
+	m.SendS2CResults(1, 2, 3)
+}
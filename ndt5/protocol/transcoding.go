@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"context"
+	"time"
+)
+
+// TranscodingMessager receives messages with one Messager and sends them with
+// another, so that messages can be translated between encodings; for instance
+// by a man-in-the-middle test harness that compares how clients behave with
+// each encoding.
+type TranscodingMessager struct {
+	in  Messager
+	out Messager
+}
+
+// NewTranscodingMessager creates a TranscodingMessager that receives messages
+// with in and sends them with out.
+func NewTranscodingMessager(in, out Messager) *TranscodingMessager {
+	return &TranscodingMessager{in: in, out: out}
+}
+
+// Forward receives the next message of any type with the inbound Messager and
+// sends it with the outbound Messager, returning its type.
+func (tm *TranscodingMessager) Forward() (MessageType, error) {
+	kind, b, err := tm.in.ReceiveAnyMessage()
+	if err != nil {
+		return kind, err
+	}
+	return kind, tm.out.SendMessage(kind, b)
+}
+
+// SendMessage sends the message with the outbound Messager.
+func (tm *TranscodingMessager) SendMessage(kind MessageType, contents []byte) error {
+	return tm.out.SendMessage(kind, contents)
+}
+
+// SendMessageString sends the message with the outbound Messager.
+func (tm *TranscodingMessager) SendMessageString(kind MessageType, s string) error {
+	return tm.out.SendMessageString(kind, s)
+}
+
+// SendS2CResults sends the results with the outbound Messager.
+func (tm *TranscodingMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	return tm.out.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+}
+
+// ReceiveMessage receives a message with the inbound Messager.
+func (tm *TranscodingMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	return tm.in.ReceiveMessage(kind)
+}
+
+// ReceiveOneOf receives a message with the inbound Messager.
+func (tm *TranscodingMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	return tm.in.ReceiveOneOf(kinds...)
+}
+
+// ReceiveAnyMessage receives a message with the inbound Messager.
+func (tm *TranscodingMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	return tm.in.ReceiveAnyMessage()
+}
+
+// ReceiveMessageContext receives a message with the inbound Messager.
+func (tm *TranscodingMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	return tm.in.ReceiveMessageContext(ctx, kind)
+}
+
+// ReceiveAnyMessageContext receives a message with the inbound Messager.
+func (tm *TranscodingMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	return tm.in.ReceiveAnyMessageContext(ctx)
+}
+
+// CancelReceive cancels the receive of the inbound Messager.
+func (tm *TranscodingMessager) CancelReceive() {
+	tm.in.CancelReceive()
+}
+
+// SetReadDeadline sets the read deadline of the inbound Messager.
+func (tm *TranscodingMessager) SetReadDeadline(t time.Time) error {
+	return tm.in.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the outbound Messager.
+func (tm *TranscodingMessager) SetWriteDeadline(t time.Time) error {
+	return tm.out.SetWriteDeadline(t)
+}
+
+// Flush flushes the outbound Messager.
+func (tm *TranscodingMessager) Flush() error {
+	return tm.out.Flush()
+}
+
+// Release releases the outbound Messager and then the inbound Messager.
+func (tm *TranscodingMessager) Release() {
+	tm.out.Release()
+	tm.in.Release()
+}
+
+// Close closes the outbound Messager and then the inbound Messager, returning
+// the first error.
+func (tm *TranscodingMessager) Close() error {
+	err := tm.out.Close()
+	if ierr := tm.in.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// Encoding returns the encoding of the outbound Messager, which is the
+// encoding of every message sent.
+func (tm *TranscodingMessager) Encoding() Encoding {
+	return tm.out.Encoding()
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func assertTranscodingMessagerIsMessager(tm *TranscodingMessager) {
+	func(m Messager) {}(tm)
+}
+
+func TestTranscodingMessagerForward(t *testing.T) {
+	messages := []struct {
+		kind MessageType
+		msg  string
+	}{
+		{MsgLogin, "v5.0-NDTinGO"},
+		{TestMsg, `quotes " and \ backslashes`},
+		{MsgResults, ""},
+	}
+	jsonSide := &loopbackConnection{}
+	client := JSON.Messager(jsonSide)
+	for _, m := range messages {
+		client.SendMessage(m.kind, []byte(m.msg))
+	}
+
+	tlvSide := &loopbackConnection{}
+	tm := NewTranscodingMessager(JSON.Messager(jsonSide), TLV.Messager(tlvSide))
+	var want [][]byte
+	for _, m := range messages {
+		kind, err := tm.Forward()
+		if err != nil || kind != m.kind {
+			t.Fatalf("Forward() = %v, %v, want %v", kind, err, m.kind)
+		}
+		want = append(want, historicalTLVFrame(m.kind, []byte(m.msg)))
+	}
+	if !reflect.DeepEqual(tlvSide.frames, want) {
+		t.Errorf("Forward() sent %q, want %q", tlvSide.frames, want)
+	}
+	if _, err := tm.Forward(); err == nil {
+		t.Error("Forward() should fail once the inbound side is drained")
+	}
+}
+
+func TestTranscodingMessagerDirections(t *testing.T) {
+	in := NewNopMessager(TLV)
+	in.AddResponse(TestMsg, []byte("1"))
+	in.AddResponse(MsgError, []byte("2"))
+	in.AddResponse(MsgLogout, []byte("3"))
+	out := NewNopMessager(JSON)
+	tm := NewTranscodingMessager(in, out)
+
+	tm.SendMessage(TestMsg, []byte("x"))
+	tm.SendS2CResults(1, 2, 3)
+	if out.Sent(TestMsg) != 2 || in.SentTotal() != 0 {
+		t.Errorf("sends went to the wrong side: %d out, %d in", out.SentTotal(), in.SentTotal())
+	}
+	if b, err := tm.ReceiveMessage(TestMsg); err != nil || string(b) != "1" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if kind, _, err := tm.ReceiveOneOf(MsgError); err != nil || kind != MsgError {
+		t.Errorf("ReceiveOneOf() = %v, %v", kind, err)
+	}
+	if kind, _, err := tm.ReceiveAnyMessage(); err != nil || kind != MsgLogout {
+		t.Errorf("ReceiveAnyMessage() = %v, %v", kind, err)
+	}
+	if tm.Encoding() != JSON {
+		t.Errorf("Encoding() = %v, want the outbound encoding", tm.Encoding())
+	}
+}
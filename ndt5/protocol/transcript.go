@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The directions of the messages in a transcript.
+const (
+	TranscriptSend = "send"
+	TranscriptRecv = "recv"
+)
+
+// TranscriptEntry is a single message recorded by a TranscriptMessager.
+type TranscriptEntry struct {
+	Time      time.Time
+	Direction string
+	Type      MessageType
+	Payload   []byte
+}
+
+// String formats the entry as a line of a transcript, without the trailing
+// newline. The fields are separated by spaces: the time in RFC 3339 format
+// with nanoseconds, the direction, the name of the type, and the payload as a
+// quoted Go string.
+func (e *TranscriptEntry) String() string {
+	return fmt.Sprintf("%s %s %s %s", e.Time.Format(time.RFC3339Nano), e.Direction, e.Type, strconv.Quote(string(e.Payload)))
+}
+
+// ParseTranscriptLine parses a line written by a TranscriptMessager.
+func ParseTranscriptLine(line string) (*TranscriptEntry, error) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("malformed transcript line: %q", line)
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if fields[1] != TranscriptSend && fields[1] != TranscriptRecv {
+		return nil, fmt.Errorf("unknown direction in transcript line: %q", fields[1])
+	}
+	kind, err := ParseMessageType(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	payload, err := strconv.Unquote(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	return &TranscriptEntry{Time: t, Direction: fields[1], Type: kind, Payload: []byte(payload)}, nil
+}
+
+// TranscriptMessager wraps another Messager, forwarding all calls to it and
+// writing every message that is sent or received to an io.Writer, one
+// TranscriptEntry per line, in the order in which they happened. Messages of
+// an unexpected type are recorded as received, because they were read from
+// the connection. It is safe to use from multiple goroutines at once if the
+// wrapped Messager is.
+type TranscriptMessager struct {
+	Messager
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+	now func() time.Time
+}
+
+// NewTranscriptMessager creates a TranscriptMessager that forwards to m and
+// writes the transcript to w.
+func NewTranscriptMessager(m Messager, w io.Writer) *TranscriptMessager {
+	return &TranscriptMessager{Messager: m, w: w, now: time.Now}
+}
+
+// Err returns the first error encountered while writing the transcript. Once
+// writing has failed, nothing more is written.
+func (tm *TranscriptMessager) Err() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.err
+}
+
+func (tm *TranscriptMessager) record(direction string, kind MessageType, payload []byte) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.err != nil {
+		return
+	}
+	e := &TranscriptEntry{Time: tm.now(), Direction: direction, Type: kind, Payload: payload}
+	_, tm.err = io.WriteString(tm.w, e.String()+"\n")
+}
+
+// recordReceived records a received message, or the message of the wrong type
+// carried by err.
+func (tm *TranscriptMessager) recordReceived(kind MessageType, payload []byte, err error) {
+	if err == nil {
+		tm.record(TranscriptRecv, kind, payload)
+	} else if ue, ok := err.(*UnexpectedMessageError); ok {
+		tm.record(TranscriptRecv, ue.Got, ue.Payload)
+	}
+}
+
+// SendMessage forwards the message and records it if it was sent.
+func (tm *TranscriptMessager) SendMessage(kind MessageType, contents []byte) error {
+	err := tm.Messager.SendMessage(kind, contents)
+	if err == nil {
+		tm.record(TranscriptSend, kind, contents)
+	}
+	return err
+}
+
+// SendMessageString forwards the message and records it if it was sent.
+func (tm *TranscriptMessager) SendMessageString(kind MessageType, s string) error {
+	err := tm.Messager.SendMessageString(kind, s)
+	if err == nil {
+		tm.record(TranscriptSend, kind, []byte(s))
+	}
+	return err
+}
+
+// SendS2CResults forwards the results and records them, in the format sent to
+// TLV clients, if they were sent.
+func (tm *TranscriptMessager) SendS2CResults(throughputKbps, unsentBytes, totalSentBytes int64) error {
+	err := tm.Messager.SendS2CResults(throughputKbps, unsentBytes, totalSentBytes)
+	if err == nil {
+		r := &S2CResult{ThroughputKbps: throughputKbps, UnsentBytes: unsentBytes, TotalSentBytes: totalSentBytes}
+		tm.record(TranscriptSend, TestMsg, []byte(r.TLV()))
+	}
+	return err
+}
+
+// ReceiveMessage forwards to the wrapped Messager and records the message.
+func (tm *TranscriptMessager) ReceiveMessage(kind MessageType) ([]byte, error) {
+	b, err := tm.Messager.ReceiveMessage(kind)
+	tm.recordReceived(kind, b, err)
+	return b, err
+}
+
+// ReceiveOneOf forwards to the wrapped Messager and records the message.
+func (tm *TranscriptMessager) ReceiveOneOf(kinds ...MessageType) (MessageType, []byte, error) {
+	kind, b, err := tm.Messager.ReceiveOneOf(kinds...)
+	tm.recordReceived(kind, b, err)
+	return kind, b, err
+}
+
+// ReceiveAnyMessage forwards to the wrapped Messager and records the message.
+func (tm *TranscriptMessager) ReceiveAnyMessage() (MessageType, []byte, error) {
+	kind, b, err := tm.Messager.ReceiveAnyMessage()
+	tm.recordReceived(kind, b, err)
+	return kind, b, err
+}
+
+// ReceiveMessageContext forwards to the wrapped Messager and records the
+// message.
+func (tm *TranscriptMessager) ReceiveMessageContext(ctx context.Context, kind MessageType) ([]byte, error) {
+	b, err := tm.Messager.ReceiveMessageContext(ctx, kind)
+	tm.recordReceived(kind, b, err)
+	return b, err
+}
+
+// ReceiveAnyMessageContext forwards to the wrapped Messager and records the
+// message.
+func (tm *TranscriptMessager) ReceiveAnyMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	kind, b, err := tm.Messager.ReceiveAnyMessageContext(ctx)
+	tm.recordReceived(kind, b, err)
+	return kind, b, err
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertTranscriptMessagerIsMessager(tm *TranscriptMessager) {
+	func(m Messager) {}(tm)
+}
+
+func TestTranscriptMessager(t *testing.T) {
+	n := NewNopMessager(JSON)
+	n.AddResponse(MsgExtendedLogin, []byte("v5.0"))
+	n.AddResponse(TestMsg, []byte("rate \"1\"\n"))
+	n.AddResponse(MsgError, []byte("oops"))
+	var buf bytes.Buffer
+	tm := NewTranscriptMessager(n, &buf)
+	start := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	now := start
+	tm.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	tm.ReceiveMessage(MsgExtendedLogin)
+	tm.SendMessage(MsgLogin, []byte("v5.0-NDTinGO"))
+	tm.ReceiveAnyMessage()
+	tm.SendS2CResults(100, 0, 12345)
+	if _, err := tm.ReceiveMessage(TestMsg); err == nil {
+		t.Error("ReceiveMessage() of the wrong type should fail")
+	}
+	tm.SendMessageString(MsgLogout, "")
+
+	want := []TranscriptEntry{
+		{Direction: TranscriptRecv, Type: MsgExtendedLogin, Payload: []byte("v5.0")},
+		{Direction: TranscriptSend, Type: MsgLogin, Payload: []byte("v5.0-NDTinGO")},
+		{Direction: TranscriptRecv, Type: TestMsg, Payload: []byte("rate \"1\"\n")},
+		{Direction: TranscriptSend, Type: TestMsg, Payload: []byte("100 0 12345")},
+		{Direction: TranscriptRecv, Type: MsgError, Payload: []byte("oops")},
+		{Direction: TranscriptSend, Type: MsgLogout, Payload: []byte("")},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("transcript has %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		got, err := ParseTranscriptLine(line)
+		if err != nil {
+			t.Fatalf("ParseTranscriptLine(%q) = %v", line, err)
+		}
+		w := want[i]
+		w.Time = start.Add(time.Duration(i+1) * time.Millisecond)
+		if !got.Time.Equal(w.Time) || got.Direction != w.Direction || got.Type != w.Type || !bytes.Equal(got.Payload, w.Payload) {
+			t.Errorf("line %d = %+v, want %+v", i, got, w)
+		}
+	}
+	if tm.Err() != nil || n.SentTotal() != 3 {
+		t.Errorf("Err() = %v, forwarded %d sends", tm.Err(), n.SentTotal())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestTranscriptMessagerWriteError(t *testing.T) {
+	tm := NewTranscriptMessager(NewNopMessager(TLV), failingWriter{})
+	if err := tm.SendMessage(TestMsg, []byte("hi")); err != nil {
+		t.Errorf("SendMessage() = %v; transcript errors must not fail sends", err)
+	}
+	if tm.Err() == nil {
+		t.Error("Err() should report the write error")
+	}
+}
+
+func TestParseTranscriptLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"2019-03-04T05:06:07Z send TestMsg",
+		"yesterday send TestMsg \"\"",
+		"2019-03-04T05:06:07Z sideways TestMsg \"\"",
+		"2019-03-04T05:06:07Z send NoSuchMsg \"\"",
+		"2019-03-04T05:06:07Z send TestMsg unquoted",
+	} {
+		if _, err := ParseTranscriptLine(line); err == nil {
+			t.Errorf("ParseTranscriptLine(%q) succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package protocol
+
+// Message is a message received by ExtendedMessager.ReceiveTyped, for handlers that branch on
+// the type of the message they receive.
+type Message struct {
+	Type MessageType
+	// Body is the message, as ReceiveOneOf returns it: the payload of a TLV
+	// frame, or the value of the "msg" key of the object carrying it in the
+	// other encodings.
+	Body []byte
+	// Object is the whole object carrying the message, like
+	// {"msg": "v5.0", "tests": "20"} for a JSON login. It is nil for the TLV
+	// encoding, which has no object model.
+	Object map[string]interface{}
+}
+
+// receiveTyped receives a message of one of the given types from conn. The
+// message is decoded with decode, and the object carrying it is decoded with
+// object, unless object is nil.
+func receiveTyped(conn Connection, lim readLimits, kinds []MessageType, decode func([]byte) ([]byte, error), object func([]byte, interface{}) error) (Message, error) {
+	b, kind, err := readTLVMessage(conn, lim, kinds...)
+	if err != nil {
+		if ue, ok := err.(*UnexpectedMessageError); ok {
+			if msg, derr := decode(ue.Payload); derr == nil {
+				ue.Payload = msg
+			}
+		}
+		return Message{Type: kind}, err
+	}
+	m := Message{Type: kind}
+	if m.Body, err = decode(b); err != nil {
+		lim.malformed.add()
+		return m, err
+	}
+	if object != nil {
+		if err := object(b, &m.Object); err != nil {
+			lim.malformed.add()
+			return m, err
+		}
+	}
+	return m, nil
+}
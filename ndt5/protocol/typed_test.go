@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReceiveTyped(t *testing.T) {
+	for _, enc := range []Encoding{JSON, TLV, MessagePack, CBOR} {
+		t.Run(enc.String(), func(t *testing.T) {
+			lc := &loopbackConnection{}
+			m := enc.Messager(lc)
+			m.SendMessage(MsgExtendedLogin, []byte("v5.0"))
+			m.SendMessage(MsgKeepalive, nil)
+			m.SendMessage(TestMsg, []byte("12345"))
+			m.SendMessage(MsgLogout, nil)
+
+			tm := enc.Messager(lc).(ExtendedMessager)
+			for _, want := range []Message{
+				{Type: MsgExtendedLogin, Body: []byte("v5.0")},
+				{Type: TestMsg, Body: []byte("12345")},
+			} {
+				got, err := tm.ReceiveTyped(MsgExtendedLogin, TestMsg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Type != want.Type || string(got.Body) != string(want.Body) {
+					t.Errorf("ReceiveTyped() = %v %q, want %v %q", got.Type, got.Body, want.Type, want.Body)
+				}
+				if enc == TLV && got.Object != nil {
+					t.Errorf("ReceiveTyped() returned the object %v for TLV", got.Object)
+				}
+				if enc == JSON && !reflect.DeepEqual(got.Object, map[string]interface{}{"msg": string(want.Body)}) {
+					t.Errorf("ReceiveTyped() returned the object %v", got.Object)
+				}
+			}
+
+			got, err := tm.ReceiveTyped(MsgExtendedLogin, TestMsg)
+			ue, ok := err.(*UnexpectedMessageError)
+			if !ok || ue.Got != MsgLogout || got.Type != MsgLogout {
+				t.Errorf("ReceiveTyped() of a MsgLogout = %v, %v, want an *UnexpectedMessageError", got, err)
+			}
+		})
+	}
+}
+
+func TestReceiveTypedObject(t *testing.T) {
+	lc := &loopbackConnection{}
+	WriteTLVMessage(lc, MsgExtendedLogin, `{"msg":"v5.0","tests":"20"}`)
+	got, err := JSON.Messager(lc).(ExtendedMessager).ReceiveTyped(MsgExtendedLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"msg": "v5.0", "tests": "20"}
+	if string(got.Body) != "v5.0" || !reflect.DeepEqual(got.Object, want) {
+		t.Errorf("ReceiveTyped() = %q, %v, want \"v5.0\", %v", got.Body, got.Object, want)
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WithTypeWidth sets the number of bytes used for the type in the header of
+// each TLV frame, for interoperating with legacy NDT variants. The default
+// width of 1 is the standard ndt5 header. With a width of 2, the type is sent
+// as a big-endian 16-bit value, whose high byte is always zero because every
+// MessageType fits in a byte. Other widths are rejected by
+// Encoding.MessagerE.
+func WithTypeWidth(width int) MessagerOption {
+	return func(o *messagerOptions) {
+		o.typeWidth = width
+	}
+}
+
+// adaptTypeWidth returns a Connection that reads and writes TLV frames whose
+// type is width bytes wide on the wire. Like AdaptTLVByteOrder, it returns a
+// view of connections that read frames from a byte stream, leaving their
+// other views alone, and wraps the others, so it must be applied to conn
+// before any other wrapper.
+func adaptTypeWidth(conn Connection, width int) (Connection, error) {
+	switch width {
+	case 1:
+		return conn, nil
+	case 2:
+		if sf, ok := conn.(streamFormatter); ok {
+			return sf.withStreamFormat(func(f *streamFormat) {
+				f.wideType = true
+			}), nil
+		}
+		return &wideTypeConnection{wrappedConnection{Connection: conn, overhead: 1}}, nil
+	}
+	return nil, fmt.Errorf("unsupported TLV type width: %d", width)
+}
+
+// wideTypeConnection translates between the standard TLV header used
+// throughout this package and a header with a 2-byte type on the wire. It is
+// only used for connections that preserve the boundaries of frames.
+type wideTypeConnection struct {
+	wrappedConnection
+}
+
+func (wc *wideTypeConnection) WriteMessage(messageType int, data []byte) error {
+	if len(data) < 3 {
+		return errors.New("Message is too short")
+	}
+	buf := make([]byte, len(data)+1)
+	buf[0] = 0
+	copy(buf[1:], data)
+	return wc.Connection.WriteMessage(messageType, buf)
+}
+
+func (wc *wideTypeConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := wc.Connection.ReadMessage()
+	if err != nil {
+		return messageType, data, err
+	}
+	if len(data) < 4 {
+		return messageType, nil, errors.New("Message is too short")
+	}
+	if err := checkWideType(data[0], data[1]); err != nil {
+		return messageType, nil, err
+	}
+	return messageType, data[1:], nil
+}
+
+// checkWideType returns an error unless a 2-byte type, whose bytes are high
+// and low, fits in a MessageType.
+func checkWideType(high, low byte) error {
+	if high != 0 {
+		return fmt.Errorf("Message type 0x%02X%02X does not fit in a MessageType", high, low)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTypeWidth(t *testing.T) {
+	tests := []struct {
+		width  int
+		header []byte
+	}{
+		{width: 1, header: []byte{byte(TestMsg), 0, 4}},
+		{width: 2, header: []byte{0, byte(TestMsg), 0, 4}},
+	}
+	for _, tt := range tests {
+		lc := &loopbackConnection{}
+		sender, err := TLV.MessagerE(lc, WithTypeWidth(tt.width))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sender.SendMessage(TestMsg, []byte("rate")); err != nil {
+			t.Fatal(err)
+		}
+		if got := lc.frames[0][:len(tt.header)]; !reflect.DeepEqual(got, tt.header) {
+			t.Errorf("width %d: header = %v, want %v", tt.width, got, tt.header)
+		}
+
+		receiver, _ := TLV.MessagerE(lc, WithTypeWidth(tt.width))
+		b, kind, _, err := receiver.(ExtendedMessager).ReceiveMessageMeta(TestMsg)
+		if err != nil || kind != TestMsg || string(b) != "rate" {
+			t.Errorf("width %d: ReceiveMessageMeta() = %q, %v, %v", tt.width, b, kind, err)
+		}
+	}
+}
+
+func TestTypeWidthErrors(t *testing.T) {
+	if _, err := TLV.MessagerE(&loopbackConnection{}, WithTypeWidth(3)); err == nil {
+		t.Error("MessagerE should reject a type width of 3")
+	}
+	lc := &loopbackConnection{frames: [][]byte{{1, byte(TestMsg), 0, 0}}}
+	m, _ := TLV.MessagerE(lc, WithTypeWidth(2))
+	if _, _, err := m.ReceiveAnyMessage(); err == nil {
+		t.Error("a type that does not fit in a MessageType should be an error")
+	}
+}
+
+func TestTypeWidthOverNetConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// Misframed reads fail rather than hang.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sender := TLV.Messager(AdaptNetConn(server, server), WithTypeWidth(2), WithByteCounts())
+	go func() {
+		sender.SendMessage(TestMsg, []byte("rate"))
+		sender.SendMessage(TestMsg, []byte("next"))
+	}()
+	// The first frame is read as it is on the wire.
+	wire := make([]byte, 8)
+	if _, err := io.ReadFull(client, wire); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, byte(TestMsg), 0, 4, 'r', 'a', 't', 'e'}; !reflect.DeepEqual(wire, want) {
+		t.Errorf("frame on the wire = %v, want %v", wire, want)
+	}
+	receiver := TLV.Messager(AdaptNetConn(client, client), WithTypeWidth(2), WithByteCounts())
+	if b, err := receiver.ReceiveMessage(TestMsg); err != nil || string(b) != "next" {
+		t.Errorf("ReceiveMessage() = %q, %v", b, err)
+	}
+	if got := receiver.(ExtendedMessager).BytesReceived(); got != 8 {
+		t.Errorf("BytesReceived() = %d, want 8", got)
+	}
+
+	// A type that does not fit in a MessageType is rejected, without losing
+	// track of the frames that follow it.
+	go func() {
+		server.Write([]byte{1, byte(TestMsg), 0, 1, 'x'})
+		sender.SendMessage(TestMsg, []byte("ok"))
+	}()
+	if _, _, err := receiver.ReceiveAnyMessage(); err == nil {
+		t.Error("a type that does not fit in a MessageType should be an error")
+	}
+	if b, err := receiver.ReceiveMessage(TestMsg); err != nil || string(b) != "ok" {
+		t.Errorf("ReceiveMessage() after a bad type = %q, %v", b, err)
+	}
+}
+
+func TestTypeWidthStaysWithMessager(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// Misframed reads fail rather than hang.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn := AdaptNetConn(server, server)
+	wide := TLV.Messager(conn, WithTypeWidth(2))
+	standard := TLV.Messager(conn)
+	go func() {
+		wide.SendMessage(TestMsg, []byte("rate"))
+		standard.SendMessage(TestMsg, []byte("rate"))
+		client.Write([]byte{byte(TestMsg), 0, 4, 'n', 'e', 'x', 't'})
+	}()
+	wire := make([]byte, 15)
+	if _, err := io.ReadFull(client, wire); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0, byte(TestMsg), 0, 4, 'r', 'a', 't', 'e',
+		byte(TestMsg), 0, 4, 'r', 'a', 't', 'e',
+	}
+	if !reflect.DeepEqual(wire, want) {
+		t.Errorf("frames on the wire = %v, want %v", wire, want)
+	}
+	if b, err := standard.ReceiveMessage(TestMsg); err != nil || string(b) != "next" {
+		t.Errorf("ReceiveMessage() of a standard frame = %q, %v", b, err)
+	}
+}
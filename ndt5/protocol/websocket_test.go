@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// fakeWSConnection is a loopbackConnection that, like a websocket, preserves
+// the boundaries of the messages written to it.
+type fakeWSConnection struct {
+	loopbackConnection
+}
+
+func (fc *fakeWSConnection) framesMessages() bool { return true }
+func (fc *fakeWSConnection) Encoding() Encoding   { return JSON }
+
+func TestWebSocketMessageBoundaries(t *testing.T) {
+	fc := &fakeWSConnection{}
+	m := JSON.Messager(fc)
+	messages := []string{"one", "two", ""}
+	for _, msg := range messages {
+		if err := m.SendMessage(TestMsg, []byte(msg)); err != nil {
+			t.Fatalf("SendMessage(%q) = %v", msg, err)
+		}
+	}
+	// Every NDT message was written as a websocket message of its own.
+	if len(fc.frames) != len(messages) {
+		t.Fatalf("wrote %d websocket messages, want %d", len(fc.frames), len(messages))
+	}
+	for i, frame := range fc.frames {
+		kind, payload, err := ParseTLVFrame(frame)
+		if err != nil || kind != TestMsg {
+			t.Fatalf("websocket message %d = %q, %v, want a single TestMsg frame", i, frame, err)
+		}
+		var jm JSONMessage
+		if err := json.Unmarshal(payload, &jm); err != nil || jm.Msg != messages[i] {
+			t.Errorf("websocket message %d carries %q, %v, want the message %q", i, payload, err, messages[i])
+		}
+	}
+	// Every read consumes exactly one websocket message.
+	for i, want := range messages {
+		got, err := m.ReceiveMessage(TestMsg)
+		if err != nil || string(got) != want {
+			t.Errorf("ReceiveMessage() = %q, %v, want %q", got, err, want)
+		}
+		if left := len(messages) - i - 1; len(fc.frames) != left {
+			t.Errorf("%d websocket messages left after a read, want %d", len(fc.frames), left)
+		}
+	}
+}
+
+func TestWebSocketFullSizeMessage(t *testing.T) {
+	fc := &fakeWSConnection{}
+	m := TLV.Messager(fc)
+	payload := strings.Repeat("a", maxTLVFrameSize)
+	m.SendMessage(TestMsg, []byte(payload))
+	m.SendMessage(TestMsg, []byte("next"))
+	// On a stream, a frame of the largest size is continued by the next one.
+	// A websocket message is always complete.
+	got, err := m.ReceiveMessage(TestMsg)
+	if err != nil || string(got) != payload {
+		t.Fatalf("ReceiveMessage() = %d bytes, %v, want %d bytes", len(got), err, len(payload))
+	}
+	got, err = m.ReceiveMessage(TestMsg)
+	if err != nil || string(got) != "next" {
+		t.Errorf("ReceiveMessage() = %q, %v, want \"next\"", got, err)
+	}
+}
+
+func TestWrappedConnectionFramesMessages(t *testing.T) {
+	if !framesMessages(&wrappedConnection{Connection: &fakeWSConnection{}}) {
+		t.Error("a wrapped websocket does not preserve message boundaries")
+	}
+	if framesMessages(&wrappedConnection{Connection: &loopbackConnection{}}) {
+		t.Error("a wrapped stream preserves message boundaries")
+	}
+}
+
+func TestWebSocketChunkedWrite(t *testing.T) {
+	fc := &fakeWSConnection{}
+	long := strings.Repeat("a", maxTLVFrameSize+1)
+	err := WriteTLVMessageChunked(fc, TestMsg, long)
+	if te, ok := err.(*MessageTooLongError); !ok || te.Size != len(long) {
+		t.Errorf("WriteTLVMessageChunked() of %d bytes = %v, want a *MessageTooLongError", len(long), err)
+	}
+	if len(fc.frames) != 0 {
+		t.Errorf("a failed write sent %d websocket messages", len(fc.frames))
+	}
+	// Without a trailing empty frame, which would be read as a message.
+	if err := WriteTLVMessageChunked(fc, TestMsg, long[1:]); err != nil {
+		t.Fatalf("WriteTLVMessageChunked() = %v", err)
+	}
+	if len(fc.frames) != 1 {
+		t.Errorf("WriteTLVMessageChunked() sent %d websocket messages, want 1", len(fc.frames))
+	}
+}
+
+func TestWebSocketConcatenatedFrames(t *testing.T) {
+	fc := &fakeWSConnection{}
+	var both bytes.Buffer
+	both.Write([]byte{byte(TestMsg), 0, 1, 'a'})
+	both.Write([]byte{byte(TestMsg), 0, 1, 'b'})
+	fc.WriteMessage(0, both.Bytes())
+	m := TLV.Messager(fc)
+	if got, err := m.ReceiveMessage(TestMsg); err == nil {
+		t.Errorf("ReceiveMessage() of two frames in one websocket message = %q, want an error", got)
+	}
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// wrappedConnection is the base for Connections that change the frames
+// written to and read from another Connection. It forwards the optional
+// methods used by Messagers to the underlying Connection.
+type wrappedConnection struct {
+	Connection
+	// overhead is the number of bytes the wrapper adds to each frame.
+	overhead int64
+}
+
+// SetReadLimit leaves room for the overhead in the limit of the underlying
+// connection, if it has one.
+func (wc *wrappedConnection) SetReadLimit(limit int64) {
+	if rl, ok := wc.Connection.(readLimiter); ok {
+		rl.SetReadLimit(limit + wc.overhead)
+	}
+}
+
+func (wc *wrappedConnection) SetReadDeadline(t time.Time) error {
+	rd, ok := wc.Connection.(readDeadliner)
+	if !ok {
+		return fmt.Errorf("connection %s does not support read deadlines", wc.String())
+	}
+	return rd.SetReadDeadline(t)
+}
+
+func (wc *wrappedConnection) keptDeadline() *readDeadline {
+	if k, ok := wc.Connection.(deadlineKeeper); ok {
+		return k.keptDeadline()
+	}
+	return nil
+}
+
+func (wc *wrappedConnection) keptReceiveGate() *receiveGate {
+	if k, ok := wc.Connection.(receiveGateKeeper); ok {
+		return k.keptReceiveGate()
+	}
+	return nil
+}
+
+func (wc *wrappedConnection) interruptRead() error {
+	return interruptRead(wc.Connection)
+}
+
+func (wc *wrappedConnection) resumeRead() error {
+	return resumeRead(wc.Connection)
+}
+
+func (wc *wrappedConnection) Flush() error {
+	return flushConnection(wc.Connection)
+}
+
+func (wc *wrappedConnection) SetWriteDeadline(t time.Time) error {
+	wd, ok := wc.Connection.(writeDeadliner)
+	if !ok {
+		return fmt.Errorf("connection %s does not support write deadlines", wc.String())
+	}
+	return wd.SetWriteDeadline(t)
+}
+
+func (wc *wrappedConnection) framesMessages() bool {
+	return framesMessages(wc.Connection)
+}
+
+func (wc *wrappedConnection) chunksMessages() bool {
+	return chunksMessages(wc.Connection)
+}
+
+func (wc *wrappedConnection) trailing() []byte {
+	return trailingBytes(wc.Connection)
+}
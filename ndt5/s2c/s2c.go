@@ -64,7 +64,13 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "StartSingleServingServer").Inc()
 		return record, err
 	}
-	m := controlConn.Messager()
+	m, err := controlConn.Encoding().MessagerE(controlConn)
+	if err != nil {
+		log.Println("Could not create a Messager", err)
+		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "Messager").Inc()
+		return record, err
+	}
+	defer m.Release()
 	err = m.SendMessage(protocol.TestPrepare, []byte(strconv.Itoa(srv.Port())))
 	if err != nil {
 		log.Println("Could not send TestPrepare", err)
@@ -98,10 +104,18 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 		return record, err
 	}
 
-	testConn.StartMeasuring(localCtx)
-	record.StartTime = time.Now()
-	testConn.FillUntil(time.Now().Add(10*time.Second), dataToSend)
-	record.EndTime = time.Now()
+	// The control channel must not be read while the test is running, by
+	// this or any other Messager on it.
+	func() {
+		if hd, ok := m.(protocol.ExtendedMessager); ok {
+			hd.SetReceiveDisabled(true)
+			defer hd.SetReceiveDisabled(false)
+		}
+		testConn.StartMeasuring(localCtx)
+		record.StartTime = time.Now()
+		testConn.FillUntil(time.Now().Add(10*time.Second), dataToSend)
+		record.EndTime = time.Now()
+	}()
 
 	web100metrics, err := testConn.StopMeasuring()
 	if err != nil {
@@ -168,7 +182,7 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 		return record, err
 	}
 
-	err = m.SendMessage(protocol.TestFinalize, []byte{})
+	err = protocol.SendS2CComplete(m)
 	if err != nil {
 		log.Println("Could not send TestFinalize", err, record.UUID)
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestFinalize").Inc()